@@ -0,0 +1,458 @@
+// anthropic package provides middleware for partial compatibility with the Anthropic Messages API
+package anthropic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// ContentBlock is one block of a message's content, either text or an image
+type ContentBlock struct {
+	Type   string       `json:"type"`
+	Text   string       `json:"text,omitempty"`
+	Source *ImageSource `json:"source,omitempty"`
+}
+
+// ImageSource is the base64 encoded data of an image content block
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// Content is the content of a message or system prompt, which may be sent as
+// a string or an array of content blocks
+type Content []ContentBlock
+
+func (c *Content) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*c = Content{{Type: "text", Text: text}}
+		return nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(b, &blocks); err != nil {
+		return errors.New("content must be a string or an array of content blocks")
+	}
+
+	*c = blocks
+	return nil
+}
+
+type Message struct {
+	Role    string  `json:"role"`
+	Content Content `json:"content"`
+}
+
+type Request struct {
+	Model         string    `json:"model"`
+	Messages      []Message `json:"messages"`
+	System        Content   `json:"system,omitempty"`
+	MaxTokens     int       `json:"max_tokens"`
+	StopSequences []string  `json:"stop_sequences,omitempty"`
+	Stream        bool      `json:"stream,omitempty"`
+	Temperature   *float64  `json:"temperature,omitempty"`
+	TopP          *float64  `json:"top_p,omitempty"`
+	TopK          *int      `json:"top_k,omitempty"`
+
+	// Metadata is accepted for compatibility and otherwise ignored
+	Metadata map[string]any `json:"metadata,omitempty"`
+
+	// Tools are rejected, tool use isn't supported
+	Tools []json.RawMessage `json:"tools,omitempty"`
+}
+
+// TextBlock is a text content block of a response
+type TextBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Response is a message created by the model
+type Response struct {
+	Id           string      `json:"id"`
+	Type         string      `json:"type"`
+	Role         string      `json:"role"`
+	Model        string      `json:"model"`
+	Content      []TextBlock `json:"content"`
+	StopReason   *string     `json:"stop_reason"`
+	StopSequence *string     `json:"stop_sequence"`
+	Usage        Usage       `json:"usage"`
+}
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+// NewError returns an error response with the type Anthropic gives errors of
+// the status code
+func NewError(code int, message string) ErrorResponse {
+	var etype string
+	switch code {
+	case http.StatusBadRequest:
+		etype = "invalid_request_error"
+	case http.StatusUnauthorized:
+		etype = "authentication_error"
+	case http.StatusForbidden:
+		etype = "permission_error"
+	case http.StatusNotFound:
+		etype = "not_found_error"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_error"
+	default:
+		etype = "api_error"
+	}
+
+	return ErrorResponse{Type: "error", Error: Error{Type: etype, Message: message}}
+}
+
+const idAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// newId returns a random message id, as long as Anthropic's
+func newId() string {
+	id := make([]byte, 0, 24)
+	buf := make([]byte, 2*cap(id))
+	for len(id) < cap(id) {
+		// crypto/rand only fails without a source of randomness, which
+		// leaves the buffer as it was and the id merely predictable
+		_, _ = rand.Read(buf)
+		for _, b := range buf {
+			if len(id) < cap(id) && int(b) < 256-256%len(idAlphabet) {
+				id = append(id, idAlphabet[int(b)%len(idAlphabet)])
+			}
+		}
+	}
+
+	return "msg_" + string(id)
+}
+
+// text returns the text of content, whose text blocks are joined with
+// newlines, and its images. Images are only allowed where images is true.
+func (c Content) text(param string, images bool) (string, []api.ImageData, error) {
+	var texts []string
+	var data []api.ImageData
+	for i, block := range c {
+		switch block.Type {
+		case "text":
+			texts = append(texts, block.Text)
+		case "image":
+			if !images {
+				return "", nil, fmt.Errorf("%s.%d.type: image content blocks are only allowed in user messages", param, i)
+			}
+
+			if block.Source == nil || block.Source.Type != "base64" {
+				return "", nil, fmt.Errorf("%s.%d.source: only base64 image sources are supported", param, i)
+			}
+
+			image, err := base64.StdEncoding.DecodeString(block.Source.Data)
+			if err != nil || len(image) == 0 {
+				return "", nil, fmt.Errorf("%s.%d.source.data: the image data isn't valid base64", param, i)
+			}
+
+			data = append(data, image)
+		default:
+			return "", nil, fmt.Errorf("%s.%d.type: content blocks of type '%s' aren't supported", param, i, block.Type)
+		}
+	}
+
+	return strings.Join(texts, "\n"), data, nil
+}
+
+// FromRequest converts a messages request into a native chat request
+func FromRequest(r Request) (api.ChatRequest, error) {
+	if r.Model == "" {
+		return api.ChatRequest{}, errors.New("model: Field required")
+	}
+
+	if r.MaxTokens < 1 {
+		return api.ChatRequest{}, errors.New("max_tokens: Field required, and must be at least 1")
+	}
+
+	if len(r.Messages) == 0 {
+		return api.ChatRequest{}, errors.New("messages: at least one message is required")
+	}
+
+	if len(r.Tools) > 0 {
+		return api.ChatRequest{}, errors.New("tools: tool use isn't supported")
+	}
+
+	var messages []api.Message
+	if len(r.System) > 0 {
+		system, _, err := r.System.text("system", false)
+		if err != nil {
+			return api.ChatRequest{}, err
+		}
+
+		messages = append(messages, api.Message{Role: "system", Content: system})
+	}
+
+	for i, msg := range r.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return api.ChatRequest{}, fmt.Errorf("messages.%d.role: Input should be 'user' or 'assistant'", i)
+		}
+
+		content, images, err := msg.Content.text(fmt.Sprintf("messages.%d.content", i), msg.Role == "user")
+		if err != nil {
+			return api.ChatRequest{}, err
+		}
+
+		messages = append(messages, api.Message{Role: msg.Role, Content: content, Images: images})
+	}
+
+	options := map[string]interface{}{"num_predict": r.MaxTokens}
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	}
+
+	if r.TopK != nil {
+		options["top_k"] = *r.TopK
+	}
+
+	if len(r.StopSequences) > 0 {
+		options["stop"] = r.StopSequences
+	}
+
+	return api.ChatRequest{
+		Model:    r.Model,
+		Messages: messages,
+		Stream:   &r.Stream,
+		Options:  options,
+	}, nil
+}
+
+// stopReason returns why generation ended, and the stop sequence which ended
+// it if any
+func stopReason(r api.ChatResponse, maxTokens int) (*string, *string) {
+	reason := "end_turn"
+	switch {
+	case r.StopSequence != "":
+		reason = "stop_sequence"
+		return &reason, &r.StopSequence
+	case r.EvalCount >= maxTokens:
+		reason = "max_tokens"
+	}
+
+	return &reason, nil
+}
+
+func toUsage(r api.ChatResponse) Usage {
+	return Usage{InputTokens: r.PromptEvalCount + r.PromptCachedCount, OutputTokens: r.EvalCount}
+}
+
+// writer translates native chat responses into messages, or streams of
+// message events
+type writer struct {
+	stream    bool
+	id        string
+	model     string
+	maxTokens int
+
+	// started is set once the message_start event has been sent
+	started bool
+
+	gin.ResponseWriter
+}
+
+func (w *writer) writeEvent(event string, v any) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	if _, err := w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, d))); err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Flush()
+	return nil
+}
+
+func (w *writer) writeError(code int, data []byte) (int, error) {
+	var serr api.StatusError
+	if err := json.Unmarshal(data, &serr); err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(NewError(code, serr.Error())); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *writer) writeResponse(data []byte) (int, error) {
+	var resp struct {
+		api.ChatResponse
+		Error string `json:"error,omitempty"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, err
+	}
+
+	if resp.Model != "" {
+		w.model = resp.Model
+	}
+
+	if !w.stream {
+		reason, sequence := stopReason(resp.ChatResponse, w.maxTokens)
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w.ResponseWriter).Encode(Response{
+			Id:           w.id,
+			Type:         "message",
+			Role:         "assistant",
+			Model:        w.model,
+			Content:      []TextBlock{{Type: "text", Text: resp.Message.Content}},
+			StopReason:   reason,
+			StopSequence: sequence,
+			Usage:        toUsage(resp.ChatResponse),
+		}); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	if resp.Error != "" {
+		// the stream has already started, so the error ends it
+		if err := w.writeEvent("error", NewError(http.StatusInternalServerError, resp.Error)); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	if !w.started {
+		w.started = true
+		if err := w.writeEvent("message_start", map[string]any{
+			"type": "message_start",
+			"message": Response{
+				Id:      w.id,
+				Type:    "message",
+				Role:    "assistant",
+				Model:   w.model,
+				Content: []TextBlock{},
+			},
+		}); err != nil {
+			return 0, err
+		}
+
+		if err := w.writeEvent("content_block_start", map[string]any{
+			"type":          "content_block_start",
+			"index":         0,
+			"content_block": TextBlock{Type: "text"},
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	if resp.Message.Content != "" {
+		if err := w.writeEvent("content_block_delta", map[string]any{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]string{"type": "text_delta", "text": resp.Message.Content},
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	if !resp.Done {
+		return len(data), nil
+	}
+
+	reason, sequence := stopReason(resp.ChatResponse, w.maxTokens)
+	events := []struct {
+		event string
+		data  any
+	}{
+		{"content_block_stop", map[string]any{"type": "content_block_stop", "index": 0}},
+		{"message_delta", map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": reason, "stop_sequence": sequence},
+			"usage": toUsage(resp.ChatResponse),
+		}},
+		{"message_stop", map[string]any{"type": "message_stop"}},
+	}
+
+	for _, e := range events {
+		if err := w.writeEvent(e.event, e.data); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+func (w *writer) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	return w.writeResponse(data)
+}
+
+// Middleware serves Anthropic's /v1/messages endpoint with the native chat
+// handler
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req Request
+		if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		chatReq, err := FromRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		c.Writer = &writer{
+			ResponseWriter: c.Writer,
+			stream:         req.Stream,
+			id:             newId(),
+			model:          req.Model,
+			maxTokens:      req.MaxTokens,
+		}
+
+		c.Next()
+	}
+}
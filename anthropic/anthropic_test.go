@@ -0,0 +1,229 @@
+package anthropic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestFromRequest(t *testing.T) {
+	var req Request
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "test",
+		"max_tokens": 64,
+		"system": [{"type": "text", "text": "Be brief."}],
+		"messages": [
+			{"role": "user", "content": [{"type": "text", "text": "What's this?"}, {"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "aW1hZ2U="}}]},
+			{"role": "assistant", "content": "A cat."},
+			{"role": "user", "content": "Are you sure?"}
+		],
+		"temperature": 0.5,
+		"top_k": 10,
+		"stop_sequences": ["\n\nHuman:"],
+		"metadata": {"user_id": "user-1234"}
+	}`), &req))
+
+	chatReq, err := FromRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "test", chatReq.Model)
+	assert.Equal(t, []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "What's this?", Images: []api.ImageData{[]byte("image")}},
+		{Role: "assistant", Content: "A cat."},
+		{Role: "user", Content: "Are you sure?"},
+	}, chatReq.Messages)
+	assert.Equal(t, map[string]interface{}{
+		"num_predict": 64,
+		"temperature": 0.5,
+		"top_k":       10,
+		"stop":        []string{"\n\nHuman:"},
+	}, chatReq.Options)
+	require.NotNil(t, chatReq.Stream)
+	assert.False(t, *chatReq.Stream)
+
+	user := func(content Content) []Message {
+		return []Message{{Role: "user", Content: content}}
+	}
+
+	cases := []struct {
+		name string
+		req  Request
+		err  string
+	}{
+		{name: "model", req: Request{MaxTokens: 1, Messages: user(Content{{Type: "text", Text: "Hi"}})}, err: "model"},
+		{name: "max tokens", req: Request{Model: "test", Messages: user(Content{{Type: "text", Text: "Hi"}})}, err: "max_tokens"},
+		{name: "messages", req: Request{Model: "test", MaxTokens: 1}, err: "messages"},
+		{name: "role", req: Request{Model: "test", MaxTokens: 1, Messages: []Message{{Role: "system", Content: Content{{Type: "text", Text: "Hi"}}}}}, err: "messages.0.role"},
+		{name: "block type", req: Request{Model: "test", MaxTokens: 1, Messages: user(Content{{Type: "tool_result"}})}, err: "messages.0.content.0.type"},
+		{name: "image source", req: Request{Model: "test", MaxTokens: 1, Messages: user(Content{{Type: "image", Source: &ImageSource{Type: "url"}}})}, err: "messages.0.content.0.source"},
+		{name: "system image", req: Request{Model: "test", MaxTokens: 1, System: Content{{Type: "image"}}, Messages: user(Content{{Type: "text", Text: "Hi"}})}, err: "system.0.type"},
+		{name: "tools", req: Request{Model: "test", MaxTokens: 1, Messages: user(Content{{Type: "text", Text: "Hi"}}), Tools: []json.RawMessage{[]byte(`{}`)}}, err: "tools"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := FromRequest(tt.req)
+			require.Error(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), tt.err), err.Error())
+		})
+	}
+}
+
+func TestStopReason(t *testing.T) {
+	reason, sequence := stopReason(api.ChatResponse{Done: true, Metrics: api.Metrics{EvalCount: 3}}, 10)
+	assert.Equal(t, "end_turn", *reason)
+	assert.Nil(t, sequence)
+
+	reason, sequence = stopReason(api.ChatResponse{Done: true, Metrics: api.Metrics{EvalCount: 10}}, 10)
+	assert.Equal(t, "max_tokens", *reason)
+	assert.Nil(t, sequence)
+
+	reason, sequence = stopReason(api.ChatResponse{Done: true, StopSequence: "END"}, 10)
+	assert.Equal(t, "stop_sequence", *reason)
+	assert.Equal(t, ptr("END"), sequence)
+}
+
+// chatHandler responds to native chat requests with responses, as the native
+// chat handler would
+func chatHandler(t *testing.T, responses ...api.ChatResponse) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req api.ChatRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		if !*req.Stream {
+			final := responses[len(responses)-1]
+			var sb strings.Builder
+			for _, r := range responses {
+				sb.WriteString(r.Message.Content)
+			}
+			final.Message.Content = sb.String()
+			c.JSON(http.StatusOK, final)
+			return
+		}
+
+		for _, r := range responses {
+			bts, err := json.Marshal(r)
+			require.NoError(t, err)
+			_, err = c.Writer.Write(append(bts, '\n'))
+			require.NoError(t, err)
+		}
+	}
+}
+
+func testResponses() []api.ChatResponse {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []api.ChatResponse{
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: "Hello"}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: ", world"}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant"}, Done: true, Metrics: api.Metrics{PromptEvalCount: 3, EvalCount: 2}},
+	}
+}
+
+func doRequest(t *testing.T, r http.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/messages", Middleware(), chatHandler(t, testResponses()...))
+
+	t.Run("message", func(t *testing.T) {
+		w := doRequest(t, r, `{"model": "test", "max_tokens": 16, "messages": [{"role": "user", "content": "Hi"}]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.True(t, strings.HasPrefix(resp.Id, "msg_"))
+		assert.Equal(t, "message", resp.Type)
+		assert.Equal(t, "assistant", resp.Role)
+		assert.Equal(t, "test", resp.Model)
+		assert.Equal(t, []TextBlock{{Type: "text", Text: "Hello, world"}}, resp.Content)
+		assert.Equal(t, "end_turn", *resp.StopReason)
+		assert.Nil(t, resp.StopSequence)
+		assert.Equal(t, Usage{InputTokens: 3, OutputTokens: 2}, resp.Usage)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		w := doRequest(t, r, `{"model": "test", "max_tokens": 2, "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+		var events []string
+		var data []map[string]any
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				events = append(events, event)
+			}
+
+			if d, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var v map[string]any
+				require.NoError(t, json.Unmarshal([]byte(d), &v))
+				data = append(data, v)
+			}
+		}
+		require.NoError(t, scanner.Err())
+
+		assert.Equal(t, []string{"message_start", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}, events)
+		require.Len(t, data, len(events))
+		for i, event := range events {
+			assert.Equal(t, event, data[i]["type"])
+		}
+
+		assert.Equal(t, map[string]any{"type": "text", "text": ""}, data[1]["content_block"])
+		assert.Equal(t, map[string]any{"type": "text_delta", "text": ", world"}, data[3]["delta"])
+
+		// generation reached max_tokens
+		assert.Equal(t, map[string]any{"stop_reason": "max_tokens", "stop_sequence": nil}, data[5]["delta"])
+		assert.Equal(t, map[string]any{"input_tokens": 3.0, "output_tokens": 2.0}, data[5]["usage"])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := doRequest(t, r, `{"model": "test", "messages": [{"role": "user", "content": "Hi"}]}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "error", resp.Type)
+		assert.Equal(t, "invalid_request_error", resp.Error.Type)
+		assert.Contains(t, resp.Error.Message, "max_tokens")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		r := gin.New()
+		r.POST("/v1/messages", Middleware(), func(c *gin.Context) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+		})
+
+		w := doRequest(t, r, `{"model": "missing", "max_tokens": 16, "messages": [{"role": "user", "content": "Hi"}]}`)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "not_found_error", resp.Error.Type)
+		assert.Contains(t, resp.Error.Message, "not found")
+	})
+}
@@ -45,6 +45,11 @@ type GenerateRequest struct {
 	KeepAlive *Duration   `json:"keep_alive,omitempty"`
 	Images    []ImageData `json:"images,omitempty"`
 
+	// Logprobs reports the log probability of each generated token, along
+	// with the TopLogprobs most likely tokens at each position
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 }
 
@@ -55,6 +60,15 @@ type ChatRequest struct {
 	Format    string    `json:"format"`
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Schema is a JSON schema the message must match, which takes the place
+	// of Format
+	Schema json.RawMessage `json:"schema,omitempty"`
+
+	// Logprobs reports the log probability of each generated token, along
+	// with the TopLogprobs most likely tokens at each position
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 }
 
@@ -71,9 +85,29 @@ type ChatResponse struct {
 
 	Done bool `json:"done"`
 
+	// StopSequence is the stop sequence which ended generation, if any
+	StopSequence string `json:"stop_sequence,omitempty"`
+
+	// Logprobs are the log probabilities of the tokens of the message, when
+	// the request asks for them
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
 	Metrics
 }
 
+// TokenLogprob is a token and its log probability
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// Logprob is the log probability of a generated token, and of the most likely
+// tokens in its place
+type Logprob struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
@@ -81,6 +115,10 @@ type Metrics struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// PromptCachedCount is the number of prompt tokens reused from the cache
+	// rather than evaluated
+	PromptCachedCount int `json:"prompt_cached_count,omitempty"`
 }
 
 // Options specfied in GenerateRequest, if you add a new option here add it to the API docs also
@@ -105,6 +143,9 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// LogitBias maps token ids to a bias added to their logits
+	LogitBias map[int]float32 `json:"logit_bias,omitempty"`
 }
 
 // Runner options which must be set when the model is loaded into memory
@@ -175,6 +216,7 @@ type ShowResponse struct {
 	System     string       `json:"system,omitempty"`
 	Details    ModelDetails `json:"details,omitempty"`
 	Messages   []Message    `json:"messages,omitempty"`
+	ModifiedAt time.Time    `json:"modified_at,omitempty"`
 }
 
 type CopyRequest struct {
@@ -236,6 +278,10 @@ type GenerateResponse struct {
 	Done    bool  `json:"done"`
 	Context []int `json:"context,omitempty"`
 
+	// Logprobs are the log probabilities of the tokens of the response, when
+	// the request asks for them
+	Logprobs []Logprob `json:"logprobs,omitempty"`
+
 	Metrics
 }
 
@@ -346,6 +392,27 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 						slice[i] = str
 					}
 					field.Set(reflect.ValueOf(slice))
+				case reflect.Map:
+					// JSON unmarshals to map[string]interface{}, keyed by token id
+					val, ok := val.(map[string]interface{})
+					if !ok {
+						return fmt.Errorf("option %q must be of type object", key)
+					}
+
+					bias := make(map[int]float32, len(val))
+					for k, v := range val {
+						id, err := strconv.Atoi(k)
+						if err != nil {
+							return fmt.Errorf("option %q must be keyed by token id", key)
+						}
+
+						f, ok := v.(float64)
+						if !ok {
+							return fmt.Errorf("option %q must be a map of token ids to numbers", key)
+						}
+						bias[id] = float32(f)
+					}
+					field.Set(reflect.ValueOf(bias))
 				default:
 					return fmt.Errorf("unknown type loading config params: %v", field.Kind())
 				}
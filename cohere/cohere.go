@@ -0,0 +1,240 @@
+// cohere package provides middleware for partial compatibility with the Cohere rerank API
+package cohere
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// Document is a document to rerank, sent as a string or an object with a
+// text field
+type Document struct {
+	Text string `json:"text"`
+}
+
+func (d *Document) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Text); err == nil {
+		return nil
+	}
+
+	var doc struct {
+		Text *string `json:"text"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil || doc.Text == nil {
+		return errors.New("documents must be strings or objects with a text field")
+	}
+
+	d.Text = *doc.Text
+	return nil
+}
+
+type RerankRequest struct {
+	Model           string     `json:"model"`
+	Query           string     `json:"query"`
+	Documents       []Document `json:"documents"`
+	TopN            *int       `json:"top_n,omitempty"`
+	ReturnDocuments bool       `json:"return_documents,omitempty"`
+}
+
+type RerankResult struct {
+	Index          int       `json:"index"`
+	RelevanceScore float64   `json:"relevance_score"`
+	Document       *Document `json:"document,omitempty"`
+}
+
+type APIVersion struct {
+	Version string `json:"version"`
+}
+
+type BilledUnits struct {
+	SearchUnits int `json:"search_units"`
+}
+
+type Meta struct {
+	APIVersion  APIVersion  `json:"api_version"`
+	BilledUnits BilledUnits `json:"billed_units"`
+}
+
+type RerankResponse struct {
+	Id      string         `json:"id"`
+	Results []RerankResult `json:"results"`
+	Meta    Meta           `json:"meta"`
+}
+
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+func NewError(message string) ErrorResponse {
+	return ErrorResponse{Message: message}
+}
+
+// newId returns a random version 4 UUID, as Cohere identifies responses with
+func newId() string {
+	b := make([]byte, 16)
+	// crypto/rand only fails without a source of randomness, which leaves
+	// the id merely predictable
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (r RerankRequest) validate() error {
+	switch {
+	case r.Model == "":
+		return errors.New("model is required")
+	case r.Query == "":
+		return errors.New("query is required")
+	case len(r.Documents) == 0:
+		return errors.New("documents is required")
+	case r.TopN != nil && *r.TopN < 1:
+		return errors.New("top_n must be greater than 0")
+	}
+
+	return nil
+}
+
+// recorder captures the response to an embedding request
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+// embed sends input to next as a native embedding request for path, returning
+// the status code and message of a native error
+func embed(c *gin.Context, next http.Handler, path, model, input string) ([]float64, int, error) {
+	body, err := json.Marshal(api.EmbeddingRequest{Model: model, Prompt: input})
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	r, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	rec := &recorder{header: make(http.Header)}
+	next.ServeHTTP(rec, r)
+
+	if rec.code != http.StatusOK {
+		var serr api.StatusError
+		if err := json.Unmarshal(rec.body.Bytes(), &serr); err != nil {
+			return nil, http.StatusInternalServerError, errors.New("unexpected response")
+		}
+
+		return nil, rec.code, errors.New(serr.Error())
+	}
+
+	var resp api.EmbeddingResponse
+	if err := json.Unmarshal(rec.body.Bytes(), &resp); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return resp.Embedding, http.StatusOK, nil
+}
+
+// relevance scores the similarity of two embeddings between 0 and 1, from
+// their cosine similarity
+func relevance(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+
+	if na == 0 || nb == 0 {
+		return 0
+	}
+
+	return (1 + dot/(math.Sqrt(na)*math.Sqrt(nb))) / 2
+}
+
+// RerankMiddleware serves Cohere's /v1/rerank. The query and each document
+// are sent to next as native embedding requests for path, and documents are
+// ranked by the similarity of their embeddings to the query's.
+func RerankMiddleware(next http.Handler, path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RerankRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(err.Error()))
+			return
+		}
+
+		if err := req.validate(); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(err.Error()))
+			return
+		}
+
+		query, code, err := embed(c, next, path, req.Model, req.Query)
+		if err != nil {
+			c.AbortWithStatusJSON(code, NewError(err.Error()))
+			return
+		}
+
+		results := make([]RerankResult, len(req.Documents))
+		for i, doc := range req.Documents {
+			embedding, code, err := embed(c, next, path, req.Model, doc.Text)
+			if err != nil {
+				c.AbortWithStatusJSON(code, NewError(err.Error()))
+				return
+			}
+
+			results[i] = RerankResult{Index: i, RelevanceScore: relevance(query, embedding)}
+			if req.ReturnDocuments {
+				results[i].Document = &req.Documents[i]
+			}
+		}
+
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].RelevanceScore > results[j].RelevanceScore
+		})
+
+		if req.TopN != nil && *req.TopN < len(results) {
+			results = results[:*req.TopN]
+		}
+
+		c.JSON(http.StatusOK, RerankResponse{
+			Id:      newId(),
+			Results: results,
+			Meta: Meta{
+				APIVersion:  APIVersion{Version: "1"},
+				BilledUnits: BilledUnits{SearchUnits: 1},
+			},
+		})
+	}
+}
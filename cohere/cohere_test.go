@@ -0,0 +1,142 @@
+package cohere
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestRelevance(t *testing.T) {
+	assert.InDelta(t, 1, relevance([]float64{1, 0}, []float64{2, 0}), 1e-9)
+	assert.InDelta(t, 0.5, relevance([]float64{1, 0}, []float64{0, 1}), 1e-9)
+	assert.InDelta(t, 0, relevance([]float64{1, 0}, []float64{-1, 0}), 1e-9)
+	assert.Zero(t, relevance([]float64{0, 0}, []float64{1, 0}))
+	assert.Zero(t, relevance([]float64{1}, []float64{1, 0}))
+}
+
+func TestNewId(t *testing.T) {
+	id := newId()
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+	assert.NotEqual(t, id, newId())
+}
+
+func TestRerankMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	embeddings := map[string][]float64{
+		"capital of france":    {1, 0},
+		"Paris is in France":   {0.9, 0.1},
+		"Berlin is in Germany": {0.1, 0.9},
+		"Bananas are yellow":   {-1, 0},
+	}
+
+	r := gin.New()
+	r.POST("/api/embeddings", func(c *gin.Context) {
+		var req api.EmbeddingRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		if req.Model != "test" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model '" + req.Model + "' not found, try pulling it first"})
+			return
+		}
+
+		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: embeddings[req.Prompt]})
+	})
+	r.POST("/v1/rerank", RerankMiddleware(r, "/api/embeddings"))
+
+	doRequest := func(t *testing.T, req RerankRequest) *httptest.ResponseRecorder {
+		t.Helper()
+
+		bts, err := json.Marshal(req)
+		require.NoError(t, err)
+
+		hreq := httptest.NewRequest(http.MethodPost, "/v1/rerank", bytes.NewReader(bts))
+		hreq.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, hreq)
+		return w
+	}
+
+	docs := []Document{{Text: "Bananas are yellow"}, {Text: "Berlin is in Germany"}, {Text: "Paris is in France"}}
+
+	t.Run("rerank", func(t *testing.T) {
+		w := doRequest(t, RerankRequest{Model: "test", Query: "capital of france", Documents: docs})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp RerankResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.NotEmpty(t, resp.Id)
+		assert.Equal(t, Meta{APIVersion: APIVersion{Version: "1"}, BilledUnits: BilledUnits{SearchUnits: 1}}, resp.Meta)
+
+		require.Len(t, resp.Results, 3)
+		var indices []int
+		for _, result := range resp.Results {
+			indices = append(indices, result.Index)
+			assert.Nil(t, result.Document)
+		}
+		assert.Equal(t, []int{2, 1, 0}, indices)
+		assert.Greater(t, resp.Results[0].RelevanceScore, resp.Results[1].RelevanceScore)
+	})
+
+	t.Run("top n", func(t *testing.T) {
+		w := doRequest(t, RerankRequest{Model: "test", Query: "capital of france", Documents: docs, TopN: ptr(1), ReturnDocuments: true})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp RerankResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Results, 1)
+		assert.Equal(t, 2, resp.Results[0].Index)
+		assert.Equal(t, &Document{Text: "Paris is in France"}, resp.Results[0].Document)
+	})
+
+	t.Run("document objects", func(t *testing.T) {
+		hreq := httptest.NewRequest(http.MethodPost, "/v1/rerank", bytes.NewReader([]byte(`{"model": "test", "query": "capital of france", "documents": ["Bananas are yellow", {"text": "Paris is in France"}]}`)))
+		hreq.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, hreq)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp RerankResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Results, 2)
+		assert.Equal(t, 1, resp.Results[0].Index)
+	})
+
+	cases := []struct {
+		name string
+		req  RerankRequest
+		code int
+		err  string
+	}{
+		{name: "model", req: RerankRequest{Query: "q", Documents: docs}, code: http.StatusBadRequest, err: "model is required"},
+		{name: "query", req: RerankRequest{Model: "test", Documents: docs}, code: http.StatusBadRequest, err: "query is required"},
+		{name: "documents", req: RerankRequest{Model: "test", Query: "q"}, code: http.StatusBadRequest, err: "documents is required"},
+		{name: "top n", req: RerankRequest{Model: "test", Query: "q", Documents: docs, TopN: ptr(0)}, code: http.StatusBadRequest, err: "top_n must be greater than 0"},
+		{name: "not found", req: RerankRequest{Model: "missing", Query: "q", Documents: docs}, code: http.StatusNotFound, err: "model 'missing' not found, try pulling it first"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, tt.req)
+			require.Equal(t, tt.code, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.err, resp.Message)
+		})
+	}
+}
@@ -0,0 +1,398 @@
+// gemini package provides middleware for partial compatibility with the Google Gemini API
+package gemini
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// Blob is inline data of a part, such as an image
+type Blob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// Part is one part of a content, either text or inline data
+type Part struct {
+	Text       string `json:"text,omitempty"`
+	InlineData *Blob  `json:"inlineData,omitempty"`
+}
+
+type Content struct {
+	Role  string `json:"role,omitempty"`
+	Parts []Part `json:"parts"`
+}
+
+type GenerationConfig struct {
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"topP,omitempty"`
+	TopK             *int     `json:"topK,omitempty"`
+	MaxOutputTokens  *int     `json:"maxOutputTokens,omitempty"`
+	StopSequences    []string `json:"stopSequences,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	CandidateCount   *int     `json:"candidateCount,omitempty"`
+	ResponseMimeType string   `json:"responseMimeType,omitempty"`
+}
+
+type Request struct {
+	Contents          []Content         `json:"contents"`
+	SystemInstruction *Content          `json:"systemInstruction,omitempty"`
+	GenerationConfig  *GenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type Candidate struct {
+	Content      Content `json:"content"`
+	FinishReason string  `json:"finishReason,omitempty"`
+	Index        int     `json:"index"`
+}
+
+type UsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// Response is a generated response, or one chunk of a streamed one
+type Response struct {
+	Candidates    []Candidate    `json:"candidates"`
+	UsageMetadata *UsageMetadata `json:"usageMetadata,omitempty"`
+	ModelVersion  string         `json:"modelVersion,omitempty"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// NewError returns an error response with the status Google gives errors of
+// the status code
+func NewError(code int, message string) ErrorResponse {
+	var status string
+	switch code {
+	case http.StatusBadRequest:
+		status = "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		status = "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		status = "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		status = "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		status = "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		status = "UNAVAILABLE"
+	default:
+		status = "INTERNAL"
+	}
+
+	return ErrorResponse{Error{Code: code, Message: message, Status: status}}
+}
+
+// text returns the text of content, whose text parts are joined with
+// newlines, and its images
+func (c Content) text(param string) (string, []api.ImageData, error) {
+	var texts []string
+	var images []api.ImageData
+	for i, part := range c.Parts {
+		switch {
+		case part.InlineData != nil:
+			if !strings.HasPrefix(part.InlineData.MimeType, "image/") {
+				return "", nil, fmt.Errorf("%s.parts[%d].inline_data: only images are supported, but got '%s'", param, i, part.InlineData.MimeType)
+			}
+
+			image, err := base64.StdEncoding.DecodeString(part.InlineData.Data)
+			if err != nil || len(image) == 0 {
+				return "", nil, fmt.Errorf("%s.parts[%d].inline_data.data: the image data isn't valid base64", param, i)
+			}
+
+			images = append(images, image)
+		case part.Text != "":
+			texts = append(texts, part.Text)
+		default:
+			return "", nil, fmt.Errorf("%s.parts[%d]: only text and inline_data parts are supported", param, i)
+		}
+	}
+
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// FromRequest converts a generateContent request for model into a native chat
+// request
+func FromRequest(model string, r Request) (api.ChatRequest, error) {
+	if len(r.Contents) == 0 {
+		return api.ChatRequest{}, errors.New("contents is not specified")
+	}
+
+	var messages []api.Message
+	if r.SystemInstruction != nil {
+		system, images, err := r.SystemInstruction.text("system_instruction")
+		if err != nil {
+			return api.ChatRequest{}, err
+		}
+
+		if len(images) > 0 {
+			return api.ChatRequest{}, errors.New("system_instruction: only text parts are supported")
+		}
+
+		messages = append(messages, api.Message{Role: "system", Content: system})
+	}
+
+	for i, content := range r.Contents {
+		role := "user"
+		switch content.Role {
+		case "", "user":
+		case "model":
+			role = "assistant"
+		default:
+			return api.ChatRequest{}, fmt.Errorf("contents[%d].role: please use a valid role: user, model", i)
+		}
+
+		text, images, err := content.text(fmt.Sprintf("contents[%d]", i))
+		if err != nil {
+			return api.ChatRequest{}, err
+		}
+
+		messages = append(messages, api.Message{Role: role, Content: text, Images: images})
+	}
+
+	chatReq := api.ChatRequest{Model: model, Messages: messages, Options: make(map[string]interface{})}
+	if config := r.GenerationConfig; config != nil {
+		if config.CandidateCount != nil && *config.CandidateCount != 1 {
+			return api.ChatRequest{}, errors.New("generation_config.candidate_count: only one candidate is supported")
+		}
+
+		switch config.ResponseMimeType {
+		case "", "text/plain":
+		case "application/json":
+			chatReq.Format = "json"
+		default:
+			return api.ChatRequest{}, fmt.Errorf("generation_config.response_mime_type: allowed mimetypes are 'text/plain' and 'application/json', but got '%s'", config.ResponseMimeType)
+		}
+
+		if config.Temperature != nil {
+			chatReq.Options["temperature"] = *config.Temperature
+		}
+
+		if config.TopP != nil {
+			chatReq.Options["top_p"] = *config.TopP
+		}
+
+		if config.TopK != nil {
+			chatReq.Options["top_k"] = *config.TopK
+		}
+
+		if config.MaxOutputTokens != nil {
+			chatReq.Options["num_predict"] = *config.MaxOutputTokens
+		}
+
+		if len(config.StopSequences) > 0 {
+			chatReq.Options["stop"] = config.StopSequences
+		}
+
+		if config.Seed != nil {
+			chatReq.Options["seed"] = *config.Seed
+		}
+	}
+
+	return chatReq, nil
+}
+
+// writer translates native chat responses into generateContent responses, or
+// streams of them
+type writer struct {
+	stream bool
+
+	// sse streams server-sent events, rather than a JSON array
+	sse bool
+
+	// maxTokens is the maxOutputTokens of the request, if any
+	maxTokens int
+
+	// started is set once the first chunk of a stream has been sent
+	started bool
+
+	gin.ResponseWriter
+}
+
+func (w *writer) toResponse(r api.ChatResponse) Response {
+	candidate := Candidate{Content: Content{Role: "model", Parts: []Part{{Text: r.Message.Content}}}}
+	resp := Response{Candidates: []Candidate{candidate}, ModelVersion: r.Model}
+	if !r.Done {
+		return resp
+	}
+
+	resp.Candidates[0].FinishReason = "STOP"
+	if w.maxTokens > 0 && r.EvalCount >= w.maxTokens {
+		resp.Candidates[0].FinishReason = "MAX_TOKENS"
+	}
+
+	prompt := r.PromptEvalCount + r.PromptCachedCount
+	resp.UsageMetadata = &UsageMetadata{
+		PromptTokenCount:     prompt,
+		CandidatesTokenCount: r.EvalCount,
+		TotalTokenCount:      prompt + r.EvalCount,
+	}
+
+	return resp
+}
+
+// writeChunk sends one chunk of a stream, ending the stream after the last
+func (w *writer) writeChunk(v any, last bool) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	if w.sse {
+		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(&b, "data: %s\r\n\r\n", d)
+	} else {
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		if w.started {
+			b.WriteString(",\r\n")
+		} else {
+			b.WriteString("[")
+		}
+
+		b.Write(d)
+		if last {
+			b.WriteString("]")
+		}
+	}
+
+	w.started = true
+	if _, err := w.ResponseWriter.Write(b.Bytes()); err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Flush()
+	return nil
+}
+
+func (w *writer) writeError(code int, data []byte) (int, error) {
+	var serr api.StatusError
+	if err := json.Unmarshal(data, &serr); err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(NewError(code, serr.Error())); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *writer) writeResponse(data []byte) (int, error) {
+	var resp struct {
+		api.ChatResponse
+		Error string `json:"error,omitempty"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, err
+	}
+
+	if resp.Error != "" && w.stream {
+		// the stream has already started, so the error ends it
+		if err := w.writeChunk(NewError(http.StatusInternalServerError, resp.Error), true); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	if w.stream {
+		if err := w.writeChunk(w.toResponse(resp.ChatResponse), resp.Done); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(w.toResponse(resp.ChatResponse)); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *writer) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	return w.writeResponse(data)
+}
+
+// Middleware serves Gemini's /v1beta/models/{model}:generateContent and
+// :streamGenerateContent endpoints with the native chat handler. The route
+// must capture the model and method as its "action" parameter.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		action := strings.TrimPrefix(c.Param("action"), "/")
+		i := strings.LastIndex(action, ":")
+		if i < 0 {
+			c.AbortWithStatusJSON(http.StatusNotFound, NewError(http.StatusNotFound, fmt.Sprintf("unknown method '%s'", action)))
+			return
+		}
+
+		model, method := action[:i], action[i+1:]
+		var stream bool
+		switch method {
+		case "generateContent":
+		case "streamGenerateContent":
+			stream = true
+		default:
+			c.AbortWithStatusJSON(http.StatusNotFound, NewError(http.StatusNotFound, fmt.Sprintf("unknown method '%s'", method)))
+			return
+		}
+
+		var req Request
+		if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		chatReq, err := FromRequest(model, req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		chatReq.Stream = &stream
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &writer{ResponseWriter: c.Writer, stream: stream, sse: c.Query("alt") == "sse"}
+		if config := req.GenerationConfig; config != nil && config.MaxOutputTokens != nil {
+			w.maxTokens = *config.MaxOutputTokens
+		}
+		c.Writer = w
+
+		c.Next()
+	}
+}
@@ -0,0 +1,237 @@
+package gemini
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestFromRequest(t *testing.T) {
+	var req Request
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"systemInstruction": {"parts": [{"text": "Be brief."}]},
+		"contents": [
+			{"role": "user", "parts": [{"text": "What's this?"}, {"inlineData": {"mimeType": "image/png", "data": "aW1hZ2U="}}]},
+			{"role": "model", "parts": [{"text": "A cat."}]},
+			{"parts": [{"text": "Are you sure?"}]}
+		],
+		"generationConfig": {
+			"temperature": 0.5,
+			"topK": 10,
+			"maxOutputTokens": 64,
+			"stopSequences": ["END"],
+			"responseMimeType": "application/json"
+		}
+	}`), &req))
+
+	chatReq, err := FromRequest("test", req)
+	require.NoError(t, err)
+	assert.Equal(t, "test", chatReq.Model)
+	assert.Equal(t, "json", chatReq.Format)
+	assert.Equal(t, []api.Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "What's this?", Images: []api.ImageData{[]byte("image")}},
+		{Role: "assistant", Content: "A cat."},
+		{Role: "user", Content: "Are you sure?"},
+	}, chatReq.Messages)
+	assert.Equal(t, map[string]interface{}{
+		"num_predict": 64,
+		"temperature": 0.5,
+		"top_k":       10,
+		"stop":        []string{"END"},
+	}, chatReq.Options)
+
+	user := []Content{{Parts: []Part{{Text: "Hi"}}}}
+	cases := []struct {
+		name string
+		req  Request
+		err  string
+	}{
+		{name: "contents", req: Request{}, err: "contents"},
+		{name: "role", req: Request{Contents: []Content{{Role: "system", Parts: []Part{{Text: "Hi"}}}}}, err: "contents[0].role"},
+		{name: "empty part", req: Request{Contents: []Content{{Parts: []Part{{}}}}}, err: "contents[0].parts[0]"},
+		{name: "inline data type", req: Request{Contents: []Content{{Parts: []Part{{InlineData: &Blob{MimeType: "audio/wav", Data: "aW1hZ2U="}}}}}}, err: "contents[0].parts[0].inline_data"},
+		{name: "system image", req: Request{SystemInstruction: &Content{Parts: []Part{{InlineData: &Blob{MimeType: "image/png", Data: "aW1hZ2U="}}}}, Contents: user}, err: "system_instruction"},
+		{name: "candidate count", req: Request{Contents: user, GenerationConfig: &GenerationConfig{CandidateCount: ptr(2)}}, err: "generation_config.candidate_count"},
+		{name: "mime type", req: Request{Contents: user, GenerationConfig: &GenerationConfig{ResponseMimeType: "text/x.enum"}}, err: "generation_config.response_mime_type"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := FromRequest("test", tt.req)
+			require.Error(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), tt.err), err.Error())
+		})
+	}
+}
+
+// chatHandler responds to native chat requests with responses, as the native
+// chat handler would
+func chatHandler(t *testing.T, responses ...api.ChatResponse) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req api.ChatRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		if !*req.Stream {
+			final := responses[len(responses)-1]
+			var sb strings.Builder
+			for _, r := range responses {
+				sb.WriteString(r.Message.Content)
+			}
+			final.Message.Content = sb.String()
+			c.JSON(http.StatusOK, final)
+			return
+		}
+
+		for _, r := range responses {
+			bts, err := json.Marshal(r)
+			require.NoError(t, err)
+			_, err = c.Writer.Write(append(bts, '\n'))
+			require.NoError(t, err)
+		}
+	}
+}
+
+func testResponses() []api.ChatResponse {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []api.ChatResponse{
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: "Hello"}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: ", world"}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant"}, Done: true, Metrics: api.Metrics{PromptEvalCount: 3, EvalCount: 2}},
+	}
+}
+
+func doRequest(t *testing.T, r http.Handler, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1beta/models/*action", Middleware(), chatHandler(t, testResponses()...))
+
+	body := `{"contents": [{"role": "user", "parts": [{"text": "Hi"}]}]}`
+
+	t.Run("generate", func(t *testing.T) {
+		w := doRequest(t, r, "/v1beta/models/test:generateContent", body)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, Response{
+			Candidates: []Candidate{{
+				Content:      Content{Role: "model", Parts: []Part{{Text: "Hello, world"}}},
+				FinishReason: "STOP",
+			}},
+			UsageMetadata: &UsageMetadata{PromptTokenCount: 3, CandidatesTokenCount: 2, TotalTokenCount: 5},
+			ModelVersion:  "test",
+		}, resp)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		w := doRequest(t, r, "/v1beta/models/test:streamGenerateContent", `{"contents": [{"parts": [{"text": "Hi"}]}], "generationConfig": {"maxOutputTokens": 2}}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var resps []Response
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resps))
+		require.Len(t, resps, 3)
+		assert.Equal(t, "Hello", resps[0].Candidates[0].Content.Parts[0].Text)
+		assert.Empty(t, resps[0].Candidates[0].FinishReason)
+		assert.Nil(t, resps[0].UsageMetadata)
+
+		// generation reached maxOutputTokens
+		assert.Equal(t, "MAX_TOKENS", resps[2].Candidates[0].FinishReason)
+		assert.Equal(t, &UsageMetadata{PromptTokenCount: 3, CandidatesTokenCount: 2, TotalTokenCount: 5}, resps[2].UsageMetadata)
+	})
+
+	t.Run("stream sse", func(t *testing.T) {
+		w := doRequest(t, r, "/v1beta/models/test:streamGenerateContent?alt=sse", body)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+		var resps []Response
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			if d, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var resp Response
+				require.NoError(t, json.Unmarshal([]byte(d), &resp))
+				resps = append(resps, resp)
+			}
+		}
+		require.NoError(t, scanner.Err())
+
+		require.Len(t, resps, 3)
+		assert.Equal(t, ", world", resps[1].Candidates[0].Content.Parts[0].Text)
+		assert.Equal(t, "STOP", resps[2].Candidates[0].FinishReason)
+	})
+
+	t.Run("model with slashes", func(t *testing.T) {
+		r := gin.New()
+		r.POST("/v1beta/models/*action", Middleware(), func(c *gin.Context) {
+			var req api.ChatRequest
+			require.NoError(t, c.ShouldBindJSON(&req))
+			assert.Equal(t, "library/test:latest", req.Model)
+			c.JSON(http.StatusOK, testResponses()[2])
+		})
+
+		w := doRequest(t, r, "/v1beta/models/library/test:latest:generateContent", body)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		w := doRequest(t, r, "/v1beta/models/test:countTokens", body)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "NOT_FOUND", resp.Error.Status)
+		assert.Contains(t, resp.Error.Message, "countTokens")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := doRequest(t, r, "/v1beta/models/test:generateContent", `{"contents": []}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, Error{Code: http.StatusBadRequest, Message: "contents is not specified", Status: "INVALID_ARGUMENT"}, resp.Error)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		r := gin.New()
+		r.POST("/v1beta/models/*action", Middleware(), func(c *gin.Context) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+		})
+
+		w := doRequest(t, r, "/v1beta/models/missing:generateContent", body)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "NOT_FOUND", resp.Error.Status)
+		assert.Contains(t, resp.Error.Message, "not found")
+	})
+}
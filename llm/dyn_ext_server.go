@@ -190,10 +190,26 @@ func (llm *dynExtServer) Predict(ctx context.Context, predict PredictOpts, fn fu
 		"cache_prompt":      true,
 	}
 
-	if predict.Format == "json" {
+	switch {
+	case predict.Grammar != "":
+		request["grammar"] = predict.Grammar
+	case predict.Format == "json":
 		request["grammar"] = jsonGrammar
 	}
 
+	if predict.Logprobs {
+		request["n_probs"] = max(predict.TopLogprobs, minProbs)
+	}
+
+	if len(predict.Options.LogitBias) > 0 {
+		// the server expects a list of [token id, bias] pairs
+		logitBias := make([][2]any, 0, len(predict.Options.LogitBias))
+		for id, bias := range predict.Options.LogitBias {
+			logitBias = append(logitBias, [2]any{id, bias})
+		}
+		request["logit_bias"] = logitBias
+	}
+
 	retryDelay := 100 * time.Microsecond
 	for retries := 0; retries < maxRetries; retries++ {
 		if retries > 0 {
@@ -253,18 +269,31 @@ func (llm *dynExtServer) Predict(ctx context.Context, predict PredictOpts, fn fu
 				}
 
 				if p.Content != "" {
-					fn(PredictResult{
+					result := PredictResult{
 						Content: p.Content,
-					})
+					}
+
+					if predict.Logprobs {
+						result.Logprobs = toLogprobs(p.CompletionProbabilities, predict.TopLogprobs)
+					}
+
+					fn(result)
 				}
 
 				if p.Stop {
+					var stopSequence string
+					if p.StoppedWord {
+						stopSequence = p.StoppingWord
+					}
+
 					fn(PredictResult{
 						Done:               true,
 						PromptEvalCount:    p.Timings.PromptN,
 						PromptEvalDuration: parseDurationMs(p.Timings.PromptMS),
 						EvalCount:          p.Timings.PredictedN,
 						EvalDuration:       parseDurationMs(p.Timings.PredictedMS),
+						PromptCachedCount:  max(p.TokensEvaluated-p.Timings.PromptN, 0),
+						StopSequence:       stopSequence,
 					})
 					return nil
 				}
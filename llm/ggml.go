@@ -84,6 +84,7 @@ type model interface {
 	NumHead() uint32
 	NumHeadKv() uint32
 	NumCtx() uint32
+	Tokens() []string
 }
 
 type container interface {
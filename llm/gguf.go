@@ -324,6 +324,20 @@ func (llm *ggufModel) NumCtx() uint32 {
 	return value.(uint32)
 }
 
+// Tokens returns the vocabulary of the model's tokenizer
+func (llm *ggufModel) Tokens() []string {
+	values, _ := llm.kv["tokenizer.ggml.tokens"].([]any)
+
+	tokens := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			tokens = append(tokens, s)
+		}
+	}
+
+	return tokens
+}
+
 func (llm *ggufModel) NumGQA() uint32 {
 	numHeadKv := llm.NumHeadKv()
 	if numHeadKv == 0 {
@@ -0,0 +1,474 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// schemaRules are the rules, alongside those of jsonGrammar, that the
+// grammars of JSON schemas build on
+const schemaRules = `
+integer ::= ("-"? ([0-9] | [1-9] [0-9]*)) ws
+boolean ::= ("true" | "false") ws
+null    ::= "null" ws
+char    ::= [^"\\] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F])
+`
+
+// unsupportedKeywords constrain values in ways a grammar can't express, so
+// schemas which use them are rejected rather than loosely followed
+var unsupportedKeywords = []string{
+	"allOf", "not", "if", "then", "else",
+	"pattern", "patternProperties", "propertyNames",
+	"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf",
+	"minProperties", "maxProperties", "dependentRequired", "dependentSchemas",
+	"unevaluatedProperties", "unevaluatedItems",
+	"prefixItems", "contains", "uniqueItems",
+}
+
+// ruleNamePattern matches the characters which can't be part of a rule name
+var ruleNamePattern = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// SchemaGrammar converts a JSON schema into a grammar which only accepts
+// JSON matching it. Objects are generated with their properties in the order
+// the schema lists them, required properties first, and never with
+// properties the schema doesn't list. Annotations such as format and
+// description are ignored.
+func SchemaGrammar(schema json.RawMessage) (string, error) {
+	c := schemaConverter{
+		rules: make(map[string]string),
+		refs:  make(map[string]string),
+		defs:  make(map[string]json.RawMessage),
+	}
+
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(schema, &root); err == nil {
+		for _, key := range []string{"$defs", "definitions"} {
+			var defs map[string]json.RawMessage
+			if err := json.Unmarshal(root[key], &defs); err == nil {
+				for name, def := range defs {
+					c.defs["#/"+key+"/"+name] = def
+				}
+			}
+		}
+	}
+
+	name := c.name("root")
+	c.refs["#"] = name
+	body, err := c.visit(name, schema)
+	if err != nil {
+		return "", err
+	}
+	c.rules[name] = body
+
+	var sb strings.Builder
+	for _, name := range c.names {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+	}
+
+	// the first rule of jsonGrammar is its root, which the schema's replaces
+	_, rules, _ := strings.Cut(strings.TrimPrefix(jsonGrammar, "\n"), "\n")
+	sb.WriteString(rules)
+	sb.WriteString(schemaRules)
+	return sb.String(), nil
+}
+
+type schemaConverter struct {
+	// rules are the bodies of the generated rules, in the order of names
+	rules map[string]string
+	names []string
+
+	// refs are the rule names of the schemas $ref has pointed to
+	refs map[string]string
+
+	// defs are the definitions of the root schema by their $ref
+	defs map[string]json.RawMessage
+}
+
+// name reserves a unique rule name based on name
+func (c *schemaConverter) name(name string) string {
+	name = strings.Trim(ruleNamePattern.ReplaceAllString(name, "-"), "-")
+	unique := name
+	for i := 1; ; i++ {
+		if _, ok := c.rules[unique]; !ok {
+			break
+		}
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+
+	c.rules[unique] = ""
+	c.names = append(c.names, unique)
+	return unique
+}
+
+// rule generates a rule for schema, returning its name
+func (c *schemaConverter) rule(name string, schema json.RawMessage) (string, error) {
+	name = c.name(name)
+	body, err := c.visit(name, schema)
+	if err != nil {
+		return "", err
+	}
+
+	c.rules[name] = body
+	return name, nil
+}
+
+// ref returns the rule for the schema a $ref points to
+func (c *schemaConverter) ref(ref string) (string, error) {
+	if name, ok := c.refs[ref]; ok {
+		return name, nil
+	}
+
+	def, ok := c.defs[ref]
+	if !ok {
+		return "", fmt.Errorf("unresolved $ref '%s'", ref)
+	}
+
+	name := c.name("ref-" + ref[strings.LastIndex(ref, "/")+1:])
+	c.refs[ref] = name
+	body, err := c.visit(name, def)
+	if err != nil {
+		return "", err
+	}
+
+	c.rules[name] = body
+	return name, nil
+}
+
+// visit returns the body of the rule called name for schema
+func (c *schemaConverter) visit(name string, schema json.RawMessage) (string, error) {
+	switch string(bytes.TrimSpace(schema)) {
+	case "true":
+		return "value", nil
+	case "false":
+		return "", errors.New("schema 'false' doesn't match any value")
+	}
+
+	var s map[string]json.RawMessage
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return "", errors.New("schema must be an object")
+	}
+
+	for _, keyword := range unsupportedKeywords {
+		if _, ok := s[keyword]; ok {
+			return "", fmt.Errorf("the '%s' keyword isn't supported", keyword)
+		}
+	}
+
+	if raw, ok := s["$ref"]; ok {
+		var ref string
+		if err := json.Unmarshal(raw, &ref); err != nil {
+			return "", errors.New("$ref must be a string")
+		}
+		return c.ref(ref)
+	}
+
+	if raw, ok := s["const"]; ok {
+		return literal(raw)
+	}
+
+	if raw, ok := s["enum"]; ok {
+		var values []json.RawMessage
+		if err := json.Unmarshal(raw, &values); err != nil || len(values) == 0 {
+			return "", errors.New("enum must be a non-empty array")
+		}
+
+		var alts []string
+		for _, value := range values {
+			alt, err := literal(value)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, alt)
+		}
+		return "( " + strings.Join(alts, " | ") + " )", nil
+	}
+
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		raw, ok := s[keyword]
+		if !ok {
+			continue
+		}
+
+		var schemas []json.RawMessage
+		if err := json.Unmarshal(raw, &schemas); err != nil || len(schemas) == 0 {
+			return "", fmt.Errorf("%s must be a non-empty array", keyword)
+		}
+
+		var alts []string
+		for i, schema := range schemas {
+			alt, err := c.rule(fmt.Sprintf("%s-%d", name, i), schema)
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, alt)
+		}
+		return "( " + strings.Join(alts, " | ") + " )", nil
+	}
+
+	var types []string
+	if raw, ok := s["type"]; ok {
+		var t string
+		if err := json.Unmarshal(raw, &t); err == nil {
+			types = []string{t}
+		} else if err := json.Unmarshal(raw, &types); err != nil || len(types) == 0 {
+			return "", errors.New("type must be a string or a non-empty array of strings")
+		}
+	} else if _, ok := s["properties"]; ok {
+		types = []string{"object"}
+	} else if _, ok := s["items"]; ok {
+		types = []string{"array"}
+	} else {
+		return "value", nil
+	}
+
+	var alts []string
+	for _, t := range types {
+		alt, err := c.visitType(name, t, s)
+		if err != nil {
+			return "", err
+		}
+		alts = append(alts, alt)
+	}
+
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+
+	return "( " + strings.Join(alts, " | ") + " )", nil
+}
+
+// visitType returns the body of a rule matching the values of schema s of
+// type t
+func (c *schemaConverter) visitType(name, t string, s map[string]json.RawMessage) (string, error) {
+	switch t {
+	case "object":
+		return c.object(name, s)
+	case "array":
+		items := "value"
+		if raw, ok := s["items"]; ok {
+			var err error
+			if items, err = c.rule(name+"-item", raw); err != nil {
+				return "", err
+			}
+		}
+
+		min, max, err := bounds(s, "minItems", "maxItems")
+		if err != nil {
+			return "", err
+		}
+
+		return `"[" ws ` + repeat(items, `"," ws`, min, max) + ` "]" ws`, nil
+	case "string":
+		min, max, err := bounds(s, "minLength", "maxLength")
+		if err != nil {
+			return "", err
+		}
+
+		if min == 0 && max < 0 {
+			return "string", nil
+		}
+
+		return `"\"" ` + repeat("char", "", min, max) + ` "\"" ws`, nil
+	case "number", "integer", "boolean", "null":
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported type '%s'", t)
+	}
+}
+
+// object returns the body of a rule matching the objects of schema s
+func (c *schemaConverter) object(name string, s map[string]json.RawMessage) (string, error) {
+	var required []string
+	if raw, ok := s["required"]; ok {
+		if err := json.Unmarshal(raw, &required); err != nil {
+			return "", errors.New("required must be an array of strings")
+		}
+	}
+
+	keys, properties, err := orderedProperties(s["properties"])
+	if err != nil {
+		return "", err
+	}
+
+	additional := bytes.TrimSpace(s["additionalProperties"])
+	if string(additional) != "" && string(additional) != "false" {
+		if len(keys) > 0 {
+			return "", errors.New("additionalProperties can't be combined with properties")
+		}
+
+		value, err := c.rule(name+"-value", additional)
+		if err != nil {
+			return "", err
+		}
+
+		kv := `string ":" ws ` + value
+		return `"{" ws ( ` + kv + ` ( "," ws ` + kv + ` )* )? "}" ws`, nil
+	}
+
+	if len(keys) == 0 && string(additional) == "" {
+		// without properties any object matches
+		return "object", nil
+	}
+
+	for _, key := range required {
+		if !slices.Contains(keys, key) {
+			return "", fmt.Errorf("required property '%s' isn't one of the properties", key)
+		}
+	}
+
+	var requiredKVs, optionalKVs []string
+	for _, key := range keys {
+		value, err := c.rule(name+"-"+key, properties[key])
+		if err != nil {
+			return "", err
+		}
+
+		k, err := json.Marshal(key)
+		if err != nil {
+			return "", err
+		}
+
+		kv := quote(string(k)) + ` ws ":" ws ` + value
+		if slices.Contains(required, key) {
+			requiredKVs = append(requiredKVs, kv)
+		} else {
+			optionalKVs = append(optionalKVs, kv)
+		}
+	}
+
+	body := `"{" ws`
+	if len(requiredKVs) > 0 {
+		body += " " + strings.Join(requiredKVs, ` "," ws `)
+	}
+
+	if len(optionalKVs) > 0 {
+		// any of the optional properties may come first, each followed by
+		// any of those after it
+		var alts []string
+		for i, kv := range optionalKVs {
+			for _, next := range optionalKVs[i+1:] {
+				kv += ` ( "," ws ` + next + ` )?`
+			}
+			alts = append(alts, kv)
+		}
+
+		optional := "( " + strings.Join(alts, " | ") + " )"
+		if len(requiredKVs) > 0 {
+			body += ` ( "," ws ` + optional + ` )?`
+		} else {
+			body += " " + optional + "?"
+		}
+	}
+
+	return body + ` "}" ws`, nil
+}
+
+// orderedProperties returns the properties of a schema along with their
+// names, in the order the schema lists them
+func orderedProperties(raw json.RawMessage) ([]string, map[string]json.RawMessage, error) {
+	if len(raw) == 0 {
+		return nil, nil, nil
+	}
+
+	properties := make(map[string]json.RawMessage)
+	d := json.NewDecoder(bytes.NewReader(raw))
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return nil, nil, errors.New("properties must be an object")
+	}
+
+	var keys []string
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key := t.(string)
+		var value json.RawMessage
+		if err := d.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+
+		if _, ok := properties[key]; !ok {
+			keys = append(keys, key)
+		}
+		properties[key] = value
+	}
+
+	return keys, properties, nil
+}
+
+// bounds returns the lower and upper bounds of a schema set by the minKey and
+// maxKey keywords, with an upper bound of -1 when there's none
+func bounds(s map[string]json.RawMessage, minKey, maxKey string) (int, int, error) {
+	min, max := 0, -1
+	if raw, ok := s[minKey]; ok {
+		if err := json.Unmarshal(raw, &min); err != nil || min < 0 {
+			return 0, 0, fmt.Errorf("%s must be a non-negative integer", minKey)
+		}
+	}
+
+	if raw, ok := s[maxKey]; ok {
+		if err := json.Unmarshal(raw, &max); err != nil || max < 0 {
+			return 0, 0, fmt.Errorf("%s must be a non-negative integer", maxKey)
+		}
+	}
+
+	if max >= 0 && min > max {
+		return 0, 0, fmt.Errorf("%s is greater than %s", minKey, maxKey)
+	}
+
+	return min, max, nil
+}
+
+// repeat returns an expression matching item repeated between min and max
+// times, separated by sep. A max of -1 is unbounded.
+func repeat(item, sep string, min, max int) string {
+	element := func(i int) string {
+		if i == 0 || sep == "" {
+			return item
+		}
+		return sep + " " + item
+	}
+
+	var parts []string
+	for i := 0; i < min; i++ {
+		parts = append(parts, element(i))
+	}
+
+	switch {
+	case max < 0 && min == 0:
+		parts = append(parts, "( "+item+" ( "+element(1)+" )* )?")
+	case max < 0:
+		parts = append(parts, "( "+element(min)+" )*")
+	case max > min:
+		var tail string
+		for i := max - 1; i >= min; i-- {
+			tail = strings.TrimSpace("( "+element(i)+" "+tail) + " )?"
+		}
+		parts = append(parts, tail)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// literal returns an expression matching a JSON value exactly
+func literal(value json.RawMessage) (string, error) {
+	var b bytes.Buffer
+	if err := json.Compact(&b, value); err != nil {
+		return "", err
+	}
+
+	return quote(b.String()) + " ws", nil
+}
+
+// quote returns a grammar string literal of s
+func quote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
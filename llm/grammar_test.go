@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rules returns the generated rules of a grammar, without those it builds on
+func rules(t *testing.T, schema string) []string {
+	t.Helper()
+
+	g, err := SchemaGrammar([]byte(schema))
+	require.NoError(t, err)
+
+	generated, _, ok := strings.Cut(g, "\nvalue  ::=")
+	require.True(t, ok)
+	return strings.Split(generated, "\n")
+}
+
+func TestSchemaGrammar(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		rules  []string
+	}{
+		{
+			name:   "object",
+			schema: `{"type": "object", "properties": {"name": {"type": "string"}, "age": {"type": "integer"}, "email": {"type": "string", "format": "email"}}, "required": ["name"], "additionalProperties": false}`,
+			rules: []string{
+				`root ::= "{" ws "\"name\"" ws ":" ws root-name ( "," ws ( "\"age\"" ws ":" ws root-age ( "," ws "\"email\"" ws ":" ws root-email )? | "\"email\"" ws ":" ws root-email ) )? "}" ws`,
+				`root-name ::= string`,
+				`root-age ::= integer`,
+				`root-email ::= string`,
+			},
+		},
+		{
+			name:   "optional properties",
+			schema: `{"properties": {"a": {"type": "number"}, "b": {"type": "boolean"}}}`,
+			rules: []string{
+				`root ::= "{" ws ( "\"a\"" ws ":" ws root-a ( "," ws "\"b\"" ws ":" ws root-b )? | "\"b\"" ws ":" ws root-b )? "}" ws`,
+				`root-a ::= number`,
+				`root-b ::= boolean`,
+			},
+		},
+		{
+			name:   "array",
+			schema: `{"type": "array", "items": {"enum": ["red", "green", 1, null]}, "minItems": 1, "maxItems": 3}`,
+			rules: []string{
+				`root ::= "[" ws root-item ( "," ws root-item ( "," ws root-item )? )? "]" ws`,
+				`root-item ::= ( "\"red\"" ws | "\"green\"" ws | "1" ws | "null" ws )`,
+			},
+		},
+		{
+			name:   "string length",
+			schema: `{"type": "string", "minLength": 1, "maxLength": 2}`,
+			rules:  []string{`root ::= "\"" char ( char )? "\"" ws`},
+		},
+		{
+			name:   "nullable",
+			schema: `{"type": ["string", "null"]}`,
+			rules:  []string{`root ::= ( string | null )`},
+		},
+		{
+			name:   "const",
+			schema: `{"const": "say \"hi\""}`,
+			rules:  []string{`root ::= "\"say \\\"hi\\\"\"" ws`},
+		},
+		{
+			name:   "any of",
+			schema: `{"anyOf": [{"type": "integer"}, {"type": "object", "additionalProperties": {"type": "string"}}]}`,
+			rules: []string{
+				`root ::= ( root-0 | root-1 )`,
+				`root-0 ::= integer`,
+				`root-1 ::= "{" ws ( string ":" ws root-1-value ( "," ws string ":" ws root-1-value )* )? "}" ws`,
+				`root-1-value ::= string`,
+			},
+		},
+		{
+			name:   "refs",
+			schema: `{"$defs": {"node": {"type": "object", "properties": {"value": {"type": "integer"}, "next": {"anyOf": [{"$ref": "#/$defs/node"}, {"type": "null"}]}}, "required": ["value", "next"]}}, "$ref": "#/$defs/node"}`,
+			rules: []string{
+				`root ::= ref-node`,
+				`ref-node ::= "{" ws "\"value\"" ws ":" ws ref-node-value "," ws "\"next\"" ws ":" ws ref-node-next "}" ws`,
+				`ref-node-value ::= integer`,
+				`ref-node-next ::= ( ref-node-next-0 | ref-node-next-1 )`,
+				`ref-node-next-0 ::= ref-node`,
+				`ref-node-next-1 ::= null`,
+			},
+		},
+		{
+			name:   "any",
+			schema: `{"description": "anything"}`,
+			rules:  []string{`root ::= value`},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.rules, rules(t, tt.schema))
+		})
+	}
+}
+
+func TestSchemaGrammarErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{name: "not an object", schema: `[]`, err: "schema must be an object"},
+		{name: "false", schema: `false`, err: "doesn't match any value"},
+		{name: "unsupported keyword", schema: `{"type": "string", "pattern": "^a+$"}`, err: "'pattern'"},
+		{name: "nested unsupported keyword", schema: `{"properties": {"n": {"type": "integer", "minimum": 1}}}`, err: "'minimum'"},
+		{name: "unsupported type", schema: `{"type": "date"}`, err: "unsupported type 'date'"},
+		{name: "unresolved ref", schema: `{"$ref": "#/$defs/missing"}`, err: "unresolved $ref"},
+		{name: "required", schema: `{"properties": {"a": {}}, "required": ["b"]}`, err: "'b'"},
+		{name: "bounds", schema: `{"type": "array", "minItems": 2, "maxItems": 1}`, err: "minItems is greater than maxItems"},
+		{name: "additional properties", schema: `{"properties": {"a": {}}, "additionalProperties": true}`, err: "additionalProperties"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SchemaGrammar([]byte(tt.schema))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
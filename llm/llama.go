@@ -3,6 +3,7 @@ package llm
 import (
 	_ "embed"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/jmorganca/ollama/api"
@@ -49,6 +50,17 @@ type prediction struct {
 	Prompt  string `json:"prompt"`
 	Stop    bool   `json:"stop"`
 
+	StoppedWord  bool   `json:"stopped_word"`
+	StoppingWord string `json:"stopping_word"`
+
+	// TokensEvaluated is the length of the prompt, including any tokens
+	// reused from the cache
+	TokensEvaluated int `json:"tokens_evaluated"`
+
+	// CompletionProbabilities are the candidates for each token of the
+	// content, when the request sets n_probs
+	CompletionProbabilities []tokenProbs `json:"completion_probabilities"`
+
 	Timings struct {
 		PredictedN  int     `json:"predicted_n"`
 		PredictedMS float64 `json:"predicted_ms"`
@@ -57,6 +69,55 @@ type prediction struct {
 	}
 }
 
+// tokenProbs is a generated token and the probabilities of the most likely
+// candidates for it
+type tokenProbs struct {
+	Content string `json:"content"`
+	Probs   []struct {
+		TokStr string  `json:"tok_str"`
+		Prob   float64 `json:"prob"`
+	} `json:"probs"`
+}
+
+// minProbs is the fewest candidates requested per token when log
+// probabilities are reported, so the sampled token is usually among them
+const minProbs = 20
+
+// unlikelyLogprob is reported for tokens which aren't among the candidates
+// the server returned, as OpenAI does for tokens of negligible probability
+const unlikelyLogprob = -9999.0
+
+// logprob returns the natural log of a probability
+func logprob(p float64) float64 {
+	if p <= 0 {
+		return unlikelyLogprob
+	}
+
+	return max(math.Log(p), unlikelyLogprob)
+}
+
+// toLogprobs converts the candidate probabilities of generated tokens into log
+// probabilities, keeping the top most likely candidates of each
+func toLogprobs(tokens []tokenProbs, top int) []api.Logprob {
+	logprobs := make([]api.Logprob, 0, len(tokens))
+	for _, token := range tokens {
+		l := api.Logprob{TokenLogprob: api.TokenLogprob{Token: token.Content, Logprob: unlikelyLogprob}}
+		for i, p := range token.Probs {
+			if p.TokStr == token.Content && l.Logprob == unlikelyLogprob {
+				l.Logprob = logprob(p.Prob)
+			}
+
+			if i < top {
+				l.TopLogprobs = append(l.TopLogprobs, api.TokenLogprob{Token: p.TokStr, Logprob: logprob(p.Prob)})
+			}
+		}
+
+		logprobs = append(logprobs, l)
+	}
+
+	return logprobs
+}
+
 const maxRetries = 3
 
 type PredictOpts struct {
@@ -64,6 +125,14 @@ type PredictOpts struct {
 	Format  string
 	Images  []ImageData
 	Options api.Options
+
+	// Grammar constrains the output, and takes the place of Format
+	Grammar string
+
+	// Logprobs reports the log probability of each generated token, along
+	// with the TopLogprobs most likely tokens at each position
+	Logprobs    bool
+	TopLogprobs int
 }
 
 type PredictResult struct {
@@ -73,6 +142,16 @@ type PredictResult struct {
 	PromptEvalDuration time.Duration
 	EvalCount          int
 	EvalDuration       time.Duration
+
+	// PromptCachedCount is the number of prompt tokens reused from the cache
+	// rather than evaluated
+	PromptCachedCount int
+
+	// StopSequence is the stop sequence which ended generation, if any
+	StopSequence string
+
+	// Logprobs are the log probabilities of the tokens of Content
+	Logprobs []api.Logprob
 }
 
 type TokenizeRequest struct {
@@ -0,0 +1,36 @@
+package llm
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestToLogprobs(t *testing.T) {
+	var tokens []tokenProbs
+	require.NoError(t, json.Unmarshal([]byte(`[
+		{"content": "Hi", "probs": [{"tok_str": "Hello", "prob": 0.5}, {"tok_str": "Hi", "prob": 0.25}, {"tok_str": "Hey", "prob": 0}]},
+		{"content": "!", "probs": [{"tok_str": ".", "prob": 0.9}]}
+	]`), &tokens))
+
+	assert.Equal(t, []api.Logprob{
+		{
+			TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: math.Log(0.25)},
+			TopLogprobs:  []api.TokenLogprob{{Token: "Hello", Logprob: math.Log(0.5)}, {Token: "Hi", Logprob: math.Log(0.25)}},
+		},
+		{
+			// the sampled token wasn't among the candidates
+			TokenLogprob: api.TokenLogprob{Token: "!", Logprob: unlikelyLogprob},
+			TopLogprobs:  []api.TokenLogprob{{Token: ".", Logprob: math.Log(0.9)}},
+		},
+	}, toLogprobs(tokens, 2))
+
+	logprobs := toLogprobs(tokens, 0)
+	assert.Nil(t, logprobs[0].TopLogprobs)
+	assert.Equal(t, unlikelyLogprob, toLogprobs(tokens, 3)[0].TopLogprobs[2].Logprob)
+}
@@ -0,0 +1,90 @@
+package openai
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authKey is the context key of the API key a request was authenticated with
+type authKey struct{}
+
+// maskKey hides all but the ends of an API key, for error messages
+func maskKey(key string) string {
+	if len(key) < 12 {
+		return strings.Repeat("*", len(key))
+	}
+
+	return key[:3] + strings.Repeat("*", len(key)-7) + key[len(key)-4:]
+}
+
+// validKey reports whether key is one of keys, taking the same time whichever
+// key it matches
+func validKey(keys []string, key string) bool {
+	var valid int
+	for _, k := range keys {
+		valid |= subtle.ConstantTimeCompare([]byte(k), []byte(key))
+	}
+
+	return valid == 1
+}
+
+// requestKey returns the API key of a request, from its Authorization: Bearer
+// header, the x-api-key or x-goog-api-key header Anthropic's and Google's
+// clients send, or the openai-insecure-api-key WebSocket protocol browsers
+// connecting to the realtime API offer since they can't set headers
+func requestKey(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); auth != "" {
+		key, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok {
+			return ""
+		}
+
+		return strings.TrimSpace(key)
+	}
+
+	for _, header := range []string{"x-api-key", "x-goog-api-key"} {
+		if key := strings.TrimSpace(c.GetHeader(header)); key != "" {
+			return key
+		}
+	}
+
+	for _, protocol := range strings.Split(c.GetHeader("Sec-WebSocket-Protocol"), ",") {
+		if key, ok := strings.CutPrefix(strings.TrimSpace(protocol), "openai-insecure-api-key."); ok {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// AuthMiddleware requires requests to the OpenAI endpoints to send one of keys
+// as their API key. Requests a middleware makes on behalf of one which was
+// authenticated, such as for each of its choices, are let through. With no
+// keys, every request is rejected.
+func AuthMiddleware(keys ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Request.Context().Value(authKey{}).(string); ok {
+			c.Next()
+			return
+		}
+
+		key := requestKey(c)
+		if key == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, NewErrorWithCode(http.StatusUnauthorized, "You didn't provide an API key. You need to provide your API key in an Authorization header using Bearer auth (i.e. Authorization: Bearer YOUR_KEY).", "invalid_api_key", ""))
+			return
+		}
+
+		if !validKey(keys, key) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, NewErrorWithCode(http.StatusUnauthorized, fmt.Sprintf("Incorrect API key provided: %s.", maskKey(key)), "invalid_api_key", ""))
+			return
+		}
+
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), authKey{}, key))
+		c.Next()
+	}
+}
@@ -0,0 +1,99 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaskKey(t *testing.T) {
+	assert.Equal(t, "sk-*********wxyz", maskKey("sk-abcdefghiwxyz"))
+	assert.Equal(t, "*****", maskKey("short"))
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/chat/completions", AuthMiddleware("sk-first-key", "sk-second-key"), ChoicesMiddleware(r, "/v1/chat/completions"), Middleware(), chatHandler(t, testResponses()...))
+
+	n := 2
+	bts, err := json.Marshal(Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+		N:        &n,
+	})
+	require.NoError(t, err)
+
+	cases := []struct {
+		name    string
+		header  string
+		apiKey  string
+		googKey string
+		proto   string
+		code    int
+	}{
+		{name: "first key", header: "Bearer sk-first-key", code: http.StatusOK},
+		{name: "second key", header: "Bearer sk-second-key", code: http.StatusOK},
+		{name: "x-api-key", apiKey: "sk-first-key", code: http.StatusOK},
+		{name: "wrong x-api-key", apiKey: "sk-wrong-key-1234", code: http.StatusUnauthorized},
+		{name: "x-goog-api-key", googKey: "sk-second-key", code: http.StatusOK},
+		{name: "websocket protocol", proto: "realtime, openai-insecure-api-key.sk-first-key", code: http.StatusOK},
+		{name: "missing", code: http.StatusUnauthorized},
+		{name: "empty", header: "Bearer ", code: http.StatusUnauthorized},
+		{name: "not bearer", header: "Basic sk-first-key", code: http.StatusUnauthorized},
+		{name: "wrong key", header: "Bearer sk-wrong-key-1234", code: http.StatusUnauthorized},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.apiKey != "" {
+				req.Header.Set("x-api-key", tt.apiKey)
+			}
+			if tt.googKey != "" {
+				req.Header.Set("x-goog-api-key", tt.googKey)
+			}
+			if tt.proto != "" {
+				req.Header.Set("Sec-WebSocket-Protocol", tt.proto)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+
+			if tt.code == http.StatusOK {
+				// the choices, requested without the key, are let through
+				var completion Completion
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+				assert.Len(t, completion.Choices, 2)
+				return
+			}
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "invalid_request_error", resp.Error.Type)
+			assert.Equal(t, "invalid_api_key", *resp.Error.Code)
+			assert.NotContains(t, resp.Error.Message, "wrong-key")
+		})
+	}
+
+	t.Run("no keys", func(t *testing.T) {
+		r := newRouter(AuthMiddleware(), Middleware(), chatHandler(t, testResponses()...))
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts))
+		req.Header.Set("Authorization", "Bearer sk-first-key")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
@@ -0,0 +1,45 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AzureMiddleware serves requests in Azure OpenAI's URL scheme, such as
+// /openai/deployments/{deployment}/chat/completions, as OpenAI requests for
+// the model named by the deployment. Azure's api-key header is accepted in
+// place of an Authorization header, and the api-version parameter is ignored.
+func AzureMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := c.GetHeader("api-key"); key != "" && c.GetHeader("Authorization") == "" {
+			c.Request.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		// requests name their deployment rather than a model, and malformed
+		// bodies are left for the next handler to reject
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err == nil && fields != nil {
+			if model, err := json.Marshal(c.Param("deployment")); err == nil {
+				fields["model"] = model
+			}
+
+			if b, err := json.Marshal(fields); err == nil {
+				body = b
+			}
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Request.ContentLength = int64(len(body))
+		c.Next()
+	}
+}
@@ -0,0 +1,63 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestAzureMiddleware(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/openai/deployments/:deployment/chat/completions", AzureMiddleware(), AuthMiddleware("azure-key"), Middleware(WithAliases(map[string]string{"gpt-4o": "llama3"})), capture)
+
+	request := func(deployment string, header http.Header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/openai/deployments/"+deployment+"/chat/completions?api-version=2024-02-01", bytes.NewReader([]byte(body)))
+		req.Header = header
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// the deployment names the model, and the api-key header authenticates
+	w := request("test", http.Header{"Api-Key": {"azure-key"}}, `{"messages": [{"role": "user", "content": "Hi"}]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "test", captured.Model)
+
+	var completion Completion
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+	assert.Len(t, completion.Choices, 1)
+	assert.Equal(t, "Hi", captured.Messages[0].Content)
+
+	// a model in the body is overridden by the deployment, which may be an alias
+	w = request("gpt-4o", http.Header{"Authorization": {"Bearer azure-key"}}, `{"model": "other", "messages": [{"role": "user", "content": "Hi"}]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "llama3", captured.Model)
+
+	w = request("test", http.Header{"Api-Key": {"wrong-key"}}, `{"messages": [{"role": "user", "content": "Hi"}]}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// malformed bodies are reported as they are for OpenAI requests
+	w = request("test", http.Header{"Api-Key": {"azure-key"}}, `{"messages": `)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "invalid_request_error", resp.Error.Type)
+}
@@ -0,0 +1,128 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BatchCompletion is the result of one request in a batch. Error is set, and
+// Choices are empty, when the request failed.
+type BatchCompletion struct {
+	Completion
+	Error *Error `json:"error,omitempty"`
+}
+
+func batchError(req Request, id string, code int, message string) BatchCompletion {
+	resp := NewError(code, message)
+	return BatchCompletion{
+		Completion: Completion{Id: id, Object: "chat.completion", Model: req.Model},
+		Error:      &resp.Error,
+	}
+}
+
+// batchRecorder captures the response to a single request of a batch
+type batchRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *batchRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *batchRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+// completion converts the captured response into a batch result
+func (r *batchRecorder) completion(req Request) BatchCompletion {
+	id := r.header.Get("X-Request-ID")
+	if r.code == http.StatusOK {
+		var result BatchCompletion
+		if err := json.Unmarshal(r.body.Bytes(), &result.Completion); err == nil {
+			return result
+		}
+	}
+
+	var resp ErrorResponse
+	if err := json.Unmarshal(r.body.Bytes(), &resp); err != nil || resp.Error.Message == "" {
+		return batchError(req, id, http.StatusInternalServerError, "unexpected response")
+	}
+
+	return BatchCompletion{
+		Completion: Completion{Id: id, Object: "chat.completion", Model: req.Model},
+		Error:      &resp.Error,
+	}
+}
+
+// BatchMiddleware serves /v1/chat/completions/batch. Each request of the batch
+// is sent to next as a separate non-streaming request for path, with at most
+// max requests in flight at once. Results are returned in request order and a
+// failed request doesn't fail the rest of the batch.
+func BatchMiddleware(next http.Handler, path string, max int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reqs []Request
+		if err := c.ShouldBindJSON(&reqs); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		if len(reqs) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, "[] is too short", "empty_array", ""))
+			return
+		}
+
+		results := make([]BatchCompletion, len(reqs))
+		sem := make(chan struct{}, max)
+
+		var wg sync.WaitGroup
+		for i, req := range reqs {
+			if req.Stream {
+				results[i] = batchError(req, "", http.StatusBadRequest, "stream is not supported in batch requests")
+				continue
+			}
+
+			wg.Add(1)
+			go func(i int, req Request) {
+				defer wg.Done()
+
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				body, err := json.Marshal(req)
+				if err != nil {
+					results[i] = batchError(req, "", http.StatusBadRequest, err.Error())
+					return
+				}
+
+				r, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, path, bytes.NewReader(body))
+				if err != nil {
+					results[i] = batchError(req, "", http.StatusInternalServerError, err.Error())
+					return
+				}
+				r.Header.Set("Content-Type", "application/json")
+
+				rec := &batchRecorder{header: make(http.Header)}
+				next.ServeHTTP(rec, r)
+				results[i] = rec.completion(req)
+			}(i, req)
+		}
+
+		wg.Wait()
+		c.JSON(http.StatusOK, results)
+	}
+}
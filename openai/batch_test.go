@@ -0,0 +1,96 @@
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestBatchMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var inflight, peak int
+
+	handler := func(c *gin.Context) {
+		var req api.ChatRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		mu.Lock()
+		inflight++
+		peak = max(peak, inflight)
+		mu.Unlock()
+
+		defer func() {
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+
+		if req.Model == "missing" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+			return
+		}
+
+		resp := testResponses()[2]
+		resp.Model = req.Model
+		resp.Message.Content = req.Messages[0].Content
+		c.JSON(http.StatusOK, resp)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/chat/completions", Middleware(), handler)
+	r.POST("/v1/chat/completions/batch", BatchMiddleware(r, "/v1/chat/completions", 2))
+
+	t.Run("mixed", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions/batch", []Request{
+			{Model: "test", Messages: []Message{{Role: "user", Content: "one"}}},
+			{Model: "missing", Messages: []Message{{Role: "user", Content: "two"}}},
+			{Model: "test", Messages: []Message{{Role: "user", Content: "three"}}},
+			{Model: "test", Messages: []Message{{Role: "user", Content: "four"}}, Stream: true},
+			{Model: "test", Messages: []Message{{Role: "user", Content: "five"}}},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var results []BatchCompletion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+		require.Len(t, results, 5)
+
+		for i, content := range map[int]string{0: "one", 2: "three", 4: "five"} {
+			assert.Nil(t, results[i].Error)
+			assert.NotEmpty(t, results[i].Id)
+			require.Len(t, results[i].Choices, 1)
+			assert.Equal(t, content, results[i].Choices[0].Message.Content)
+		}
+
+		require.NotNil(t, results[1].Error)
+		assert.Equal(t, "not_found_error", results[1].Error.Type)
+		assert.Contains(t, results[1].Error.Message, "not found")
+		assert.NotEmpty(t, results[1].Id)
+		assert.Empty(t, results[1].Choices)
+
+		require.NotNil(t, results[3].Error)
+		assert.Equal(t, "invalid_request_error", results[3].Error.Type)
+
+		assert.LessOrEqual(t, peak, 2)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions/batch", []Request{})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("not an array", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions/batch", Request{Model: "test"})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
@@ -0,0 +1,678 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchEndpoints are the endpoints the requests of a batch can be sent to
+var batchEndpoints = []string{"/v1/chat/completions", "/v1/completions", "/v1/embeddings"}
+
+// maxBatchRequests is the most requests a batch may have
+const maxBatchRequests = 50000
+
+type BatchErrorData struct {
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	Param   *string `json:"param"`
+	Line    *int    `json:"line"`
+}
+
+type BatchErrors struct {
+	Object string           `json:"object"`
+	Data   []BatchErrorData `json:"data"`
+}
+
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// Batch is a batch of requests created at /v1/batches and run in the
+// background
+type Batch struct {
+	Id               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           *BatchErrors       `json:"errors"`
+	InputFileId      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileId     *string            `json:"output_file_id"`
+	ErrorFileId      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        *int64             `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	FailedAt         *int64             `json:"failed_at"`
+	ExpiredAt        *int64             `json:"expired_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata"`
+}
+
+type BatchList struct {
+	Object  string  `json:"object"`
+	Data    []Batch `json:"data"`
+	FirstId string  `json:"first_id,omitempty"`
+	LastId  string  `json:"last_id,omitempty"`
+	HasMore bool    `json:"has_more"`
+}
+
+type BatchRequest struct {
+	InputFileId      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// BatchLine is a request of a batch's input file
+type BatchLine struct {
+	CustomId string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+type BatchLineResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestId  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type BatchLineError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// BatchResult is the result of a request of a batch, a line of its output or
+// error file
+type BatchResult struct {
+	Id       string             `json:"id"`
+	CustomId string             `json:"custom_id"`
+	Response *BatchLineResponse `json:"response"`
+	Error    *BatchLineError    `json:"error"`
+}
+
+// BatchStore keeps the files uploaded to /v1/files, and the batches of
+// /v1/batches, in a directory. The requests of each batch are sent to next,
+// workers at a time, in the background, with the context values of the
+// request which created the batch so they're authenticated as it was.
+type BatchStore struct {
+	next    http.Handler
+	dir     string
+	workers int
+
+	mu      sync.Mutex
+	files   map[string]*File
+	batches map[string]*Batch
+	cancels map[string]func()
+}
+
+// NewBatchStore opens the store in dir, creating it if needed. Batches which
+// were running when the store was last closed are failed.
+func NewBatchStore(next http.Handler, dir string, workers int) (*BatchStore, error) {
+	s := &BatchStore{
+		next:    next,
+		dir:     dir,
+		workers: max(workers, 1),
+		files:   make(map[string]*File),
+		batches: make(map[string]*Batch),
+		cancels: make(map[string]func()),
+	}
+
+	for _, d := range []string{"files", "batches"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "files", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		var f File
+		if err := readJSON(path, &f); err != nil {
+			slog.Warn("skipping batch file", "path", path, "error", err)
+			continue
+		}
+		s.files[f.Id] = &f
+	}
+
+	paths, err = filepath.Glob(filepath.Join(dir, "batches", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		var b Batch
+		if err := readJSON(path, &b); err != nil {
+			slog.Warn("skipping batch", "path", path, "error", err)
+			continue
+		}
+
+		switch b.Status {
+		case "validating", "in_progress", "finalizing", "cancelling":
+			now := time.Now().Unix()
+			b.Status, b.FailedAt = "failed", &now
+			b.Errors = &BatchErrors{Object: "list", Data: []BatchErrorData{{Code: "batch_interrupted", Message: "The server stopped while the batch was running."}}}
+			if err := writeJSON(path, b); err != nil {
+				return nil, err
+			}
+		}
+
+		s.batches[b.Id] = &b
+	}
+
+	return s, nil
+}
+
+func readJSON(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func (s *BatchStore) batchPath(id string) string {
+	return filepath.Join(s.dir, "batches", id+".json")
+}
+
+// save writes b to the store. It's called with s.mu held.
+func (s *BatchStore) save(b *Batch) {
+	if err := writeJSON(s.batchPath(b.Id), b); err != nil {
+		slog.Error("saving batch", "id", b.Id, "error", err)
+	}
+}
+
+// update changes the batch of id with fn, and saves it
+func (s *BatchStore) update(id string, fn func(*Batch)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(s.batches[id])
+	s.save(s.batches[id])
+}
+
+// end changes the batch of id with fn, once it's no longer running, so it
+// can't be cancelled
+func (s *BatchStore) end(id string, fn func(*Batch)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cancels[id]()
+	delete(s.cancels, id)
+
+	fn(s.batches[id])
+	s.save(s.batches[id])
+}
+
+func batchNotFound(id string) ErrorResponse {
+	return NewErrorWithCode(http.StatusNotFound, fmt.Sprintf("No batch found with id '%s'.", id), "", "batch_id")
+}
+
+// batchLines reads the requests of a batch's input file, or the errors of
+// the lines which aren't valid requests to endpoint
+func batchLines(r io.Reader, endpoint string) ([]BatchLine, []BatchErrorData, error) {
+	var lines []BatchLine
+	var errs []BatchErrorData
+	lineError := func(n int, param, format string, args ...any) {
+		e := BatchErrorData{Code: "invalid_request", Message: fmt.Sprintf(format, args...), Line: &n}
+		if param != "" {
+			e.Param = &param
+		}
+		errs = append(errs, e)
+	}
+
+	ids := make(map[string]bool)
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, nil, err
+		}
+
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			var line BatchLine
+			switch {
+			case json.Unmarshal(b, &line) != nil:
+				lineError(n, "", "This line is not parseable as valid JSON.")
+			case line.CustomId == "":
+				lineError(n, "custom_id", "Missing required parameter: 'custom_id'.")
+			case ids[line.CustomId]:
+				lineError(n, "custom_id", "The custom_id '%s' is used by more than one request.", line.CustomId)
+			case line.Method != http.MethodPost:
+				lineError(n, "method", "Invalid value: '%s'. Supported values are: 'POST'.", line.Method)
+			case line.URL != endpoint:
+				lineError(n, "url", "The url '%s' does not match the batch's endpoint '%s'.", line.URL, endpoint)
+			case len(line.Body) == 0 || line.Body[0] != '{':
+				lineError(n, "body", "The body must be a JSON object.")
+			default:
+				ids[line.CustomId] = true
+				lines = append(lines, line)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	switch {
+	case len(errs) > 0:
+	case len(lines) == 0:
+		errs = append(errs, BatchErrorData{Code: "empty_file", Message: "The batch input file is empty."})
+	case len(lines) > maxBatchRequests:
+		errs = append(errs, BatchErrorData{Code: "too_many_requests", Message: fmt.Sprintf("The batch has %d requests, more than the maximum of %d.", len(lines), maxBatchRequests)})
+	}
+
+	return lines, errs, nil
+}
+
+// send sends a request of a batch to next
+func (s *BatchStore) send(ctx context.Context, line BatchLine) BatchResult {
+	result := BatchResult{Id: newId("batch_req_"), CustomId: line.CustomId}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, line.URL, bytes.NewReader(line.Body))
+	if err != nil {
+		result.Error = &BatchLineError{Code: "invalid_request", Message: err.Error()}
+		return result
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	rec := &batchRecorder{header: make(http.Header)}
+	s.next.ServeHTTP(rec, r)
+
+	body := bytes.TrimSpace(rec.body.Bytes())
+	if !json.Valid(body) {
+		body, _ = json.Marshal(NewError(http.StatusInternalServerError, "unexpected response"))
+	}
+
+	result.Response = &BatchLineResponse{StatusCode: rec.code, RequestId: rec.header.Get("X-Request-ID"), Body: body}
+	return result
+}
+
+// resultFile collects the results written to a batch's output or error file
+type resultFile struct {
+	f *os.File
+	w *bufio.Writer
+	n int
+}
+
+func (s *BatchStore) createResultFile() (*resultFile, error) {
+	f, err := os.CreateTemp(filepath.Join(s.dir, "files"), "batch-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &resultFile{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (rf *resultFile) write(result BatchResult) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	rf.n++
+	_, err = rf.w.Write(append(b, '\n'))
+	return err
+}
+
+// close adds the file to the store as filename, unless nothing was written
+// to it, and returns its id
+func (rf *resultFile) close(s *BatchStore, filename string) (*string, error) {
+	defer os.Remove(rf.f.Name())
+
+	err := rf.w.Flush()
+	if cerr := rf.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || rf.n == 0 {
+		return nil, err
+	}
+
+	f, err := s.addFile(rf.f.Name(), filename, "batch_output")
+	if err != nil {
+		return nil, err
+	}
+
+	return &f.Id, nil
+}
+
+// run validates and sends the requests of the batch of id, until ctx is done
+func (s *BatchStore) run(ctx context.Context, id string) {
+	s.mu.Lock()
+	b := *s.batches[id]
+	s.mu.Unlock()
+
+	fail := func(errs ...BatchErrorData) {
+		s.end(id, func(b *Batch) {
+			now := time.Now().Unix()
+			b.Status, b.FailedAt = "failed", &now
+			b.Errors = &BatchErrors{Object: "list", Data: errs}
+		})
+	}
+
+	in, err := os.Open(s.filePath(b.InputFileId))
+	if err != nil {
+		fail(BatchErrorData{Code: "invalid_file", Message: err.Error()})
+		return
+	}
+
+	lines, errs, err := batchLines(in, b.Endpoint)
+	in.Close()
+	switch {
+	case err != nil:
+		fail(BatchErrorData{Code: "invalid_file", Message: err.Error()})
+		return
+	case len(errs) > 0:
+		fail(errs...)
+		return
+	}
+
+	output, err := s.createResultFile()
+	if err != nil {
+		fail(BatchErrorData{Code: "server_error", Message: err.Error()})
+		return
+	}
+
+	failures, err := s.createResultFile()
+	if err != nil {
+		output.close(s, "")
+		fail(BatchErrorData{Code: "server_error", Message: err.Error()})
+		return
+	}
+
+	s.update(id, func(b *Batch) {
+		if b.Status == "validating" {
+			b.Status = "in_progress"
+		}
+		now := time.Now().Unix()
+		b.InProgressAt = &now
+		b.RequestCounts.Total = len(lines)
+	})
+
+	var mu sync.Mutex
+	record := func(result BatchResult) {
+		ok := result.Response != nil && result.Response.StatusCode == http.StatusOK
+
+		mu.Lock()
+		var err error
+		if ok {
+			err = output.write(result)
+		} else {
+			err = failures.write(result)
+		}
+		mu.Unlock()
+		if err != nil {
+			slog.Error("writing batch result", "id", id, "error", err)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if ok {
+			s.batches[id].RequestCounts.Completed++
+		} else {
+			s.batches[id].RequestCounts.Failed++
+		}
+	}
+
+	expired := func(line BatchLine) BatchResult {
+		return BatchResult{Id: newId("batch_req_"), CustomId: line.CustomId, Error: &BatchLineError{Code: "batch_expired", Message: "This request could not be executed before the completion window expired."}}
+	}
+
+	var wg sync.WaitGroup
+	next := make(chan BatchLine)
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range next {
+				result := s.send(ctx, line)
+				switch {
+				case errors.Is(ctx.Err(), context.DeadlineExceeded):
+					record(expired(line))
+				case ctx.Err() != nil:
+					// requests of a cancelled batch which were being sent
+					// are left out of its results
+				default:
+					record(result)
+				}
+			}
+		}()
+	}
+
+	sent := 0
+send:
+	for _, line := range lines {
+		select {
+		case next <- line:
+			sent++
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		for _, line := range lines[sent:] {
+			record(expired(line))
+		}
+	}
+
+	s.update(id, func(b *Batch) {
+		if b.Status == "in_progress" {
+			b.Status = "finalizing"
+		}
+		now := time.Now().Unix()
+		b.FinalizingAt = &now
+	})
+
+	outputId, err := output.close(s, id+"_output.jsonl")
+	if err != nil {
+		slog.Error("saving batch output", "id", id, "error", err)
+	}
+
+	errorId, err := failures.close(s, id+"_error.jsonl")
+	if err != nil {
+		slog.Error("saving batch errors", "id", id, "error", err)
+	}
+
+	deadline := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	s.end(id, func(b *Batch) {
+		b.OutputFileId, b.ErrorFileId = outputId, errorId
+
+		now := time.Now().Unix()
+		switch {
+		case b.Status == "cancelling":
+			b.Status, b.CancelledAt = "cancelled", &now
+		case deadline:
+			b.Status, b.ExpiredAt = "expired", &now
+		default:
+			b.Status, b.CompletedAt = "completed", &now
+		}
+	})
+}
+
+// CreateBatch serves POST /v1/batches, starting a batch of the requests in
+// an uploaded file
+func (s *BatchStore) CreateBatch(c *gin.Context) {
+	var req BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+		return
+	}
+
+	var err error
+	switch {
+	case req.InputFileId == "":
+		err = newParamError("input_file_id", "missing_required_parameter", "Missing required parameter: 'input_file_id'.")
+	case !slices.Contains(batchEndpoints, req.Endpoint):
+		err = newParamError("endpoint", "invalid_value", "Invalid value: '%s'. Supported values are: '%s'.", req.Endpoint, strings.Join(batchEndpoints, "', '"))
+	case req.CompletionWindow != "24h":
+		err = newParamError("completion_window", "invalid_value", "Invalid value: '%s'. Supported values are: '24h'.", req.CompletionWindow)
+	case len(req.Metadata) > 16:
+		err = newParamError("metadata", "object_above_max_properties", "Invalid 'metadata': too many properties. Expected an object with at most 16 properties, but got an object with %d properties instead.", len(req.Metadata))
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+		return
+	}
+
+	f, ok := s.file(req.InputFileId)
+	switch {
+	case !ok:
+		c.AbortWithStatusJSON(http.StatusNotFound, fileNotFound(req.InputFileId))
+		return
+	case f.Purpose != "batch":
+		c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("File %s has purpose '%s', but batches need a file with purpose 'batch'.", f.Id, f.Purpose), "invalid_value", "input_file_id"))
+		return
+	}
+
+	created := time.Now()
+	expires := created.Add(24 * time.Hour)
+	expiresAt := expires.Unix()
+	b := &Batch{
+		Id:               newId("batch_"),
+		Object:           "batch",
+		Endpoint:         req.Endpoint,
+		InputFileId:      req.InputFileId,
+		CompletionWindow: req.CompletionWindow,
+		Status:           "validating",
+		CreatedAt:        created.Unix(),
+		ExpiresAt:        &expiresAt,
+		Metadata:         req.Metadata,
+	}
+
+	if err := writeJSON(s.batchPath(b.Id), b); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	// the batch outlives the request, but its requests are sent with the
+	// values of its context
+	ctx, cancel := context.WithDeadline(context.WithoutCancel(c.Request.Context()), expires)
+
+	s.mu.Lock()
+	s.batches[b.Id] = b
+	s.cancels[b.Id] = cancel
+	resp := *b
+	s.mu.Unlock()
+
+	go s.run(ctx, b.Id)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetBatch serves GET /v1/batches/:id
+func (s *BatchStore) GetBatch(c *gin.Context) {
+	s.mu.Lock()
+	b, ok := s.batches[c.Param("id")]
+	var resp Batch
+	if ok {
+		resp = *b
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, batchNotFound(c.Param("id")))
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// ListBatches serves GET /v1/batches, newest first. Pages of limit batches
+// follow the batch of the after query parameter.
+func (s *BatchStore) ListBatches(c *gin.Context) {
+	limit, err := listLimit(c, 100)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+		return
+	}
+
+	s.mu.Lock()
+	batches := make([]Batch, 0, len(s.batches))
+	for _, b := range s.batches {
+		batches = append(batches, *b)
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(batches, func(a, b Batch) int {
+		if c := cmp.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(b.Id, a.Id)
+	})
+
+	if after := c.Query("after"); after != "" {
+		i := slices.IndexFunc(batches, func(b Batch) bool { return b.Id == after })
+		batches = batches[i+1:]
+	}
+
+	list := BatchList{Object: "list", Data: batches[:min(limit, len(batches))], HasMore: len(batches) > limit}
+	if len(list.Data) > 0 {
+		list.FirstId, list.LastId = list.Data[0].Id, list.Data[len(list.Data)-1].Id
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// CancelBatch serves POST /v1/batches/:id/cancel. The batch is cancelling
+// until the requests being sent finish, and then cancelled, with the results
+// of the requests which were sent.
+func (s *BatchStore) CancelBatch(c *gin.Context) {
+	id := c.Param("id")
+
+	s.mu.Lock()
+	b, ok := s.batches[id]
+	cancel, running := s.cancels[id]
+	var resp Batch
+	if ok && running && b.Status != "cancelling" {
+		now := time.Now().Unix()
+		b.Status, b.CancellingAt = "cancelling", &now
+		s.save(b)
+	}
+	if ok {
+		resp = *b
+	}
+	s.mu.Unlock()
+
+	switch {
+	case !ok:
+		c.AbortWithStatusJSON(http.StatusNotFound, batchNotFound(id))
+		return
+	case !running:
+		c.AbortWithStatusJSON(http.StatusConflict, NewErrorWithCode(http.StatusConflict, fmt.Sprintf("Cannot cancel a batch with status '%s'.", resp.Status), "", ""))
+		return
+	}
+
+	cancel()
+	c.JSON(http.StatusOK, resp)
+}
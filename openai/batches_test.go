@@ -0,0 +1,307 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestBatchLines(t *testing.T) {
+	input := strings.Join([]string{
+		`{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "test"}}`,
+		``,
+		`{"custom_id": "b", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "test"}}`,
+	}, "\n")
+
+	lines, errs, err := batchLines(strings.NewReader(input), "/v1/chat/completions")
+	require.NoError(t, err)
+	assert.Empty(t, errs)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "b", lines[1].CustomId)
+	assert.JSONEq(t, `{"model": "test"}`, string(lines[1].Body))
+
+	input = strings.Join([]string{
+		`not json`,
+		`{"method": "POST", "url": "/v1/chat/completions", "body": {}}`,
+		`{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {}}`,
+		`{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {}}`,
+		`{"custom_id": "b", "method": "GET", "url": "/v1/chat/completions", "body": {}}`,
+		`{"custom_id": "c", "method": "POST", "url": "/v1/embeddings", "body": {}}`,
+		`{"custom_id": "d", "method": "POST", "url": "/v1/chat/completions", "body": "hello"}`,
+	}, "\n")
+
+	_, errs, err = batchLines(strings.NewReader(input), "/v1/chat/completions")
+	require.NoError(t, err)
+
+	var params []any
+	var lineNumbers []int
+	for _, e := range errs {
+		if e.Param != nil {
+			params = append(params, *e.Param)
+		} else {
+			params = append(params, nil)
+		}
+		lineNumbers = append(lineNumbers, *e.Line)
+	}
+	assert.Equal(t, []any{nil, "custom_id", "custom_id", "method", "url", "body"}, params)
+	assert.Equal(t, []int{1, 2, 4, 5, 6, 7}, lineNumbers)
+
+	_, errs, err = batchLines(strings.NewReader("\n"), "/v1/chat/completions")
+	require.NoError(t, err)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "empty_file", errs[0].Code)
+}
+
+// batchHandler answers chat completions of the model "missing" as not found,
+// blocks those of the model "slow" until they're cancelled, and answers the
+// rest with testResponses
+func batchHandler(t *testing.T) gin.HandlerFunc {
+	responses := chatHandler(t, testResponses()...)
+	return func(c *gin.Context) {
+		var req api.ChatRequest
+		body, err := c.GetRawData()
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &req))
+
+		switch req.Model {
+		case "missing":
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+		case "slow":
+			<-c.Request.Context().Done()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "cancelled"})
+		default:
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			responses(c)
+		}
+	}
+}
+
+// batchInput is the input file of a batch of chat completions of models
+func batchInput(models ...string) []byte {
+	var b bytes.Buffer
+	for i, model := range models {
+		fmt.Fprintf(&b, `{"custom_id": "request-%d", "method": "POST", "url": "/v1/chat/completions", "body": {"model": %q, "messages": [{"role": "user", "content": "Hi"}]}}`+"\n", i, model)
+	}
+	return b.Bytes()
+}
+
+func createBatch(t *testing.T, r http.Handler, input []byte) Batch {
+	t.Helper()
+
+	w := uploadFile(t, r, "batch", "requests.jsonl", input)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var f File
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &f))
+
+	w = doAuthRequest(t, r, http.MethodPost, "/v1/batches", BatchRequest{InputFileId: f.Id, Endpoint: "/v1/chat/completions", CompletionWindow: "24h", Metadata: map[string]string{"run": "eval"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var b Batch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+	return b
+}
+
+func getBatch(t *testing.T, r http.Handler, id string) Batch {
+	t.Helper()
+
+	w := doAuthRequest(t, r, http.MethodGet, "/v1/batches/"+id, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var b Batch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+	return b
+}
+
+// waitBatch returns the batch of id once it has status
+func waitBatch(t *testing.T, r http.Handler, id, status string) Batch {
+	t.Helper()
+
+	var b Batch
+	require.Eventually(t, func() bool {
+		b = getBatch(t, r, id)
+		return b.Status == status
+	}, 5*time.Second, 10*time.Millisecond)
+	return b
+}
+
+// batchResults reads the results of a batch's output or error file by their
+// custom id
+func batchResults(t *testing.T, r http.Handler, id *string) map[string]BatchResult {
+	t.Helper()
+	require.NotNil(t, id)
+
+	w := doAuthRequest(t, r, http.MethodGet, "/v1/files/"+*id+"/content", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	results := make(map[string]BatchResult)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var result BatchResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+		assert.True(t, strings.HasPrefix(result.Id, "batch_req_"))
+		results[result.CustomId] = result
+	}
+	return results
+}
+
+func TestBatches(t *testing.T) {
+	r, _ := newBatchRouter(t, t.TempDir(), batchHandler(t))
+
+	t.Run("completed", func(t *testing.T) {
+		b := createBatch(t, r, batchInput("test", "missing", "test"))
+		assert.Equal(t, "batch", b.Object)
+		assert.Equal(t, "validating", b.Status)
+		assert.Equal(t, map[string]string{"run": "eval"}, b.Metadata)
+		require.NotNil(t, b.ExpiresAt)
+		assert.Equal(t, b.CreatedAt+24*60*60, *b.ExpiresAt)
+
+		b = waitBatch(t, r, b.Id, "completed")
+		assert.Equal(t, BatchRequestCounts{Total: 3, Completed: 2, Failed: 1}, b.RequestCounts)
+		assert.NotNil(t, b.InProgressAt)
+		assert.NotNil(t, b.FinalizingAt)
+		assert.NotNil(t, b.CompletedAt)
+
+		output := batchResults(t, r, b.OutputFileId)
+		require.Len(t, output, 2)
+		result := output["request-2"]
+		require.NotNil(t, result.Response)
+		assert.Nil(t, result.Error)
+		assert.Equal(t, http.StatusOK, result.Response.StatusCode)
+		assert.NotEmpty(t, result.Response.RequestId)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(result.Response.Body, &completion))
+		assert.Equal(t, "Hello, world", completion.Choices[0].Message.Content)
+
+		errors := batchResults(t, r, b.ErrorFileId)
+		require.Len(t, errors, 1)
+		assert.Equal(t, http.StatusNotFound, errors["request-1"].Response.StatusCode)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(errors["request-1"].Response.Body, &resp))
+		assert.Equal(t, "model_not_found", *resp.Error.Code)
+
+		w := doAuthRequest(t, r, http.MethodPost, "/v1/batches/"+b.Id+"/cancel", nil)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("no errors", func(t *testing.T) {
+		b := createBatch(t, r, batchInput("test"))
+		b = waitBatch(t, r, b.Id, "completed")
+		assert.NotNil(t, b.OutputFileId)
+		assert.Nil(t, b.ErrorFileId)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		b := createBatch(t, r, []byte(`{"custom_id": "a", "method": "POST", "url": "/v1/embeddings", "body": {}}`))
+		b = waitBatch(t, r, b.Id, "failed")
+		require.NotNil(t, b.Errors)
+		require.Len(t, b.Errors.Data, 1)
+		assert.Equal(t, "url", *b.Errors.Data[0].Param)
+		assert.Equal(t, 1, *b.Errors.Data[0].Line)
+		assert.Nil(t, b.OutputFileId)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		b := createBatch(t, r, batchInput("test", "test", "slow", "slow", "slow"))
+		require.Eventually(t, func() bool {
+			return getBatch(t, r, b.Id).RequestCounts.Completed == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		w := doAuthRequest(t, r, http.MethodPost, "/v1/batches/"+b.Id+"/cancel", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var cancelling Batch
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &cancelling))
+		assert.Equal(t, "cancelling", cancelling.Status)
+		assert.NotNil(t, cancelling.CancellingAt)
+
+		b = waitBatch(t, r, b.Id, "cancelled")
+		assert.Equal(t, BatchRequestCounts{Total: 5, Completed: 2}, b.RequestCounts)
+		assert.Len(t, batchResults(t, r, b.OutputFileId), 2)
+		assert.Nil(t, b.ErrorFileId)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := doAuthRequest(t, r, http.MethodGet, "/v1/batches?limit=2", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var list BatchList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Len(t, list.Data, 2)
+		assert.True(t, list.HasMore)
+
+		w = doAuthRequest(t, r, http.MethodGet, "/v1/batches?after="+list.LastId, nil)
+		var next BatchList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &next))
+		assert.Len(t, next.Data, 2)
+		assert.False(t, next.HasMore)
+	})
+
+	w := uploadFile(t, r, "vision", "image.png", []byte("png"))
+	var image File
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &image))
+
+	cases := []struct {
+		name  string
+		req   BatchRequest
+		code  int
+		param string
+	}{
+		{name: "missing input file", req: BatchRequest{Endpoint: "/v1/chat/completions", CompletionWindow: "24h"}, code: http.StatusBadRequest, param: "input_file_id"},
+		{name: "unknown input file", req: BatchRequest{InputFileId: "file-missing", Endpoint: "/v1/chat/completions", CompletionWindow: "24h"}, code: http.StatusNotFound, param: "id"},
+		{name: "input file purpose", req: BatchRequest{InputFileId: image.Id, Endpoint: "/v1/chat/completions", CompletionWindow: "24h"}, code: http.StatusBadRequest, param: "input_file_id"},
+		{name: "invalid endpoint", req: BatchRequest{InputFileId: image.Id, Endpoint: "/v1/responses", CompletionWindow: "24h"}, code: http.StatusBadRequest, param: "endpoint"},
+		{name: "invalid completion window", req: BatchRequest{InputFileId: image.Id, Endpoint: "/v1/chat/completions", CompletionWindow: "1h"}, code: http.StatusBadRequest, param: "completion_window"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doAuthRequest(t, r, http.MethodPost, "/v1/batches", tt.req)
+			assert.Equal(t, tt.code, w.Code, w.Body.String())
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.param, resp.Error.Param)
+		})
+	}
+
+	w = doAuthRequest(t, r, http.MethodGet, "/v1/batches/batch_missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestBatchStoreInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewBatchStore(nil, dir, 1)
+	require.NoError(t, err)
+
+	b := Batch{Id: "batch_running", Object: "batch", Status: "in_progress"}
+	require.NoError(t, writeJSON(filepath.Join(dir, "batches", b.Id+".json"), b))
+
+	r, _ := newBatchRouter(t, dir, batchHandler(t))
+	b = getBatch(t, r, b.Id)
+	assert.Equal(t, "failed", b.Status)
+	assert.NotNil(t, b.FailedAt)
+	require.NotNil(t, b.Errors)
+	assert.Equal(t, "batch_interrupted", b.Errors.Data[0].Code)
+
+	// the failure is saved
+	bts, err := os.ReadFile(filepath.Join(dir, "batches", b.Id+".json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(bts), `"failed"`)
+}
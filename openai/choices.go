@@ -0,0 +1,412 @@
+package openai
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// maxChoices is the largest n a request may ask for
+const maxChoices = 128
+
+// mergeUsage combines the usage of each choice of a request. The prompt is
+// the same for every choice so its tokens are counted once.
+func mergeUsage(usages []Usage) Usage {
+	if len(usages) == 0 {
+		return Usage{}
+	}
+
+	merged := usages[0]
+	for _, usage := range usages[1:] {
+		merged.CompletionTokens += usage.CompletionTokens
+
+		if usage.CompletionTokensDetails != nil {
+			if merged.CompletionTokensDetails == nil {
+				merged.CompletionTokensDetails = &CompletionTokensDetails{}
+			}
+			merged.CompletionTokensDetails.ReasoningTokens += usage.CompletionTokensDetails.ReasoningTokens
+		}
+
+		if usage.Timings != nil {
+			if merged.Timings == nil {
+				merged.Timings = &Timings{}
+			}
+			merged.Timings.TotalDuration += usage.Timings.TotalDuration
+			merged.Timings.LoadDuration += usage.Timings.LoadDuration
+			merged.Timings.PromptEvalDuration += usage.Timings.PromptEvalDuration
+			merged.Timings.EvalDuration += usage.Timings.EvalDuration
+		}
+	}
+
+	merged.TotalTokens = merged.PromptTokens + merged.CompletionTokens
+	return merged
+}
+
+// choiceRequest returns the body of the request for the i'th choice of req.
+// Seeded requests get a different seed for each choice so that choices
+// differ but are still reproducible.
+func choiceRequest(req Request, i int) ([]byte, error) {
+	req.N = nil
+	if req.Seed != nil {
+		seed := *req.Seed + i
+		req.Seed = &seed
+	}
+
+	return json.Marshal(req)
+}
+
+// choiceStream forwards the events of a streamed choice to the client,
+// setting the index of the choice and the id of the first choice on each
+// chunk. The end of the stream, and usage, are held back for the last choice.
+type choiceStream struct {
+	gin.ResponseWriter
+
+	header  http.Header
+	code    int
+	index   int
+	id      string
+	pending []byte
+
+	// last is the last chunk of the choice, with its usage if the request
+	// asked for it
+	last Chunk
+
+	// body holds the response when the choice fails
+	body bytes.Buffer
+}
+
+func (s *choiceStream) Header() http.Header {
+	return s.header
+}
+
+func (s *choiceStream) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+}
+
+func (s *choiceStream) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+
+	if s.code != http.StatusOK {
+		return s.body.Write(b)
+	}
+
+	s.pending = append(s.pending, b...)
+	for {
+		event, rest, ok := bytes.Cut(s.pending, []byte("\n\n"))
+		if !ok {
+			return len(b), nil
+		}
+		s.pending = rest
+
+		data, ok := eventData(event)
+		if !ok || string(data) == "[DONE]" {
+			continue
+		}
+
+		var chunk Chunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return 0, err
+		}
+
+		if s.id == "" {
+			s.id = chunk.Id
+		}
+
+		if len(chunk.Choices) == 0 {
+			// the usage of the choice, which is sent once for all of them
+			s.last.Usage = chunk.Usage
+			continue
+		}
+
+		chunk.Id = s.id
+		for i := range chunk.Choices {
+			chunk.Choices[i].Index = s.index
+		}
+
+		s.last = chunk
+		chunk.Usage = nil
+
+		d, err := json.Marshal(chunk)
+		if err != nil {
+			return 0, err
+		}
+
+		if !s.ResponseWriter.Written() {
+			s.ResponseWriter.Header().Set("X-Request-ID", s.header.Get("X-Request-ID"))
+		}
+
+		s.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+		if _, err := s.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d))); err != nil {
+			return 0, err
+		}
+		s.ResponseWriter.Flush()
+	}
+}
+
+// eventData returns the data of an SSE event, ignoring its other fields
+func eventData(event []byte) ([]byte, bool) {
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		if data, ok := bytes.CutPrefix(line, []byte("data: ")); ok {
+			return data, true
+		}
+	}
+
+	return nil, false
+}
+
+// ChoicesMiddleware generates the n choices of chat completion requests which
+// ask for more than one. Each choice is sent to next as a separate request
+// for path, one after another, and the choices are returned together as one
+// completion. Streamed choices are sent in full one after another, each with
+// its own index. Requests for a single choice are passed on unchanged.
+func ChoicesMiddleware(next http.Handler, path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req Request
+		if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil || req.N == nil || *req.N == 1 {
+			// the chat middleware reports any error
+			c.Next()
+			return
+		}
+
+		if err := req.validate(); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		if req.Stream {
+			streamChoices(c, next, path, req)
+			return
+		}
+
+		var completion Completion
+		usages := make([]Usage, *req.N)
+		for i := range usages {
+			body, err := choiceRequest(req, i)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+				return
+			}
+
+			r, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, path, bytes.NewReader(body))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+				return
+			}
+			r.Header.Set("Content-Type", "application/json")
+
+			rec := &batchRecorder{header: make(http.Header)}
+			next.ServeHTTP(rec, r)
+			if rec.code != http.StatusOK {
+				// a choice which fails fails the request
+				c.Data(rec.code, "application/json", rec.body.Bytes())
+				c.Abort()
+				return
+			}
+
+			var choice Completion
+			if err := json.Unmarshal(rec.body.Bytes(), &choice); err != nil || len(choice.Choices) != 1 {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, "unexpected response"))
+				return
+			}
+
+			if i == 0 {
+				completion = choice
+				completion.Choices = nil
+				c.Header("X-Request-ID", choice.Id)
+			}
+
+			choice.Choices[0].Index = i
+			completion.Choices = append(completion.Choices, choice.Choices[0])
+			usages[i] = choice.Usage
+		}
+
+		completion.Usage = mergeUsage(usages)
+		c.AbortWithStatusJSON(http.StatusOK, completion)
+	}
+}
+
+// streamChoices streams the choices of req to the client one after another
+func streamChoices(c *gin.Context, next http.Handler, path string, req Request) {
+	var id string
+	var last Chunk
+	var usages []Usage
+	for i := 0; i < *req.N; i++ {
+		body, err := choiceRequest(req, i)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		r, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, path, bytes.NewReader(body))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+		r.Header.Set("Content-Type", "application/json")
+
+		s := &choiceStream{ResponseWriter: c.Writer, header: make(http.Header), index: i, id: id}
+		next.ServeHTTP(s, r)
+		if s.code != http.StatusOK {
+			if i == 0 {
+				c.Data(s.code, "application/json", s.body.Bytes())
+				c.Abort()
+				return
+			}
+
+			// the stream has already started, so the error ends it
+			fmt.Fprintf(c.Writer, "data: %s\n\n", bytes.TrimSpace(s.body.Bytes()))
+			break
+		}
+
+		id, last = s.id, s.last
+		if last.Usage != nil {
+			usages = append(usages, *last.Usage)
+		}
+	}
+
+	// usage is sent once for all choices, in a final chunk of its own
+	if len(usages) > 0 {
+		usage := mergeUsage(usages)
+		last.Choices = []ChunkChoice{}
+		last.Usage = &usage
+		if d, err := json.Marshal(last); err == nil {
+			fmt.Fprintf(c.Writer, "data: %s\n\n", d)
+		}
+	}
+
+	fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+	c.Abort()
+}
+
+// meanLogprob scores a candidate by the mean log probability of its tokens.
+// Candidates which generated nothing score lowest, so they're never preferred
+// to ones which did.
+func meanLogprob(l *CompletionLogprobs) float64 {
+	if l == nil || len(l.TokenLogprobs) == 0 {
+		return math.Inf(-1)
+	}
+
+	var sum float64
+	for _, logprob := range l.TokenLogprobs {
+		sum += logprob
+	}
+
+	return sum / float64(len(l.TokenLogprobs))
+}
+
+// completionChoiceRequest returns the body of the request for the i'th
+// candidate of req, which always reports log probabilities so candidates can
+// be ranked
+func completionChoiceRequest(req CompletionRequest, i int) ([]byte, error) {
+	req.N, req.BestOf = nil, nil
+	if req.Logprobs == nil {
+		req.Logprobs = new(int)
+	}
+
+	if req.Seed != nil {
+		seed := *req.Seed + i
+		req.Seed = &seed
+	}
+
+	return json.Marshal(req)
+}
+
+// CompletionChoicesMiddleware generates the choices of text completion
+// requests which ask for more than one, or for best_of candidates. Each
+// candidate is sent to next as a separate request for path, one after
+// another, and the n with the highest mean token log probability are returned
+// together as one completion. The mean, unlike the total, doesn't favor
+// shorter candidates. Every candidate is a full generation, so a request
+// takes about best_of times as long as one for a single choice, and its usage
+// counts the tokens of all of them. Requests for a single candidate are
+// passed on unchanged.
+func CompletionChoicesMiddleware(next http.Handler, path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CompletionRequest
+		if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+			// the completions middleware reports any error
+			c.Next()
+			return
+		}
+
+		if _, bestOf := req.choices(); bestOf == 1 {
+			c.Next()
+			return
+		}
+
+		if err := req.validate(); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		n, bestOf := req.choices()
+
+		var completion TextCompletion
+		usages := make([]Usage, bestOf)
+		for i := range usages {
+			body, err := completionChoiceRequest(req, i)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+				return
+			}
+
+			r, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, path, bytes.NewReader(body))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+				return
+			}
+			r.Header.Set("Content-Type", "application/json")
+
+			rec := &batchRecorder{header: make(http.Header)}
+			next.ServeHTTP(rec, r)
+			if rec.code != http.StatusOK {
+				// a candidate which fails fails the request
+				c.Data(rec.code, "application/json", rec.body.Bytes())
+				c.Abort()
+				return
+			}
+
+			var candidate TextCompletion
+			if err := json.Unmarshal(rec.body.Bytes(), &candidate); err != nil || len(candidate.Choices) != 1 || candidate.Usage == nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, "unexpected response"))
+				return
+			}
+
+			if i == 0 {
+				completion = candidate
+				completion.Choices = nil
+				c.Header("X-Request-ID", candidate.Id)
+			}
+
+			completion.Choices = append(completion.Choices, candidate.Choices[0])
+			usages[i] = *candidate.Usage
+		}
+
+		slices.SortStableFunc(completion.Choices, func(a, b CompletionChoice) int {
+			return cmp.Compare(meanLogprob(b.Logprobs), meanLogprob(a.Logprobs))
+		})
+
+		completion.Choices = completion.Choices[:n]
+		for i := range completion.Choices {
+			completion.Choices[i].Index = i
+			if req.Logprobs == nil {
+				completion.Choices[i].Logprobs = nil
+			}
+		}
+
+		usage := mergeUsage(usages)
+		completion.Usage = &usage
+		c.AbortWithStatusJSON(http.StatusOK, completion)
+	}
+}
@@ -0,0 +1,247 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestChoicesMiddleware(t *testing.T) {
+	var seeds []any
+	handler := func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		require.NoError(t, err)
+
+		var req api.ChatRequest
+		require.NoError(t, json.Unmarshal(body, &req))
+		seeds = append(seeds, req.Options["seed"])
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		chatHandler(t, testResponses()...)(c)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/chat/completions", ChoicesMiddleware(r, "/v1/chat/completions"), Middleware(), handler)
+
+	messages := []Message{{Role: "user", Content: "Hello"}}
+
+	t.Run("completion", func(t *testing.T) {
+		seeds = nil
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: messages, N: ptr(3), Seed: ptr(7)})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, []any{7.0, 8.0, 9.0}, seeds)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, w.Header().Get("X-Request-ID"), completion.Id)
+		require.Len(t, completion.Choices, 3)
+		for i, choice := range completion.Choices {
+			assert.Equal(t, i, choice.Index)
+			assert.Equal(t, "Hello, world", choice.Message.Content)
+			assert.Equal(t, "stop", *choice.FinishReason)
+		}
+
+		assert.Equal(t, 3, completion.Usage.PromptTokens)
+		assert.Equal(t, 6, completion.Usage.CompletionTokens)
+		assert.Equal(t, 9, completion.Usage.TotalTokens)
+	})
+
+	t.Run("single choice", func(t *testing.T) {
+		seeds = nil
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: messages, N: ptr(1)})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, seeds, 1)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: messages, N: ptr(2), Stream: true, StreamOptions: &StreamOptions{IncludeUsage: true}})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+		assert.Equal(t, 1, strings.Count(w.Body.String(), "data: [DONE]"))
+
+		chunks := readChunks(t, w.Body)
+		require.Len(t, chunks, 7)
+
+		contents := make([]string, 2)
+		for _, chunk := range chunks[:6] {
+			assert.Equal(t, w.Header().Get("X-Request-ID"), chunk.Id)
+			assert.Nil(t, chunk.Usage)
+			require.Len(t, chunk.Choices, 1)
+			contents[chunk.Choices[0].Index] += chunk.Choices[0].Delta.Content
+		}
+		assert.Equal(t, []string{"Hello, world", "Hello, world"}, contents)
+
+		last := chunks[6]
+		assert.Empty(t, last.Choices)
+		require.NotNil(t, last.Usage)
+		assert.Equal(t, 7, last.Usage.TotalTokens)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cases := []struct {
+			name string
+			req  Request
+			code int
+		}{
+			{name: "zero", req: Request{Model: "test", Messages: messages, N: ptr(0)}, code: http.StatusBadRequest},
+			{name: "too many", req: Request{Model: "test", Messages: messages, N: ptr(129)}, code: http.StatusBadRequest},
+			{name: "invalid request", req: Request{Model: "test", N: ptr(2)}, code: http.StatusBadRequest},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				seeds = nil
+				w := doRequest(t, r, "/v1/chat/completions", tt.req)
+				require.Equal(t, tt.code, w.Code)
+				assert.Empty(t, seeds)
+
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.NotEmpty(t, resp.Error.Message)
+			})
+		}
+	})
+}
+
+func TestCompletionChoicesMiddleware(t *testing.T) {
+	// the candidate of each seed, with the mean log probability of its tokens
+	candidates := map[float64][]api.Logprob{
+		0: {{TokenLogprob: api.TokenLogprob{Token: "zero", Logprob: -2}}},
+		1: {{TokenLogprob: api.TokenLogprob{Token: "one", Logprob: -0.25}}, {TokenLogprob: api.TokenLogprob{Token: "!", Logprob: -0.75}}},
+		2: {{TokenLogprob: api.TokenLogprob{Token: "two", Logprob: -1.5}}},
+		3: {},
+	}
+
+	var reqs []api.GenerateRequest
+	handler := func(c *gin.Context) {
+		var req api.GenerateRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+		reqs = append(reqs, req)
+
+		logprobs := candidates[req.Options["seed"].(float64)]
+		var text strings.Builder
+		for _, l := range logprobs {
+			text.WriteString(l.Token)
+		}
+
+		c.JSON(http.StatusOK, api.GenerateResponse{
+			Model:    "test",
+			Response: text.String(),
+			Done:     true,
+			Logprobs: logprobs,
+			Metrics:  api.Metrics{PromptEvalCount: 5, EvalCount: len(logprobs)},
+		})
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/completions", CompletionChoicesMiddleware(r, "/v1/completions"), CompletionsMiddleware(), handler)
+
+	t.Run("best of", func(t *testing.T) {
+		reqs = nil
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: "Hello", N: ptr(2), BestOf: ptr(4), Seed: ptr(0)})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		require.Len(t, reqs, 4)
+		for _, req := range reqs {
+			assert.True(t, req.Logprobs)
+		}
+
+		var completion TextCompletion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, w.Header().Get("X-Request-ID"), completion.Id)
+		require.Len(t, completion.Choices, 2)
+		assert.Equal(t, "one!", completion.Choices[0].Text)
+		assert.Equal(t, "two", completion.Choices[1].Text)
+		for i, choice := range completion.Choices {
+			assert.Equal(t, i, choice.Index)
+			assert.Nil(t, choice.Logprobs)
+		}
+
+		require.NotNil(t, completion.Usage)
+		assert.Equal(t, 5, completion.Usage.PromptTokens)
+		assert.Equal(t, 4, completion.Usage.CompletionTokens)
+	})
+
+	t.Run("top n", func(t *testing.T) {
+		cases := []struct {
+			n        int
+			expected []string
+		}{
+			{n: 1, expected: []string{"one!"}},
+			{n: 3, expected: []string{"one!", "two", "zero"}},
+			// a candidate which generated nothing is ranked last
+			{n: 4, expected: []string{"one!", "two", "zero", ""}},
+		}
+
+		for _, tt := range cases {
+			reqs = nil
+			w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: "Hello", N: ptr(tt.n), BestOf: ptr(4), Seed: ptr(0)})
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Len(t, reqs, 4)
+
+			var completion TextCompletion
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+
+			var texts []string
+			for _, choice := range completion.Choices {
+				texts = append(texts, choice.Text)
+			}
+			assert.Equal(t, tt.expected, texts)
+		}
+	})
+
+	t.Run("logprobs", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: "Hello", BestOf: ptr(2), Seed: ptr(0), Logprobs: ptr(1)})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var completion TextCompletion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		require.Len(t, completion.Choices, 1)
+		require.NotNil(t, completion.Choices[0].Logprobs)
+		assert.Equal(t, []string{"one", "!"}, completion.Choices[0].Logprobs.Tokens)
+		assert.Equal(t, []int{0, 3}, completion.Choices[0].Logprobs.TextOffset)
+	})
+
+	t.Run("single candidate", func(t *testing.T) {
+		reqs = nil
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: "Hello", BestOf: ptr(1), Seed: ptr(1)})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, reqs, 1)
+		assert.False(t, reqs[0].Logprobs)
+	})
+
+	cases := []struct {
+		name  string
+		req   CompletionRequest
+		param string
+	}{
+		{name: "best of below n", req: CompletionRequest{Model: "test", Prompt: "Hello", N: ptr(3), BestOf: ptr(2)}, param: "best_of"},
+		{name: "best of above max", req: CompletionRequest{Model: "test", Prompt: "Hello", BestOf: ptr(21)}, param: "best_of"},
+		{name: "n below min", req: CompletionRequest{Model: "test", Prompt: "Hello", N: ptr(0)}, param: "n"},
+		{name: "stream best of", req: CompletionRequest{Model: "test", Prompt: "Hello", BestOf: ptr(2), Stream: true}, param: "best_of"},
+		{name: "stream n", req: CompletionRequest{Model: "test", Prompt: "Hello", N: ptr(2), Stream: true}, param: "n"},
+		{name: "logprobs above max", req: CompletionRequest{Model: "test", Prompt: "Hello", Logprobs: ptr(6)}, param: "logprobs"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, r, "/v1/completions", tt.req)
+			require.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.param, resp.Error.Param)
+		})
+	}
+}
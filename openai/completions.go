@@ -0,0 +1,505 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// CompletionRequest is a legacy text completion request
+type CompletionRequest struct {
+	Model            string         `json:"model"`
+	Prompt           any            `json:"prompt"`
+	Suffix           string         `json:"suffix"`
+	Echo             bool           `json:"echo"`
+	N                *int           `json:"n"`
+	BestOf           *int           `json:"best_of"`
+	Logprobs         *int           `json:"logprobs"`
+	Stream           bool           `json:"stream"`
+	StreamOptions    *StreamOptions `json:"stream_options"`
+	MaxTokens        *int           `json:"max_tokens"`
+	Seed             *int           `json:"seed"`
+	Stop             any            `json:"stop"`
+	Temperature      *float64       `json:"temperature"`
+	FrequencyPenalty *float64       `json:"frequency_penalty"`
+	PresencePenalty  *float64       `json:"presence_penalty"`
+	TopP             *float64       `json:"top_p"`
+
+	// Options are native ollama options with no OpenAI equivalent
+	Options map[string]any `json:"options"`
+}
+
+// UnmarshalJSON decodes a completion request, accepting sampling parameters
+// sent as numeric strings as chat completion requests do
+func (r *CompletionRequest) UnmarshalJSON(b []byte) error {
+	type request CompletionRequest
+	var aux struct {
+		*request
+		Temperature      json.RawMessage `json:"temperature"`
+		FrequencyPenalty json.RawMessage `json:"frequency_penalty"`
+		PresencePenalty  json.RawMessage `json:"presence_penalty"`
+		TopP             json.RawMessage `json:"top_p"`
+	}
+
+	aux.request = (*request)(r)
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	var err error
+	if r.Temperature, err = number("temperature", aux.Temperature); err != nil {
+		return err
+	}
+
+	if r.FrequencyPenalty, err = number("frequency_penalty", aux.FrequencyPenalty); err != nil {
+		return err
+	}
+
+	if r.PresencePenalty, err = number("presence_penalty", aux.PresencePenalty); err != nil {
+		return err
+	}
+
+	if r.TopP, err = number("top_p", aux.TopP); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r CompletionRequest) validate() error {
+	if r.Model == "" {
+		return newParamError("model", "missing_required_parameter", "you must provide a model parameter")
+	}
+
+	if r.StreamOptions != nil && !r.Stream {
+		return newParamError("stream_options", "invalid_value", "The 'stream_options' parameter is only allowed when 'stream' is enabled.")
+	}
+
+	if err := checkInt("n", r.N, 1, maxChoices); err != nil {
+		return err
+	}
+
+	if err := checkInt("best_of", r.BestOf, 1, maxBestOf); err != nil {
+		return err
+	}
+
+	if err := checkInt("logprobs", r.Logprobs, 0, maxCompletionLogprobs); err != nil {
+		return err
+	}
+
+	// the runner only reports log probabilities of generated tokens, so an
+	// echoed prompt would have none
+	if r.Echo && r.Logprobs != nil {
+		return newParamError("echo", "invalid_value", "Setting 'echo' and 'logprobs' at the same time is not supported for this model.")
+	}
+
+	n, bestOf := r.choices()
+	if bestOf < n {
+		return newParamError("best_of", "invalid_value", "Invalid 'best_of': %d must be greater than or equal to 'n' (%d).", bestOf, n)
+	}
+
+	if r.Stream && bestOf > 1 {
+		param := "best_of"
+		if r.BestOf == nil {
+			param = "n"
+		}
+		return newParamError(param, "invalid_value", "Invalid '%s': streaming is only supported for a single choice.", param)
+	}
+
+	return checkBounds([]bound{
+		{"temperature", r.Temperature, 0, 2},
+		{"top_p", r.TopP, 0, 1},
+		{"frequency_penalty", r.FrequencyPenalty, -2, 2},
+		{"presence_penalty", r.PresencePenalty, -2, 2},
+	})
+}
+
+// choices returns the number of choices a request asks for and the number of
+// candidates to pick them from, which defaults to the number of choices
+func (r CompletionRequest) choices() (n, bestOf int) {
+	n = 1
+	if r.N != nil {
+		n = *r.N
+	}
+
+	bestOf = n
+	if r.BestOf != nil {
+		bestOf = *r.BestOf
+	}
+
+	return n, bestOf
+}
+
+// checkInt returns an error if an integer parameter is set to a value out of
+// its range
+func checkInt(name string, value *int, min, max int) error {
+	switch {
+	case value == nil:
+	case *value < min:
+		return newParamError(name, "integer_below_min_value", "Invalid '%s': integer below minimum value. Expected a value >= %d, but got %d instead.", name, min, *value)
+	case *value > max:
+		return newParamError(name, "integer_above_max_value", "Invalid '%s': integer above maximum value. Expected a value <= %d, but got %d instead.", name, max, *value)
+	}
+
+	return nil
+}
+
+// prompt returns the prompt of a request, which may be a string or an array
+// holding a single string
+func (r CompletionRequest) prompt() (string, error) {
+	switch prompt := r.Prompt.(type) {
+	case string:
+		return prompt, nil
+	case []any:
+		if len(prompt) != 1 {
+			return "", newParamError("prompt", "invalid_value", "Invalid 'prompt': only a single prompt is supported, but got %d.", len(prompt))
+		}
+
+		s, ok := prompt[0].(string)
+		if !ok {
+			return "", newParamError("prompt.0", "invalid_type", "%v is not of type 'string' - 'prompt.0'", prompt[0])
+		}
+		return s, nil
+	case nil:
+		return "", newParamError("prompt", "missing_required_parameter", "'prompt' is a required property")
+	default:
+		return "", newParamError("prompt", "invalid_type", "'prompt' must be a string or an array of strings")
+	}
+}
+
+// infill rewrites the prompt of a request into the fill-in-the-middle
+// format of its model, completing the text between prompt and suffix. The
+// prompt is sent raw, since it's already in the form the model was trained on.
+func infill(ctx context.Context, b Backend, r *api.GenerateRequest, suffix string) error {
+	if b == nil {
+		return newParamError("suffix", "invalid_value", "Invalid 'suffix': fill-in-the-middle completions aren't supported.")
+	}
+
+	info, err := b.ModelInfo(ctx, r.Model)
+	if err != nil {
+		// missing models are reported by the generate handler
+		slog.Debug("openai model info", "model", r.Model, "error", err)
+		return nil
+	}
+
+	if info.Infill == "" {
+		return newParamError("suffix", "invalid_value", "Invalid 'suffix': the model '%s' doesn't support fill-in-the-middle completions.", r.Model)
+	}
+
+	r.Prompt = fmt.Sprintf(info.Infill, r.Prompt, suffix)
+	r.Raw = true
+	return nil
+}
+
+// FromCompleteRequest converts a text completion request into a native
+// generate request. The prompt is rendered with the model's template.
+func FromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
+	prompt, err := r.prompt()
+	if err != nil {
+		return api.GenerateRequest{}, err
+	}
+
+	// text completions share the sampling parameters of chat completions
+	options, err := Request{
+		MaxTokens:        r.MaxTokens,
+		Seed:             r.Seed,
+		Stop:             r.Stop,
+		Temperature:      r.Temperature,
+		FrequencyPenalty: r.FrequencyPenalty,
+		PresencePenalty:  r.PresencePenalty,
+		TopP:             r.TopP,
+		Options:          r.Options,
+	}.nativeOptions()
+	if err != nil {
+		return api.GenerateRequest{}, err
+	}
+
+	generateReq := api.GenerateRequest{
+		Model:   r.Model,
+		Prompt:  prompt,
+		Options: options,
+		Stream:  &r.Stream,
+	}
+
+	if r.Logprobs != nil {
+		generateReq.Logprobs = true
+		generateReq.TopLogprobs = *r.Logprobs
+	}
+
+	return generateReq, nil
+}
+
+const (
+	// maxBestOf is the largest best_of a request may ask for
+	maxBestOf = 20
+
+	// maxCompletionLogprobs is the most likely tokens a request may ask for
+	// at each position
+	maxCompletionLogprobs = 5
+)
+
+// CompletionLogprobs are the log probabilities of the tokens of a text
+// completion, in the legacy format of parallel lists
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+
+	// TextOffset is the offset of each token in the text of the choice
+	TextOffset []int `json:"text_offset"`
+}
+
+// toCompletionLogprobs converts native log probabilities into those of a text
+// completion whose tokens start at offset in its text
+func toCompletionLogprobs(logprobs []api.Logprob, offset int) *CompletionLogprobs {
+	l := &CompletionLogprobs{
+		Tokens:        make([]string, len(logprobs)),
+		TokenLogprobs: make([]float64, len(logprobs)),
+		TopLogprobs:   make([]map[string]float64, len(logprobs)),
+		TextOffset:    make([]int, len(logprobs)),
+	}
+
+	for i, token := range logprobs {
+		l.Tokens[i] = token.Token
+		l.TokenLogprobs[i] = token.Logprob
+		l.TextOffset[i] = offset
+		offset += len(token.Token)
+
+		l.TopLogprobs[i] = make(map[string]float64, len(token.TopLogprobs))
+		for _, top := range token.TopLogprobs {
+			l.TopLogprobs[i][top.Token] = top.Logprob
+		}
+	}
+
+	return l
+}
+
+type CompletionChoice struct {
+	Text  string `json:"text"`
+	Index int    `json:"index"`
+
+	// Logprobs are only reported when the request asks for them, but the
+	// key is always present since clients index into it
+	Logprobs     *CompletionLogprobs `json:"logprobs"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+// TextCompletion is a text completion, or one chunk of a streamed one
+type TextCompletion struct {
+	Id                string             `json:"id"`
+	Object            string             `json:"object"`
+	Created           int64              `json:"created"`
+	Model             string             `json:"model"`
+	SystemFingerprint string             `json:"system_fingerprint"`
+	Choices           []CompletionChoice `json:"choices"`
+	Usage             *Usage             `json:"usage,omitempty"`
+}
+
+// ToTextCompletion converts a native generate response into a text
+// completion, or a chunk of a streamed one, from the backend configuration
+// fingerprint, as returned by SystemFingerprint
+func ToTextCompletion(id, fingerprint string, r api.GenerateResponse) TextCompletion {
+	return TextCompletion{
+		Id:                id,
+		Object:            "text_completion",
+		Created:           r.CreatedAt.Unix(),
+		Model:             r.Model,
+		SystemFingerprint: fingerprint,
+		Choices: []CompletionChoice{{
+			Text:         r.Response,
+			Index:        0,
+			FinishReason: finishReason(r.Done),
+		}},
+	}
+}
+
+// completeWriter translates native generate responses into text completions
+type completeWriter struct {
+	stream        bool
+	streamOptions *StreamOptions
+	id            string
+	created       time.Time
+
+	// echo is the prompt, prepended to the first text of the completion
+	echo string
+
+	// logprobs reports the log probabilities of the completion, and offset
+	// is where the tokens of the next response start in its text
+	logprobs bool
+	offset   int
+
+	// fingerprint returns the system fingerprint of the model serving the request
+	fingerprint func() string
+
+	// charge charges the tokens of the completion to the client's rate limit
+	charge func(int)
+
+	// abort cancels generation once a write to the client fails
+	abort func()
+
+	gin.ResponseWriter
+}
+
+// write forwards b to the client. A failed write means the client has
+// disconnected, so the rest of the request is aborted.
+func (w *completeWriter) write(b []byte) error {
+	_, err := w.ResponseWriter.Write(b)
+	if err != nil && w.abort != nil {
+		w.abort()
+	}
+
+	return err
+}
+
+func (w *completeWriter) writeResponse(data []byte) (int, error) {
+	var generateResponse api.GenerateResponse
+	if err := json.Unmarshal(data, &generateResponse); err != nil {
+		return 0, err
+	}
+
+	generateResponse.CreatedAt = w.created
+	generateResponse.Response = w.echo + generateResponse.Response
+
+	completion := ToTextCompletion(w.id, w.fingerprint(), generateResponse)
+
+	if w.logprobs {
+		completion.Choices[0].Logprobs = toCompletionLogprobs(generateResponse.Logprobs, w.offset+len(w.echo))
+	}
+	w.offset += len(generateResponse.Response)
+	w.echo = ""
+
+	if !w.stream || (generateResponse.Done && w.streamOptions != nil && w.streamOptions.IncludeUsage) {
+		usage := toUsage(generateResponse.Metrics)
+		completion.Usage = &usage
+	}
+
+	if generateResponse.Done && w.charge != nil {
+		w.charge(toUsage(generateResponse.Metrics).TotalTokens)
+	}
+
+	d, err := json.Marshal(completion)
+	if err != nil {
+		return 0, err
+	}
+
+	if !w.stream {
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		if err := w.write(append(d, '\n')); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	if err := w.write([]byte(fmt.Sprintf("data: %s\n\n", d))); err != nil {
+		return 0, err
+	}
+
+	if generateResponse.Done {
+		if err := w.write([]byte("data: [DONE]\n\n")); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(data), nil
+}
+
+func (w *completeWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		// the generate handler only responds not found for missing models
+		return writeModelError(w.ResponseWriter, code, data)
+	}
+
+	return w.writeResponse(data)
+}
+
+// CompletionsMiddleware serves the legacy /v1/completions endpoint with the
+// native generate handler
+func CompletionsMiddleware(opts ...Option) gin.HandlerFunc {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(c *gin.Context) {
+		id := newId("cmpl-")
+		c.Header("X-Request-ID", id)
+
+		var req CompletionRequest
+		if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		if err := req.validate(); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		if model, ok := o.aliases[req.Model]; ok {
+			req.Model = model
+		}
+
+		generateReq, err := FromCompleteRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		var echo string
+		if req.Echo {
+			echo = generateReq.Prompt
+		}
+
+		if req.Suffix != "" {
+			if err := infill(c.Request.Context(), o.backend, &generateReq, req.Suffix); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+				return
+			}
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(generateReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Writer = &completeWriter{
+			ResponseWriter: c.Writer,
+			stream:         req.Stream,
+			streamOptions:  req.StreamOptions,
+			id:             id,
+			created:        time.Now().UTC(),
+			echo:           echo,
+			logprobs:       generateReq.Logprobs,
+			fingerprint: func() string {
+				return handlerFingerprint(c)
+			},
+			charge: chargeTokens(c.Request.Context()),
+			abort: func() {
+				cancel()
+				c.Abort()
+			},
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,337 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func generateResponses() []api.GenerateResponse {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []api.GenerateResponse{
+		{Model: "test", CreatedAt: start, Response: "The sky"},
+		{Model: "test", CreatedAt: start, Response: " is blue."},
+		{Model: "test", CreatedAt: start, Done: true, Metrics: api.Metrics{PromptEvalCount: 5, EvalCount: 4, TotalDuration: time.Second}},
+	}
+}
+
+// generateHandler responds to native generate requests with responses, all
+// at once unless the request streams
+func generateHandler(t *testing.T, captured *api.GenerateRequest, responses ...api.GenerateResponse) gin.HandlerFunc {
+	t.Helper()
+
+	return func(c *gin.Context) {
+		var req api.GenerateRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+		*captured = req
+
+		if req.Model == "missing" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+			return
+		}
+
+		if req.Stream != nil && !*req.Stream {
+			final := responses[len(responses)-1]
+			var sb strings.Builder
+			for _, r := range responses {
+				sb.WriteString(r.Response)
+			}
+			final.Response = sb.String()
+			c.JSON(http.StatusOK, final)
+			return
+		}
+
+		c.Header("Content-Type", "application/x-ndjson")
+		for _, r := range responses {
+			bts, err := json.Marshal(r)
+			require.NoError(t, err)
+			_, err = c.Writer.Write(append(bts, '\n'))
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestToTextCompletion(t *testing.T) {
+	responses := generateResponses()
+
+	completion := ToTextCompletion("cmpl-1", "fp_0123456789", responses[0])
+	assert.Equal(t, "cmpl-1", completion.Id)
+	assert.Equal(t, "text_completion", completion.Object)
+	assert.Equal(t, "fp_0123456789", completion.SystemFingerprint)
+	require.Len(t, completion.Choices, 1)
+	assert.Equal(t, "The sky", completion.Choices[0].Text)
+	assert.Nil(t, completion.Choices[0].FinishReason)
+
+	completion = ToTextCompletion("cmpl-1", "fp_0123456789", responses[2])
+	assert.Equal(t, "stop", *completion.Choices[0].FinishReason)
+}
+
+func TestCompletionsMiddleware(t *testing.T) {
+	var captured api.GenerateRequest
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/completions", CompletionsMiddleware(WithAliases(map[string]string{"gpt-3.5-turbo-instruct": "test"})), generateHandler(t, &captured, generateResponses()...))
+
+	t.Run("completion", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{
+			Model:       "gpt-3.5-turbo-instruct",
+			Prompt:      "Why is the sky blue?",
+			MaxTokens:   ptr(32),
+			Temperature: ptr(0.5),
+			Stop:        []string{"\n"},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		assert.Equal(t, "test", captured.Model)
+		assert.Equal(t, "Why is the sky blue?", captured.Prompt)
+		assert.Equal(t, 32.0, captured.Options["num_predict"])
+		assert.Equal(t, 1.0, captured.Options["temperature"])
+		assert.Equal(t, []any{"\n"}, captured.Options["stop"])
+
+		var raw map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+		choice := raw["choices"].([]any)[0].(map[string]any)
+		assert.Contains(t, choice, "logprobs")
+		assert.Nil(t, choice["logprobs"])
+
+		var completion TextCompletion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, "text_completion", completion.Object)
+		assert.Equal(t, w.Header().Get("X-Request-ID"), completion.Id)
+		assert.True(t, strings.HasPrefix(completion.Id, "cmpl-"))
+		require.Len(t, completion.Choices, 1)
+		assert.Equal(t, "The sky is blue.", completion.Choices[0].Text)
+		assert.Equal(t, "stop", *completion.Choices[0].FinishReason)
+		require.NotNil(t, completion.Usage)
+		assert.Equal(t, 5, completion.Usage.PromptTokens)
+		assert.Equal(t, 4, completion.Usage.CompletionTokens)
+		assert.Equal(t, 9, completion.Usage.TotalTokens)
+	})
+
+	t.Run("prompt array", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: []string{"Hello"}})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Hello", captured.Prompt)
+	})
+
+	t.Run("logprobs", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: "Hello", Logprobs: ptr(2)})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, captured.Logprobs)
+		assert.Equal(t, 2, captured.TopLogprobs)
+	})
+
+	t.Run("echo", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: "Why is the sky blue?", Echo: true})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Why is the sky blue?", captured.Prompt)
+
+		var completion TextCompletion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, "Why is the sky blue?The sky is blue.", completion.Choices[0].Text)
+	})
+
+	t.Run("stream echo", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: "Why is the sky blue?", Stream: true, Echo: true})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var texts []string
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok || data == "[DONE]" {
+				continue
+			}
+
+			var chunk TextCompletion
+			require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+			texts = append(texts, chunk.Choices[0].Text)
+		}
+		assert.Equal(t, []string{"Why is the sky blue?The sky", " is blue.", ""}, texts)
+	})
+
+	for _, includeUsage := range []bool{false, true} {
+		name := "stream"
+		if includeUsage {
+			name = "stream with usage"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			w := doRequest(t, r, "/v1/completions", CompletionRequest{
+				Model:         "test",
+				Prompt:        "Why is the sky blue?",
+				Stream:        true,
+				StreamOptions: &StreamOptions{IncludeUsage: includeUsage},
+			})
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+			var chunks []TextCompletion
+			var done bool
+			scanner := bufio.NewScanner(w.Body)
+			for scanner.Scan() {
+				data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+				if !ok {
+					continue
+				}
+
+				if data == "[DONE]" {
+					done = true
+					continue
+				}
+
+				var chunk TextCompletion
+				require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+				chunks = append(chunks, chunk)
+			}
+			assert.True(t, done)
+			require.Len(t, chunks, 3)
+
+			var text strings.Builder
+			for _, chunk := range chunks {
+				assert.Equal(t, "text_completion", chunk.Object)
+				text.WriteString(chunk.Choices[0].Text)
+			}
+			assert.Equal(t, "The sky is blue.", text.String())
+
+			assert.Nil(t, chunks[0].Choices[0].FinishReason)
+			assert.Nil(t, chunks[0].Usage)
+
+			last := chunks[len(chunks)-1]
+			assert.Equal(t, "stop", *last.Choices[0].FinishReason)
+			if includeUsage {
+				require.NotNil(t, last.Usage)
+				assert.Equal(t, 9, last.Usage.TotalTokens)
+			} else {
+				assert.Nil(t, last.Usage)
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		cases := []struct {
+			name  string
+			req   CompletionRequest
+			code  int
+			param string
+		}{
+			{name: "missing model", req: CompletionRequest{Prompt: "Hello"}, code: http.StatusBadRequest, param: "model"},
+			{name: "missing prompt", req: CompletionRequest{Model: "test"}, code: http.StatusBadRequest, param: "prompt"},
+			{name: "multiple prompts", req: CompletionRequest{Model: "test", Prompt: []string{"one", "two"}}, code: http.StatusBadRequest, param: "prompt"},
+			{name: "token prompt", req: CompletionRequest{Model: "test", Prompt: []int{1, 2, 3}}, code: http.StatusBadRequest, param: "prompt"},
+			{name: "temperature", req: CompletionRequest{Model: "test", Prompt: "Hello", Temperature: ptr(3.0)}, code: http.StatusBadRequest, param: "temperature"},
+			{name: "stream options", req: CompletionRequest{Model: "test", Prompt: "Hello", StreamOptions: &StreamOptions{IncludeUsage: true}}, code: http.StatusBadRequest, param: "stream_options"},
+			{name: "echo logprobs", req: CompletionRequest{Model: "test", Prompt: "Hello", Echo: true, Logprobs: ptr(0)}, code: http.StatusBadRequest, param: "echo"},
+			{name: "unknown model", req: CompletionRequest{Model: "missing", Prompt: "Hello"}, code: http.StatusNotFound, param: "model"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := doRequest(t, r, "/v1/completions", tt.req)
+				require.Equal(t, tt.code, w.Code)
+
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, tt.param, resp.Error.Param)
+			})
+		}
+	})
+}
+
+func TestCompletionsMiddlewareSuffix(t *testing.T) {
+	var captured api.GenerateRequest
+
+	gin.SetMode(gin.TestMode)
+	handler := generateHandler(t, &captured, generateResponses()...)
+
+	r := gin.New()
+	r.POST("/v1/completions", CompletionsMiddleware(WithBackend(testBackend{infill: "<PRE> %[1]s <SUF>%[2]s <MID>"})), handler)
+	r.POST("/v1/plain/completions", CompletionsMiddleware(WithBackend(testBackend{})), handler)
+	r.POST("/v1/nobackend/completions", CompletionsMiddleware(), handler)
+
+	t.Run("infill", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: "def add(a, b):\n", Suffix: "\n    return c"})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "<PRE> def add(a, b):\n <SUF>\n    return c <MID>", captured.Prompt)
+		assert.True(t, captured.Raw)
+	})
+
+	t.Run("no suffix", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "test", Prompt: "Hello"})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Hello", captured.Prompt)
+		assert.False(t, captured.Raw)
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/completions", CompletionRequest{Model: "missing", Prompt: "Hello", Suffix: "!"})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	for _, path := range []string{"/v1/plain/completions", "/v1/nobackend/completions"} {
+		t.Run(path, func(t *testing.T) {
+			w := doRequest(t, r, path, CompletionRequest{Model: "test", Prompt: "Hello", Suffix: "!"})
+			require.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "suffix", resp.Error.Param)
+			assert.Equal(t, "invalid_value", *resp.Error.Code)
+		})
+	}
+}
+
+func TestCompletionsMiddlewareDisconnect(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	handler := func(c *gin.Context) {
+		var req api.GenerateRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		for _, r := range generateResponses() {
+			bts, err := json.Marshal(r)
+			require.NoError(t, err)
+			if _, err := c.Writer.Write(append(bts, '\n')); err != nil {
+				continue
+			}
+		}
+
+		cancelled <- c.Request.Context().Err() != nil
+	}
+
+	var after bool
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/completions", CompletionsMiddleware(), handler, func(c *gin.Context) { after = true })
+
+	bts, err := json.Marshal(CompletionRequest{Model: "test", Prompt: "Hello", Stream: true})
+	require.NoError(t, err)
+
+	w := &disconnectRecorder{ResponseRecorder: httptest.NewRecorder(), limit: 1}
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/completions", bytes.NewReader(bts)))
+
+	assert.True(t, <-cancelled)
+	assert.False(t, after)
+	assert.Equal(t, 1, w.writes)
+
+	var events int
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data: ") {
+			events++
+		}
+	}
+	assert.Equal(t, 1, events)
+}
@@ -0,0 +1,270 @@
+package openai
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// ContentPart is one part of a message whose content is an array, either
+// text or an image
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	// URL is a data URL holding the base64 encoded image, or with
+	// WithImageHosts, the http(s) URL of an image to download
+	URL string `json:"url"`
+
+	// Detail is accepted for compatibility, images are always passed to
+	// the model whole
+	Detail string `json:"detail,omitempty"`
+}
+
+// UnmarshalJSON decodes a message, whose content may be a string or an array
+// of content parts
+func (m *Message) UnmarshalJSON(b []byte) error {
+	type message Message
+	var aux struct {
+		*message
+		Content json.RawMessage `json:"content"`
+	}
+
+	aux.message = (*message)(m)
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	m.Content, m.Parts = "", nil
+	if len(aux.Content) == 0 || string(aux.Content) == "null" {
+		return nil
+	}
+
+	if err := json.Unmarshal(aux.Content, &m.Content); err == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(aux.Content, &m.Parts); err != nil {
+		var terr *json.UnmarshalTypeError
+		if errors.As(err, &terr) {
+			if terr.Field == "" {
+				// content is neither a string nor an array
+				terr.Type = reflect.TypeOf("")
+			}
+			terr.Field = strings.TrimSuffix("content."+terr.Field, ".")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes a message, with its parts as the content when it has
+// them
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message
+	if m.Parts == nil {
+		return json.Marshal(message(m))
+	}
+
+	return json.Marshal(struct {
+		message
+		Content []ContentPart `json:"content"`
+	}{message(m), m.Parts})
+}
+
+// content returns the text and images of the i'th message of a request. The
+// text of content parts is joined with newlines.
+func (m Message) content(i int) (string, []api.ImageData, error) {
+	if m.Parts == nil {
+		return m.Content, nil, nil
+	}
+
+	if len(m.Parts) == 0 {
+		return "", nil, newParamError(fmt.Sprintf("messages[%d].content", i), "empty_array", "Invalid 'messages[%d].content': empty array. Expected an array with minimum length 1, but got an empty array instead.", i)
+	}
+
+	var texts []string
+	var images []api.ImageData
+	for j, part := range m.Parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if m.Role != "user" {
+				return "", nil, newParamError(fmt.Sprintf("messages[%d].content[%d].type", i, j), "invalid_value", "Invalid 'messages[%d].content[%d]': image content parts are only allowed in messages with role 'user', but got '%s'.", i, j, m.Role)
+			}
+
+			image, err := part.ImageURL.decode(fmt.Sprintf("messages[%d].content[%d].image_url", i, j))
+			if err != nil {
+				return "", nil, err
+			}
+
+			images = append(images, image)
+		default:
+			return "", nil, newParamError(fmt.Sprintf("messages[%d].content[%d].type", i, j), "invalid_value", "Invalid value: '%s'. Supported values are: 'text' and 'image_url'. - 'messages[%d].content[%d].type'", part.Type, i, j)
+		}
+	}
+
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// decode returns the image of a data URL
+func (u *ImageURL) decode(param string) (api.ImageData, error) {
+	if u == nil {
+		return nil, newParamError(param, "missing_required_parameter", "Missing required parameter: '%s'.", param)
+	}
+
+	if u.Detail != "" && !slices.Contains([]string{"auto", "low", "high"}, u.Detail) {
+		return nil, newParamError(param+".detail", "invalid_value", "Invalid value: '%s'. Supported values are: 'auto', 'low', and 'high'. - '%s.detail'", u.Detail, param)
+	}
+
+	mediaType, data, ok := strings.Cut(strings.TrimPrefix(u.URL, "data:"), ",")
+	if !strings.HasPrefix(u.URL, "data:") || !ok || !strings.HasSuffix(mediaType, ";base64") {
+		return nil, newParamError(param+".url", "invalid_image_url", "Invalid '%s.url': expected a base64 encoded data URL, such as 'data:image/png;base64,...'.", param)
+	}
+
+	image, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(image) == 0 {
+		return nil, newParamError(param+".url", "invalid_image_url", "Invalid '%s.url': the image data isn't valid base64.", param)
+	}
+
+	return image, nil
+}
+
+const (
+	// maxImageSize is the largest image downloaded for an image_url part
+	maxImageSize = 20 << 20
+
+	// imageTimeout limits how long downloading an image may take
+	imageTimeout = 10 * time.Second
+)
+
+// WithImageHosts allows image_url parts to reference images on the given
+// hosts, which are downloaded before the request is passed on. A host of "*"
+// allows any host. Without it, images must be sent as data URLs.
+func WithImageHosts(hosts ...string) Option {
+	return func(o *options) {
+		for _, host := range hosts {
+			if host = strings.TrimSpace(host); host != "" {
+				o.imageHosts = append(o.imageHosts, strings.ToLower(host))
+			}
+		}
+	}
+}
+
+// imageHostAllowed reports whether images may be downloaded from u
+func imageHostAllowed(hosts []string, u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	return slices.Contains(hosts, "*") || slices.Contains(hosts, strings.ToLower(u.Hostname()))
+}
+
+// fetchImages downloads the images of image_url parts which reference allowed
+// hosts, replacing their URLs with data URLs
+func fetchImages(ctx context.Context, hosts []string, msgs []Message) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	for i, msg := range msgs {
+		for j, part := range msg.Parts {
+			if part.Type != "image_url" || part.ImageURL == nil || strings.HasPrefix(part.ImageURL.URL, "data:") {
+				continue
+			}
+
+			param := fmt.Sprintf("messages[%d].content[%d].image_url.url", i, j)
+			u, err := url.Parse(part.ImageURL.URL)
+			if err != nil || !imageHostAllowed(hosts, u) {
+				return newParamError(param, "invalid_image_url", "Invalid '%s': images can't be downloaded from '%s'. Send the image as a base64 encoded data URL instead.", param, part.ImageURL.URL)
+			}
+
+			image, err := downloadImage(ctx, hosts, u)
+			if err != nil {
+				return newParamError(param, "invalid_image_url", "Invalid '%s': failed to download the image: %v", param, err)
+			}
+
+			fetched := *part.ImageURL
+			fetched.URL = "data:" + http.DetectContentType(image) + ";base64," + base64.StdEncoding.EncodeToString(image)
+			msgs[i].Parts[j].ImageURL = &fetched
+		}
+	}
+
+	return nil
+}
+
+// downloadImage downloads the image at u, following redirects only to allowed
+// hosts
+func downloadImage(ctx context.Context, hosts []string, u *url.URL) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, imageTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+
+			if !imageHostAllowed(hosts, req.URL) {
+				return fmt.Errorf("redirected to '%s', which isn't an allowed host", req.URL.Host)
+			}
+
+			return nil
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			// the url is already part of the message
+			err = uerr.Err
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if resp.ContentLength > maxImageSize {
+		return nil, fmt.Errorf("image is larger than %d MB", maxImageSize>>20)
+	}
+
+	image, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(image) > maxImageSize {
+		return nil, fmt.Errorf("image is larger than %d MB", maxImageSize>>20)
+	}
+
+	if !strings.HasPrefix(http.DetectContentType(image), "image/") {
+		return nil, errors.New("the response isn't an image")
+	}
+
+	return image, nil
+}
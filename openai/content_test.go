@@ -0,0 +1,199 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// "image" encoded as base64
+const testImageURL = "data:image/png;base64,aW1hZ2U="
+
+func TestMessageContentParts(t *testing.T) {
+	var msg Message
+	require.NoError(t, json.Unmarshal([]byte(`{"role": "user", "content": [{"type": "text", "text": "What's this?"}, {"type": "image_url", "image_url": {"url": "`+testImageURL+`", "detail": "low"}}]}`), &msg))
+	assert.Empty(t, msg.Content)
+	assert.Equal(t, []ContentPart{
+		{Type: "text", Text: "What's this?"},
+		{Type: "image_url", ImageURL: &ImageURL{URL: testImageURL, Detail: "low"}},
+	}, msg.Parts)
+
+	// parts are written back as they were read
+	d, err := json.Marshal(msg)
+	require.NoError(t, err)
+
+	var roundTrip Message
+	require.NoError(t, json.Unmarshal(d, &roundTrip))
+	assert.Equal(t, msg, roundTrip)
+
+	d, err = json.Marshal(Message{Role: "assistant", Content: "A cat."})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"role": "assistant", "content": "A cat."}`, string(d))
+}
+
+func TestFromRequestContentParts(t *testing.T) {
+	req, err := FromRequest(Request{Model: "test", Messages: []Message{
+		{Role: "user", Parts: []ContentPart{
+			{Type: "text", Text: "Compare these"},
+			{Type: "image_url", ImageURL: &ImageURL{URL: testImageURL}},
+			{Type: "text", Text: "and this"},
+			{Type: "image_url", ImageURL: &ImageURL{URL: "data:image/jpeg;base64,b3RoZXI="}},
+		}},
+		{Role: "user", Parts: []ContentPart{{Type: "image_url", ImageURL: &ImageURL{URL: testImageURL}}}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []api.Message{
+		{Role: "user", Content: "Compare these\nand this", Images: []api.ImageData{[]byte("image"), []byte("other")}},
+		{Role: "user", Images: []api.ImageData{[]byte("image")}},
+	}, req.Messages)
+
+	cases := []struct {
+		name  string
+		msg   Message
+		param string
+	}{
+		{name: "empty", msg: Message{Role: "user", Parts: []ContentPart{}}, param: "messages[0].content"},
+		{name: "empty text", msg: Message{Role: "user", Parts: []ContentPart{{Type: "text"}}}, param: "messages[0].content"},
+		{name: "part type", msg: Message{Role: "user", Parts: []ContentPart{{Type: "input_audio"}}}, param: "messages[0].content[0].type"},
+		{name: "assistant image", msg: Message{Role: "assistant", Parts: []ContentPart{{Type: "image_url", ImageURL: &ImageURL{URL: testImageURL}}}}, param: "messages[0].content[0].type"},
+		{name: "missing image url", msg: Message{Role: "user", Parts: []ContentPart{{Type: "image_url"}}}, param: "messages[0].content[0].image_url"},
+		{name: "remote image", msg: Message{Role: "user", Parts: []ContentPart{{Type: "image_url", ImageURL: &ImageURL{URL: "https://example.com/cat.png"}}}}, param: "messages[0].content[0].image_url.url"},
+		{name: "invalid base64", msg: Message{Role: "user", Parts: []ContentPart{{Type: "image_url", ImageURL: &ImageURL{URL: "data:image/png;base64,!!"}}}}, param: "messages[0].content[0].image_url.url"},
+		{name: "detail", msg: Message{Role: "user", Parts: []ContentPart{{Type: "image_url", ImageURL: &ImageURL{URL: testImageURL, Detail: "medium"}}}}, param: "messages[0].content[0].image_url.detail"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := FromRequest(Request{Model: "test", Messages: []Message{tt.msg}})
+
+			var perr *paramError
+			require.ErrorAs(t, err, &perr)
+			assert.Equal(t, tt.param, perr.param)
+		})
+	}
+}
+
+func TestFromRequestImageDetail(t *testing.T) {
+	// detail has no effect, so every valid value, or none, sends the image
+	for name, detail := range map[string]string{"omitted": "", "auto": "auto", "low": "low", "high": "high"} {
+		t.Run(name, func(t *testing.T) {
+			req, err := FromRequest(Request{Model: "test", Messages: []Message{
+				{Role: "user", Parts: []ContentPart{{Type: "image_url", ImageURL: &ImageURL{URL: testImageURL, Detail: detail}}}},
+			}})
+			require.NoError(t, err)
+			assert.Equal(t, []api.Message{{Role: "user", Images: []api.ImageData{[]byte("image")}}}, req.Messages)
+		})
+	}
+
+	_, err := FromRequest(Request{Model: "test", Messages: []Message{
+		{Role: "user", Parts: []ContentPart{{Type: "image_url", ImageURL: &ImageURL{URL: testImageURL, Detail: "medium"}}}},
+	}})
+
+	var perr *paramError
+	require.ErrorAs(t, err, &perr)
+	assert.Equal(t, "messages[0].content[0].image_url.detail", perr.param)
+	assert.Contains(t, perr.Error(), "'auto', 'low', and 'high'")
+}
+
+func TestMiddlewareContentParts(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	r := newRouter(Middleware(), capture)
+
+	w := doRequest(t, r, "/v1/chat/completions", json.RawMessage(`{"model": "test", "messages": [{"role": "user", "content": [{"type": "text", "text": "What's this?"}, {"type": "image_url", "image_url": {"url": "`+testImageURL+`"}}]}]}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, captured.Messages, 1)
+	assert.Equal(t, "What's this?", captured.Messages[0].Content)
+	assert.Equal(t, []api.ImageData{[]byte("image")}, captured.Messages[0].Images)
+
+	w = doRequest(t, r, "/v1/chat/completions", json.RawMessage(`{"model": "test", "messages": [{"role": "user", "content": {"type": "text"}}]}`))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "messages.0.content", resp.Error.Param)
+	assert.Equal(t, "Invalid type for 'messages.0.content': expected a string, but got an object instead.", resp.Error.Message)
+}
+
+func TestMiddlewareImageHosts(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nimage")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cat.png", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(png)
+	})
+	mux.HandleFunc("/cat.txt", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("not an image"))
+	})
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(maxImageSize+1))
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/elsewhere.png", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://example.com/cat.png", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	image := func(url string) Request {
+		return Request{Model: "test", Messages: []Message{{Role: "user", Parts: []ContentPart{
+			{Type: "text", Text: "What's this?"},
+			{Type: "image_url", ImageURL: &ImageURL{URL: url}},
+		}}}}
+	}
+
+	for _, hosts := range [][]string{{"127.0.0.1"}, {" * "}} {
+		t.Run(strings.Join(hosts, ","), func(t *testing.T) {
+			r := newRouter(Middleware(WithImageHosts(hosts...)), capture)
+			w := doRequest(t, r, "/v1/chat/completions", image(srv.URL+"/cat.png"))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, []api.ImageData{png}, captured.Messages[0].Images)
+		})
+	}
+
+	cases := []struct {
+		name  string
+		hosts []string
+		url   string
+	}{
+		{name: "no hosts", url: srv.URL + "/cat.png"},
+		{name: "host not allowed", hosts: []string{"example.com"}, url: srv.URL + "/cat.png"},
+		{name: "scheme", hosts: []string{"*"}, url: "file:///etc/passwd"},
+		{name: "not found", hosts: []string{"127.0.0.1"}, url: srv.URL + "/missing.png"},
+		{name: "not an image", hosts: []string{"127.0.0.1"}, url: srv.URL + "/cat.txt"},
+		{name: "too large", hosts: []string{"127.0.0.1"}, url: srv.URL + "/large.png"},
+		{name: "redirect", hosts: []string{"127.0.0.1"}, url: srv.URL + "/elsewhere.png"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRouter(Middleware(WithImageHosts(tt.hosts...)), capture)
+			w := doRequest(t, r, "/v1/chat/completions", image(tt.url))
+			require.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "messages[0].content[1].image_url.url", resp.Error.Param)
+			assert.Equal(t, "invalid_image_url", *resp.Error.Code)
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+type EmbeddingRequest struct {
+	Input          any    `json:"input"`
+	Model          string `json:"model"`
+	EncodingFormat string `json:"encoding_format"`
+	Dimensions     *int   `json:"dimensions"`
+}
+
+type Embedding struct {
+	Object string `json:"object"`
+
+	// Embedding is a list of floats, or a base64 string of little endian
+	// float32 values when the request's encoding_format is base64
+	Embedding any `json:"embedding"`
+	Index     int `json:"index"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type EmbeddingList struct {
+	Object string         `json:"object"`
+	Data   []Embedding    `json:"data"`
+	Model  string         `json:"model"`
+	Usage  EmbeddingUsage `json:"usage"`
+}
+
+func (r EmbeddingRequest) validate() error {
+	if r.Model == "" {
+		return newParamError("model", "missing_required_parameter", "you must provide a model parameter")
+	}
+
+	switch r.EncodingFormat {
+	case "", "float", "base64":
+	default:
+		return newParamError("encoding_format", "invalid_value", "Invalid value: '%s'. Supported values are: 'float' and 'base64'. - 'encoding_format'", r.EncodingFormat)
+	}
+
+	if r.Dimensions != nil && *r.Dimensions < 1 {
+		return newParamError("dimensions", "integer_below_min_value", "Invalid 'dimensions': integer below minimum value. Expected a value >= 1, but got %d instead.", *r.Dimensions)
+	}
+
+	return nil
+}
+
+// A Detokenizer is a Backend which can decode tokens into text, so inputs
+// may be sent as tokens
+type Detokenizer interface {
+	Detokenize(ctx context.Context, model string, tokens []int) (string, error)
+}
+
+// embeddingInput is one input of an embedding request, given as text or as
+// tokens
+type embeddingInput struct {
+	text   string
+	tokens []int
+}
+
+// embeddingInputs returns the inputs of an embedding request, which may be a
+// string, an array of strings, an array of tokens or an array of arrays of
+// tokens
+func embeddingInputs(input any) ([]embeddingInput, error) {
+	if input, ok := input.([]any); ok && len(input) > 0 {
+		switch input[0].(type) {
+		case float64:
+			tokens, err := tokenInput("input", input)
+			if err != nil {
+				return nil, err
+			}
+			return []embeddingInput{{tokens: tokens}}, nil
+		case []any:
+			inputs := make([]embeddingInput, len(input))
+			for i, v := range input {
+				param := fmt.Sprintf("input.%d", i)
+				arr, ok := v.([]any)
+				if !ok {
+					return nil, newParamError(param, "invalid_type", "%v is not of type 'array' - '%s'", v, param)
+				}
+
+				tokens, err := tokenInput(param, arr)
+				if err != nil {
+					return nil, err
+				}
+				inputs[i] = embeddingInput{tokens: tokens}
+			}
+			return inputs, nil
+		}
+	}
+
+	texts, err := stringInputs(input)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make([]embeddingInput, len(texts))
+	for i, text := range texts {
+		inputs[i] = embeddingInput{text: text}
+	}
+	return inputs, nil
+}
+
+// tokenInput returns the tokens of an input given as an array of tokens
+func tokenInput(param string, input []any) ([]int, error) {
+	if len(input) == 0 {
+		return nil, newParamError(param, "empty_array", "[] is too short - '%s'", param)
+	}
+
+	tokens := make([]int, len(input))
+	for i, v := range input {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != math.Trunc(f) {
+			return nil, newParamError(fmt.Sprintf("%s.%d", param, i), "invalid_type", "%v is not of type 'integer' - '%s.%d'", v, param, i)
+		}
+		tokens[i] = int(f)
+	}
+
+	return tokens, nil
+}
+
+// truncateEmbedding shortens an embedding to its first dimensions values and
+// normalizes it to unit length again. Models trained with Matryoshka
+// representation learning keep most of their accuracy when truncated.
+func truncateEmbedding(embedding []float64, dimensions int) []float64 {
+	embedding = embedding[:dimensions]
+
+	var norm float64
+	for _, v := range embedding {
+		norm += v * v
+	}
+
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		return embedding
+	}
+
+	truncated := make([]float64, dimensions)
+	for i, v := range embedding {
+		truncated[i] = v / norm
+	}
+
+	return truncated
+}
+
+// encodeEmbedding encodes an embedding as little endian float32 values in
+// base64, as OpenAI clients expect for the base64 encoding format
+func encodeEmbedding(embedding []float64) string {
+	b := make([]byte, 4*len(embedding))
+	for i, v := range embedding {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(float32(v)))
+	}
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// embed sends a single input to next as a native embedding request for path.
+// A native error is returned as an OpenAI error response along with its
+// status code.
+func embed(c *gin.Context, next http.Handler, path, model, input string) ([]float64, int, *ErrorResponse) {
+	body, err := json.Marshal(api.EmbeddingRequest{Model: model, Prompt: input})
+	if err != nil {
+		resp := NewError(http.StatusInternalServerError, err.Error())
+		return nil, http.StatusInternalServerError, &resp
+	}
+
+	r, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		resp := NewError(http.StatusInternalServerError, err.Error())
+		return nil, http.StatusInternalServerError, &resp
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	rec := &batchRecorder{header: make(http.Header)}
+	next.ServeHTTP(rec, r)
+
+	if rec.code != http.StatusOK {
+		var serr api.StatusError
+		if err := json.Unmarshal(rec.body.Bytes(), &serr); err != nil {
+			resp := NewError(http.StatusInternalServerError, "unexpected response")
+			return nil, http.StatusInternalServerError, &resp
+		}
+
+		resp := nativeError(rec.code, serr.Error())
+		return nil, rec.code, &resp
+	}
+
+	var resp api.EmbeddingResponse
+	if err := json.Unmarshal(rec.body.Bytes(), &resp); err != nil {
+		resp := NewError(http.StatusInternalServerError, err.Error())
+		return nil, http.StatusInternalServerError, &resp
+	}
+
+	return resp.Embedding, http.StatusOK, nil
+}
+
+// EmbeddingsMiddleware serves /v1/embeddings. Each input is sent to next as
+// a separate native embedding request for path, in order, and the first
+// failure fails the whole request. Usage of text inputs is only counted when
+// a Backend is set with WithBackend, and inputs of tokens need a Backend
+// which implements Detokenizer.
+func EmbeddingsMiddleware(next http.Handler, path string, opts ...Option) gin.HandlerFunc {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(c *gin.Context) {
+		var req EmbeddingRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		if err := req.validate(); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		inputs, err := embeddingInputs(req.Input)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		model := req.Model
+		if target, ok := o.aliases[model]; ok {
+			model = target
+		}
+
+		list := EmbeddingList{
+			Object: "list",
+			Data:   make([]Embedding, len(inputs)),
+			Model:  model,
+		}
+
+		detokenizer, _ := o.backend.(Detokenizer)
+		for i, input := range inputs {
+			if input.tokens != nil {
+				if detokenizer == nil {
+					c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, "Invalid 'input': inputs of tokens aren't supported.", "invalid_value", "input"))
+					return
+				}
+
+				text, err := detokenizer.Detokenize(c.Request.Context(), model, input.tokens)
+				if err != nil {
+					c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+					return
+				}
+				input.text = text
+			}
+
+			embedding, code, errResp := embed(c, next, path, model, input.text)
+			if errResp != nil {
+				c.AbortWithStatusJSON(code, errResp)
+				return
+			}
+
+			if req.Dimensions != nil {
+				if *req.Dimensions > len(embedding) {
+					c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("Invalid 'dimensions': the model '%s' has %d dimensions, fewer than the %d requested.", req.Model, len(embedding), *req.Dimensions), "invalid_value", "dimensions"))
+					return
+				}
+				embedding = truncateEmbedding(embedding, *req.Dimensions)
+			}
+
+			list.Data[i] = Embedding{Object: "embedding", Embedding: embedding, Index: i}
+			if req.EncodingFormat == "base64" {
+				list.Data[i].Embedding = encodeEmbedding(embedding)
+			}
+
+			switch {
+			case input.tokens != nil:
+				list.Usage.PromptTokens += len(input.tokens)
+			case o.backend != nil:
+				tokens, err := o.backend.Tokenize(c.Request.Context(), model, nil, input.text)
+				if err != nil {
+					slog.Debug("openai tokenize", "model", model, "error", err)
+					continue
+				}
+
+				list.Usage.PromptTokens += len(tokens)
+			}
+		}
+
+		list.Usage.TotalTokens = list.Usage.PromptTokens
+		c.JSON(http.StatusOK, list)
+	}
+}
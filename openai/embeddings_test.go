@@ -0,0 +1,166 @@
+package openai
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestEmbeddingsMiddleware(t *testing.T) {
+	var prompts []string
+	handler := func(c *gin.Context) {
+		var req api.EmbeddingRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		if req.Model == "missing" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+			return
+		}
+
+		prompts = append(prompts, req.Prompt)
+		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{float64(len(req.Prompt)), 0.5, -1}})
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/embeddings", handler)
+	r.POST("/v1/embeddings", EmbeddingsMiddleware(r, "/api/embeddings", WithBackend(testBackend{contextLength: 16}), WithAliases(map[string]string{"text-embedding-3-small": "test"})))
+
+	t.Run("string", func(t *testing.T) {
+		prompts = nil
+		w := doRequest(t, r, "/v1/embeddings", EmbeddingRequest{Model: "test", Input: "hello there"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var list EmbeddingList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Equal(t, "list", list.Object)
+		assert.Equal(t, "test", list.Model)
+		require.Len(t, list.Data, 1)
+		assert.Equal(t, Embedding{Object: "embedding", Embedding: []any{11.0, 0.5, -1.0}, Index: 0}, list.Data[0])
+		assert.Equal(t, EmbeddingUsage{PromptTokens: 2, TotalTokens: 2}, list.Usage)
+		assert.Equal(t, []string{"hello there"}, prompts)
+	})
+
+	t.Run("array", func(t *testing.T) {
+		prompts = nil
+		w := doRequest(t, r, "/v1/embeddings", EmbeddingRequest{Model: "text-embedding-3-small", Input: []string{"one", "two three", "four"}})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var list EmbeddingList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Equal(t, "test", list.Model)
+		require.Len(t, list.Data, 3)
+		for i, data := range list.Data {
+			assert.Equal(t, i, data.Index)
+		}
+		assert.Equal(t, []any{9.0, 0.5, -1.0}, list.Data[1].Embedding)
+		assert.Equal(t, EmbeddingUsage{PromptTokens: 4, TotalTokens: 4}, list.Usage)
+		assert.Equal(t, []string{"one", "two three", "four"}, prompts)
+	})
+
+	t.Run("base64", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/embeddings", EmbeddingRequest{Model: "test", Input: "abc", EncodingFormat: "base64"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var list EmbeddingList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Data, 1)
+
+		encoded, ok := list.Data[0].Embedding.(string)
+		require.True(t, ok)
+
+		b, err := base64.StdEncoding.DecodeString(encoded)
+		require.NoError(t, err)
+		require.Len(t, b, 12)
+
+		var decoded []float32
+		for i := 0; i < len(b); i += 4 {
+			decoded = append(decoded, math.Float32frombits(binary.LittleEndian.Uint32(b[i:])))
+		}
+		assert.Equal(t, []float32{3, 0.5, -1}, decoded)
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		for _, input := range []any{[]int{1, 2, 3}, [][]int{{1, 2, 3}, {4}}} {
+			prompts = nil
+			w := doRequest(t, r, "/v1/embeddings", EmbeddingRequest{Model: "test", Input: input})
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			var list EmbeddingList
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+			require.Len(t, list.Data, len(prompts))
+			assert.Equal(t, "t1 t2 t3", prompts[0])
+		}
+
+		assert.Equal(t, []string{"t1 t2 t3", "t4"}, prompts)
+	})
+
+	t.Run("tokens without detokenizer", func(t *testing.T) {
+		r := gin.New()
+		r.POST("/api/embeddings", handler)
+		r.POST("/v1/embeddings", EmbeddingsMiddleware(r, "/api/embeddings"))
+
+		w := doRequest(t, r, "/v1/embeddings", EmbeddingRequest{Model: "test", Input: []int{1, 2}})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "input", resp.Error.Param)
+	})
+
+	t.Run("dimensions", func(t *testing.T) {
+		// the embedding of "abcd" is [4, 0.5, -1], which truncates to [4, 0.5]
+		w := doRequest(t, r, "/v1/embeddings", EmbeddingRequest{Model: "test", Input: "abcd", Dimensions: ptr(2)})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var list EmbeddingList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Data, 1)
+
+		embedding := list.Data[0].Embedding.([]any)
+		require.Len(t, embedding, 2)
+		norm := math.Hypot(4, 0.5)
+		assert.InDelta(t, 4/norm, embedding[0], 1e-9)
+		assert.InDelta(t, 0.5/norm, embedding[1], 1e-9)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cases := []struct {
+			name  string
+			req   EmbeddingRequest
+			code  int
+			param string
+		}{
+			{name: "missing model", req: EmbeddingRequest{Input: "hi"}, code: http.StatusBadRequest, param: "model"},
+			{name: "missing input", req: EmbeddingRequest{Model: "test"}, code: http.StatusBadRequest, param: "input"},
+			{name: "empty array", req: EmbeddingRequest{Model: "test", Input: []string{}}, code: http.StatusBadRequest, param: "input"},
+			{name: "mixed array", req: EmbeddingRequest{Model: "test", Input: []any{"one", 2}}, code: http.StatusBadRequest, param: "input.1"},
+			{name: "invalid token", req: EmbeddingRequest{Model: "test", Input: []any{1, -2}}, code: http.StatusBadRequest, param: "input.1"},
+			{name: "empty token array", req: EmbeddingRequest{Model: "test", Input: [][]int{{1}, {}}}, code: http.StatusBadRequest, param: "input.1"},
+			{name: "dimensions below min", req: EmbeddingRequest{Model: "test", Input: "hi", Dimensions: ptr(0)}, code: http.StatusBadRequest, param: "dimensions"},
+			{name: "dimensions above model", req: EmbeddingRequest{Model: "test", Input: "hi", Dimensions: ptr(4)}, code: http.StatusBadRequest, param: "dimensions"},
+			{name: "encoding format", req: EmbeddingRequest{Model: "test", Input: "hi", EncodingFormat: "int8"}, code: http.StatusBadRequest, param: "encoding_format"},
+			{name: "unknown model", req: EmbeddingRequest{Model: "missing", Input: "hi"}, code: http.StatusNotFound, param: "model"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				w := doRequest(t, r, "/v1/embeddings", tt.req)
+				require.Equal(t, tt.code, w.Code)
+
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, tt.param, resp.Error.Param)
+			})
+		}
+	})
+}
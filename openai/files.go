@@ -0,0 +1,279 @@
+package openai
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// filePurposes are the purposes files can be uploaded for
+var filePurposes = []string{"assistants", "batch", "fine-tune", "vision", "user_data", "evals"}
+
+// File is a file uploaded to /v1/files, or the output of a batch
+type File struct {
+	Id        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+}
+
+type FileList struct {
+	Object  string `json:"object"`
+	Data    []File `json:"data"`
+	FirstId string `json:"first_id,omitempty"`
+	LastId  string `json:"last_id,omitempty"`
+	HasMore bool   `json:"has_more"`
+}
+
+type DeletedFile struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+func (s *BatchStore) filePath(id string) string {
+	return filepath.Join(s.dir, "files", id)
+}
+
+// writeJSON writes v to path, replacing it in one step so it's never read
+// half written
+func writeJSON(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// addFile moves the file at path into the store
+func (s *BatchStore) addFile(path, filename, purpose string) (File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return File{}, err
+	}
+
+	f := File{
+		Id:        newId("file-"),
+		Object:    "file",
+		Bytes:     info.Size(),
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+		Status:    "processed",
+	}
+
+	if err := os.Rename(path, s.filePath(f.Id)); err != nil {
+		return File{}, err
+	}
+
+	if err := writeJSON(s.filePath(f.Id)+".json", f); err != nil {
+		os.Remove(s.filePath(f.Id))
+		return File{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[f.Id] = &f
+	return f, nil
+}
+
+func (s *BatchStore) file(id string) (File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[id]
+	if !ok {
+		return File{}, false
+	}
+
+	return *f, true
+}
+
+func fileNotFound(id string) ErrorResponse {
+	return NewErrorWithCode(http.StatusNotFound, fmt.Sprintf("No such File object: %s", id), "", "id")
+}
+
+// UploadFile serves POST /v1/files, a multipart upload of a file and its
+// purpose
+func (s *BatchStore) UploadFile(c *gin.Context) {
+	purpose := c.PostForm("purpose")
+	switch {
+	case purpose == "":
+		c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, "'purpose' is a required property", "missing_required_parameter", "purpose"))
+		return
+	case !slices.Contains(filePurposes, purpose):
+		c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("Invalid value: '%s'. Supported values are: 'assistants', 'batch', 'fine-tune', 'vision', 'user_data', and 'evals'. - 'purpose'", purpose), "invalid_value", "purpose"))
+		return
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, "'file' is a required property", "missing_required_parameter", "file"))
+		return
+	}
+
+	src, err := fh.Open()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(filepath.Join(s.dir, "files"), "upload-*")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+	defer os.Remove(dst.Name())
+
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	f, err := s.addFile(dst.Name(), fh.Filename, purpose)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, f)
+}
+
+// listLimit parses the limit query parameter of a list request
+func listLimit(c *gin.Context, max int) (int, error) {
+	s := c.Query("limit")
+	if s == "" {
+		return min(max, 20), nil
+	}
+
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 1 || limit > max {
+		return 0, newParamError("limit", "invalid_value", "Invalid 'limit': expected an integer between 1 and %d, but got '%s' instead.", max, s)
+	}
+
+	return limit, nil
+}
+
+// ListFiles serves GET /v1/files, the files with the purpose query parameter,
+// or all of them, newest first unless order is asc. Pages of limit files
+// follow the file of the after query parameter.
+func (s *BatchStore) ListFiles(c *gin.Context) {
+	limit, err := listLimit(c, 10000)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+		return
+	}
+
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("Invalid value: '%s'. Supported values are: 'asc' and 'desc'. - 'order'", order), "invalid_value", "order"))
+		return
+	}
+
+	purpose := c.Query("purpose")
+
+	s.mu.Lock()
+	files := make([]File, 0, len(s.files))
+	for _, f := range s.files {
+		if purpose == "" || f.Purpose == purpose {
+			files = append(files, *f)
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(files, func(a, b File) int {
+		if c := cmp.Compare(a.CreatedAt, b.CreatedAt); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.Id, b.Id)
+	})
+	if order == "desc" {
+		slices.Reverse(files)
+	}
+
+	if after := c.Query("after"); after != "" {
+		i := slices.IndexFunc(files, func(f File) bool { return f.Id == after })
+		files = files[i+1:]
+	}
+
+	list := FileList{Object: "list", Data: files[:min(limit, len(files))], HasMore: len(files) > limit}
+	if len(list.Data) > 0 {
+		list.FirstId, list.LastId = list.Data[0].Id, list.Data[len(list.Data)-1].Id
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// GetFile serves GET /v1/files/:id
+func (s *BatchStore) GetFile(c *gin.Context) {
+	f, ok := s.file(c.Param("id"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, fileNotFound(c.Param("id")))
+		return
+	}
+
+	c.JSON(http.StatusOK, f)
+}
+
+// FileContent serves GET /v1/files/:id/content
+func (s *BatchStore) FileContent(c *gin.Context) {
+	f, ok := s.file(c.Param("id"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, fileNotFound(c.Param("id")))
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.Filename))
+	c.File(s.filePath(f.Id))
+}
+
+// DeleteFile serves DELETE /v1/files/:id
+func (s *BatchStore) DeleteFile(c *gin.Context) {
+	id := c.Param("id")
+
+	s.mu.Lock()
+	_, ok := s.files[id]
+	delete(s.files, id)
+	s.mu.Unlock()
+
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, fileNotFound(id))
+		return
+	}
+
+	for _, path := range []string{s.filePath(id) + ".json", s.filePath(id)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, DeletedFile{Id: id, Object: "file", Deleted: true})
+}
@@ -0,0 +1,191 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBatchRouter serves the files and batches of a store in dir, with
+// handler serving the chat completions its batches send, for the API key
+// sk-test
+func newBatchRouter(t *testing.T, dir string, handler gin.HandlerFunc) (*gin.Engine, *BatchStore) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+
+	s, err := NewBatchStore(r, dir, 2)
+	require.NoError(t, err)
+
+	v1 := r.Group("/v1", AuthMiddleware("sk-test"))
+	v1.POST("/chat/completions", Middleware(), handler)
+	v1.POST("/files", s.UploadFile)
+	v1.GET("/files", s.ListFiles)
+	v1.GET("/files/:id", s.GetFile)
+	v1.GET("/files/:id/content", s.FileContent)
+	v1.DELETE("/files/:id", s.DeleteFile)
+	v1.POST("/batches", s.CreateBatch)
+	v1.GET("/batches", s.ListBatches)
+	v1.GET("/batches/:id", s.GetBatch)
+	v1.POST("/batches/:id/cancel", s.CancelBatch)
+	return r, s
+}
+
+// doAuthRequest sends a request with the API key of newBatchRouter
+func doAuthRequest(t *testing.T, r http.Handler, method, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var b io.Reader
+	if body != nil {
+		bts, err := json.Marshal(body)
+		require.NoError(t, err)
+		b = bytes.NewReader(bts)
+	}
+
+	req := httptest.NewRequest(method, path, b)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-test")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func uploadFile(t *testing.T, r http.Handler, purpose, filename string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	if purpose != "" {
+		require.NoError(t, mw.WriteField("purpose", purpose))
+	}
+
+	if content != nil {
+		fw, err := mw.CreateFormFile("file", filename)
+		require.NoError(t, err)
+		_, err = fw.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/files", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer sk-test")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	r, _ := newBatchRouter(t, dir, chatHandler(t, testResponses()...))
+
+	var ids []string
+	for _, purpose := range []string{"batch", "vision", "batch"} {
+		w := uploadFile(t, r, purpose, "requests.jsonl", []byte("hello "+purpose))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var f File
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &f))
+		assert.Equal(t, "file", f.Object)
+		assert.Equal(t, purpose, f.Purpose)
+		assert.Equal(t, "requests.jsonl", f.Filename)
+		assert.Equal(t, int64(len("hello "+purpose)), f.Bytes)
+		assert.Equal(t, "processed", f.Status)
+		ids = append(ids, f.Id)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		w := doAuthRequest(t, r, http.MethodGet, "/v1/files/"+ids[1], nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var f File
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &f))
+		assert.Equal(t, ids[1], f.Id)
+		assert.Equal(t, "vision", f.Purpose)
+	})
+
+	t.Run("content", func(t *testing.T) {
+		w := doAuthRequest(t, r, http.MethodGet, "/v1/files/"+ids[0]+"/content", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello batch", w.Body.String())
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := doAuthRequest(t, r, http.MethodGet, "/v1/files?purpose=batch&order=asc", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var list FileList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Equal(t, "list", list.Object)
+		require.Len(t, list.Data, 2)
+		assert.False(t, list.HasMore)
+
+		// pages follow the last file of the one before
+		w = doAuthRequest(t, r, http.MethodGet, "/v1/files?limit=2", nil)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Data, 2)
+		assert.True(t, list.HasMore)
+
+		w = doAuthRequest(t, r, http.MethodGet, "/v1/files?limit=2&after="+list.LastId, nil)
+		var next FileList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &next))
+		require.Len(t, next.Data, 1)
+		assert.False(t, next.HasMore)
+		assert.ElementsMatch(t, ids, []string{list.Data[0].Id, list.Data[1].Id, next.Data[0].Id})
+	})
+
+	t.Run("reopened", func(t *testing.T) {
+		r, _ := newBatchRouter(t, dir, chatHandler(t, testResponses()...))
+
+		w := doAuthRequest(t, r, http.MethodGet, "/v1/files/"+ids[2]+"/content", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello batch", w.Body.String())
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		w := doAuthRequest(t, r, http.MethodDelete, "/v1/files/"+ids[0], nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"id": "`+ids[0]+`", "object": "file", "deleted": true}`, w.Body.String())
+
+		for _, path := range []string{"/v1/files/" + ids[0], "/v1/files/" + ids[0] + "/content"} {
+			w = doAuthRequest(t, r, http.MethodGet, path, nil)
+			assert.Equal(t, http.StatusNotFound, w.Code)
+		}
+
+		w = doAuthRequest(t, r, http.MethodDelete, "/v1/files/"+ids[0], nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	cases := []struct {
+		name    string
+		purpose string
+		content []byte
+		param   string
+	}{
+		{name: "missing purpose", content: []byte("hello"), param: "purpose"},
+		{name: "invalid purpose", purpose: "batch_output", content: []byte("hello"), param: "purpose"},
+		{name: "missing file", purpose: "batch", param: "file"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := uploadFile(t, r, tt.purpose, "requests.jsonl", tt.content)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.param, resp.Error.Param)
+		})
+	}
+}
@@ -0,0 +1,666 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// minTrainingExamples is the fewest examples a training file may have
+const minTrainingExamples = 10
+
+type FineTuningHyperparameters struct {
+	NEpochs                any `json:"n_epochs,omitempty"`
+	BatchSize              any `json:"batch_size,omitempty"`
+	LearningRateMultiplier any `json:"learning_rate_multiplier,omitempty"`
+}
+
+type FineTuningJobRequest struct {
+	Model           string                     `json:"model"`
+	TrainingFile    string                     `json:"training_file"`
+	ValidationFile  string                     `json:"validation_file,omitempty"`
+	Hyperparameters *FineTuningHyperparameters `json:"hyperparameters,omitempty"`
+	Suffix          string                     `json:"suffix,omitempty"`
+	Seed            *int                       `json:"seed,omitempty"`
+	Metadata        map[string]string          `json:"metadata,omitempty"`
+}
+
+type FineTuningError struct {
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	Param   *string `json:"param"`
+}
+
+// FineTuningJob is a job training a LoRA adapter of a local model, created
+// at /v1/fine_tuning/jobs
+type FineTuningJob struct {
+	Object          string                    `json:"object"`
+	Id              string                    `json:"id"`
+	Model           string                    `json:"model"`
+	CreatedAt       int64                     `json:"created_at"`
+	FinishedAt      *int64                    `json:"finished_at"`
+	FineTunedModel  *string                   `json:"fine_tuned_model"`
+	OrganizationId  string                    `json:"organization_id"`
+	ResultFiles     []string                  `json:"result_files"`
+	Status          string                    `json:"status"`
+	ValidationFile  *string                   `json:"validation_file"`
+	TrainingFile    string                    `json:"training_file"`
+	Hyperparameters FineTuningHyperparameters `json:"hyperparameters"`
+	TrainedTokens   *int                      `json:"trained_tokens"`
+	Error           *FineTuningError          `json:"error"`
+	Seed            int                       `json:"seed"`
+	Suffix          *string                   `json:"suffix"`
+	Metadata        map[string]string         `json:"metadata"`
+}
+
+type FineTuningJobEvent struct {
+	Object    string         `json:"object"`
+	Id        string         `json:"id"`
+	CreatedAt int64          `json:"created_at"`
+	Level     string         `json:"level"`
+	Message   string         `json:"message"`
+	Type      string         `json:"type"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+type FineTuningJobList struct {
+	Object  string          `json:"object"`
+	Data    []FineTuningJob `json:"data"`
+	HasMore bool            `json:"has_more"`
+}
+
+type FineTuningJobEventList struct {
+	Object  string               `json:"object"`
+	Data    []FineTuningJobEvent `json:"data"`
+	HasMore bool                 `json:"has_more"`
+}
+
+// TrainingRequest is the base model, examples and hyperparameters of the
+// adapter a Trainer is asked to train
+type TrainingRequest struct {
+	Model                  string
+	TrainingFile           string
+	ValidationFile         string
+	Epochs                 int
+	BatchSize              int
+	LearningRateMultiplier float64
+	Seed                   int
+}
+
+// TrainingProgress is reported by a Trainer after each step of training
+type TrainingProgress struct {
+	Step       int
+	TotalSteps int
+	TrainLoss  float64
+	Tokens     int
+}
+
+// A Trainer trains LoRA adapters of local models from JSONL files of chat
+// examples. It reports its progress after each step, and returns the path of
+// the GGUF adapter it trained, or ErrUnsupportedModel when the model can't be
+// trained.
+type Trainer interface {
+	Train(ctx context.Context, r TrainingRequest, progress func(TrainingProgress)) (string, error)
+}
+
+// FineTuningJobs runs the fine-tuning jobs of /v1/fine_tuning/jobs with a
+// Trainer, one at a time, in the background. Training files are those
+// uploaded to files, and trained adapters are registered as models with a
+// create request sent to next for path. Jobs are kept in memory, so they're
+// forgotten when the server stops, but their models aren't.
+type FineTuningJobs struct {
+	next    http.Handler
+	path    string
+	files   *BatchStore
+	trainer Trainer
+
+	// running holds the job which is training
+	running chan struct{}
+
+	mu      sync.Mutex
+	jobs    map[string]*FineTuningJob
+	events  map[string][]FineTuningJobEvent
+	cancels map[string]func()
+}
+
+func NewFineTuningJobs(next http.Handler, path string, files *BatchStore, trainer Trainer) *FineTuningJobs {
+	return &FineTuningJobs{
+		next:    next,
+		path:    path,
+		files:   files,
+		trainer: trainer,
+		running: make(chan struct{}, 1),
+		jobs:    make(map[string]*FineTuningJob),
+		events:  make(map[string][]FineTuningJobEvent),
+		cancels: make(map[string]func()),
+	}
+}
+
+// hyperparameter resolves a hyperparameter which is "auto", or omitted, to
+// auto, or checks it's a number between lo and hi
+func hyperparameter(name string, v any, auto, lo, hi float64, integer bool) (float64, error) {
+	switch v := v.(type) {
+	case nil:
+		return auto, nil
+	case string:
+		if v == "auto" {
+			return auto, nil
+		}
+	case float64:
+		if v >= lo && v <= hi && (!integer || v == float64(int(v))) {
+			return v, nil
+		}
+	}
+
+	return 0, newParamError("hyperparameters."+name, "invalid_value", "Invalid value for '%s': expected 'auto' or a number between %v and %v, but got %v instead.", name, lo, hi, v)
+}
+
+// invalidSuffixRune reports whether r can't be part of a model suffix
+func invalidSuffixRune(r rune) bool {
+	return !(r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+}
+
+func (r FineTuningJobRequest) trainingRequest() (TrainingRequest, error) {
+	switch {
+	case r.Model == "":
+		return TrainingRequest{}, newParamError("model", "missing_required_parameter", "Missing required parameter: 'model'.")
+	case r.TrainingFile == "":
+		return TrainingRequest{}, newParamError("training_file", "missing_required_parameter", "Missing required parameter: 'training_file'.")
+	case len(r.Suffix) > 18:
+		return TrainingRequest{}, newParamError("suffix", "string_above_max_length", "Invalid 'suffix': string too long. Expected a string with maximum length 18, but got a string with length %d instead.", len(r.Suffix))
+	case strings.ContainsFunc(r.Suffix, invalidSuffixRune):
+		return TrainingRequest{}, newParamError("suffix", "invalid_value", "Invalid 'suffix': only letters, numbers, '-' and '_' are allowed.")
+	}
+
+	var h FineTuningHyperparameters
+	if r.Hyperparameters != nil {
+		h = *r.Hyperparameters
+	}
+
+	epochs, err := hyperparameter("n_epochs", h.NEpochs, 3, 1, 50, true)
+	if err != nil {
+		return TrainingRequest{}, err
+	}
+
+	batchSize, err := hyperparameter("batch_size", h.BatchSize, 1, 1, 256, true)
+	if err != nil {
+		return TrainingRequest{}, err
+	}
+
+	lr, err := hyperparameter("learning_rate_multiplier", h.LearningRateMultiplier, 1, 0.001, 10, false)
+	if err != nil {
+		return TrainingRequest{}, err
+	}
+
+	seed := rand.Intn(1 << 31)
+	if r.Seed != nil {
+		seed = *r.Seed
+	}
+
+	return TrainingRequest{
+		Model:                  r.Model,
+		Epochs:                 int(epochs),
+		BatchSize:              int(batchSize),
+		LearningRateMultiplier: lr,
+		Seed:                   seed,
+	}, nil
+}
+
+// trainingExamples checks the examples of a training or validation file are
+// conversations, and returns how many there are
+func trainingExamples(r io.Reader, param string) (int, error) {
+	var n int
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			var example struct {
+				Messages []Message `json:"messages"`
+			}
+
+			switch {
+			case json.Unmarshal(b, &example) != nil:
+				return 0, newParamError(param, "invalid_file_format", "Line %d of the file is not valid JSON.", line)
+			case len(example.Messages) == 0:
+				return 0, newParamError(param, "invalid_file_format", "Line %d of the file has no 'messages'.", line)
+			case !slices.ContainsFunc(example.Messages, func(m Message) bool { return m.Role == "assistant" }):
+				return 0, newParamError(param, "invalid_file_format", "Line %d of the file has no assistant message to train on.", line)
+			}
+			n++
+		}
+
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+	}
+}
+
+// fineTunedModel names the model of an adapter of base trained by a job
+func fineTunedModel(base, suffix, id string) string {
+	if i := strings.LastIndex(base, ":"); i > strings.LastIndex(base, "/") {
+		base = base[:i]
+	}
+
+	tag := "ft-" + strings.ToLower(strings.TrimPrefix(id, "ftjob-")[:12])
+	if suffix != "" {
+		tag = "ft-" + strings.ToLower(suffix) + "-" + tag[len("ft-"):]
+	}
+
+	return base + ":" + tag
+}
+
+func (j *FineTuningJobs) event(id, level, message string, data map[string]any) {
+	typ := "message"
+	if data != nil {
+		typ = "metrics"
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.events[id] = append(j.events[id], FineTuningJobEvent{
+		Object:    "fine_tuning.job.event",
+		Id:        newId("ftevent-"),
+		CreatedAt: time.Now().Unix(),
+		Level:     level,
+		Message:   message,
+		Type:      typ,
+		Data:      data,
+	})
+}
+
+func (j *FineTuningJobs) update(id string, fn func(*FineTuningJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fn(j.jobs[id])
+}
+
+// register creates the model of an adapter trained by a job
+func (j *FineTuningJobs) register(ctx context.Context, model, base, adapter string) error {
+	stream := false
+	body, err := json.Marshal(api.CreateRequest{Model: model, Modelfile: fmt.Sprintf("FROM %s\nADAPTER %s\n", base, adapter), Stream: &stream})
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, j.path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	rec := &batchRecorder{header: make(http.Header)}
+	j.next.ServeHTTP(rec, r)
+	if rec.code != http.StatusOK {
+		var resp struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(rec.body.Bytes(), &resp); err != nil || resp.Error == "" {
+			return fmt.Errorf("creating %s: unexpected response", model)
+		}
+		return fmt.Errorf("creating %s: %s", model, resp.Error)
+	}
+
+	return nil
+}
+
+// results writes the training loss of each step of a job to a CSV file
+func (j *FineTuningJobs) results(id string, steps []TrainingProgress) (string, error) {
+	f, err := os.CreateTemp(filepath.Join(j.files.dir, "files"), "results-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"step", "train_loss"})
+	for _, step := range steps {
+		w.Write([]string{strconv.Itoa(step.Step), strconv.FormatFloat(step.TrainLoss, 'f', -1, 64)})
+	}
+	w.Flush()
+
+	err = w.Error()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	file, err := j.files.addFile(f.Name(), id+"_results.csv", "fine-tune-results")
+	if err != nil {
+		return "", err
+	}
+
+	return file.Id, nil
+}
+
+// run validates the files of the job of id, waits for the jobs before it,
+// and trains and registers its adapter, until ctx is done
+func (j *FineTuningJobs) run(ctx context.Context, id string, r TrainingRequest, suffix string) {
+	fail := func(err error) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		e := &FineTuningError{Code: "training_failed", Message: err.Error()}
+		if errors.Is(err, ErrUnsupportedModel) {
+			e = &FineTuningError{Code: "model_not_supported", Message: fmt.Sprintf("model '%s' does not support fine-tuning", r.Model)}
+		}
+
+		var perr *paramError
+		if errors.As(err, &perr) {
+			e.Code, e.Param = "invalid_training_file", &perr.param
+		}
+
+		j.end(id, func(job *FineTuningJob) {
+			job.Status, job.Error = "failed", e
+		})
+		j.event(id, "error", e.Message, nil)
+	}
+
+	j.event(id, "info", "Validating training file: "+r.TrainingFile, nil)
+	for _, file := range []struct{ id, param string }{{r.TrainingFile, "training_file"}, {r.ValidationFile, "validation_file"}} {
+		if file.id == "" {
+			continue
+		}
+
+		f, err := os.Open(j.files.filePath(file.id))
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		n, err := trainingExamples(f, file.param)
+		f.Close()
+		switch {
+		case err != nil:
+			fail(err)
+			return
+		case file.param == "training_file" && n < minTrainingExamples:
+			fail(newParamError(file.param, "invalid_file_format", "Training file has %d example(s), but must have at least %d examples.", n, minTrainingExamples))
+			return
+		}
+	}
+
+	j.update(id, func(job *FineTuningJob) { job.Status = "queued" })
+	j.event(id, "info", "Files validated, moving job to queued state", nil)
+
+	// only one job is trained at a time
+	select {
+	case j.running <- struct{}{}:
+		defer func() { <-j.running }()
+	case <-ctx.Done():
+		return
+	}
+
+	j.update(id, func(job *FineTuningJob) { job.Status = "running" })
+	j.event(id, "info", "Fine-tuning job started", nil)
+
+	r.TrainingFile = j.files.filePath(r.TrainingFile)
+	if r.ValidationFile != "" {
+		r.ValidationFile = j.files.filePath(r.ValidationFile)
+	}
+
+	var steps []TrainingProgress
+	adapter, err := j.trainer.Train(ctx, r, func(p TrainingProgress) {
+		steps = append(steps, p)
+		j.update(id, func(job *FineTuningJob) { job.TrainedTokens = &p.Tokens })
+		j.event(id, "info", fmt.Sprintf("Step %d/%d: training loss=%.4f", p.Step, p.TotalSteps, p.TrainLoss), map[string]any{"step": p.Step, "total_steps": p.TotalSteps, "train_loss": p.TrainLoss})
+	})
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	model := fineTunedModel(r.Model, suffix, id)
+	if err := j.register(ctx, model, r.Model, adapter); err != nil {
+		fail(err)
+		return
+	}
+	j.event(id, "info", "New fine-tuned model created: "+model, nil)
+
+	results, err := j.results(id, steps)
+	if err != nil {
+		slog.Error("saving fine-tuning results", "id", id, "error", err)
+	}
+
+	j.end(id, func(job *FineTuningJob) {
+		job.Status, job.FineTunedModel = "succeeded", &model
+		if results != "" {
+			job.ResultFiles = []string{results}
+		}
+	})
+	j.event(id, "info", "The job has successfully completed", nil)
+}
+
+// end changes the job of id with fn, once it's no longer running, so it can't
+// be cancelled
+func (j *FineTuningJobs) end(id string, fn func(*FineTuningJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// a cancelled job stays cancelled
+	cancel, ok := j.cancels[id]
+	if !ok {
+		return
+	}
+	cancel()
+	delete(j.cancels, id)
+
+	now := time.Now().Unix()
+	j.jobs[id].FinishedAt = &now
+	fn(j.jobs[id])
+}
+
+// CreateJob serves POST /v1/fine_tuning/jobs, starting a job training an
+// adapter of a local model with an uploaded file of chat examples
+func (j *FineTuningJobs) CreateJob(c *gin.Context) {
+	var req FineTuningJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+		return
+	}
+
+	r, err := req.trainingRequest()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+		return
+	}
+
+	for _, file := range []struct{ id, param string }{{req.TrainingFile, "training_file"}, {req.ValidationFile, "validation_file"}} {
+		if file.id == "" {
+			continue
+		}
+
+		f, ok := j.files.file(file.id)
+		switch {
+		case !ok:
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", file.param, file.id), "invalid_value", file.param))
+			return
+		case f.Purpose != "fine-tune":
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("File %s has purpose '%s', but fine-tuning needs a file with purpose 'fine-tune'.", f.Id, f.Purpose), "invalid_value", file.param))
+			return
+		}
+	}
+	r.TrainingFile, r.ValidationFile = req.TrainingFile, req.ValidationFile
+
+	job := &FineTuningJob{
+		Object:       "fine_tuning.job",
+		Id:           newId("ftjob-"),
+		Model:        req.Model,
+		CreatedAt:    time.Now().Unix(),
+		ResultFiles:  []string{},
+		Status:       "validating_files",
+		TrainingFile: req.TrainingFile,
+		Hyperparameters: FineTuningHyperparameters{
+			NEpochs:                r.Epochs,
+			BatchSize:              r.BatchSize,
+			LearningRateMultiplier: r.LearningRateMultiplier,
+		},
+		Seed:     r.Seed,
+		Metadata: req.Metadata,
+	}
+
+	if req.ValidationFile != "" {
+		job.ValidationFile = &req.ValidationFile
+	}
+
+	if req.Suffix != "" {
+		job.Suffix = &req.Suffix
+	}
+
+	// the job outlives the request, but its model is created with the
+	// values of its context
+	ctx, cancel := context.WithCancel(context.WithoutCancel(c.Request.Context()))
+
+	j.mu.Lock()
+	j.jobs[job.Id] = job
+	j.cancels[job.Id] = cancel
+	resp := *job
+	j.mu.Unlock()
+
+	j.event(job.Id, "info", "Created fine-tuning job: "+job.Id, nil)
+	go j.run(ctx, job.Id, r, req.Suffix)
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func fineTuningJobNotFound(id string) ErrorResponse {
+	return NewErrorWithCode(http.StatusNotFound, fmt.Sprintf("Could not find fine tune job: %s", id), "fine_tune_not_found", "fine_tuning_job_id")
+}
+
+// GetJob serves GET /v1/fine_tuning/jobs/:id
+func (j *FineTuningJobs) GetJob(c *gin.Context) {
+	j.mu.Lock()
+	job, ok := j.jobs[c.Param("id")]
+	var resp FineTuningJob
+	if ok {
+		resp = *job
+	}
+	j.mu.Unlock()
+
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, fineTuningJobNotFound(c.Param("id")))
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// ListJobs serves GET /v1/fine_tuning/jobs, newest first. Pages of limit jobs
+// follow the job of the after query parameter.
+func (j *FineTuningJobs) ListJobs(c *gin.Context) {
+	limit, err := listLimit(c, 100)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+		return
+	}
+
+	j.mu.Lock()
+	jobs := make([]FineTuningJob, 0, len(j.jobs))
+	for _, job := range j.jobs {
+		jobs = append(jobs, *job)
+	}
+	j.mu.Unlock()
+
+	slices.SortFunc(jobs, func(a, b FineTuningJob) int {
+		if c := cmp.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(b.Id, a.Id)
+	})
+
+	if after := c.Query("after"); after != "" {
+		i := slices.IndexFunc(jobs, func(job FineTuningJob) bool { return job.Id == after })
+		jobs = jobs[i+1:]
+	}
+
+	c.JSON(http.StatusOK, FineTuningJobList{Object: "list", Data: jobs[:min(limit, len(jobs))], HasMore: len(jobs) > limit})
+}
+
+// ListEvents serves GET /v1/fine_tuning/jobs/:id/events, newest first. Pages
+// of limit events follow the event of the after query parameter.
+func (j *FineTuningJobs) ListEvents(c *gin.Context) {
+	limit, err := listLimit(c, 100)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+		return
+	}
+
+	j.mu.Lock()
+	_, ok := j.jobs[c.Param("id")]
+	events := slices.Clone(j.events[c.Param("id")])
+	j.mu.Unlock()
+
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, fineTuningJobNotFound(c.Param("id")))
+		return
+	}
+
+	slices.Reverse(events)
+	if after := c.Query("after"); after != "" {
+		i := slices.IndexFunc(events, func(e FineTuningJobEvent) bool { return e.Id == after })
+		events = events[i+1:]
+	}
+
+	c.JSON(http.StatusOK, FineTuningJobEventList{Object: "list", Data: events[:min(limit, len(events))], HasMore: len(events) > limit})
+}
+
+// CancelJob serves POST /v1/fine_tuning/jobs/:id/cancel
+func (j *FineTuningJobs) CancelJob(c *gin.Context) {
+	id := c.Param("id")
+
+	j.mu.Lock()
+	job, ok := j.jobs[id]
+	cancel, running := j.cancels[id]
+	var resp FineTuningJob
+	if ok && running {
+		delete(j.cancels, id)
+		now := time.Now().Unix()
+		job.Status, job.FinishedAt = "cancelled", &now
+	}
+	if ok {
+		resp = *job
+	}
+	j.mu.Unlock()
+
+	switch {
+	case !ok:
+		c.AbortWithStatusJSON(http.StatusNotFound, fineTuningJobNotFound(id))
+		return
+	case !running:
+		c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("Job has already completed: %s", id), "", ""))
+		return
+	}
+
+	cancel()
+	j.event(id, "info", "Fine-tuning job cancelled", nil)
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,244 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// testTrainer trains two steps of an adapter named after the model, blocks
+// training the "slow" model until it's cancelled, and rejects the
+// "unsupported" model
+type testTrainer struct {
+	testBackend
+}
+
+func (testTrainer) Train(ctx context.Context, r TrainingRequest, progress func(TrainingProgress)) (string, error) {
+	switch r.Model {
+	case "unsupported":
+		return "", ErrUnsupportedModel
+	case "slow":
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+
+	for step := 1; step <= 2; step++ {
+		progress(TrainingProgress{Step: step, TotalSteps: 2, TrainLoss: 1.0 / float64(step), Tokens: 100 * step})
+	}
+
+	return "/adapters/" + r.Model + ".gguf", nil
+}
+
+// trainingFile is a file of n chat examples
+func trainingFile(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `{"messages": [{"role": "user", "content": "Hi %d"}, {"role": "assistant", "content": "Hello"}]}`+"\n", i)
+	}
+	return b.Bytes()
+}
+
+func TestTrainingExamples(t *testing.T) {
+	n, err := trainingExamples(bytes.NewReader(trainingFile(3)), "training_file")
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	for _, input := range []string{
+		"not json",
+		`{"messages": []}`,
+		`{"messages": [{"role": "user", "content": "Hi"}]}`,
+	} {
+		_, err := trainingExamples(strings.NewReader(input), "training_file")
+		assert.Error(t, err, input)
+	}
+}
+
+func TestFineTunedModel(t *testing.T) {
+	assert.Equal(t, "llama2:ft-abcdefghijkl", fineTunedModel("llama2", "", "ftjob-AbCdEfGhIjKlMnOpQrStUvWxYz123"))
+	assert.Equal(t, "llama2:ft-support-abcdefghijkl", fineTunedModel("llama2:7b", "Support", "ftjob-AbCdEfGhIjKlMnOpQrStUvWxYz123"))
+	assert.Equal(t, "localhost:5000/me/llama2:ft-abcdefghijkl", fineTunedModel("localhost:5000/me/llama2", "", "ftjob-abcdefghijklmnopqrstuvwxyz123"))
+}
+
+func TestFineTuningJobs(t *testing.T) {
+	r, files := newBatchRouter(t, t.TempDir(), batchHandler(t))
+
+	creates := make(chan api.CreateRequest, 4)
+	r.POST("/api/create", func(c *gin.Context) {
+		var req api.CreateRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+		creates <- req
+
+		if strings.HasPrefix(req.Model, "missing:") {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "pull model manifest: file does not exist"})
+			return
+		}
+		c.JSON(http.StatusOK, api.ProgressResponse{Status: "success"})
+	})
+
+	jobs := NewFineTuningJobs(r, "/api/create", files, testTrainer{})
+	v1 := r.Group("/v1", AuthMiddleware("sk-test"))
+	v1.POST("/fine_tuning/jobs", jobs.CreateJob)
+	v1.GET("/fine_tuning/jobs", jobs.ListJobs)
+	v1.GET("/fine_tuning/jobs/:id", jobs.GetJob)
+	v1.GET("/fine_tuning/jobs/:id/events", jobs.ListEvents)
+	v1.POST("/fine_tuning/jobs/:id/cancel", jobs.CancelJob)
+
+	upload := func(t *testing.T, purpose string, content []byte) string {
+		w := uploadFile(t, r, purpose, "train.jsonl", content)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var f File
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &f))
+		return f.Id
+	}
+
+	training := upload(t, "fine-tune", trainingFile(10))
+
+	create := func(t *testing.T, req FineTuningJobRequest) FineTuningJob {
+		w := doAuthRequest(t, r, http.MethodPost, "/v1/fine_tuning/jobs", req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var job FineTuningJob
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+		return job
+	}
+
+	wait := func(t *testing.T, id, status string) FineTuningJob {
+		var job FineTuningJob
+		require.Eventually(t, func() bool {
+			w := doAuthRequest(t, r, http.MethodGet, "/v1/fine_tuning/jobs/"+id, nil)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+			return job.Status == status
+		}, 5*time.Second, 10*time.Millisecond)
+		return job
+	}
+
+	t.Run("succeeded", func(t *testing.T) {
+		job := create(t, FineTuningJobRequest{Model: "llama2", TrainingFile: training, Suffix: "support", Seed: ptr(42), Hyperparameters: &FineTuningHyperparameters{NEpochs: 2.0}})
+		assert.Equal(t, "fine_tuning.job", job.Object)
+		assert.Equal(t, "validating_files", job.Status)
+		assert.Equal(t, 42, job.Seed)
+		assert.Equal(t, FineTuningHyperparameters{NEpochs: 2.0, BatchSize: 1.0, LearningRateMultiplier: 1.0}, job.Hyperparameters)
+
+		job = wait(t, job.Id, "succeeded")
+		require.NotNil(t, job.FineTunedModel)
+		assert.True(t, strings.HasPrefix(*job.FineTunedModel, "llama2:ft-support-"), *job.FineTunedModel)
+		assert.NotNil(t, job.FinishedAt)
+		assert.Equal(t, ptr(200), job.TrainedTokens)
+
+		req := <-creates
+		assert.Equal(t, *job.FineTunedModel, req.Model)
+		assert.Equal(t, "FROM llama2\nADAPTER /adapters/llama2.gguf\n", req.Modelfile)
+
+		require.Len(t, job.ResultFiles, 1)
+		w := doAuthRequest(t, r, http.MethodGet, "/v1/files/"+job.ResultFiles[0]+"/content", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "step,train_loss\n1,1\n2,0.5\n", w.Body.String())
+
+		w = doAuthRequest(t, r, http.MethodGet, "/v1/fine_tuning/jobs/"+job.Id+"/events?limit=3", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var events FineTuningJobEventList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+		require.Len(t, events.Data, 3)
+		assert.True(t, events.HasMore)
+		assert.Equal(t, "The job has successfully completed", events.Data[0].Message)
+		assert.Equal(t, "metrics", events.Data[2].Type)
+		assert.Equal(t, 2.0, events.Data[2].Data["step"])
+
+		w = doAuthRequest(t, r, http.MethodPost, "/v1/fine_tuning/jobs/"+job.Id+"/cancel", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("too few examples", func(t *testing.T) {
+		job := create(t, FineTuningJobRequest{Model: "llama2", TrainingFile: upload(t, "fine-tune", trainingFile(3))})
+		job = wait(t, job.Id, "failed")
+		require.NotNil(t, job.Error)
+		assert.Equal(t, "invalid_training_file", job.Error.Code)
+		assert.Equal(t, "training_file", *job.Error.Param)
+		assert.Nil(t, job.FineTunedModel)
+	})
+
+	t.Run("unsupported model", func(t *testing.T) {
+		job := wait(t, create(t, FineTuningJobRequest{Model: "unsupported", TrainingFile: training}).Id, "failed")
+		assert.Equal(t, "model_not_supported", job.Error.Code)
+	})
+
+	t.Run("model not created", func(t *testing.T) {
+		job := wait(t, create(t, FineTuningJobRequest{Model: "missing", TrainingFile: training}).Id, "failed")
+		assert.Equal(t, "training_failed", job.Error.Code)
+		assert.Contains(t, job.Error.Message, "file does not exist")
+		<-creates
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		job := create(t, FineTuningJobRequest{Model: "slow", TrainingFile: training})
+		wait(t, job.Id, "running")
+
+		// jobs are trained one at a time
+		queued := create(t, FineTuningJobRequest{Model: "llama2", TrainingFile: training})
+		wait(t, queued.Id, "queued")
+
+		w := doAuthRequest(t, r, http.MethodPost, "/v1/fine_tuning/jobs/"+job.Id+"/cancel", nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+		assert.Equal(t, "cancelled", job.Status)
+
+		wait(t, queued.Id, "succeeded")
+		<-creates
+		assert.Equal(t, "cancelled", wait(t, job.Id, "cancelled").Status)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := doAuthRequest(t, r, http.MethodGet, "/v1/fine_tuning/jobs?limit=2", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var list FineTuningJobList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Len(t, list.Data, 2)
+		assert.True(t, list.HasMore)
+	})
+
+	image := upload(t, "vision", []byte("png"))
+
+	cases := []struct {
+		name  string
+		req   FineTuningJobRequest
+		param string
+	}{
+		{name: "missing model", req: FineTuningJobRequest{TrainingFile: training}, param: "model"},
+		{name: "missing training file", req: FineTuningJobRequest{Model: "llama2"}, param: "training_file"},
+		{name: "unknown training file", req: FineTuningJobRequest{Model: "llama2", TrainingFile: "file-missing"}, param: "training_file"},
+		{name: "training file purpose", req: FineTuningJobRequest{Model: "llama2", TrainingFile: image}, param: "training_file"},
+		{name: "validation file purpose", req: FineTuningJobRequest{Model: "llama2", TrainingFile: training, ValidationFile: image}, param: "validation_file"},
+		{name: "invalid suffix", req: FineTuningJobRequest{Model: "llama2", TrainingFile: training, Suffix: "my model"}, param: "suffix"},
+		{name: "invalid epochs", req: FineTuningJobRequest{Model: "llama2", TrainingFile: training, Hyperparameters: &FineTuningHyperparameters{NEpochs: 1.5}}, param: "hyperparameters.n_epochs"},
+		{name: "invalid learning rate", req: FineTuningJobRequest{Model: "llama2", TrainingFile: training, Hyperparameters: &FineTuningHyperparameters{LearningRateMultiplier: "fast"}}, param: "hyperparameters.learning_rate_multiplier"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doAuthRequest(t, r, http.MethodPost, "/v1/fine_tuning/jobs", tt.req)
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.param, resp.Error.Param)
+		})
+	}
+
+	w := doAuthRequest(t, r, http.MethodGet, "/v1/fine_tuning/jobs/ftjob-missing", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
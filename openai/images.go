@@ -0,0 +1,144 @@
+package openai
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ImageGenerationRequest is a /v1/images/generations request
+type ImageGenerationRequest struct {
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	N              *int   `json:"n,omitempty"`
+	Size           string `json:"size,omitempty"`
+	Quality        string `json:"quality,omitempty"`
+	Style          string `json:"style,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+	User           string `json:"user,omitempty"`
+}
+
+// ImageRequest is the prompt and parameters of the images an ImageGenerator
+// is asked for
+type ImageRequest struct {
+	Model  string
+	Prompt string
+	N      int
+	Width  int
+	Height int
+}
+
+// An ImageGenerator is a Backend which can generate images. It returns the
+// PNG encoding of each image, and ErrUnsupportedModel when the model can't
+// generate images.
+type ImageGenerator interface {
+	GenerateImages(ctx context.Context, r ImageRequest) ([][]byte, error)
+}
+
+type Image struct {
+	B64JSON       string `json:"b64_json,omitempty"`
+	URL           string `json:"url,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+}
+
+type ImagesResponse struct {
+	Created int64   `json:"created"`
+	Data    []Image `json:"data"`
+}
+
+// imageSize parses a size of the form WIDTHxHEIGHT
+func imageSize(size string) (int, int, error) {
+	if size == "" {
+		return 1024, 1024, nil
+	}
+
+	w, h, ok := strings.Cut(size, "x")
+	width, werr := strconv.Atoi(w)
+	height, herr := strconv.Atoi(h)
+	if !ok || werr != nil || herr != nil || width < 64 || height < 64 || width > 4096 || height > 4096 {
+		return 0, 0, newParamError("size", "invalid_value", "Invalid value: '%s'. Sizes must be of the form WIDTHxHEIGHT, between 64 and 4096 pixels a side. - 'size'", size)
+	}
+
+	return width, height, nil
+}
+
+func (r ImageGenerationRequest) imageRequest() (ImageRequest, error) {
+	switch {
+	case r.Model == "":
+		return ImageRequest{}, newParamError("model", "missing_required_parameter", "'model' is a required property")
+	case r.Prompt == "":
+		return ImageRequest{}, newParamError("prompt", "missing_required_parameter", "'prompt' is a required property")
+	case len([]rune(r.Prompt)) > 4000:
+		return ImageRequest{}, newParamError("prompt", "string_above_max_length", "'%s...' is too long - 'prompt'", string([]rune(r.Prompt)[:16]))
+	case r.N != nil && (*r.N < 1 || *r.N > 10):
+		return ImageRequest{}, newParamError("n", "invalid_value", "%d is not between 1 and 10 - 'n'", *r.N)
+	}
+
+	switch r.ResponseFormat {
+	case "", "b64_json", "url":
+	default:
+		return ImageRequest{}, newParamError("response_format", "invalid_value", "Invalid value: '%s'. Supported values are: 'url' and 'b64_json'. - 'response_format'", r.ResponseFormat)
+	}
+
+	width, height, err := imageSize(r.Size)
+	if err != nil {
+		return ImageRequest{}, err
+	}
+
+	n := 1
+	if r.N != nil {
+		n = *r.N
+	}
+
+	return ImageRequest{Model: r.Model, Prompt: r.Prompt, N: n, Width: width, Height: height}, nil
+}
+
+// ImagesMiddleware serves /v1/images/generations, generating images with
+// generator. Images are returned base64 encoded, or as data URLs when a url
+// response_format is asked for, since they aren't hosted.
+func ImagesMiddleware(generator ImageGenerator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ImageGenerationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		r, err := req.imageRequest()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		images, err := generator.GenerateImages(c.Request.Context(), r)
+		switch {
+		case errors.Is(err, ErrUnsupportedModel):
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("model '%s' does not support image generation", req.Model), "model_not_supported", "model"))
+			return
+		case err != nil:
+			slog.Error("image generation failed", "model", req.Model, "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		resp := ImagesResponse{Created: time.Now().Unix(), Data: make([]Image, len(images))}
+		for i, image := range images {
+			b64 := base64.StdEncoding.EncodeToString(image)
+			if req.ResponseFormat == "url" {
+				resp.Data[i].URL = "data:image/png;base64," + b64
+			} else {
+				resp.Data[i].B64JSON = b64
+			}
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,98 @@
+package openai
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testImageGenerator "draws" each image of the "diffusion" model as a
+// description of it, and rejects every other model
+type testImageGenerator struct {
+	testBackend
+}
+
+func (testImageGenerator) GenerateImages(_ context.Context, r ImageRequest) ([][]byte, error) {
+	if r.Model != "diffusion" {
+		return nil, ErrUnsupportedModel
+	}
+
+	images := make([][]byte, r.N)
+	for i := range images {
+		images[i] = []byte(fmt.Sprintf("%s %dx%d #%d", r.Prompt, r.Width, r.Height, i))
+	}
+
+	return images, nil
+}
+
+func TestImagesMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/images/generations", ImagesMiddleware(testImageGenerator{}))
+
+	decode := func(t *testing.T, s string) string {
+		b, err := base64.StdEncoding.DecodeString(s)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	t.Run("b64 json", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/images/generations", ImageGenerationRequest{Model: "diffusion", Prompt: "a cat", N: ptr(2), Size: "512x256"})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp ImagesResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.NotZero(t, resp.Created)
+		require.Len(t, resp.Data, 2)
+		assert.Equal(t, "a cat 512x256 #0", decode(t, resp.Data[0].B64JSON))
+		assert.Equal(t, "a cat 512x256 #1", decode(t, resp.Data[1].B64JSON))
+		assert.Empty(t, resp.Data[0].URL)
+	})
+
+	t.Run("url", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/images/generations", ImageGenerationRequest{Model: "diffusion", Prompt: "a cat", ResponseFormat: "url"})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp ImagesResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Data, 1)
+		b64, ok := strings.CutPrefix(resp.Data[0].URL, "data:image/png;base64,")
+		require.True(t, ok, resp.Data[0].URL)
+		assert.Equal(t, "a cat 1024x1024 #0", decode(t, b64))
+	})
+
+	cases := []struct {
+		name  string
+		req   ImageGenerationRequest
+		param string
+	}{
+		{name: "unsupported model", req: ImageGenerationRequest{Model: "llama2", Prompt: "a cat"}, param: "model"},
+		{name: "missing model", req: ImageGenerationRequest{Prompt: "a cat"}, param: "model"},
+		{name: "missing prompt", req: ImageGenerationRequest{Model: "diffusion"}, param: "prompt"},
+		{name: "long prompt", req: ImageGenerationRequest{Model: "diffusion", Prompt: strings.Repeat("a", 4001)}, param: "prompt"},
+		{name: "invalid n", req: ImageGenerationRequest{Model: "diffusion", Prompt: "a cat", N: ptr(11)}, param: "n"},
+		{name: "invalid size", req: ImageGenerationRequest{Model: "diffusion", Prompt: "a cat", Size: "large"}, param: "size"},
+		{name: "small size", req: ImageGenerationRequest{Model: "diffusion", Prompt: "a cat", Size: "32x32"}, param: "size"},
+		{name: "invalid response format", req: ImageGenerationRequest{Model: "diffusion", Prompt: "a cat", ResponseFormat: "png"}, param: "response_format"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, r, "/v1/images/generations", tt.req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "invalid_request_error", resp.Error.Type)
+			assert.Equal(t, tt.param, resp.Error.Param)
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// moderationCategories are the categories reported for every moderation result
+var moderationCategories = []string{
+	"harassment",
+	"harassment/threatening",
+	"hate",
+	"hate/threatening",
+	"illicit",
+	"illicit/violent",
+	"self-harm",
+	"self-harm/instructions",
+	"self-harm/intent",
+	"sexual",
+	"sexual/minors",
+	"violence",
+	"violence/graphic",
+}
+
+// guardCategories map the hazard categories of Llama Guard 3 to the moderation
+// categories they're reported as. Hazards without a category, such as
+// specialized advice or elections, only flag the input.
+var guardCategories = map[string][]string{
+	"S1":  {"violence"},
+	"S2":  {"illicit"},
+	"S3":  {"sexual", "illicit"},
+	"S4":  {"sexual", "sexual/minors"},
+	"S5":  {"harassment"},
+	"S9":  {"illicit/violent", "violence"},
+	"S10": {"hate"},
+	"S11": {"self-harm"},
+	"S12": {"sexual"},
+}
+
+type ModerationRequest struct {
+	Input any    `json:"input"`
+	Model string `json:"model"`
+}
+
+type ModerationResult struct {
+	Flagged        bool               `json:"flagged"`
+	Categories     map[string]bool    `json:"categories"`
+	CategoryScores map[string]float64 `json:"category_scores"`
+}
+
+type Moderation struct {
+	Id      string             `json:"id"`
+	Model   string             `json:"model"`
+	Results []ModerationResult `json:"results"`
+}
+
+// inputs returns the text inputs of a moderation request, which may be a
+// single string or an array of strings
+func (r ModerationRequest) inputs() ([]string, error) {
+	return stringInputs(r.Input)
+}
+
+// stringInputs returns the strings of an input parameter which may be a
+// single string or a non-empty array of strings
+func stringInputs(input any) ([]string, error) {
+	switch input := input.(type) {
+	case string:
+		return []string{input}, nil
+	case []any:
+		if len(input) == 0 {
+			return nil, newParamError("input", "empty_array", "[] is too short - 'input'")
+		}
+
+		inputs := make([]string, len(input))
+		for i, v := range input {
+			s, ok := v.(string)
+			if !ok {
+				return nil, newParamError(fmt.Sprintf("input.%d", i), "invalid_type", "%v is not of type 'string' - 'input.%d'", v, i)
+			}
+			inputs[i] = s
+		}
+		return inputs, nil
+	case nil:
+		return nil, newParamError("input", "missing_required_parameter", "'input' is a required property")
+	default:
+		return nil, newParamError("input", "invalid_type", "'input' must be a string or an array of strings")
+	}
+}
+
+func unflagged() ModerationResult {
+	result := ModerationResult{
+		Categories:     make(map[string]bool, len(moderationCategories)),
+		CategoryScores: make(map[string]float64, len(moderationCategories)),
+	}
+
+	for _, category := range moderationCategories {
+		result.Categories[category] = false
+		result.CategoryScores[category] = 0
+	}
+
+	return result
+}
+
+// guardResult converts the verdict of a guard model, "safe", or "unsafe"
+// followed by a line of the comma separated hazard categories violated, into
+// a moderation result
+func guardResult(verdict string) ModerationResult {
+	result := unflagged()
+
+	verdict, categories, _ := strings.Cut(strings.TrimSpace(verdict), "\n")
+	if !strings.EqualFold(strings.TrimSpace(verdict), "unsafe") {
+		return result
+	}
+
+	result.Flagged = true
+	for _, hazard := range strings.Split(categories, ",") {
+		for _, category := range guardCategories[strings.ToUpper(strings.TrimSpace(hazard))] {
+			result.Categories[category] = true
+			result.CategoryScores[category] = 1
+		}
+	}
+
+	return result
+}
+
+// moderationModel reports whether model is one of OpenAI's moderation models,
+// which are answered by the configured guard model
+func moderationModel(model string) bool {
+	return model == "" || strings.HasPrefix(model, "text-moderation-") || strings.HasPrefix(model, "omni-moderation-")
+}
+
+// classify asks the guard model for the verdict of input, as a chat completion
+// request sent to next for path. It returns the status and body of a failed
+// request.
+func classify(ctx context.Context, next http.Handler, path, guard, input string) (string, *batchRecorder, error) {
+	temperature := 0.0
+	body, err := json.Marshal(Request{
+		Model:       guard,
+		Messages:    []Message{{Role: "user", Content: input}},
+		Temperature: &temperature,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	rec := &batchRecorder{header: make(http.Header)}
+	next.ServeHTTP(rec, r)
+	if rec.code != http.StatusOK {
+		return "", rec, nil
+	}
+
+	var completion Completion
+	if err := json.Unmarshal(rec.body.Bytes(), &completion); err != nil || len(completion.Choices) != 1 {
+		return "", nil, errors.New("unexpected response")
+	}
+
+	return completion.Choices[0].Message.Content, nil, nil
+}
+
+// ModerationMiddleware serves /v1/moderations. Each input is classified by a
+// guard model, such as Llama Guard, sent as a chat completion request to next
+// for path. The guard model is the requested model, or guard for requests of
+// OpenAI's moderation models. Without a guard model no classifier is run:
+// every input is reported as not flagged so that clients which moderate
+// before chatting keep working.
+func ModerationMiddleware(next http.Handler, path, guard string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ModerationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		inputs, err := req.inputs()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		model, guard := req.Model, guard
+		if !moderationModel(model) {
+			guard = model
+		} else if model == "" {
+			model = "text-moderation-latest"
+		}
+
+		results := make([]ModerationResult, len(inputs))
+		for i, input := range inputs {
+			if guard == "" {
+				results[i] = unflagged()
+				continue
+			}
+
+			verdict, failed, err := classify(c.Request.Context(), next, path, guard, input)
+			switch {
+			case err != nil:
+				c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+				return
+			case failed != nil:
+				c.Data(failed.code, "application/json", failed.body.Bytes())
+				c.Abort()
+				return
+			}
+
+			results[i] = guardResult(verdict)
+		}
+
+		c.JSON(http.StatusOK, Moderation{
+			Id:      newId("modr-"),
+			Model:   model,
+			Results: results,
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestModerationMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/moderations", ModerationMiddleware(r, "/v1/chat/completions", ""))
+
+	cases := []struct {
+		name    string
+		body    any
+		code    int
+		results int
+	}{
+		{name: "single", body: map[string]any{"input": "I want to hug a puppy"}, code: http.StatusOK, results: 1},
+		{name: "array", body: map[string]any{"input": []string{"one", "two", "three"}}, code: http.StatusOK, results: 3},
+		{name: "missing", body: map[string]any{}, code: http.StatusBadRequest},
+		{name: "empty array", body: map[string]any{"input": []string{}}, code: http.StatusBadRequest},
+		{name: "non-string", body: map[string]any{"input": []any{"one", 2}}, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, r, "/v1/moderations", tt.body)
+			assert.Equal(t, tt.code, w.Code)
+
+			if tt.code != http.StatusOK {
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, "invalid_request_error", resp.Error.Type)
+				assert.NotNil(t, resp.Error.Code)
+				assert.NotNil(t, resp.Error.Param)
+				return
+			}
+
+			var moderation Moderation
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &moderation))
+			assert.NotEmpty(t, moderation.Id)
+			assert.NotEmpty(t, moderation.Model)
+			require.Len(t, moderation.Results, tt.results)
+
+			for _, result := range moderation.Results {
+				assert.False(t, result.Flagged)
+				assert.Len(t, result.Categories, len(moderationCategories))
+				for _, category := range moderationCategories {
+					assert.False(t, result.Categories[category])
+					assert.Zero(t, result.CategoryScores[category])
+				}
+			}
+		})
+	}
+}
+
+func TestGuardResult(t *testing.T) {
+	assert.Equal(t, unflagged(), guardResult("safe"))
+	assert.Equal(t, unflagged(), guardResult("\n\nsafe\n"))
+
+	result := guardResult("\n\nunsafe\nS1, s10")
+	assert.True(t, result.Flagged)
+	for category, flagged := range result.Categories {
+		want := category == "violence" || category == "hate"
+		assert.Equal(t, want, flagged, category)
+		assert.Equal(t, map[bool]float64{true: 1}[want], result.CategoryScores[category], category)
+	}
+
+	// hazards without a category only flag the input
+	result = guardResult("unsafe\nS13")
+	assert.True(t, result.Flagged)
+	for category, flagged := range result.Categories {
+		assert.False(t, flagged, category)
+	}
+}
+
+func TestModerationMiddlewareGuard(t *testing.T) {
+	var models []string
+	r := newRouter(Middleware(), func(c *gin.Context) {
+		var req api.ChatRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+		models = append(models, req.Model)
+
+		if req.Model == "missing" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+			return
+		}
+
+		assert.Equal(t, 0.0, req.Options["temperature"])
+		require.Len(t, req.Messages, 1)
+
+		verdict := "safe"
+		if strings.Contains(req.Messages[0].Content, "kill") {
+			verdict = "unsafe\nS1"
+		}
+
+		c.JSON(http.StatusOK, api.ChatResponse{Model: req.Model, CreatedAt: time.Now(), Message: api.Message{Role: "assistant", Content: verdict}, Done: true})
+	})
+	r.POST("/v1/moderations", ModerationMiddleware(r, "/v1/chat/completions", "llama-guard3"))
+
+	w := doRequest(t, r, "/v1/moderations", map[string]any{"model": "omni-moderation-latest", "input": []string{"I want to hug a puppy", "I want to kill"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var moderation Moderation
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &moderation))
+	assert.Equal(t, "omni-moderation-latest", moderation.Model)
+	require.Len(t, moderation.Results, 2)
+	assert.False(t, moderation.Results[0].Flagged)
+	assert.True(t, moderation.Results[1].Flagged)
+	assert.True(t, moderation.Results[1].Categories["violence"])
+	assert.Equal(t, []string{"llama-guard3", "llama-guard3"}, models)
+
+	// a local model is used as the guard model
+	models = nil
+	w = doRequest(t, r, "/v1/moderations", map[string]any{"model": "shieldgemma", "input": "I want to hug a puppy"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"shieldgemma"}, models)
+
+	w = doRequest(t, r, "/v1/moderations", map[string]any{"model": "missing", "input": "I want to hug a puppy"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "model_not_found", *resp.Error.Code)
+}
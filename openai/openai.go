@@ -0,0 +1,2487 @@
+// openai package provides middleware for partial compatibility with the OpenAI REST API
+package openai
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"path"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/version"
+)
+
+type Error struct {
+	Message string      `json:"message"`
+	Type    string      `json:"type"`
+	Param   interface{} `json:"param"`
+	Code    *string     `json:"code"`
+}
+
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+
+	// Parts are set in place of Content when the content of a request
+	// message is an array of text and image parts
+	Parts []ContentPart `json:"-"`
+
+	// ToolCalls are the tools an assistant message calls, and ToolCallId
+	// is the call a tool message is the result of
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallId string     `json:"tool_call_id,omitempty"`
+
+	// FunctionCall is the legacy equivalent of ToolCalls, the function an
+	// assistant message calls
+	FunctionCall *ToolCallFunction `json:"function_call,omitempty"`
+
+	// Name is the function a function message is the result of, and for
+	// other messages the participant who wrote it
+	Name string `json:"name,omitempty"`
+
+	// ReasoningContent is a non-standard field with the reasoning a model
+	// produced before its answer, when it is separated from the content
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+}
+
+// roles are the message roles accepted in a chat completion request
+var roles = []string{"system", "user", "assistant", "tool", "function", "developer"}
+
+type Choice struct {
+	Index        int             `json:"index"`
+	Message      Message         `json:"message"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs"`
+	FinishReason *string         `json:"finish_reason"`
+
+	// StopReasonSequence is the stop sequence that ended generation. It's
+	// omitted when generation ended for any other reason.
+	StopReasonSequence *string `json:"stop_reason_sequence,omitempty"`
+}
+
+type ChunkChoice struct {
+	Index              int             `json:"index"`
+	Delta              Message         `json:"delta"`
+	Logprobs           *ChoiceLogprobs `json:"logprobs"`
+	FinishReason       *string         `json:"finish_reason"`
+	StopReasonSequence *string         `json:"stop_reason_sequence,omitempty"`
+}
+
+// ChoiceLogprobs are the log probabilities of the tokens of a choice, or of
+// the tokens in one chunk of a streamed choice
+type ChoiceLogprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+type TokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+
+	// Bytes are the UTF-8 bytes of the token
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+
+	// token details are omitted when there's nothing to report
+	PromptTokensDetails     *PromptTokensDetails     `json:"prompt_tokens_details,omitempty"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+
+	// Timings is a non-standard extension with the durations reported by
+	// the backend
+	Timings *Timings `json:"timings,omitempty"`
+}
+
+// Timings are the durations, in nanoseconds, spent generating a response
+type Timings struct {
+	TotalDuration      time.Duration `json:"total_duration"`
+	LoadDuration       time.Duration `json:"load_duration"`
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
+	EvalDuration       time.Duration `json:"eval_duration"`
+}
+
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JsonSchema *JsonSchema `json:"json_schema,omitempty"`
+}
+
+// JsonSchema is the schema of a json_schema response format. Responses are
+// always constrained to the schema, so Strict is accepted but has no effect.
+type JsonSchema struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type Request struct {
+	Model            string          `json:"model"`
+	Messages         []Message       `json:"messages"`
+	Stream           bool            `json:"stream"`
+	StreamOptions    *StreamOptions  `json:"stream_options"`
+	MaxTokens        *int            `json:"max_tokens"`
+	N                *int            `json:"n"`
+	Seed             *int            `json:"seed"`
+	Stop             any             `json:"stop"`
+	Temperature      *float64        `json:"temperature"`
+	FrequencyPenalty *float64        `json:"frequency_penalty"`
+	PresencePenalty  *float64        `json:"presence_penalty"`
+	TopP             *float64        `json:"top_p"`
+	ResponseFormat   *ResponseFormat `json:"response_format"`
+	ServiceTier      *string         `json:"service_tier"`
+	Tools            []Tool          `json:"tools"`
+
+	// ToolChoice is "none", "auto", "required" or an object naming the
+	// function to call
+	ToolChoice any `json:"tool_choice"`
+
+	// Logprobs reports the log probability of each token of the response,
+	// with the TopLogprobs most likely tokens at each position
+	Logprobs    *bool `json:"logprobs"`
+	TopLogprobs *int  `json:"top_logprobs"`
+
+	// ParallelToolCalls allows more than one tool call per response, and is
+	// true unless set
+	ParallelToolCalls *bool `json:"parallel_tool_calls"`
+
+	// ReasoningEffort is one of reasoningEfforts
+	ReasoningEffort *string `json:"reasoning_effort"`
+
+	// Functions and FunctionCall are the legacy equivalents of Tools and
+	// ToolChoice, still sent by older clients
+	Functions    []ToolFunction `json:"functions"`
+	FunctionCall any            `json:"function_call"`
+
+	// LogitBias maps token ids to a bias between -100 and 100. As an
+	// extension, keys may also be token strings which are resolved to ids
+	// with the model's tokenizer.
+	LogitBias map[string]float64 `json:"logit_bias"`
+
+	// MaxCompletionTokens replaces MaxTokens in newer clients, and takes
+	// precedence over it when both are set
+	MaxCompletionTokens *int `json:"max_completion_tokens"`
+
+	// NumCtx is a non-standard extension which sets the context window size
+	NumCtx *int `json:"num_ctx"`
+
+	// System is a non-standard top-level system prompt, as in Anthropic's
+	// API, which is sent ahead of the messages
+	System string `json:"system"`
+
+	// Metadata is logged with the request and never affects generation
+	Metadata map[string]any `json:"metadata"`
+
+	// User identifies the end user a request is made for. It's logged with
+	// the request and its usage, and never affects generation.
+	User string `json:"user"`
+
+	// Options are native ollama options with no OpenAI equivalent, e.g.
+	// mirostat or num_ctx. Standard OpenAI parameters take precedence.
+	Options map[string]any `json:"options"`
+}
+
+// UnmarshalJSON decodes a request, accepting sampling parameters sent as
+// numeric strings such as "0.7" since some SDKs serialize them that way
+func (r *Request) UnmarshalJSON(b []byte) error {
+	type request Request
+	var aux struct {
+		*request
+		Messages         []json.RawMessage `json:"messages"`
+		Temperature      json.RawMessage   `json:"temperature"`
+		FrequencyPenalty json.RawMessage   `json:"frequency_penalty"`
+		PresencePenalty  json.RawMessage   `json:"presence_penalty"`
+		TopP             json.RawMessage   `json:"top_p"`
+	}
+
+	aux.request = (*request)(r)
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+
+	// messages decode themselves, so type errors are given the path of the
+	// message they're in
+	r.Messages = nil
+	if aux.Messages != nil {
+		r.Messages = make([]Message, len(aux.Messages))
+	}
+
+	for i, raw := range aux.Messages {
+		if err := json.Unmarshal(raw, &r.Messages[i]); err != nil {
+			var terr *json.UnmarshalTypeError
+			if errors.As(err, &terr) {
+				terr.Field = strings.TrimSuffix(fmt.Sprintf("messages.%d.%s", i, terr.Field), ".")
+			}
+			return err
+		}
+	}
+
+	var err error
+	if r.Temperature, err = number("temperature", aux.Temperature); err != nil {
+		return err
+	}
+
+	if r.FrequencyPenalty, err = number("frequency_penalty", aux.FrequencyPenalty); err != nil {
+		return err
+	}
+
+	if r.PresencePenalty, err = number("presence_penalty", aux.PresencePenalty); err != nil {
+		return err
+	}
+
+	if r.TopP, err = number("top_p", aux.TopP); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validate checks the request for missing fields, values out of range and
+// parameters which conflict with each other
+func (r Request) validate() error {
+	if r.Model == "" {
+		return newParamError("model", "missing_required_parameter", "you must provide a model parameter")
+	}
+
+	if len(r.Messages) == 0 {
+		return newParamError("messages", "empty_array", "[] is too short - 'messages'")
+	}
+
+	if r.StreamOptions != nil && !r.Stream {
+		return newParamError("stream_options", "invalid_value", "The 'stream_options' parameter is only allowed when 'stream' is enabled.")
+	}
+
+	if err := r.validateTools(); err != nil {
+		return err
+	}
+
+	if r.ReasoningEffort != nil && !slices.Contains(reasoningEfforts, *r.ReasoningEffort) {
+		return newParamError("reasoning_effort", "invalid_value", "Invalid value: '%s'. Supported values are: 'none', 'minimal', 'low', 'medium', and 'high'. - 'reasoning_effort'", *r.ReasoningEffort)
+	}
+
+	if r.N != nil && (*r.N < 1 || *r.N > maxChoices) {
+		code := "integer_below_min_value"
+		if *r.N > maxChoices {
+			code = "integer_above_max_value"
+		}
+		return newParamError("n", code, "Invalid 'n': expected a value between 1 and %d, but got %d instead.", maxChoices, *r.N)
+	}
+
+	if r.TopLogprobs != nil {
+		switch {
+		case r.Logprobs == nil || !*r.Logprobs:
+			return newParamError("top_logprobs", "invalid_value", "Invalid value for 'top_logprobs': 'logprobs' must be set to true when 'top_logprobs' is set.")
+		case *r.TopLogprobs < 0:
+			return newParamError("top_logprobs", "integer_below_min_value", "Invalid 'top_logprobs': integer below minimum value. Expected a value >= 0, but got %d instead.", *r.TopLogprobs)
+		case *r.TopLogprobs > 20:
+			return newParamError("top_logprobs", "integer_above_max_value", "Invalid 'top_logprobs': integer above maximum value. Expected a value <= 20, but got %d instead.", *r.TopLogprobs)
+		}
+	}
+
+	ranges := []bound{
+		{"temperature", r.Temperature, 0, 2},
+		{"top_p", r.TopP, 0, 1},
+		{"frequency_penalty", r.FrequencyPenalty, -2, 2},
+		{"presence_penalty", r.PresencePenalty, -2, 2},
+	}
+
+	for k, v := range r.LogitBias {
+		bias := v
+		ranges = append(ranges, bound{"logit_bias." + k, &bias, -100, 100})
+	}
+
+	return checkBounds(ranges)
+}
+
+// bound is the range a numeric request parameter must be within
+type bound struct {
+	name     string
+	value    *float64
+	min, max float64
+}
+
+// checkBounds returns an error for the first set parameter out of its range
+func checkBounds(ranges []bound) error {
+	for _, p := range ranges {
+		switch {
+		case p.value == nil:
+		case *p.value < p.min:
+			return newParamError(p.name, "decimal_below_min_value", "%v is less than the minimum of %v - '%s'", *p.value, p.min, p.name)
+		case *p.value > p.max:
+			return newParamError(p.name, "decimal_above_max_value", "%v is greater than the maximum of %v - '%s'", *p.value, p.max, p.name)
+		}
+	}
+
+	return nil
+}
+
+// number decodes a JSON number or a string containing one
+func number(name string, raw json.RawMessage) (*float64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var f float64
+	if err := json.Unmarshal(raw, &f); err == nil {
+		return &f, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return &f, nil
+		}
+	}
+
+	return nil, newParamError(name, "invalid_type", "Invalid type for '%s': expected a number, but got %s instead.", name, describeJSON(raw))
+}
+
+type Completion struct {
+	Id                string   `json:"id"`
+	Object            string   `json:"object"`
+	Created           int64    `json:"created"`
+	Model             string   `json:"model"`
+	SystemFingerprint string   `json:"system_fingerprint"`
+	Choices           []Choice `json:"choices"`
+	Usage             Usage    `json:"usage,omitempty"`
+	ServiceTier       *string  `json:"service_tier,omitempty"`
+}
+
+type Chunk struct {
+	Id                string        `json:"id"`
+	Object            string        `json:"object"`
+	Created           int64         `json:"created"`
+	Model             string        `json:"model"`
+	SystemFingerprint string        `json:"system_fingerprint"`
+	Choices           []ChunkChoice `json:"choices"`
+	Usage             *Usage        `json:"usage,omitempty"`
+	ServiceTier       *string       `json:"service_tier,omitempty"`
+}
+
+type Model struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type ModelDeleted struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+type ListCompletion struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+// ModelInfo describes the limits of a model
+type ModelInfo struct {
+	// ContextLength is the size of the model's default context window in tokens
+	ContextLength int
+
+	// MaxContextLength is the longest context the model supports, or 0 if
+	// it isn't known
+	MaxContextLength int
+
+	// Capabilities are what the model can be used for, e.g. "chat" or
+	// "embedding"
+	Capabilities []string
+
+	// Reasoning is set for models which write their reasoning in a <think>
+	// block before answering
+	Reasoning bool
+
+	// Infill is the model's fill-in-the-middle prompt format, with the text
+	// before the insertion as %[1]s and the text after it as %[2]s, or ""
+	// if the model can't infill
+	Infill string
+}
+
+// capabilities are the values accepted by the capability filter on
+// /v1/models
+var capabilities = []string{"chat", "embedding"}
+
+// A Backend looks up details about models so requests can be checked before
+// they are handed to the native API
+type Backend interface {
+	ModelInfo(ctx context.Context, model string) (ModelInfo, error)
+
+	// Tokenize encodes content with the model's tokenizer. options are the
+	// native options of the request the tokens are for, so a model which
+	// has to be loaded is loaded as the request will need it.
+	Tokenize(ctx context.Context, model string, options map[string]any, content string) ([]int, error)
+}
+
+type options struct {
+	backend          Backend
+	timeout          time.Duration
+	defaultMaxTokens bool
+	aliases          map[string]string
+	imageHosts       []string
+	heartbeat        time.Duration
+	streams          *streams
+	mergeSystem      bool
+	alternateRoles   bool
+	instructJSON     bool
+	trim             bool
+	reasoning        Reasoning
+}
+
+// An Option configures Middleware
+type Option func(*options)
+
+// WithTimeout limits how long a response may generate for. Once the timeout
+// passes, generation is cancelled and the response ends with a finish_reason
+// of "length". Zero means no limit.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithDefaultMaxTokens caps requests without max_tokens to the context left
+// after their messages, instead of generating until the model stops. It has
+// no effect without WithBackend.
+func WithDefaultMaxTokens() Option {
+	return func(o *options) {
+		o.defaultMaxTokens = true
+	}
+}
+
+// WithAliases routes requests for each alias, e.g. "gpt-4o", to the local
+// model it maps to. Aliases of models which exist are also listed on
+// /v1/models. Other model names are passed through unchanged.
+func WithAliases(aliases map[string]string) Option {
+	return func(o *options) {
+		o.aliases = aliases
+	}
+}
+
+// WithHeartbeat sends an SSE comment every d while a stream waits for its
+// first token, so clients and proxies with idle timeouts don't give up on
+// prompts which take a long time to evaluate. Zero disables heartbeats.
+func WithHeartbeat(d time.Duration) Option {
+	return func(o *options) {
+		o.heartbeat = d
+	}
+}
+
+// WithMergeSystemMessages joins adjacent system and developer messages with
+// newlines, for model templates which only render the first of them
+func WithMergeSystemMessages() Option {
+	return func(o *options) {
+		o.mergeSystem = true
+	}
+}
+
+// WithAlternateRoles inserts an empty turn of the other role between adjacent
+// user or assistant messages, for model templates which expect the two to
+// alternate
+func WithAlternateRoles() Option {
+	return func(o *options) {
+		o.alternateRoles = true
+	}
+}
+
+// WithJSONInstruction also instructs the model to respond with JSON in JSON
+// mode, unless a system message already mentions JSON, for models which
+// wander into prose despite the grammar
+func WithJSONInstruction() Option {
+	return func(o *options) {
+		o.instructJSON = true
+	}
+}
+
+// WithTrimResponse removes leading and trailing whitespace from response
+// content. Streamed responses are only trimmed at the start and end of the
+// stream.
+func WithTrimResponse() Option {
+	return func(o *options) {
+		o.trim = true
+	}
+}
+
+// Reasoning is what is done with the <think> blocks some models write their
+// reasoning in before the answer
+type Reasoning string
+
+const (
+	// ReasoningSeparate moves <think> blocks from the content to
+	// reasoning_content
+	ReasoningSeparate Reasoning = "separate"
+
+	// ReasoningStrip removes <think> blocks from the content
+	ReasoningStrip Reasoning = "strip"
+)
+
+// Valid reports whether r is one of ReasoningSeparate or ReasoningStrip
+func (r Reasoning) Valid() bool {
+	return r == ReasoningSeparate || r == ReasoningStrip
+}
+
+// WithReasoning separates or strips the <think> blocks of responses. An
+// invalid r leaves them in the content.
+func WithReasoning(r Reasoning) Option {
+	return func(o *options) {
+		o.reasoning = r
+	}
+}
+
+// WithBackend enables checks which need details about the requested model,
+// such as validating max_tokens against its context window
+func WithBackend(b Backend) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
+
+// paramError is an error caused by the value of a single request parameter
+type paramError struct {
+	param   string
+	code    string
+	message string
+}
+
+func newParamError(param, code, format string, args ...any) error {
+	return &paramError{param: param, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *paramError) Error() string {
+	return e.message
+}
+
+// describeType describes the JSON type expected for a Go type
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Pointer:
+		return describeType(t.Elem())
+	default:
+		return "a valid value"
+	}
+}
+
+// describeValue describes a JSON value as reported by json.UnmarshalTypeError
+func describeValue(v string) string {
+	switch {
+	case v == "string":
+		return "a string"
+	case v == "bool":
+		return "a boolean"
+	case v == "array":
+		return "an array"
+	case v == "object":
+		return "an object"
+	case strings.HasPrefix(v, "number "):
+		// numbers which don't fit the expected type include their value
+		if strings.ContainsAny(strings.TrimPrefix(v, "number "), ".eE") {
+			return "a decimal"
+		}
+		return "a number"
+	case v == "number":
+		return "a number"
+	default:
+		return v
+	}
+}
+
+// describeJSON describes the type of a raw JSON value
+func describeJSON(raw json.RawMessage) string {
+	switch raw[0] {
+	case '"':
+		return "a string"
+	case 't', 'f':
+		return "a boolean"
+	case '[':
+		return "an array"
+	case '{':
+		return "an object"
+	default:
+		return "a number"
+	}
+}
+
+// requestError converts an error decoding or validating a request into an
+// error response which names the parameter at fault rather than Go types
+func requestError(err error) ErrorResponse {
+	var perr *paramError
+	var terr *json.UnmarshalTypeError
+	var serr *json.SyntaxError
+	switch {
+	case errors.As(err, &perr):
+		return NewErrorWithCode(http.StatusBadRequest, perr.message, perr.code, perr.param)
+	case errors.As(err, &terr) && terr.Field != "":
+		return NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("Invalid type for '%s': expected %s, but got %s instead.", terr.Field, describeType(terr.Type), describeValue(terr.Value)), "invalid_type", terr.Field)
+	case errors.As(err, &terr):
+		return NewError(http.StatusBadRequest, fmt.Sprintf("Invalid request body: expected %s, but got %s instead.", describeType(terr.Type), describeValue(terr.Value)))
+	case errors.As(err, &serr), errors.Is(err, io.ErrUnexpectedEOF):
+		return NewError(http.StatusBadRequest, "We could not parse the JSON body of your request. The OpenAI API expects a JSON payload, but what was sent was not valid JSON.")
+	case errors.Is(err, io.EOF):
+		return NewError(http.StatusBadRequest, "missing request body")
+	default:
+		return NewError(http.StatusBadRequest, err.Error())
+	}
+}
+
+// NewError returns an error response with the type OpenAI gives errors of
+// the status code
+func NewError(code int, message string) ErrorResponse {
+	var etype string
+	switch {
+	case code == http.StatusNotFound:
+		etype = "not_found_error"
+	case code == http.StatusTooManyRequests:
+		etype = "requests"
+	case code >= http.StatusInternalServerError:
+		etype = "server_error"
+	case code >= http.StatusBadRequest:
+		etype = "invalid_request_error"
+	default:
+		etype = "api_error"
+	}
+
+	return ErrorResponse{Error{Type: etype, Message: message}}
+}
+
+// NewErrorWithCode is NewError with a machine readable error code, such as
+// context_length_exceeded, and the request parameter which caused the error.
+// Empty values are left unset. An insufficient_quota error is also of that
+// type, as with OpenAI.
+func NewErrorWithCode(code int, message, errCode, param string) ErrorResponse {
+	resp := NewError(code, message)
+	if errCode != "" {
+		resp.Error.Code = &errCode
+	}
+
+	if errCode == "insufficient_quota" {
+		resp.Error.Type = errCode
+	}
+
+	if param != "" {
+		resp.Error.Param = param
+	}
+
+	return resp
+}
+
+// nativeError translates an error response of the native API. Its handlers
+// only respond not found for missing models, and too many requests when
+// they're overloaded.
+func nativeError(code int, message string) ErrorResponse {
+	switch code {
+	case http.StatusNotFound:
+		return NewErrorWithCode(code, message, "model_not_found", "model")
+	case http.StatusTooManyRequests:
+		return NewErrorWithCode(code, message, "rate_limit_exceeded", "")
+	default:
+		return NewError(code, message)
+	}
+}
+
+// SystemFingerprint identifies the backend configuration that produced a
+// response. It changes whenever the model digest, which covers its weights
+// and quantization, the options the runner loads it with, or the ollama
+// version do.
+func SystemFingerprint(digest string, runner api.Runner) string {
+	if digest == "" {
+		return "fp_ollama"
+	}
+
+	h := sha256.New()
+	h.Write([]byte(digest + version.Version))
+	if err := json.NewEncoder(h).Encode(runner); err != nil {
+		return "fp_ollama"
+	}
+
+	return fmt.Sprintf("fp_%x", h.Sum(nil)[:5])
+}
+
+// idAlphabet are the characters of the random part of ids
+const idAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// newId returns prefix followed by 29 random characters, the length of
+// OpenAI's ids, so ids of concurrent requests don't collide
+func newId(prefix string) string {
+	id := make([]byte, 0, 29)
+	buf := make([]byte, 2*cap(id))
+	for len(id) < cap(id) {
+		// crypto/rand only fails without a source of randomness, which
+		// leaves the buffer as it was and the id merely predictable
+		_, _ = rand.Read(buf)
+		for _, b := range buf {
+			// bytes past the last whole multiple of the alphabet would
+			// favor its first characters
+			if len(id) < cap(id) && int(b) < 256-256%len(idAlphabet) {
+				id = append(id, idAlphabet[int(b)%len(idAlphabet)])
+			}
+		}
+	}
+
+	return prefix + string(id)
+}
+
+// handlerFingerprint returns the system fingerprint of the model resolved by
+// the chat or generate handler, which sets the model's digest and runner
+// options on the context
+func handlerFingerprint(c *gin.Context) string {
+	runner, _ := c.Value("runner").(api.Runner)
+	return SystemFingerprint(c.GetString("digest"), runner)
+}
+
+func finishReason(done bool) *string {
+	if done {
+		reason := "stop"
+		return &reason
+	}
+	return nil
+}
+
+func toolCallsReason() *string {
+	reason := "tool_calls"
+	return &reason
+}
+
+func functionCallReason() *string {
+	reason := "function_call"
+	return &reason
+}
+
+func lengthReason() *string {
+	reason := "length"
+	return &reason
+}
+
+func stopReasonSequence(r api.ChatResponse) *string {
+	if r.Done && r.StopSequence != "" {
+		return &r.StopSequence
+	}
+	return nil
+}
+
+// ToCompletion converts a native chat response into a chat completion from
+// the backend configuration fingerprint, as returned by SystemFingerprint
+func ToCompletion(id, fingerprint string, r api.ChatResponse) Completion {
+	return Completion{
+		Id:                id,
+		Object:            "chat.completion",
+		Created:           r.CreatedAt.Unix(),
+		Model:             r.Model,
+		SystemFingerprint: fingerprint,
+		Choices: []Choice{{
+			Index:        0,
+			Message:      Message{Role: r.Message.Role, Content: r.Message.Content},
+			FinishReason: finishReason(r.Done),
+
+			StopReasonSequence: stopReasonSequence(r),
+		}},
+		Usage: toUsage(r.Metrics),
+	}
+}
+
+// toLogprobs converts native log probabilities into those of a choice
+func toLogprobs(logprobs []api.Logprob) *ChoiceLogprobs {
+	bytes := func(token string) []int {
+		b := make([]int, len(token))
+		for i := 0; i < len(token); i++ {
+			b[i] = int(token[i])
+		}
+		return b
+	}
+
+	content := make([]TokenLogprob, len(logprobs))
+	for i, l := range logprobs {
+		content[i] = TokenLogprob{
+			Token:       l.Token,
+			Logprob:     l.Logprob,
+			Bytes:       bytes(l.Token),
+			TopLogprobs: make([]TopLogprob, len(l.TopLogprobs)),
+		}
+
+		for j, top := range l.TopLogprobs {
+			content[i].TopLogprobs[j] = TopLogprob{Token: top.Token, Logprob: top.Logprob, Bytes: bytes(top.Token)}
+		}
+	}
+
+	return &ChoiceLogprobs{Content: content}
+}
+
+// toUsage converts the metrics of a native response into usage. Ollama only
+// counts the prompt tokens it evaluated, while OpenAI counts the whole prompt,
+// so tokens reused from the cache are added back.
+func toUsage(r api.Metrics) Usage {
+	usage := Usage{
+		PromptTokens:     r.PromptEvalCount + r.PromptCachedCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.PromptCachedCount + r.EvalCount,
+	}
+
+	if r.PromptCachedCount > 0 {
+		usage.PromptTokensDetails = &PromptTokensDetails{CachedTokens: r.PromptCachedCount}
+	}
+
+	if r.TotalDuration > 0 {
+		usage.Timings = &Timings{
+			TotalDuration:      r.TotalDuration,
+			LoadDuration:       r.LoadDuration,
+			PromptEvalDuration: r.PromptEvalDuration,
+			EvalDuration:       r.EvalDuration,
+		}
+	}
+
+	return usage
+}
+
+// ToChunk converts a native chat response into a streamed chat completion
+// chunk from the backend configuration fingerprint
+func ToChunk(id, fingerprint string, r api.ChatResponse) Chunk {
+	return Chunk{
+		Id:                id,
+		Object:            "chat.completion.chunk",
+		Created:           r.CreatedAt.Unix(),
+		Model:             r.Model,
+		SystemFingerprint: fingerprint,
+		Choices: []ChunkChoice{{
+			Index:        0,
+			Delta:        Message{Role: "assistant", Content: r.Message.Content},
+			FinishReason: finishReason(r.Done),
+
+			StopReasonSequence: stopReasonSequence(r),
+		}},
+	}
+}
+
+// ownedBy returns the namespace of a model name, e.g. "library" for
+// "llama2:latest" and "example" for "registry.example.com/example/model"
+func ownedBy(name string) string {
+	if _, after, found := strings.Cut(name, "://"); found {
+		name = after
+	}
+
+	parts := strings.Split(name, "/")
+	switch len(parts) {
+	case 3:
+		return parts[1]
+	case 2:
+		return parts[0]
+	default:
+		return "library"
+	}
+}
+
+func toModel(r api.ModelResponse) Model {
+	return Model{
+		Id:      r.Name,
+		Object:  "model",
+		Created: r.ModifiedAt.Unix(),
+		OwnedBy: ownedBy(r.Name),
+	}
+}
+
+func toListCompletion(r api.ListResponse) ListCompletion {
+	data := make([]Model, 0, len(r.Models))
+	for _, m := range r.Models {
+		data = append(data, toModel(m))
+	}
+
+	return ListCompletion{
+		Object: "list",
+		Data:   data,
+	}
+}
+
+// mergeSystemMessages joins runs of adjacent system messages into one since
+// some model templates only render the first system message of a run
+func mergeSystemMessages(msgs []api.Message) []api.Message {
+	var merged []api.Message
+	for _, msg := range msgs {
+		if n := len(merged); n > 0 && msg.Role == "system" && merged[n-1].Role == "system" {
+			merged[n-1].Content += "\n" + msg.Content
+			continue
+		}
+
+		merged = append(merged, msg)
+	}
+
+	return merged
+}
+
+// alternateRoles inserts an empty turn of the opposite role between adjacent
+// user or assistant messages, for model templates which expect the two roles
+// to alternate
+func alternateRoles(msgs []api.Message) []api.Message {
+	var alternated []api.Message
+	for _, msg := range msgs {
+		if n := len(alternated); n > 0 && alternated[n-1].Role == msg.Role {
+			switch msg.Role {
+			case "user":
+				alternated = append(alternated, api.Message{Role: "assistant"})
+			case "assistant":
+				alternated = append(alternated, api.Message{Role: "user"})
+			}
+		}
+
+		alternated = append(alternated, msg)
+	}
+
+	return alternated
+}
+
+// jsonInstruction is the system instruction added to JSON mode requests
+// with WithJSONInstruction
+const jsonInstruction = "Respond only with valid JSON."
+
+// instructJSON tells the model to respond in JSON, for models which wander
+// into prose despite the JSON grammar, unless a system message already
+// mentions JSON.
+func instructJSON(msgs []api.Message) []api.Message {
+	for _, msg := range msgs {
+		if msg.Role == "system" && strings.Contains(strings.ToLower(msg.Content), "json") {
+			return msgs
+		}
+	}
+
+	return addInstruction(msgs, jsonInstruction)
+}
+
+// addInstruction adds a system instruction to the leading system message, or
+// as a new system message when there isn't one
+func addInstruction(msgs []api.Message, instruction string) []api.Message {
+	if len(msgs) > 0 && msgs[0].Role == "system" {
+		instructed := slices.Clone(msgs)
+		instructed[0].Content += "\n\n" + instruction
+		return instructed
+	}
+
+	return append([]api.Message{{Role: "system", Content: instruction}}, msgs...)
+}
+
+// validate checks the json_schema of a json_schema response format
+func (s *JsonSchema) validate() error {
+	if s == nil {
+		return newParamError("response_format.json_schema", "missing_required_parameter", "Missing required parameter: 'response_format.json_schema'.")
+	}
+
+	if s.Name == "" {
+		return newParamError("response_format.json_schema.name", "missing_required_parameter", "Missing required parameter: 'response_format.json_schema.name'.")
+	}
+
+	if !toolNamePattern.MatchString(s.Name) {
+		return newParamError("response_format.json_schema.name", "invalid_value", "Invalid 'response_format.json_schema.name': string does not match pattern. Expected a string that matches the pattern '^[a-zA-Z0-9_-]{1,64}$'.")
+	}
+
+	if len(s.Schema) > 0 && string(s.Schema) != "null" && describeJSON(s.Schema) != "an object" {
+		return newParamError("response_format.json_schema.schema", "invalid_type", "Invalid type for 'response_format.json_schema.schema': expected an object, but got %s instead.", describeJSON(s.Schema))
+	}
+
+	return nil
+}
+
+// nativeOptions converts the sampling parameters of a request into native
+// options, on top of any native options the request sets itself
+func (r Request) nativeOptions() (map[string]any, error) {
+	options := make(map[string]interface{})
+	for k, v := range r.Options {
+		options[k] = v
+	}
+
+	switch stop := r.Stop.(type) {
+	case string:
+		options["stop"] = []string{stop}
+	case []interface{}:
+		var stops []string
+		for i, s := range stop {
+			str, ok := s.(string)
+			if !ok {
+				return nil, newParamError(fmt.Sprintf("stop.%d", i), "invalid_type", "%v is not of type 'string' - 'stop.%d'", s, i)
+			}
+			stops = append(stops, str)
+		}
+		options["stop"] = stops
+	}
+
+	switch {
+	case r.MaxCompletionTokens != nil:
+		options["num_predict"] = *r.MaxCompletionTokens
+	case r.MaxTokens != nil:
+		options["num_predict"] = *r.MaxTokens
+	}
+
+	if r.NumCtx != nil {
+		options["num_ctx"] = *r.NumCtx
+	}
+
+	if len(r.LogitBias) > 0 {
+		logitBias := make(map[string]any, len(r.LogitBias))
+		for k, v := range r.LogitBias {
+			logitBias[k] = v
+		}
+		options["logit_bias"] = logitBias
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature * 2.0
+	} else if _, ok := options["temperature"]; !ok {
+		options["temperature"] = 1.0
+		if r.Seed != nil {
+			// a seed on its own asks for deterministic outputs
+			options["temperature"] = 0.0
+		}
+	}
+
+	if r.Seed != nil {
+		options["seed"] = *r.Seed
+	}
+
+	if r.FrequencyPenalty != nil {
+		options["frequency_penalty"] = *r.FrequencyPenalty * 2.0
+	}
+
+	if r.PresencePenalty != nil {
+		options["presence_penalty"] = *r.PresencePenalty * 2.0
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	} else if _, ok := options["top_p"]; !ok {
+		options["top_p"] = 1.0
+	}
+
+	return options, nil
+}
+
+// FromRequest converts a chat completion request into a native chat request.
+// An error is returned if the request can't be translated. Of opts, only
+// those which change how messages are translated, such as
+// WithMergeSystemMessages, have an effect.
+func FromRequest(r Request, opts ...Option) (api.ChatRequest, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return fromRequest(r, o)
+}
+
+func fromRequest(r Request, o options) (api.ChatRequest, error) {
+	r, err := r.fromFunctions()
+	if err != nil {
+		return api.ChatRequest{}, err
+	}
+
+	var messages []api.Message
+
+	// toolNames maps the ids of tool calls to the tool called
+	toolNames := make(map[string]string)
+	if r.System != "" {
+		messages = append(messages, api.Message{Role: "system", Content: r.System})
+	}
+
+	for i, msg := range r.Messages {
+		if !slices.Contains(roles, msg.Role) {
+			return api.ChatRequest{}, newParamError(fmt.Sprintf("messages.%d.role", i), "invalid_value", "Invalid value: '%s'. Supported values are: 'system', 'user', 'assistant', 'tool', 'function', and 'developer'. - 'messages.%d.role'", msg.Role, i)
+		}
+
+		content, images, err := msg.content(i)
+		if err != nil {
+			return api.ChatRequest{}, err
+		}
+
+		// an empty turn renders as a blank prompt which derails generation
+		if msg.Role != "assistant" && content == "" && len(images) == 0 {
+			return api.ChatRequest{}, newParamError(fmt.Sprintf("messages[%d].content", i), "string_below_min_length", "Invalid 'messages[%d].content': string too short. Expected a string with minimum length 1, but got an empty string instead.", i)
+		}
+
+		role := msg.Role
+		if role == "developer" {
+			// newer models use developer in place of system
+			role = "system"
+		}
+
+		if role == "system" && r.System != "" {
+			return api.ChatRequest{}, newParamError("system", "invalid_value", "Invalid 'system': a top-level system prompt can't be combined with a '%s' message in 'messages'. - 'messages.%d.role'", msg.Role, i)
+		}
+
+		if msg.Name != "" && content != "" && role != "function" && role != "tool" {
+			// model templates have no place for names, so the content is
+			// attributed to its participant instead
+			content = msg.Name + ": " + content
+		}
+
+		switch {
+		case role == "assistant" && len(msg.ToolCalls) > 0:
+			// replay earlier calls in the form the model writes them
+			for _, call := range msg.ToolCalls {
+				toolNames[call.Id] = call.Function.Name
+			}
+
+			content = strings.TrimSpace(content + "\n\n" + formatToolCalls(msg.ToolCalls))
+		case role == "assistant" && msg.FunctionCall != nil:
+			content = strings.TrimSpace(content + "\n\n" + formatToolCalls([]ToolCall{{Function: *msg.FunctionCall}}))
+		case role == "function":
+			role = "user"
+			content = fmt.Sprintf("Result of calling the %s tool:\n%s", msg.Name, content)
+		case role == "tool":
+			// model templates have no tool turns, so results are reported
+			// back as the user
+			role = "user"
+			tool := "a tool"
+			if name, ok := toolNames[msg.ToolCallId]; ok {
+				tool = "the " + name + " tool"
+			} else if msg.Name != "" {
+				tool = "the " + msg.Name + " tool"
+			}
+
+			content = fmt.Sprintf("Result of calling %s:\n%s", tool, content)
+		}
+
+		messages = append(messages, api.Message{Role: role, Content: content, Images: images})
+	}
+
+	if o.mergeSystem {
+		messages = mergeSystemMessages(messages)
+	}
+
+	if o.alternateRoles {
+		messages = alternateRoles(messages)
+	}
+
+	options, err := r.nativeOptions()
+	if err != nil {
+		return api.ChatRequest{}, err
+	}
+
+	var format string
+	var schema json.RawMessage
+	if r.ResponseFormat != nil {
+		switch r.ResponseFormat.Type {
+		case "text":
+		case "json_object":
+			format = "json"
+		case "json_schema":
+			if err := r.ResponseFormat.JsonSchema.validate(); err != nil {
+				return api.ChatRequest{}, err
+			}
+			format, schema = "json", r.ResponseFormat.JsonSchema.Schema
+		default:
+			return api.ChatRequest{}, newParamError("response_format.type", "invalid_value", "Invalid value: '%s'. Supported values are: 'text', 'json_object', and 'json_schema'. - 'response_format.type'", r.ResponseFormat.Type)
+		}
+	}
+
+	if o.instructJSON && format == "json" {
+		messages = instructJSON(messages)
+	}
+
+	if len(r.Tools) > 0 {
+		choice, err := r.toolChoice()
+		if err != nil {
+			return api.ChatRequest{}, err
+		}
+
+		if choice.mode != "none" {
+			messages = addInstruction(messages, toolInstruction(r.Tools, choice, r.parallelToolCalls()))
+		}
+
+		// constrain the response to JSON when a call is required
+		if choice.mode == "required" {
+			format, schema = "json", nil
+		}
+	}
+
+	chatReq := api.ChatRequest{
+		Model:    r.Model,
+		Messages: messages,
+		Format:   format,
+		Schema:   schema,
+		Options:  options,
+		Stream:   &r.Stream,
+	}
+
+	if r.Logprobs != nil && *r.Logprobs {
+		chatReq.Logprobs = true
+		if r.TopLogprobs != nil {
+			chatReq.TopLogprobs = *r.TopLogprobs
+		}
+	}
+
+	return chatReq, nil
+}
+
+// trimmer strips leading and trailing whitespace from content that arrives in
+// pieces. Trailing whitespace is held back until more content follows it so
+// spacing in the middle of a stream is preserved.
+type trimmer struct {
+	started bool
+	pending string
+}
+
+func (t *trimmer) next(content string, done bool) string {
+	if !t.started {
+		content = strings.TrimLeftFunc(content, unicode.IsSpace)
+		if content == "" {
+			return ""
+		}
+		t.started = true
+	}
+
+	content = t.pending + content
+	trimmed := strings.TrimRightFunc(content, unicode.IsSpace)
+	t.pending = content[len(trimmed):]
+	if done {
+		t.pending = ""
+	}
+
+	return trimmed
+}
+
+// reasoner separates <think> blocks from content that arrives in pieces.
+// Text which may be the start of a tag is held back until the next piece
+// shows whether it is one, so tags split across chunks are still found.
+type reasoner struct {
+	thinking bool
+	pending  string
+
+	// leading whitespace is dropped after each tag
+	trimLeft bool
+}
+
+func (r *reasoner) next(s string, done bool) (content, reasoning string) {
+	var cb, rb strings.Builder
+	emit := func(s string) {
+		if r.trimLeft {
+			s = strings.TrimLeftFunc(s, unicode.IsSpace)
+			r.trimLeft = s == ""
+		}
+
+		if r.thinking {
+			rb.WriteString(s)
+		} else {
+			cb.WriteString(s)
+		}
+	}
+
+	r.pending += s
+	for {
+		tag := "<think>"
+		if r.thinking {
+			tag = "</think>"
+		}
+
+		if i := strings.Index(r.pending, tag); i >= 0 {
+			emit(r.pending[:i])
+			r.pending = r.pending[i+len(tag):]
+			r.trimLeft = true
+			r.thinking = !r.thinking
+			continue
+		}
+
+		// hold back the longest suffix which could begin the tag
+		keep := 0
+		if !done {
+			for n := min(len(tag)-1, len(r.pending)); n > 0; n-- {
+				if strings.HasSuffix(r.pending, tag[:n]) {
+					keep = n
+					break
+				}
+			}
+		}
+
+		emit(r.pending[:len(r.pending)-keep])
+		r.pending = r.pending[len(r.pending)-keep:]
+		return cb.String(), rb.String()
+	}
+}
+
+type writer struct {
+	stream        bool
+	streamOptions *StreamOptions
+	id            string
+
+	// created is captured once per request so every chunk and the final
+	// completion report the same timestamp
+	created time.Time
+
+	// fingerprint returns the system fingerprint of the model serving the request
+	fingerprint func() string
+
+	// serviceTier is echoed back to clients that requested one
+	serviceTier *string
+
+	// user is the end user of the request, whose usage is logged once the
+	// response is done
+	user string
+
+	// charge charges the tokens of the response to the client's rate limit
+	charge func(int)
+
+	// trim removes leading and trailing whitespace from the response content
+	trim    bool
+	trimmer trimmer
+
+	// reasoning is what is done with <think> blocks in the content
+	reasoning Reasoning
+	reasoner  reasoner
+
+	// tools are the tools the model may call, whose calls are parsed out of
+	// the response content
+	tools      []Tool
+	toolBuffer toolBuffer
+
+	// logprobs reports the log probabilities of response tokens
+	logprobs bool
+
+	// functions is set when the request used the legacy functions field, so
+	// the first call is sent as a function_call in place of tool_calls
+	functions bool
+
+	// gzip compresses non-streaming responses for clients that accept it
+	gzip bool
+
+	// abort cancels generation once a write to the client fails
+	abort func()
+	err   error
+
+	// timedOut reports whether generation was cut short by a timeout
+	timedOut func() bool
+	model    string
+	done     bool
+
+	// mu serializes writes while a heartbeat may be running. header holds
+	// the handler's headers until it writes, since a heartbeat may already be
+	// sending the response, code is the status the handler responded with,
+	// and pinged is set once a heartbeat has started the stream.
+	mu      sync.Mutex
+	header  http.Header
+	code    int
+	started bool
+	pinged  bool
+
+	// resumable keeps the events of a stream which may be resumed, and
+	// detached is set once the client reading it has gone away
+	resumable *stream
+	detached  bool
+
+	gin.ResponseWriter
+}
+
+func (w *writer) Header() http.Header {
+	if w.header != nil {
+		return w.header
+	}
+
+	return w.ResponseWriter.Header()
+}
+
+func (w *writer) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.code = code
+	w.copyHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *writer) Status() int {
+	if w.code != 0 {
+		return w.code
+	}
+
+	return w.ResponseWriter.Status()
+}
+
+func (w *writer) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.ResponseWriter.Flush()
+}
+
+// copyHeader copies the headers set by the handler to the response, unless a
+// heartbeat has already sent them
+func (w *writer) copyHeader() {
+	if w.header == nil || w.ResponseWriter.Written() {
+		return
+	}
+
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+}
+
+// heartbeat sends an SSE comment every interval until the handler first
+// writes. A heartbeat which fails to write cancels generation. The returned
+// function stops the heartbeat.
+func (w *writer) heartbeat(interval time.Duration, cancel func()) (stop func()) {
+	w.header = w.ResponseWriter.Header().Clone()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !w.ping(cancel) {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// ping sends a heartbeat, reporting whether more should follow
+func (w *writer) ping(cancel func()) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.started || w.err != nil || w.detached {
+		return false
+	}
+
+	if !w.pinged {
+		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+		w.pinged = true
+	}
+
+	// the handler's chain isn't safe to abort from here, so only generation
+	// is cancelled and the handler's next write fails
+	if _, err := w.ResponseWriter.Write([]byte(": ping\n\n")); err != nil {
+		if w.resumable != nil {
+			w.detached = true
+			w.resumable.detach()
+			return false
+		}
+
+		w.err = err
+		cancel()
+		return false
+	}
+
+	w.ResponseWriter.Flush()
+	return true
+}
+
+// event sends an SSE event to the client. The events of resumable streams are
+// numbered and kept, and the stream carries on if its client goes away so that
+// it can be resumed.
+func (w *writer) event(b []byte) error {
+	if w.resumable == nil {
+		_, err := w.write(b)
+		return err
+	}
+
+	b = w.resumable.add(w.id, b)
+	if w.detached {
+		return nil
+	}
+
+	if _, err := w.ResponseWriter.Write(b); err != nil {
+		w.detached = true
+		w.resumable.detach()
+	}
+
+	return nil
+}
+
+// write forwards b to the client. A failed write means the client has
+// disconnected, so the rest of the request is aborted.
+func (w *writer) write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		w.err = err
+		if w.abort != nil {
+			w.abort()
+		}
+	}
+
+	return n, err
+}
+
+func (w *writer) writeJSON(v any) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	d = append(d, '\n')
+
+	if w.gzip {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		if _, err := gz.Write(d); err != nil {
+			return err
+		}
+
+		if err := gz.Close(); err != nil {
+			return err
+		}
+
+		w.ResponseWriter.Header().Set("Content-Encoding", "gzip")
+		w.ResponseWriter.Header().Set("Vary", "Accept-Encoding")
+		d = b.Bytes()
+	}
+
+	_, err = w.write(d)
+	return err
+}
+
+func (w *writer) writeError(code int, data []byte) (int, error) {
+	var serr api.StatusError
+	err := json.Unmarshal(data, &serr)
+	if err != nil {
+		return 0, err
+	}
+
+	resp := nativeError(code, serr.Error())
+
+	if w.pinged {
+		// a heartbeat has already started the stream, so the error ends it
+		d, err := json.Marshal(resp)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := w.event([]byte(fmt.Sprintf("data: %s\n\n", d))); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = w.writeJSON(resp)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *writer) writeResponse(data []byte) (int, error) {
+	var chatResponse api.ChatResponse
+	err := json.Unmarshal(data, &chatResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	chatResponse.CreatedAt = w.created
+	w.model = chatResponse.Model
+
+	timedOut := w.timedOut != nil && w.timedOut() && !chatResponse.Done
+	if timedOut {
+		chatResponse.Done = true
+	}
+	w.done = chatResponse.Done
+
+	if chatResponse.Done && (w.user != "" || w.charge != nil) {
+		usage := toUsage(chatResponse.Metrics)
+		if w.user != "" {
+			slog.Info("openai usage", "id", w.id, "user", w.user, "model", chatResponse.Model, "prompt_tokens", usage.PromptTokens, "completion_tokens", usage.CompletionTokens)
+		}
+
+		if w.charge != nil {
+			w.charge(usage.TotalTokens)
+		}
+	}
+
+	var reasoningContent string
+	if w.reasoning.Valid() {
+		chatResponse.Message.Content, reasoningContent = w.reasoner.next(chatResponse.Message.Content, chatResponse.Done || !w.stream)
+		if !w.stream {
+			reasoningContent = strings.TrimRightFunc(reasoningContent, unicode.IsSpace)
+		}
+
+		if w.reasoning == ReasoningStrip {
+			reasoningContent = ""
+		}
+	}
+
+	if w.trim {
+		if w.stream {
+			chatResponse.Message.Content = w.trimmer.next(chatResponse.Message.Content, chatResponse.Done)
+		} else {
+			chatResponse.Message.Content = strings.TrimSpace(chatResponse.Message.Content)
+		}
+	}
+
+	var toolCalls []ToolCall
+	if len(w.tools) > 0 {
+		if w.stream {
+			chatResponse.Message.Content, toolCalls = w.toolBuffer.next(chatResponse.Message.Content, chatResponse.Done)
+		} else if toolCalls = parseToolCalls(chatResponse.Message.Content, w.tools); toolCalls != nil {
+			if w.toolBuffer.single {
+				toolCalls = toolCalls[:1]
+			}
+			chatResponse.Message.Content = ""
+		}
+	}
+
+	// chat chunk
+	if w.stream {
+		chunk := ToChunk(w.id, w.fingerprint(), chatResponse)
+		chunk.Choices[0].Delta.ReasoningContent = reasoningContent
+		if w.logprobs && len(chatResponse.Logprobs) > 0 {
+			chunk.Choices[0].Logprobs = toLogprobs(chatResponse.Logprobs)
+		}
+		if w.functions {
+			chunk.Choices[0].Delta.FunctionCall = firstFunctionCall(toolCalls)
+			if chatResponse.Done && w.toolBuffer.calls > 0 {
+				chunk.Choices[0].FinishReason = functionCallReason()
+			}
+		} else {
+			chunk.Choices[0].Delta.ToolCalls = toolCalls
+			if chatResponse.Done && w.toolBuffer.calls > 0 {
+				chunk.Choices[0].FinishReason = toolCallsReason()
+			}
+		}
+		if timedOut {
+			chunk.Choices[0].FinishReason = lengthReason()
+		}
+		chunk.ServiceTier = w.serviceTier
+
+		chunks := []Chunk{chunk}
+		if chatResponse.Done && w.streamOptions != nil && w.streamOptions.IncludeUsage {
+			// usage follows the last choice in a chunk of its own, with no
+			// choices
+			usage := toUsage(chatResponse.Metrics)
+			final := chunk
+			final.Choices = []ChunkChoice{}
+			final.Usage = &usage
+			chunks = append(chunks, final)
+		}
+
+		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			d, err := json.Marshal(chunk)
+			if err != nil {
+				return 0, err
+			}
+
+			err = w.event([]byte(fmt.Sprintf("data: %s\n\n", d)))
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if chatResponse.Done {
+			err = w.event([]byte("data: [DONE]\n\n"))
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return len(data), nil
+	}
+
+	// chat completion
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	completion := ToCompletion(w.id, w.fingerprint(), chatResponse)
+	completion.Choices[0].Message.ReasoningContent = reasoningContent
+	if w.logprobs {
+		completion.Choices[0].Logprobs = toLogprobs(chatResponse.Logprobs)
+	}
+	if toolCalls != nil && w.functions {
+		completion.Choices[0].Message.FunctionCall = firstFunctionCall(toolCalls)
+		completion.Choices[0].FinishReason = functionCallReason()
+	} else if toolCalls != nil {
+		completion.Choices[0].Message.ToolCalls = toolCalls
+		completion.Choices[0].FinishReason = toolCallsReason()
+	}
+	if timedOut {
+		completion.Choices[0].FinishReason = lengthReason()
+	}
+	completion.ServiceTier = w.serviceTier
+	err = w.writeJSON(completion)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *writer) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.started = true
+	w.copyHeader()
+
+	// the client has gone away, drop anything the handler still produces
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	// the response was already finished by a timeout
+	if w.done {
+		return len(data), nil
+	}
+
+	code := w.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	return w.writeResponse(data)
+}
+
+// intOption returns an integer option which may have been decoded from JSON
+func intOption(opts map[string]any, key string) (int, bool) {
+	switch v := opts[key].(type) {
+	case int:
+		return v, true
+	case float64:
+		return int(v), true
+	default:
+		return 0, false
+	}
+}
+
+// reasoningEfforts are the values of reasoning_effort. Local models can't be
+// told how much to reason, only whether to, so "none" and "minimal" skip
+// reasoning and the others leave it as the model does it.
+var reasoningEfforts = []string{"none", "minimal", "low", "medium", "high"}
+
+// skipReasoning is the start of a response whose reasoning is empty, which
+// reasoning models continue by answering straight away. The templates of
+// models such as Qwen3 use it to turn thinking off.
+const skipReasoning = "<think>\n\n</think>\n\n"
+
+// applyReasoningEffort turns off the reasoning of reasoning models for
+// requests with an effort of "none" or "minimal", by prefilling the response
+// with an empty <think> block. A prefill sent with the request is kept.
+func applyReasoningEffort(ctx context.Context, b Backend, r *api.ChatRequest, effort string) {
+	if effort != "none" && effort != "minimal" {
+		return
+	}
+
+	if n := len(r.Messages); n > 0 && r.Messages[n-1].Role == "assistant" {
+		return
+	}
+
+	info, err := b.ModelInfo(ctx, r.Model)
+	if err != nil {
+		// missing models are reported by the chat handler
+		slog.Debug("openai model info", "model", r.Model, "error", err)
+		return
+	}
+
+	if info.Reasoning {
+		r.Messages = append(r.Messages, api.Message{Role: "assistant", Content: skipReasoning})
+	}
+}
+
+// fitContext sizes the context window for a request and verifies the
+// requested completion fits in it. An explicit num_ctx is clamped to the
+// longest context the model supports. Otherwise the context is raised, but
+// never lowered, to the power of two which fits the messages and
+// max_tokens. Requests without max_tokens that still don't fit are left to
+// the chat handler, which truncates the conversation, unless fill is set:
+// then max_tokens defaults to the context remaining after the messages, and
+// messages which leave no room are rejected.
+//
+// The messages are only tokenized when they might not fit, or to fill the
+// context, since tokenizing needs the model to be loaded.
+func fitContext(ctx context.Context, b Backend, r *api.ChatRequest, fill bool) error {
+	info, err := b.ModelInfo(ctx, r.Model)
+	if err != nil {
+		// missing models are reported by the chat handler
+		slog.Debug("openai model info", "model", r.Model, "error", err)
+		return nil
+	}
+
+	contextLength := info.ContextLength
+	numCtx, explicit := intOption(r.Options, "num_ctx")
+	if explicit {
+		if info.MaxContextLength > 0 && numCtx > info.MaxContextLength {
+			numCtx = info.MaxContextLength
+			r.Options["num_ctx"] = numCtx
+		}
+		contextLength = numCtx
+	}
+
+	if contextLength <= 0 {
+		return nil
+	}
+
+	maxTokens, _ := intOption(r.Options, "num_predict")
+	maxTokens = max(maxTokens, 0)
+
+	infer := !explicit && info.MaxContextLength > contextLength
+	fill = fill && maxTokens == 0
+	if maxTokens == 0 && !infer && !fill {
+		return nil
+	}
+
+	limit := contextLength
+	if infer {
+		limit = info.MaxContextLength
+	}
+
+	if maxTokens > limit {
+		return newParamError("max_tokens", "context_length_exceeded", "max_tokens is too large: %d. This model's maximum context length is %d tokens.", maxTokens, limit)
+	}
+
+	var sb strings.Builder
+	for _, msg := range r.Messages {
+		sb.WriteString(msg.Content)
+		sb.WriteString("\n")
+	}
+
+	// tokens are rarely shorter than a byte, so messages which fit counting
+	// a token for each byte fit
+	if !fill && sb.Len()+maxTokens <= contextLength {
+		return nil
+	}
+
+	tokens, err := b.Tokenize(ctx, r.Model, r.Options, sb.String())
+	if err != nil {
+		slog.Debug("openai tokenize", "model", r.Model, "error", err)
+		return nil
+	}
+
+	required := len(tokens) + maxTokens
+	if fill {
+		// leave room for a completion after the messages
+		required++
+	}
+
+	if infer && required > contextLength {
+		contextLength = min(contextSize(required), limit)
+		r.Options["num_ctx"] = contextLength
+	}
+
+	if fill {
+		if len(tokens) >= contextLength {
+			return newParamError("messages", "context_length_exceeded", "This model's maximum context length is %d tokens. However, your messages resulted in %d tokens. Please reduce the length of the messages.", contextLength, len(tokens))
+		}
+
+		r.Options["num_predict"] = contextLength - len(tokens)
+		return nil
+	}
+
+	if maxTokens > 0 && required > contextLength {
+		return newParamError("messages", "context_length_exceeded", "This model's maximum context length is %d tokens. However, you requested %d tokens (%d in the messages, %d in the completion). Please reduce the length of the messages or completion.", contextLength, required, len(tokens), maxTokens)
+	}
+
+	return nil
+}
+
+// contextSize rounds a context length up to a power of two, so requests of
+// similar lengths share a runner instead of each loading one of its own size
+func contextSize(tokens int) int {
+	n := 1
+	for n < tokens {
+		n <<= 1
+	}
+
+	return n
+}
+
+// resolveLogitBias replaces logit_bias keys which are token strings with the
+// id of the single token they encode to
+func resolveLogitBias(ctx context.Context, b Backend, r *api.ChatRequest) error {
+	logitBias, ok := r.Options["logit_bias"].(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	resolved := make(map[string]any, len(logitBias))
+	for k, v := range logitBias {
+		if _, err := strconv.Atoi(k); err == nil {
+			resolved[k] = v
+		}
+	}
+
+	for k, v := range logitBias {
+		if _, err := strconv.Atoi(k); err == nil {
+			continue
+		}
+
+		if b == nil {
+			return newParamError("logit_bias", "invalid_value", "Invalid key in 'logit_bias': %s. Keys must be token ids", k)
+		}
+
+		tokens, err := b.Tokenize(ctx, r.Model, r.Options, k)
+		if err != nil {
+			return newParamError("logit_bias", "invalid_value", "unable to tokenize 'logit_bias' key %q: %v", k, err)
+		}
+
+		if len(tokens) != 1 {
+			return newParamError("logit_bias", "invalid_value", "Invalid key in 'logit_bias': %q encodes to %d tokens, but a bias can only apply to a single token", k, len(tokens))
+		}
+
+		id := strconv.Itoa(tokens[0])
+		if _, ok := resolved[id]; ok {
+			return newParamError("logit_bias", "invalid_value", "Invalid key in 'logit_bias': %q is the same token as %s", k, id)
+		}
+		resolved[id] = v
+	}
+
+	r.Options["logit_bias"] = resolved
+	return nil
+}
+
+// maxDecompressedSize is the largest a gzip request body may decompress to,
+// so a small compressed body can't expand to fill the server's memory
+const maxDecompressedSize = 100 << 20
+
+func Middleware(opts ...Option) gin.HandlerFunc {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(c *gin.Context) {
+		if last := c.GetHeader("Last-Event-ID"); last != "" && o.streams != nil {
+			o.streams.resume(c, last)
+			return
+		}
+
+		id := newId("chatcmpl-")
+		c.Header("X-Request-ID", id)
+
+		if c.GetHeader("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(c.Request.Body)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, fmt.Sprintf("invalid gzip request body: %v", err)))
+				return
+			}
+			defer gz.Close()
+
+			c.Request.Body = http.MaxBytesReader(c.Writer, gz, maxDecompressedSize)
+			c.Request.Header.Del("Content-Encoding")
+		}
+
+		var req Request
+		err := c.ShouldBindBodyWith(&req, binding.JSON)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d MB once decompressed", tooLarge.Limit>>20)))
+			return
+		} else if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		// stream when the client asks for an event stream without setting
+		// stream in the body, but let an explicit stream value win
+		if !req.Stream && strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+			var explicit struct {
+				Stream *bool `json:"stream"`
+			}
+
+			if err := c.ShouldBindBodyWith(&explicit, binding.JSON); err == nil && explicit.Stream == nil {
+				req.Stream = true
+			}
+		}
+
+		functions := req.Functions != nil || req.FunctionCall != nil
+		req, err = req.fromFunctions()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		if err := req.validate(); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		if model, ok := o.aliases[req.Model]; ok {
+			req.Model = model
+		}
+
+		if req.User != "" {
+			// for handlers and loggers which attribute requests to users
+			c.Set("user", req.User)
+		}
+
+		if req.Metadata != nil || req.User != "" {
+			attrs := []any{"id", id, "model", req.Model}
+			if req.User != "" {
+				attrs = append(attrs, "user", req.User)
+			}
+			if req.Metadata != nil {
+				attrs = append(attrs, "metadata", req.Metadata)
+			}
+			slog.Info("openai request", attrs...)
+		}
+
+		if err := fetchImages(c.Request.Context(), o.imageHosts, req.Messages); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		chatReq, err := fromRequest(req, o)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		if err := resolveLogitBias(c.Request.Context(), o.backend, &chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		if o.backend != nil {
+			if req.ReasoningEffort != nil {
+				applyReasoningEffort(c.Request.Context(), o.backend, &chatReq, *req.ReasoningEffort)
+			}
+
+			if err := fitContext(c.Request.Context(), o.backend, &chatReq, o.defaultMaxTokens); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+				return
+			}
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		// resumable streams outlive their client's connection
+		parent := c.Request.Context()
+		resumable := req.Stream && o.streams != nil
+		if resumable {
+			parent = context.WithoutCancel(parent)
+		}
+
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if o.timeout > 0 {
+			ctx, cancel = context.WithTimeout(parent, o.timeout)
+		} else {
+			ctx, cancel = context.WithCancel(parent)
+		}
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		// tool calls are only looked for when the model may make them
+		var tools []Tool
+		if choice, err := req.toolChoice(); err == nil && choice.mode != "none" {
+			tools = req.Tools
+		}
+
+		// there is only one tier, report it whenever the client asks for one
+		var serviceTier *string
+		if req.ServiceTier != nil {
+			tier := "default"
+			serviceTier = &tier
+		}
+
+		w := &writer{
+			ResponseWriter: c.Writer,
+			stream:         req.Stream,
+			streamOptions:  req.StreamOptions,
+			id:             id,
+			created:        time.Now().UTC(),
+			fingerprint: func() string {
+				return handlerFingerprint(c)
+			},
+			serviceTier: serviceTier,
+			user:        req.User,
+			charge:      chargeTokens(c.Request.Context()),
+			tools:       tools,
+			toolBuffer:  toolBuffer{tools: tools, single: !req.parallelToolCalls()},
+			functions:   functions,
+			logprobs:    chatReq.Logprobs,
+			trim:        o.trim,
+			reasoning:   o.reasoning,
+			gzip:        !req.Stream && strings.Contains(c.GetHeader("Accept-Encoding"), "gzip"),
+			abort: func() {
+				cancel()
+				c.Abort()
+			},
+			timedOut: func() bool {
+				return errors.Is(ctx.Err(), context.DeadlineExceeded)
+			},
+			model: req.Model,
+		}
+
+		if resumable {
+			w.resumable = o.streams.start(id, cancel)
+		}
+
+		c.Writer = w
+
+		stop := func() {}
+		if w.stream && o.heartbeat > 0 {
+			stop = w.heartbeat(o.heartbeat, cancel)
+		}
+
+		c.Next()
+		stop()
+
+		// a stream cut short by the timeout may not have written its final
+		// chunk, so finish it here now the handler has returned
+		if w.stream && w.timedOut() && !w.done && w.err == nil && w.Status() == http.StatusOK {
+			data, err := json.Marshal(api.ChatResponse{Model: w.model, Message: api.Message{Role: "assistant"}})
+			if err == nil {
+				_, err = w.writeResponse(data)
+			}
+
+			if err != nil {
+				slog.Debug("openai timeout", "id", id, "error", err)
+			}
+		}
+
+		if w.resumable != nil {
+			o.streams.finish(id, w.resumable)
+		}
+	}
+}
+
+// MiddlewareWithLimit is Middleware with a cap of limit on the number of
+// in-flight requests. Requests over the limit are rejected with a 429 rather
+// than queueing behind the running ones. A limit of zero or less means no
+// limit.
+func MiddlewareWithLimit(limit int, opts ...Option) gin.HandlerFunc {
+	next := Middleware(opts...)
+	if limit <= 0 {
+		return next
+	}
+
+	sem := make(chan struct{}, limit)
+
+	return func(c *gin.Context) {
+		select {
+		case sem <- struct{}{}:
+			// released once the rest of the chain returns, which includes
+			// generation errors and client disconnects
+			defer func() { <-sem }()
+		default:
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, NewErrorWithCode(http.StatusTooManyRequests, fmt.Sprintf("too many concurrent requests, limit is %d", limit), "rate_limit_exceeded", ""))
+			return
+		}
+
+		next(c)
+	}
+}
+
+// listWriter translates a native model list into an OpenAI model list,
+// keeping only models with capability when it's set
+type listWriter struct {
+	gin.ResponseWriter
+	ctx        context.Context
+	backend    Backend
+	capability string
+	aliases    map[string]string
+}
+
+// sameModel reports whether name, as listed, is the model target refers to.
+// A target without a tag refers to its latest tag.
+func sameModel(name, target string) bool {
+	if !strings.Contains(path.Base(target), ":") {
+		target += ":latest"
+	}
+
+	return name == target
+}
+
+// alias adds an entry for each alias of a listed model, after the models
+func (w *listWriter) alias(models []api.ModelResponse) []api.ModelResponse {
+	names := make([]string, 0, len(w.aliases))
+	for name := range w.aliases {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	aliased := models
+	for _, name := range names {
+		// a local model with the alias's name is listed already
+		if slices.ContainsFunc(models, func(m api.ModelResponse) bool { return sameModel(m.Name, name) }) {
+			continue
+		}
+
+		i := slices.IndexFunc(models, func(m api.ModelResponse) bool { return sameModel(m.Name, w.aliases[name]) })
+		if i < 0 {
+			continue
+		}
+
+		m := models[i]
+		m.Name = name
+		aliased = append(aliased, m)
+	}
+
+	return aliased
+}
+
+// filter drops the models which don't have w.capability. Models whose
+// details can't be read are dropped as well.
+func (w *listWriter) filter(models []api.ModelResponse) []api.ModelResponse {
+	if w.capability == "" {
+		return models
+	}
+
+	var filtered []api.ModelResponse
+	for _, m := range models {
+		info, err := w.backend.ModelInfo(w.ctx, m.Name)
+		if err != nil {
+			slog.Debug("openai model info", "model", m.Name, "error", err)
+			continue
+		}
+
+		if slices.Contains(info.Capabilities, w.capability) {
+			filtered = append(filtered, m)
+		}
+	}
+
+	return filtered
+}
+
+func (w *listWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		var serr api.StatusError
+		if err := json.Unmarshal(data, &serr); err != nil {
+			return 0, err
+		}
+
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w.ResponseWriter).Encode(NewError(code, serr.Error())); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	var list api.ListResponse
+	if err := json.Unmarshal(data, &list); err != nil {
+		return 0, err
+	}
+
+	list.Models = w.alias(w.filter(list.Models))
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(toListCompletion(list)); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// ListMiddleware serves /v1/models from the native model list, which only
+// reads model metadata and never loads a model. HEAD requests are answered
+// without listing at all so clients can cheaply probe the server. The
+// capability query parameter, which needs WithBackend, limits the list to
+// models with that capability.
+func ListMiddleware(opts ...Option) gin.HandlerFunc {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead {
+			c.AbortWithStatus(http.StatusOK)
+			return
+		}
+
+		capability := c.Query("capability")
+		if capability != "" && !slices.Contains(capabilities, capability) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("Invalid value: '%s'. Supported values are: 'chat' and 'embedding'. - 'capability'", capability), "invalid_value", "capability"))
+			return
+		}
+
+		if capability != "" && o.backend == nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, "Filtering models by capability isn't supported. - 'capability'", "invalid_value", "capability"))
+			return
+		}
+
+		c.Writer = &listWriter{
+			ResponseWriter: c.Writer,
+			ctx:            c.Request.Context(),
+			backend:        o.backend,
+			capability:     capability,
+			aliases:        o.aliases,
+		}
+		c.Next()
+	}
+}
+
+// retrieveWriter translates a native model description into an OpenAI model
+type retrieveWriter struct {
+	gin.ResponseWriter
+	model string
+}
+
+// writeModelError translates a native error about a single model, where not
+// found means the model doesn't exist
+func writeModelError(w gin.ResponseWriter, code int, data []byte) (int, error) {
+	var serr api.StatusError
+	if err := json.Unmarshal(data, &serr); err != nil {
+		return 0, err
+	}
+
+	resp := nativeError(code, serr.Error())
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *retrieveWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return writeModelError(w.ResponseWriter, code, data)
+	}
+
+	var show api.ShowResponse
+	if err := json.Unmarshal(data, &show); err != nil {
+		return 0, err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(Model{
+		Id:      w.model,
+		Object:  "model",
+		Created: show.ModifiedAt.Unix(),
+		OwnedBy: ownedBy(w.model),
+	}); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// RetrieveMiddleware serves /v1/models/{model} by describing the model with
+// the native show handler. The model is read from the model path parameter,
+// which may be a catch-all parameter since model names can contain slashes.
+func RetrieveMiddleware(opts ...Option) gin.HandlerFunc {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return func(c *gin.Context) {
+		model := strings.TrimPrefix(c.Param("model"), "/")
+
+		name := model
+		if target, ok := o.aliases[model]; ok {
+			name = target
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.ShowRequest{Name: name}); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+		c.Writer = &retrieveWriter{ResponseWriter: c.Writer, model: model}
+		c.Next()
+	}
+}
+
+// deleteWriter translates a native delete response into an OpenAI deletion
+type deleteWriter struct {
+	gin.ResponseWriter
+	model string
+}
+
+func (w *deleteWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return writeModelError(w.ResponseWriter, code, data)
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w.ResponseWriter).Encode(ModelDeleted{Id: w.model, Object: "model", Deleted: true}); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// DeleteMiddleware serves DELETE /v1/models/{model} with the native delete
+// handler. Aliases are deliberately not resolved so deleting an alias can't
+// remove the model behind it.
+func DeleteMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		model := strings.TrimPrefix(c.Param("model"), "/")
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.DeleteRequest{Name: model}); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+		c.Writer = &deleteWriter{ResponseWriter: c.Writer, model: model}
+		c.Next()
+	}
+}
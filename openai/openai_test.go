@@ -0,0 +1,2748 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// chatHandler mimics the native chat handler, replying with one response per
+// element of responses as either a ndjson stream or a single object
+func chatHandler(t *testing.T, responses ...api.ChatResponse) gin.HandlerFunc {
+	t.Helper()
+
+	return func(c *gin.Context) {
+		var req api.ChatRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		if req.Stream != nil && !*req.Stream {
+			final := responses[len(responses)-1]
+			var sb strings.Builder
+			var logprobs []api.Logprob
+			for _, r := range responses {
+				sb.WriteString(r.Message.Content)
+				logprobs = append(logprobs, r.Logprobs...)
+			}
+			final.Message.Content = sb.String()
+			final.Logprobs = logprobs
+			c.JSON(http.StatusOK, final)
+			return
+		}
+
+		c.Header("Content-Type", "application/x-ndjson")
+		for _, r := range responses {
+			bts, err := json.Marshal(r)
+			require.NoError(t, err)
+			_, err = c.Writer.Write(append(bts, '\n'))
+			require.NoError(t, err)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func newRouter(handlers ...gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/chat/completions", handlers...)
+	return r
+}
+
+func doRequest(t *testing.T, r http.Handler, path string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	bts, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(bts))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// readChunks parses the data lines of a server-sent event stream
+func readChunks(t *testing.T, body io.Reader) []Chunk {
+	t.Helper()
+
+	var chunks []Chunk
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok || line == "[DONE]" {
+			continue
+		}
+
+		var chunk Chunk
+		require.NoError(t, json.Unmarshal([]byte(line), &chunk))
+		chunks = append(chunks, chunk)
+	}
+
+	require.NoError(t, scanner.Err())
+	return chunks
+}
+
+func testResponses() []api.ChatResponse {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []api.ChatResponse{
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: "Hello"}},
+		{Model: "test", CreatedAt: start.Add(2 * time.Second), Message: api.Message{Role: "assistant", Content: ", world"}},
+		{Model: "test", CreatedAt: start.Add(5 * time.Second), Message: api.Message{Role: "assistant"}, Done: true, Metrics: api.Metrics{PromptEvalCount: 3, EvalCount: 2}},
+	}
+}
+
+func TestMiddlewareStreamCreated(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	w := doRequest(t, r, "/v1/chat/completions", Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+		Stream:   true,
+	})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n"))
+
+	chunks := readChunks(t, w.Body)
+	require.Len(t, chunks, 3)
+	for _, chunk := range chunks {
+		assert.Equal(t, chunks[0].Created, chunk.Created)
+		assert.Equal(t, chunks[0].Id, chunk.Id)
+	}
+
+	assert.NotZero(t, chunks[0].Created)
+	assert.Nil(t, chunks[0].Choices[0].FinishReason)
+	require.NotNil(t, chunks[2].Choices[0].FinishReason)
+	assert.Equal(t, "stop", *chunks[2].Choices[0].FinishReason)
+}
+
+func TestMiddlewareCompletion(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	before := time.Now().Unix()
+	w := doRequest(t, r, "/v1/chat/completions", Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+	})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var completion Completion
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+	assert.Equal(t, "chat.completion", completion.Object)
+	assert.GreaterOrEqual(t, completion.Created, before)
+	assert.Equal(t, "Hello, world", completion.Choices[0].Message.Content)
+	assert.Equal(t, Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}, completion.Usage)
+}
+
+func TestMiddlewareEmptyMessages(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "invalid_request_error", resp.Error.Type)
+}
+
+func TestToListCompletion(t *testing.T) {
+	modified := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+	list := toListCompletion(api.ListResponse{
+		Models: []api.ModelResponse{
+			{Name: "llama2:latest", ModifiedAt: modified},
+			{Name: "jmorgan/mixtral:8x7b", ModifiedAt: modified},
+			{Name: "registry.example.com/acme/coder:7b", ModifiedAt: modified},
+		},
+	})
+
+	assert.Equal(t, "list", list.Object)
+	require.Len(t, list.Data, 3)
+
+	for _, m := range list.Data {
+		assert.Equal(t, "model", m.Object)
+		assert.Equal(t, modified.Unix(), m.Created)
+	}
+
+	assert.Equal(t, "llama2:latest", list.Data[0].Id)
+	assert.Equal(t, "library", list.Data[0].OwnedBy)
+	assert.Equal(t, "jmorgan", list.Data[1].OwnedBy)
+	assert.Equal(t, "acme", list.Data[2].OwnedBy)
+}
+
+func TestMiddlewareRequestID(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	t.Run("completion", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hi"}},
+		})
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.NotEmpty(t, completion.Id)
+		assert.Equal(t, completion.Id, w.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hi"}},
+			Stream:   true,
+		})
+
+		chunks := readChunks(t, w.Body)
+		require.NotEmpty(t, chunks)
+		assert.Equal(t, chunks[0].Id, w.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test"})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.True(t, strings.HasPrefix(w.Header().Get("X-Request-ID"), "chatcmpl-"))
+	})
+}
+
+func TestFromRequestOptions(t *testing.T) {
+	temperature := 0.5
+	maxTokens := 64
+	req, err := FromRequest(Request{
+		Model:       "test",
+		Messages:    []Message{{Role: "user", Content: "Hi"}},
+		Temperature: &temperature,
+		MaxTokens:   &maxTokens,
+		Options: map[string]any{
+			"mirostat":     2,
+			"num_ctx":      8192,
+			"temperature":  0.1,
+			"num_predict":  16,
+			"unknown_knob": true,
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, req.Options["mirostat"])
+	assert.Equal(t, 8192, req.Options["num_ctx"])
+	assert.Equal(t, true, req.Options["unknown_knob"])
+
+	// standard parameters win on conflict
+	assert.Equal(t, 1.0, req.Options["temperature"])
+	assert.Equal(t, 64, req.Options["num_predict"])
+
+	// defaults only apply when neither form sets the value
+	assert.Equal(t, 1.0, req.Options["top_p"])
+
+	req, err = FromRequest(Request{
+		Model:               "test",
+		Messages:            []Message{{Role: "user", Content: "Hi"}},
+		MaxCompletionTokens: ptr(32),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 32, req.Options["num_predict"])
+
+	// max_completion_tokens takes precedence over max_tokens
+	req, err = FromRequest(Request{
+		Model:               "test",
+		Messages:            []Message{{Role: "user", Content: "Hi"}},
+		MaxTokens:           &maxTokens,
+		MaxCompletionTokens: ptr(32),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 32, req.Options["num_predict"])
+
+	req, err = FromRequest(Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+		Options:  map[string]any{"top_p": 0.5},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, req.Options["top_p"])
+}
+
+func TestMiddlewareWithLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+
+	blocking := func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		chatHandler(t, testResponses()...)(c)
+	}
+
+	r := newRouter(MiddlewareWithLimit(2), blocking)
+	body := Request{Model: "test", Messages: []Message{{Role: "user", Content: "Hi"}}}
+
+	results := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- doRequest(t, r, "/v1/chat/completions", body).Code
+		}()
+	}
+
+	<-started
+	<-started
+
+	w := doRequest(t, r, "/v1/chat/completions", body)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "requests", resp.Error.Type)
+	require.NotNil(t, resp.Error.Code)
+	assert.Equal(t, "rate_limit_exceeded", *resp.Error.Code)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-results)
+	assert.Equal(t, http.StatusOK, <-results)
+
+	// slots are released once requests finish, including failed ones
+	w = doRequest(t, r, "/v1/chat/completions", Request{Model: "test"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(t, r, "/v1/chat/completions", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestMiddlewareWithoutLimit(t *testing.T) {
+	for _, limit := range []int{0, -1} {
+		r := newRouter(MiddlewareWithLimit(limit), chatHandler(t, testResponses()...))
+
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: []Message{{Role: "user", Content: "Hi"}}})
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+}
+
+// disconnectRecorder simulates a client that goes away after a number of writes
+type disconnectRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+	limit  int
+}
+
+func (r *disconnectRecorder) Write(b []byte) (int, error) {
+	if r.writes >= r.limit {
+		return 0, io.ErrClosedPipe
+	}
+
+	r.writes++
+	return r.ResponseRecorder.Write(b)
+}
+
+func TestMiddlewareDisconnect(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	handler := func(c *gin.Context) {
+		var req api.ChatRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		for _, r := range testResponses() {
+			bts, err := json.Marshal(r)
+			require.NoError(t, err)
+			if _, err := c.Writer.Write(append(bts, '\n')); err != nil {
+				continue
+			}
+		}
+
+		cancelled <- c.Request.Context().Err() != nil
+	}
+
+	var after bool
+	r := newRouter(Middleware(), handler, func(c *gin.Context) { after = true })
+
+	bts, err := json.Marshal(Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+		Stream:   true,
+	})
+	require.NoError(t, err)
+
+	w := &disconnectRecorder{ResponseRecorder: httptest.NewRecorder(), limit: 1}
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts)))
+
+	assert.True(t, <-cancelled)
+	assert.False(t, after)
+	assert.Equal(t, 1, w.writes)
+	assert.Len(t, readChunks(t, w.Body), 1)
+}
+
+func TestMiddlewareDisconnectCompletion(t *testing.T) {
+	cancelled := make(chan error, 1)
+	r := newRouter(Middleware(), slowHandler(t, 10*time.Millisecond, cancelled))
+
+	bts, err := json.Marshal(Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+	})
+	require.NoError(t, err)
+
+	// the server cancels the request context of a client which goes away
+	// before its completion is written
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts)).WithContext(ctx))
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+// slowHandler streams a chunk every interval until the request is cancelled,
+// then reports whether it was cancelled by a deadline
+func slowHandler(t *testing.T, interval time.Duration, cancelled chan<- error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req api.ChatRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var sb strings.Builder
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				cancelled <- c.Request.Context().Err()
+
+				if !*req.Stream {
+					c.JSON(http.StatusOK, api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: sb.String()}})
+				}
+				return
+			case <-ticker.C:
+				sb.WriteString("word ")
+				if *req.Stream {
+					bts, err := json.Marshal(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: "word "}})
+					require.NoError(t, err)
+					_, err = c.Writer.Write(append(bts, '\n'))
+					require.NoError(t, err)
+				}
+			}
+		}
+	}
+}
+
+func TestMiddlewareTimeout(t *testing.T) {
+	t.Run("stream", func(t *testing.T) {
+		cancelled := make(chan error, 1)
+		r := newRouter(Middleware(WithTimeout(100*time.Millisecond)), slowHandler(t, 10*time.Millisecond, cancelled))
+
+		start := time.Now()
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hi"}},
+			Stream:   true,
+		})
+		assert.Less(t, time.Since(start), time.Second)
+		assert.ErrorIs(t, <-cancelled, context.DeadlineExceeded)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n"))
+		assert.Equal(t, 1, strings.Count(w.Body.String(), "data: [DONE]"))
+
+		chunks := readChunks(t, w.Body)
+		require.Greater(t, len(chunks), 1)
+		for _, chunk := range chunks[:len(chunks)-1] {
+			assert.Nil(t, chunk.Choices[0].FinishReason)
+		}
+
+		last := chunks[len(chunks)-1]
+		require.NotNil(t, last.Choices[0].FinishReason)
+		assert.Equal(t, "length", *last.Choices[0].FinishReason)
+		assert.Equal(t, "test", last.Model)
+	})
+
+	t.Run("completion", func(t *testing.T) {
+		cancelled := make(chan error, 1)
+		r := newRouter(Middleware(WithTimeout(100*time.Millisecond)), slowHandler(t, 10*time.Millisecond, cancelled))
+
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hi"}},
+		})
+		assert.ErrorIs(t, <-cancelled, context.DeadlineExceeded)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		require.Len(t, completion.Choices, 1)
+		require.NotNil(t, completion.Choices[0].FinishReason)
+		assert.Equal(t, "length", *completion.Choices[0].FinishReason)
+		assert.NotEmpty(t, completion.Choices[0].Message.Content)
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hi"}},
+			Stream:   true,
+		})
+
+		chunks := readChunks(t, w.Body)
+		require.NotEmpty(t, chunks)
+		assert.Equal(t, "stop", *chunks[len(chunks)-1].Choices[0].FinishReason)
+	})
+}
+
+func TestMiddlewareStreamUsage(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	w := doRequest(t, r, "/v1/chat/completions", Request{
+		Model:         "test",
+		Messages:      []Message{{Role: "user", Content: "Hi"}},
+		Stream:        true,
+		StreamOptions: &StreamOptions{IncludeUsage: true},
+	})
+
+	assert.Equal(t, 1, strings.Count(w.Body.String(), `"usage"`))
+	assert.Contains(t, w.Body.String(), `"choices":[],"usage"`)
+
+	chunks := readChunks(t, w.Body)
+	require.Len(t, chunks, 4)
+	for _, chunk := range chunks[:3] {
+		assert.Nil(t, chunk.Usage)
+		assert.Len(t, chunk.Choices, 1)
+	}
+	assert.Equal(t, "stop", *chunks[2].Choices[0].FinishReason)
+
+	// usage is sent last, in a chunk without choices
+	last := chunks[3]
+	require.NotNil(t, last.Usage)
+	assert.Equal(t, Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}, *last.Usage)
+	assert.NotNil(t, last.Choices)
+	assert.Empty(t, last.Choices)
+	assert.Equal(t, chunks[0].Id, last.Id)
+
+	// usage is left out unless requested
+	w = doRequest(t, r, "/v1/chat/completions", Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+		Stream:   true,
+	})
+	assert.NotContains(t, w.Body.String(), `"usage"`)
+}
+
+func TestMiddlewareHeartbeat(t *testing.T) {
+	// the handler waits before its first token, as if evaluating a long prompt
+	delayed := func(code int) gin.HandlerFunc {
+		next := chatHandler(t, testResponses()...)
+		return func(c *gin.Context) {
+			time.Sleep(100 * time.Millisecond)
+			if code != http.StatusOK {
+				c.JSON(code, gin.H{"error": "model 'test' not found"})
+				return
+			}
+			next(c)
+		}
+	}
+
+	req := Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+		Stream:   true,
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		r := newRouter(Middleware(WithHeartbeat(10*time.Millisecond)), delayed(http.StatusOK))
+		w := doRequest(t, r, "/v1/chat/completions", req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+		assert.NotEmpty(t, w.Header().Get("X-Request-ID"))
+
+		body := w.Body.String()
+		assert.True(t, strings.HasPrefix(body, ": ping\n\n"))
+		assert.Less(t, strings.LastIndex(body, ": ping"), strings.Index(body, "data: "))
+		assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+
+		chunks := readChunks(t, w.Body)
+		require.Len(t, chunks, 3)
+		assert.Equal(t, "Hello", chunks[0].Choices[0].Delta.Content)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		r := newRouter(Middleware(WithHeartbeat(10*time.Millisecond)), delayed(http.StatusNotFound))
+		w := doRequest(t, r, "/v1/chat/completions", req)
+
+		// the heartbeat already sent the status, so the error is an event
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var event string
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				event = data
+			}
+		}
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal([]byte(event), &resp))
+		assert.Equal(t, "model_not_found", *resp.Error.Code)
+	})
+
+	t.Run("fast", func(t *testing.T) {
+		r := newRouter(Middleware(WithHeartbeat(time.Second)), chatHandler(t, testResponses()...))
+		w := doRequest(t, r, "/v1/chat/completions", req)
+		assert.NotContains(t, w.Body.String(), ": ping")
+		assert.Len(t, readChunks(t, w.Body), 3)
+	})
+
+	t.Run("not streamed", func(t *testing.T) {
+		r := newRouter(Middleware(WithHeartbeat(10*time.Millisecond)), delayed(http.StatusNotFound))
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: req.Messages})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NotContains(t, w.Body.String(), ": ping")
+	})
+}
+
+func TestMiddlewareRoles(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	cases := []struct {
+		name     string
+		messages []Message
+		code     int
+		message  string
+	}{
+		{
+			name: "valid",
+			messages: []Message{
+				{Role: "system", Content: "You are a helpful assistant."},
+				{Role: "user", Content: "Hi"},
+				{Role: "assistant", Content: "Hello"},
+				{Role: "user", Content: "How are you?"},
+			},
+			code: http.StatusOK,
+		},
+		{
+			name: "typo",
+			messages: []Message{
+				{Role: "user", Content: "Hi"},
+				{Role: "asistant", Content: "Hello"},
+			},
+			code:    http.StatusBadRequest,
+			message: "'asistant'",
+		},
+		{
+			name:     "empty",
+			messages: []Message{{Content: "Hi"}},
+			code:     http.StatusBadRequest,
+			message:  "'messages.0.role'",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: tt.messages})
+			assert.Equal(t, tt.code, w.Code)
+
+			if tt.message != "" {
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Contains(t, resp.Error.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestFromRequestSeed(t *testing.T) {
+	cases := []struct {
+		name        string
+		req         Request
+		temperature float64
+	}{
+		{name: "seed", req: Request{Seed: ptr(42)}, temperature: 0},
+		{name: "seed and temperature", req: Request{Seed: ptr(42), Temperature: ptr(0.8)}, temperature: 1.6},
+		{name: "seed and temperature option", req: Request{Seed: ptr(42), Options: map[string]any{"temperature": 0.7}}, temperature: 0.7},
+		{name: "temperature", req: Request{Temperature: ptr(0.8)}, temperature: 1.6},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Model = "test"
+			tt.req.Messages = []Message{{Role: "user", Content: "Hi"}}
+
+			req, err := FromRequest(tt.req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.temperature, req.Options["temperature"])
+			if tt.req.Seed != nil {
+				assert.Equal(t, 42, req.Options["seed"])
+			}
+		})
+	}
+}
+
+func TestFromRequestDeveloperRole(t *testing.T) {
+	req, err := FromRequest(Request{
+		Model: "test",
+		Messages: []Message{
+			{Role: "developer", Content: "Be terse."},
+			{Role: "user", Content: "Hi"},
+			{Role: "developer", Content: "Answer in French."},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []api.Message{
+		{Role: "system", Content: "Be terse."},
+		{Role: "user", Content: "Hi"},
+		{Role: "system", Content: "Answer in French."},
+	}, req.Messages)
+}
+
+func TestFromRequestNames(t *testing.T) {
+	req, err := FromRequest(Request{
+		Model: "test",
+		Messages: []Message{
+			{Role: "system", Name: "moderator", Content: "Debate the topic."},
+			{Role: "user", Name: "alice", Content: "Cats are best."},
+			{Role: "assistant", Name: "bob", Content: "Dogs are best."},
+			{Role: "assistant", Name: "bob", ToolCalls: []ToolCall{{Id: "call_1", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city": "Paris"}`}}}},
+			{Role: "tool", Name: "get_weather", ToolCallId: "call_2", Content: "Sunny"},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []api.Message{
+		{Role: "system", Content: "moderator: Debate the topic."},
+		{Role: "user", Content: "alice: Cats are best."},
+		{Role: "assistant", Content: "bob: Dogs are best."},
+		{Role: "assistant", Content: `{"tool_calls":[{"name":"get_weather","arguments":{"city":"Paris"}}]}`},
+		{Role: "user", Content: "Result of calling the get_weather tool:\nSunny"},
+	}, req.Messages)
+}
+
+func TestMiddlewareGzip(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	bts, err := json.Marshal(Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: strings.Repeat("a long document ", 1024)}},
+	})
+	require.NoError(t, err)
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, err = gz.Write(bts)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	t.Run("request", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Encoding", "gzip")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, "Hello, world", completion.Choices[0].Message.Content)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts))
+		req.Header.Set("Content-Encoding", "gzip")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		// a body which compresses to little but decompresses past the limit
+		var body bytes.Buffer
+		gz := gzip.NewWriter(&body)
+		_, err := gz.Write([]byte(`{"model": "test", "messages": [{"role": "user", "content": "`))
+		require.NoError(t, err)
+		chunk := bytes.Repeat([]byte("a"), 1<<20)
+		for i := 0; i <= maxDecompressedSize>>20; i++ {
+			_, err := gz.Write(chunk)
+			require.NoError(t, err)
+		}
+		require.NoError(t, gz.Close())
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", &body)
+		req.Header.Set("Content-Encoding", "gzip")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Contains(t, resp.Error.Message, "100 MB")
+	})
+
+	t.Run("response", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts))
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+		gz, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+
+		var completion Completion
+		require.NoError(t, json.NewDecoder(gz).Decode(&completion))
+		assert.Equal(t, "Hello, world", completion.Choices[0].Message.Content)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		bts, err := json.Marshal(Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hi"}},
+			Stream:   true,
+		})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts))
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Len(t, readChunks(t, w.Body), 3)
+	})
+}
+
+func TestFromRequestInvalidRole(t *testing.T) {
+	_, err := FromRequest(Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}, {Role: "bot", Content: "Hello"}},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "'messages.1.role'")
+}
+
+func TestFromRequestEmptyContent(t *testing.T) {
+	cases := []struct {
+		name     string
+		messages []Message
+		err      string
+	}{
+		{name: "user", messages: []Message{{Role: "user", Content: ""}}, err: "'messages[0].content'"},
+		{name: "system", messages: []Message{{Role: "system", Content: ""}, {Role: "user", Content: "Hi"}}, err: "'messages[0].content'"},
+		{name: "later user", messages: []Message{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello"}, {Role: "user", Content: ""}}, err: "'messages[2].content'"},
+		{name: "assistant", messages: []Message{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: ""}}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := FromRequest(Request{Model: "test", Messages: tt.messages})
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestMiddlewareEmptyContent(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	w := doRequest(t, r, "/v1/chat/completions", Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: ""}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "invalid_request_error", resp.Error.Type)
+	assert.Contains(t, resp.Error.Message, "'messages[0].content'")
+}
+
+func TestStopReasonSequence(t *testing.T) {
+	t.Run("stop sequence", func(t *testing.T) {
+		responses := testResponses()
+		responses[len(responses)-1].StopSequence = "\nUser:"
+		r := newRouter(Middleware(), chatHandler(t, responses...))
+
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hello"}},
+			Stop:     []string{"\nUser:", "###"},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		require.Len(t, completion.Choices, 1)
+		require.NotNil(t, completion.Choices[0].StopReasonSequence)
+		assert.Equal(t, "\nUser:", *completion.Choices[0].StopReasonSequence)
+
+		w = doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hello"}},
+			Stop:     []string{"\nUser:", "###"},
+			Stream:   true,
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		chunks := readChunks(t, w.Body)
+		require.NotEmpty(t, chunks)
+		for _, chunk := range chunks[:len(chunks)-1] {
+			assert.Nil(t, chunk.Choices[0].StopReasonSequence)
+		}
+
+		last := chunks[len(chunks)-1]
+		require.NotNil(t, last.Choices[0].StopReasonSequence)
+		assert.Equal(t, "\nUser:", *last.Choices[0].StopReasonSequence)
+	})
+
+	t.Run("end of sequence", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hello"}},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "stop_reason_sequence")
+	})
+}
+
+func TestRequestNumbers(t *testing.T) {
+	cases := []struct {
+		name        string
+		body        string
+		temperature *float64
+		topP        *float64
+		err         string
+	}{
+		{name: "float", body: `{"temperature": 0.7, "top_p": 0.9}`, temperature: ptr(0.7), topP: ptr(0.9)},
+		{name: "integer", body: `{"temperature": 1, "top_p": 0}`, temperature: ptr(1.0), topP: ptr(0.0)},
+		{name: "string", body: `{"temperature": "0.7", "top_p": " 1 "}`, temperature: ptr(0.7), topP: ptr(1.0)},
+		{name: "null", body: `{"temperature": null}`},
+		{name: "missing", body: `{}`},
+		{name: "invalid string", body: `{"temperature": "warm"}`, err: "Invalid type for 'temperature': expected a number, but got a string instead."},
+		{name: "nan", body: `{"top_p": "NaN"}`, err: "Invalid type for 'top_p': expected a number, but got a string instead."},
+		{name: "invalid type", body: `{"presence_penalty": true}`, err: "Invalid type for 'presence_penalty': expected a number, but got a boolean instead."},
+		{name: "invalid penalty", body: `{"frequency_penalty": "high"}`, err: "Invalid type for 'frequency_penalty': expected a number, but got a string instead."},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var req Request
+			err := json.Unmarshal([]byte(tt.body), &req)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.temperature, req.Temperature)
+			assert.Equal(t, tt.topP, req.TopP)
+		})
+	}
+}
+
+func TestMiddlewareBindError(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	cases := []struct {
+		name    string
+		body    string
+		param   any
+		message string
+	}{
+		{
+			name:    "string max_tokens",
+			body:    `{"model": "test", "messages": [{"role": "user", "content": "Hi"}], "max_tokens": "100"}`,
+			param:   "max_tokens",
+			message: "Invalid type for 'max_tokens': expected an integer, but got a string instead.",
+		},
+		{
+			name:    "decimal seed",
+			body:    `{"model": "test", "messages": [{"role": "user", "content": "Hi"}], "seed": 1.5}`,
+			param:   "seed",
+			message: "Invalid type for 'seed': expected an integer, but got a decimal instead.",
+		},
+		{
+			name:    "string stream",
+			body:    `{"model": "test", "messages": [{"role": "user", "content": "Hi"}], "stream": "true"}`,
+			param:   "stream",
+			message: "Invalid type for 'stream': expected a boolean, but got a string instead.",
+		},
+		{
+			name:    "nested field",
+			body:    `{"model": "test", "messages": [{"role": "user", "content": "Hi"}], "stream": true, "stream_options": {"include_usage": 1}}`,
+			param:   "stream_options.include_usage",
+			message: "Invalid type for 'stream_options.include_usage': expected a boolean, but got a number instead.",
+		},
+		{
+			name:    "message role",
+			body:    `{"model": "test", "messages": [{"role": 1, "content": "Hi"}]}`,
+			param:   "messages.0.role",
+			message: "Invalid type for 'messages.0.role': expected a string, but got a number instead.",
+		},
+		{
+			name:    "messages object",
+			body:    `{"model": "test", "messages": {"role": "user", "content": "Hi"}}`,
+			param:   "messages",
+			message: "Invalid type for 'messages': expected an array, but got an object instead.",
+		},
+		{
+			name:    "temperature",
+			body:    `{"model": "test", "messages": [{"role": "user", "content": "Hi"}], "temperature": "warm"}`,
+			param:   "temperature",
+			message: "Invalid type for 'temperature': expected a number, but got a string instead.",
+		},
+		{
+			name:    "invalid json",
+			body:    `{"model": "test",`,
+			message: "We could not parse the JSON body of your request. The OpenAI API expects a JSON payload, but what was sent was not valid JSON.",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "invalid_request_error", resp.Error.Type)
+			assert.Equal(t, tt.param, resp.Error.Param)
+			assert.Equal(t, tt.message, resp.Error.Message)
+			if tt.param != nil {
+				require.NotNil(t, resp.Error.Code)
+				assert.Equal(t, "invalid_type", *resp.Error.Code)
+			} else {
+				assert.Nil(t, resp.Error.Code)
+			}
+		})
+	}
+}
+
+func TestMiddlewareErrorCodes(t *testing.T) {
+	handler := func(c *gin.Context) {
+		var req api.ChatRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		if req.Model == "missing" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+			return
+		}
+
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	r := newRouter(Middleware(WithBackend(testBackend{contextLength: 16})), handler)
+	messages := []Message{{Role: "user", Content: "Hello"}}
+
+	cases := []struct {
+		name   string
+		req    Request
+		status int
+		code   string
+		param  string
+	}{
+		{name: "missing model", req: Request{Messages: messages}, code: "missing_required_parameter", param: "model"},
+		{name: "empty messages", req: Request{Model: "test"}, code: "empty_array", param: "messages"},
+		{name: "invalid role", req: Request{Model: "test", Messages: []Message{{Role: "user", Content: "Hello"}, {Role: "bot", Content: "Hi"}}}, code: "invalid_value", param: "messages.1.role"},
+		{name: "empty content", req: Request{Model: "test", Messages: []Message{{Role: "user"}}}, code: "string_below_min_length", param: "messages[0].content"},
+		{name: "stream options", req: Request{Model: "test", Messages: messages, StreamOptions: &StreamOptions{}}, code: "invalid_value", param: "stream_options"},
+		{name: "temperature above max", req: Request{Model: "test", Messages: messages, Temperature: ptr(3.0)}, code: "decimal_above_max_value", param: "temperature"},
+		{name: "top_p below min", req: Request{Model: "test", Messages: messages, TopP: ptr(-0.5)}, code: "decimal_below_min_value", param: "top_p"},
+		{name: "stop", req: Request{Model: "test", Messages: messages, Stop: []any{"\n", 1}}, code: "invalid_type", param: "stop.1"},
+		{name: "response format", req: Request{Model: "test", Messages: messages, ResponseFormat: &ResponseFormat{Type: "xml"}}, code: "invalid_value", param: "response_format.type"},
+		{name: "logit bias", req: Request{Model: "test", Messages: messages, LogitBias: map[string]float64{"hello world": 1}}, code: "invalid_value", param: "logit_bias"},
+		{name: "max tokens", req: Request{Model: "test", Messages: messages, MaxTokens: ptr(32)}, code: "context_length_exceeded", param: "max_tokens"},
+		{name: "context length", req: Request{Model: "test", Messages: []Message{{Role: "user", Content: strings.Repeat("word ", 12)}}, MaxTokens: ptr(8)}, code: "context_length_exceeded", param: "messages"},
+		{name: "model not found", req: Request{Model: "missing", Messages: messages}, status: http.StatusNotFound, code: "model_not_found", param: "model"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == 0 {
+				status = http.StatusBadRequest
+			}
+
+			w := doRequest(t, r, "/v1/chat/completions", tt.req)
+			assert.Equal(t, status, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.NotNil(t, resp.Error.Code)
+			assert.Equal(t, tt.code, *resp.Error.Code)
+			assert.Equal(t, tt.param, resp.Error.Param)
+		})
+	}
+}
+
+func TestNewErrorWithCode(t *testing.T) {
+	resp := NewErrorWithCode(http.StatusBadRequest, "bad", "invalid_value", "model")
+	assert.Equal(t, "invalid_request_error", resp.Error.Type)
+	require.NotNil(t, resp.Error.Code)
+	assert.Equal(t, "invalid_value", *resp.Error.Code)
+	assert.Equal(t, "model", resp.Error.Param)
+
+	resp = NewErrorWithCode(http.StatusInternalServerError, "failed", "", "")
+	assert.Nil(t, resp.Error.Code)
+	assert.Nil(t, resp.Error.Param)
+
+	bts, err := json.Marshal(NewError(http.StatusBadRequest, "bad"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"error": {"message": "bad", "type": "invalid_request_error", "param": null, "code": null}}`, string(bts))
+
+	resp = NewErrorWithCode(http.StatusTooManyRequests, "quota", "insufficient_quota", "")
+	assert.Equal(t, "insufficient_quota", resp.Error.Type)
+}
+
+func TestNativeError(t *testing.T) {
+	cases := []struct {
+		status int
+		etype  string
+		code   string
+		param  string
+	}{
+		{status: http.StatusBadRequest, etype: "invalid_request_error"},
+		{status: http.StatusNotFound, etype: "not_found_error", code: "model_not_found", param: "model"},
+		{status: http.StatusTooManyRequests, etype: "requests", code: "rate_limit_exceeded"},
+		{status: http.StatusInternalServerError, etype: "server_error"},
+		{status: http.StatusServiceUnavailable, etype: "server_error"},
+	}
+
+	for _, tt := range cases {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			resp := nativeError(tt.status, "failed")
+			assert.Equal(t, tt.etype, resp.Error.Type)
+			assert.Equal(t, "failed", resp.Error.Message)
+
+			if tt.code == "" {
+				assert.Nil(t, resp.Error.Code)
+			} else {
+				require.NotNil(t, resp.Error.Code)
+				assert.Equal(t, tt.code, *resp.Error.Code)
+			}
+
+			if tt.param == "" {
+				assert.Nil(t, resp.Error.Param)
+			} else {
+				assert.Equal(t, tt.param, resp.Error.Param)
+			}
+		})
+	}
+}
+
+func TestMiddlewareStringNumbers(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	r := newRouter(Middleware(), capture)
+
+	w := doRequest(t, r, "/v1/chat/completions", map[string]any{
+		"model":       "test",
+		"messages":    []Message{{Role: "user", Content: "Hello"}},
+		"temperature": "0.5",
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.InDelta(t, 1.0, captured.Options["temperature"], 1e-9)
+
+	w = doRequest(t, r, "/v1/chat/completions", map[string]any{
+		"model":       "test",
+		"messages":    []Message{{Role: "user", Content: "Hello"}},
+		"temperature": "warm",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "invalid_request_error", resp.Error.Type)
+	assert.Contains(t, resp.Error.Message, "'temperature'")
+}
+
+func TestFromRequestResponseFormat(t *testing.T) {
+	cases := []struct {
+		name           string
+		responseFormat *ResponseFormat
+		format         string
+		schema         json.RawMessage
+		err            string
+	}{
+		{name: "unset"},
+		{name: "text", responseFormat: &ResponseFormat{Type: "text"}},
+		{name: "json object", responseFormat: &ResponseFormat{Type: "json_object"}, format: "json"},
+		{
+			name:           "json schema",
+			responseFormat: &ResponseFormat{Type: "json_schema", JsonSchema: &JsonSchema{Name: "person", Schema: json.RawMessage(`{"type": "object"}`)}},
+			format:         "json",
+			schema:         json.RawMessage(`{"type": "object"}`),
+		},
+		{name: "json schema without schema", responseFormat: &ResponseFormat{Type: "json_schema", JsonSchema: &JsonSchema{Name: "anything"}}, format: "json"},
+		{name: "missing json schema", responseFormat: &ResponseFormat{Type: "json_schema"}, err: "'response_format.json_schema'"},
+		{name: "missing name", responseFormat: &ResponseFormat{Type: "json_schema", JsonSchema: &JsonSchema{}}, err: "'response_format.json_schema.name'"},
+		{name: "invalid name", responseFormat: &ResponseFormat{Type: "json_schema", JsonSchema: &JsonSchema{Name: "a person"}}, err: "does not match pattern"},
+		{
+			name:           "schema type",
+			responseFormat: &ResponseFormat{Type: "json_schema", JsonSchema: &JsonSchema{Name: "person", Schema: json.RawMessage(`["object"]`)}},
+			err:            "expected an object, but got an array instead",
+		},
+		{name: "unknown", responseFormat: &ResponseFormat{Type: "xml"}, err: "Invalid value: 'xml'"},
+		{name: "empty", responseFormat: &ResponseFormat{}, err: "'response_format.type'"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := FromRequest(Request{
+				Model:          "test",
+				Messages:       []Message{{Role: "user", Content: "Hello"}},
+				ResponseFormat: tt.responseFormat,
+			})
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.format, req.Format)
+			assert.Equal(t, tt.schema, req.Schema)
+		})
+	}
+}
+
+func TestMiddlewareNumCtx(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		captured = api.ChatRequest{}
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	r := newRouter(Middleware(WithBackend(testBackend{contextLength: 16, maxContextLength: 64})), capture)
+
+	cases := []struct {
+		name      string
+		content   string
+		maxTokens *int
+		numCtx    *int
+		options   map[string]any
+		code      int
+		expected  any
+	}{
+		{name: "explicit", content: "hi", numCtx: ptr(32), code: http.StatusOK, expected: 32.0},
+		{name: "explicit option", content: "hi", options: map[string]any{"num_ctx": 48}, code: http.StatusOK, expected: 48.0},
+		{name: "explicit clamped", content: "hi", numCtx: ptr(128), code: http.StatusOK, expected: 64.0},
+		{name: "explicit lower", content: "hi", numCtx: ptr(8), code: http.StatusOK, expected: 8.0},
+		{name: "inferred", content: strings.Repeat("word ", 20), maxTokens: ptr(8), code: http.StatusOK, expected: 32.0},
+		{name: "inferred without max tokens", content: strings.Repeat("word ", 20), code: http.StatusOK, expected: 32.0},
+		{name: "inferred clamped", content: strings.Repeat("word ", 80), code: http.StatusOK, expected: 64.0},
+		{name: "never lowered", content: "hi", maxTokens: ptr(4), code: http.StatusOK},
+		{name: "inferred too large", content: strings.Repeat("word ", 60), maxTokens: ptr(8), code: http.StatusBadRequest},
+		{name: "max tokens too large", content: "hi", maxTokens: ptr(100), code: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, r, "/v1/chat/completions", Request{
+				Model:     "test",
+				Messages:  []Message{{Role: "user", Content: tt.content}},
+				MaxTokens: tt.maxTokens,
+				NumCtx:    tt.numCtx,
+				Options:   tt.options,
+			})
+			require.Equal(t, tt.code, w.Code)
+
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.expected, captured.Options["num_ctx"])
+			}
+		})
+	}
+}
+
+// countingBackend counts the calls to Tokenize of a testBackend
+type countingBackend struct {
+	testBackend
+	tokenized *int
+}
+
+func (b countingBackend) Tokenize(ctx context.Context, model string, options map[string]any, content string) ([]int, error) {
+	*b.tokenized++
+	return b.testBackend.Tokenize(ctx, model, options, content)
+}
+
+func TestMiddlewareContextTokenize(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		captured = api.ChatRequest{}
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	var tokenized int
+	r := newRouter(Middleware(WithBackend(countingBackend{testBackend{contextLength: 64, maxContextLength: 4096}, &tokenized})), capture)
+
+	cases := []struct {
+		name      string
+		content   string
+		maxTokens *int
+		tokenized int
+		numCtx    any
+	}{
+		{name: "short", content: "hello there", tokenized: 0},
+		{name: "short with max tokens", content: "hello there", maxTokens: ptr(32), tokenized: 0},
+		{name: "long", content: strings.Repeat("word ", 20), tokenized: 1},
+		{name: "overflows", content: strings.Repeat("word ", 100), tokenized: 1, numCtx: 128.0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenized = 0
+			w := doRequest(t, r, "/v1/chat/completions", Request{
+				Model:     "test",
+				Messages:  []Message{{Role: "user", Content: tt.content}},
+				MaxTokens: tt.maxTokens,
+			})
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.tokenized, tokenized)
+			assert.Equal(t, tt.numCtx, captured.Options["num_ctx"])
+		})
+	}
+}
+
+func TestMiddlewareReasoningEffort(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		captured = api.ChatRequest{}
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/chat/completions", Middleware(WithBackend(testBackend{contextLength: 64, reasoning: true})), capture)
+	r.POST("/v1/plain/chat/completions", Middleware(WithBackend(testBackend{contextLength: 64})), capture)
+
+	user := Message{Role: "user", Content: "Hello"}
+	cases := []struct {
+		name     string
+		path     string
+		effort   string
+		messages []Message
+		expected []api.Message
+	}{
+		{name: "minimal", path: "/v1/chat/completions", effort: "minimal", messages: []Message{user}, expected: []api.Message{{Role: "user", Content: "Hello"}, {Role: "assistant", Content: "<think>\n\n</think>\n\n"}}},
+		{name: "none", path: "/v1/chat/completions", effort: "none", messages: []Message{user}, expected: []api.Message{{Role: "user", Content: "Hello"}, {Role: "assistant", Content: "<think>\n\n</think>\n\n"}}},
+		{name: "high", path: "/v1/chat/completions", effort: "high", messages: []Message{user}, expected: []api.Message{{Role: "user", Content: "Hello"}}},
+		{name: "prefill", path: "/v1/chat/completions", effort: "minimal", messages: []Message{user, {Role: "assistant", Content: "Sure"}}, expected: []api.Message{{Role: "user", Content: "Hello"}, {Role: "assistant", Content: "Sure"}}},
+		{name: "not a reasoning model", path: "/v1/plain/chat/completions", effort: "minimal", messages: []Message{user}, expected: []api.Message{{Role: "user", Content: "Hello"}}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, r, tt.path, Request{Model: "test", Messages: tt.messages, ReasoningEffort: &tt.effort})
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.expected, captured.Messages)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: []Message{user}, ReasoningEffort: ptr("extreme")})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "reasoning_effort", resp.Error.Param)
+	})
+}
+
+func TestMiddlewareDefaultMaxTokens(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		captured = api.ChatRequest{}
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	cases := []struct {
+		name       string
+		backend    testBackend
+		content    string
+		maxTokens  *int
+		code       int
+		numPredict any
+		numCtx     any
+	}{
+		{name: "remaining context", backend: testBackend{contextLength: 16}, content: "hello there", code: http.StatusOK, numPredict: 14.0},
+		{name: "explicit max tokens", backend: testBackend{contextLength: 16}, content: "hello there", maxTokens: ptr(4), code: http.StatusOK, numPredict: 4.0},
+		{name: "prompt fills context", backend: testBackend{contextLength: 16}, content: strings.Repeat("word ", 16), code: http.StatusBadRequest},
+		{name: "prompt over context", backend: testBackend{contextLength: 16}, content: strings.Repeat("word ", 20), code: http.StatusBadRequest},
+		{name: "inferred context", backend: testBackend{contextLength: 16, maxContextLength: 64}, content: strings.Repeat("word ", 20), code: http.StatusOK, numPredict: 12.0, numCtx: 32.0},
+		{name: "fits default context", backend: testBackend{contextLength: 16, maxContextLength: 64}, content: "hi", code: http.StatusOK, numPredict: 15.0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRouter(Middleware(WithBackend(tt.backend), WithDefaultMaxTokens()), capture)
+			w := doRequest(t, r, "/v1/chat/completions", Request{
+				Model:     "test",
+				Messages:  []Message{{Role: "user", Content: tt.content}},
+				MaxTokens: tt.maxTokens,
+			})
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.numPredict, captured.Options["num_predict"])
+				assert.Equal(t, tt.numCtx, captured.Options["num_ctx"])
+				return
+			}
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "context_length_exceeded", *resp.Error.Code)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		r := newRouter(Middleware(WithBackend(testBackend{contextLength: 16})), capture)
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "hello there"}},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, captured.Options, "num_predict")
+	})
+}
+
+func TestFromRequestStop(t *testing.T) {
+	cases := []struct {
+		name string
+		stop any
+		want []string
+		err  string
+	}{
+		{name: "string", stop: "\n", want: []string{"\n"}},
+		{name: "array", stop: []any{"\n", "###"}, want: []string{"\n", "###"}},
+		{name: "mixed", stop: []any{"\n", 42.0}, err: "42 is not of type 'string' - 'stop.1'"},
+		{name: "null element", stop: []any{nil, "\n"}, err: "'stop.0'"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := FromRequest(Request{
+				Model:    "test",
+				Messages: []Message{{Role: "user", Content: "Hello"}},
+				Stop:     tt.stop,
+			})
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, req.Options["stop"])
+		})
+	}
+}
+
+func TestMiddlewareStopMixedTypes(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	w := doRequest(t, r, "/v1/chat/completions", map[string]any{
+		"model":    "test",
+		"messages": []Message{{Role: "user", Content: "Hello"}},
+		"stop":     []any{"\n", 42},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "invalid_request_error", resp.Error.Type)
+	assert.Equal(t, "42 is not of type 'string' - 'stop.1'", resp.Error.Message)
+}
+
+func TestMiddlewareValidate(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+	messages := []Message{{Role: "user", Content: "Hello"}}
+
+	cases := []struct {
+		name string
+		req  Request
+		err  string
+	}{
+		{name: "valid", req: Request{Model: "test", Messages: messages, Temperature: ptr(2.0), TopP: ptr(0.0)}},
+		{name: "missing model", req: Request{Messages: messages}, err: "you must provide a model parameter"},
+		{name: "missing messages", req: Request{Model: "test"}, err: "[] is too short - 'messages'"},
+		{name: "stream options without stream", req: Request{Model: "test", Messages: messages, StreamOptions: &StreamOptions{IncludeUsage: true}}, err: "The 'stream_options' parameter is only allowed when 'stream' is enabled."},
+		{name: "temperature too high", req: Request{Model: "test", Messages: messages, Temperature: ptr(2.5)}, err: "2.5 is greater than the maximum of 2 - 'temperature'"},
+		{name: "temperature too low", req: Request{Model: "test", Messages: messages, Temperature: ptr(-1.0)}, err: "-1 is less than the minimum of 0 - 'temperature'"},
+		{name: "top_p too high", req: Request{Model: "test", Messages: messages, TopP: ptr(1.5)}, err: "1.5 is greater than the maximum of 1 - 'top_p'"},
+		{name: "frequency_penalty too low", req: Request{Model: "test", Messages: messages, FrequencyPenalty: ptr(-3.0)}, err: "-3 is less than the minimum of -2 - 'frequency_penalty'"},
+		{name: "presence_penalty too high", req: Request{Model: "test", Messages: messages, PresencePenalty: ptr(2.1)}, err: "2.1 is greater than the maximum of 2 - 'presence_penalty'"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, r, "/v1/chat/completions", tt.req)
+			if tt.err == "" {
+				assert.Equal(t, http.StatusOK, w.Code)
+				return
+			}
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "invalid_request_error", resp.Error.Type)
+			assert.Equal(t, tt.err, resp.Error.Message)
+		})
+	}
+}
+
+// vocabBackend tokenizes each whitespace separated word to its id in vocab
+type vocabBackend struct {
+	testBackend
+	vocab map[string]int
+}
+
+func (b vocabBackend) Tokenize(_ context.Context, _ string, _ map[string]any, content string) ([]int, error) {
+	var tokens []int
+	for _, word := range strings.Fields(content) {
+		id, ok := b.vocab[word]
+		if !ok {
+			return nil, fmt.Errorf("unknown token %q", word)
+		}
+		tokens = append(tokens, id)
+	}
+
+	return tokens, nil
+}
+
+func TestMiddlewareLogitBias(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		captured = api.ChatRequest{}
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	backend := vocabBackend{vocab: map[string]int{"hello": 15043, "world": 3186}}
+
+	cases := []struct {
+		name      string
+		backend   Backend
+		logitBias map[string]float64
+		expected  map[string]any
+		err       string
+	}{
+		{name: "ids", logitBias: map[string]float64{"15043": -100, "3186": 50}, expected: map[string]any{"15043": -100.0, "3186": 50.0}},
+		{name: "ids with backend", backend: backend, logitBias: map[string]float64{"15043": -100}, expected: map[string]any{"15043": -100.0}},
+		{name: "token strings", backend: backend, logitBias: map[string]float64{"hello": -100, "world": 10}, expected: map[string]any{"15043": -100.0, "3186": 10.0}},
+		{name: "mixed", backend: backend, logitBias: map[string]float64{"hello": 5, "42": 1}, expected: map[string]any{"15043": 5.0, "42": 1.0}},
+		{name: "multiple tokens", backend: backend, logitBias: map[string]float64{"hello world": 5}, err: "encodes to 2 tokens"},
+		{name: "duplicate token", backend: backend, logitBias: map[string]float64{"hello": 5, "15043": 1}, err: "is the same token as 15043"},
+		{name: "unknown token", backend: backend, logitBias: map[string]float64{"unknown": 5}, err: "unable to tokenize"},
+		{name: "token strings without backend", logitBias: map[string]float64{"hello": 5}, err: "Keys must be token ids"},
+		{name: "out of range", logitBias: map[string]float64{"15043": 101}, err: "101 is greater than the maximum of 100 - 'logit_bias.15043'"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []Option
+			if tt.backend != nil {
+				opts = append(opts, WithBackend(tt.backend))
+			}
+
+			r := newRouter(Middleware(opts...), capture)
+			w := doRequest(t, r, "/v1/chat/completions", Request{
+				Model:     "test",
+				Messages:  []Message{{Role: "user", Content: "Hello"}},
+				LogitBias: tt.logitBias,
+			})
+
+			if tt.err != "" {
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Contains(t, resp.Error.Message, tt.err)
+				return
+			}
+
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.expected, captured.Options["logit_bias"])
+		})
+	}
+}
+
+func TestUsageTokensDetails(t *testing.T) {
+	t.Run("cache hit", func(t *testing.T) {
+		responses := testResponses()
+		responses[len(responses)-1].PromptCachedCount = 12
+		r := newRouter(Middleware(), chatHandler(t, responses...))
+
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hello"}},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		require.NotNil(t, completion.Usage.PromptTokensDetails)
+		assert.Equal(t, 12, completion.Usage.PromptTokensDetails.CachedTokens)
+
+		// cached tokens are still part of the prompt
+		assert.Equal(t, 15, completion.Usage.PromptTokens)
+		assert.Equal(t, 17, completion.Usage.TotalTokens)
+		assert.Nil(t, completion.Usage.CompletionTokensDetails)
+
+		w = doRequest(t, r, "/v1/chat/completions", Request{
+			Model:         "test",
+			Messages:      []Message{{Role: "user", Content: "Hello"}},
+			Stream:        true,
+			StreamOptions: &StreamOptions{IncludeUsage: true},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		chunks := readChunks(t, w.Body)
+		require.NotEmpty(t, chunks)
+		usage := chunks[len(chunks)-1].Usage
+		require.NotNil(t, usage)
+		require.NotNil(t, usage.PromptTokensDetails)
+		assert.Equal(t, 12, usage.PromptTokensDetails.CachedTokens)
+	})
+
+	t.Run("no cache hit", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hello"}},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "prompt_tokens_details")
+		assert.NotContains(t, w.Body.String(), "completion_tokens_details")
+	})
+}
+
+func TestUsageTimings(t *testing.T) {
+	responses := testResponses()
+	responses[len(responses)-1].Metrics = api.Metrics{
+		TotalDuration:      1500 * time.Millisecond,
+		LoadDuration:       200 * time.Millisecond,
+		PromptEvalCount:    3,
+		PromptEvalDuration: 300 * time.Millisecond,
+		EvalCount:          2,
+		EvalDuration:       900 * time.Millisecond,
+	}
+
+	r := newRouter(Middleware(), chatHandler(t, responses...))
+	expected := &Timings{
+		TotalDuration:      1500 * time.Millisecond,
+		LoadDuration:       200 * time.Millisecond,
+		PromptEvalDuration: 300 * time.Millisecond,
+		EvalDuration:       900 * time.Millisecond,
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:         "test",
+			Messages:      []Message{{Role: "user", Content: "Hello"}},
+			Stream:        true,
+			StreamOptions: &StreamOptions{IncludeUsage: true},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		chunks := readChunks(t, w.Body)
+		require.NotEmpty(t, chunks)
+		usage := chunks[len(chunks)-1].Usage
+		require.NotNil(t, usage)
+		assert.Equal(t, expected, usage.Timings)
+	})
+
+	t.Run("completion", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hello"}},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, expected, completion.Usage.Timings)
+
+		var raw struct {
+			Usage map[string]any `json:"usage"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+		assert.Equal(t, map[string]any{
+			"total_duration":       1.5e9,
+			"load_duration":        2e8,
+			"prompt_eval_duration": 3e8,
+			"eval_duration":        9e8,
+		}, raw.Usage["timings"])
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+		w := doRequest(t, r, "/v1/chat/completions", Request{
+			Model:    "test",
+			Messages: []Message{{Role: "user", Content: "Hello"}},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "timings")
+	})
+}
+
+func TestToCompletion(t *testing.T) {
+	responses := testResponses()
+	completion := ToCompletion("chatcmpl-1", "fp_0123456789", responses[2])
+
+	assert.Equal(t, "chatcmpl-1", completion.Id)
+	assert.Equal(t, "fp_0123456789", completion.SystemFingerprint)
+	assert.Equal(t, "chat.completion", completion.Object)
+	assert.Equal(t, responses[2].CreatedAt.Unix(), completion.Created)
+	assert.Equal(t, "test", completion.Model)
+	require.Len(t, completion.Choices, 1)
+	assert.Equal(t, "assistant", completion.Choices[0].Message.Role)
+	assert.Equal(t, "stop", *completion.Choices[0].FinishReason)
+	assert.Equal(t, 5, completion.Usage.TotalTokens)
+}
+
+func TestToChunk(t *testing.T) {
+	responses := testResponses()
+
+	chunk := ToChunk("chatcmpl-1", "fp_0123456789", responses[0])
+	assert.Equal(t, "chat.completion.chunk", chunk.Object)
+	assert.Equal(t, "fp_0123456789", chunk.SystemFingerprint)
+	require.Len(t, chunk.Choices, 1)
+	assert.Equal(t, Message{Role: "assistant", Content: "Hello"}, chunk.Choices[0].Delta)
+	assert.Nil(t, chunk.Choices[0].FinishReason)
+	assert.Nil(t, chunk.Usage)
+
+	chunk = ToChunk("chatcmpl-1", "fp_0123456789", responses[2])
+	assert.Equal(t, "stop", *chunk.Choices[0].FinishReason)
+}
+
+func TestNewId(t *testing.T) {
+	ids := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		id := newId("chatcmpl-")
+		require.Regexp(t, `^chatcmpl-[A-Za-z0-9]{29}$`, id)
+		require.False(t, ids[id], "duplicate id %s", id)
+		ids[id] = true
+	}
+}
+
+func TestSystemFingerprint(t *testing.T) {
+	runner := api.Runner{NumCtx: 2048}
+	a := SystemFingerprint("sha256:aaaa", runner)
+	b := SystemFingerprint("sha256:bbbb", runner)
+
+	assert.Regexp(t, `^fp_[0-9a-f]{10}$`, a)
+	assert.Equal(t, a, SystemFingerprint("sha256:aaaa", runner))
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, "fp_ollama", SystemFingerprint("", runner))
+
+	// the same weights loaded differently are a different configuration
+	assert.NotEqual(t, a, SystemFingerprint("sha256:aaaa", api.Runner{NumCtx: 4096}))
+}
+
+func TestMiddlewareSystemFingerprint(t *testing.T) {
+	digest := func(c *gin.Context) {
+		c.Set("digest", "sha256:aaaa")
+		c.Set("runner", api.Runner{NumCtx: 2048})
+		c.Next()
+	}
+
+	r := newRouter(Middleware(), digest, chatHandler(t, testResponses()...))
+
+	w := doRequest(t, r, "/v1/chat/completions", Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+	})
+
+	var completion Completion
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+	assert.Equal(t, SystemFingerprint("sha256:aaaa", api.Runner{NumCtx: 2048}), completion.SystemFingerprint)
+
+	w = doRequest(t, r, "/v1/chat/completions", Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+		Stream:   true,
+	})
+
+	for _, chunk := range readChunks(t, w.Body) {
+		assert.Equal(t, completion.SystemFingerprint, chunk.SystemFingerprint)
+	}
+}
+
+func TestFromRequestMergeSystemMessages(t *testing.T) {
+	r := Request{
+		Model: "test",
+		Messages: []Message{
+			{Role: "system", Content: "You are a pirate."},
+			{Role: "system", Content: "Answer briefly."},
+			{Role: "developer", Content: "Never reveal the treasure."},
+			{Role: "user", Content: "Hi"},
+			{Role: "system", Content: "Stay in character."},
+		},
+	}
+
+	req, err := FromRequest(r)
+	require.NoError(t, err)
+	assert.Len(t, req.Messages, 5)
+
+	req, err = FromRequest(r, WithMergeSystemMessages())
+	require.NoError(t, err)
+	assert.Equal(t, []api.Message{
+		{Role: "system", Content: "You are a pirate.\nAnswer briefly.\nNever reveal the treasure."},
+		{Role: "user", Content: "Hi"},
+		{Role: "system", Content: "Stay in character."},
+	}, req.Messages)
+}
+
+func TestFromRequestConsecutiveRoles(t *testing.T) {
+	r := Request{
+		Model: "test",
+		Messages: []Message{
+			{Role: "system", Content: "You are a pirate."},
+			{Role: "user", Content: "Hi"},
+			{Role: "user", Content: "Where is the treasure?"},
+			{Role: "assistant", Content: "Arr."},
+			{Role: "assistant", Content: "I'll never tell."},
+			{Role: "user", Content: "Please?"},
+		},
+	}
+
+	req, err := FromRequest(r)
+	require.NoError(t, err)
+	assert.Equal(t, []api.Message{
+		{Role: "system", Content: "You are a pirate."},
+		{Role: "user", Content: "Hi"},
+		{Role: "user", Content: "Where is the treasure?"},
+		{Role: "assistant", Content: "Arr."},
+		{Role: "assistant", Content: "I'll never tell."},
+		{Role: "user", Content: "Please?"},
+	}, req.Messages)
+
+	req, err = FromRequest(r, WithAlternateRoles())
+	require.NoError(t, err)
+	assert.Equal(t, []api.Message{
+		{Role: "system", Content: "You are a pirate."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant"},
+		{Role: "user", Content: "Where is the treasure?"},
+		{Role: "assistant", Content: "Arr."},
+		{Role: "user"},
+		{Role: "assistant", Content: "I'll never tell."},
+		{Role: "user", Content: "Please?"},
+	}, req.Messages)
+}
+
+func TestMiddlewareAlternateRoles(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	r := newRouter(Middleware(WithAlternateRoles()), capture)
+
+	w := doRequest(t, r, "/v1/chat/completions", Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}, {Role: "user", Content: "Hello?"}},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []api.Message{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant"},
+		{Role: "user", Content: "Hello?"},
+	}, captured.Messages)
+}
+
+func TestFromRequestSystem(t *testing.T) {
+	cases := []struct {
+		name     string
+		system   string
+		messages []Message
+		expected []api.Message
+		err      string
+	}{
+		{
+			name:     "present",
+			system:   "You are a pirate.",
+			messages: []Message{{Role: "user", Content: "Hi"}},
+			expected: []api.Message{{Role: "system", Content: "You are a pirate."}, {Role: "user", Content: "Hi"}},
+		},
+		{
+			name:     "absent",
+			messages: []Message{{Role: "system", Content: "You are a pirate."}, {Role: "user", Content: "Hi"}},
+			expected: []api.Message{{Role: "system", Content: "You are a pirate."}, {Role: "user", Content: "Hi"}},
+		},
+		{
+			name:     "conflict",
+			system:   "You are a pirate.",
+			messages: []Message{{Role: "user", Content: "Hi"}, {Role: "system", Content: "Answer briefly."}},
+			err:      "'messages.1.role'",
+		},
+		{
+			name:     "conflict with developer",
+			system:   "You are a pirate.",
+			messages: []Message{{Role: "developer", Content: "Answer briefly."}, {Role: "user", Content: "Hi"}},
+			err:      "'developer' message",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := FromRequest(Request{Model: "test", System: tt.system, Messages: tt.messages})
+			if tt.err != "" {
+				var perr *paramError
+				require.ErrorAs(t, err, &perr)
+				assert.Equal(t, "system", perr.param)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, req.Messages)
+		})
+	}
+}
+
+func TestFromRequestJSONInstruction(t *testing.T) {
+	jsonMode := &ResponseFormat{Type: "json_object"}
+
+	cases := []struct {
+		name     string
+		format   *ResponseFormat
+		messages []Message
+		expected []api.Message
+	}{
+		{
+			name:     "no system message",
+			format:   jsonMode,
+			messages: []Message{{Role: "user", Content: "List three colors."}},
+			expected: []api.Message{
+				{Role: "system", Content: jsonInstruction},
+				{Role: "user", Content: "List three colors."},
+			},
+		},
+		{
+			name:     "system message",
+			format:   jsonMode,
+			messages: []Message{{Role: "system", Content: "You are helpful."}, {Role: "user", Content: "List three colors."}},
+			expected: []api.Message{
+				{Role: "system", Content: "You are helpful.\n\n" + jsonInstruction},
+				{Role: "user", Content: "List three colors."},
+			},
+		},
+		{
+			name:     "system message mentions json",
+			format:   jsonMode,
+			messages: []Message{{Role: "system", Content: "Reply in Json."}, {Role: "user", Content: "List three colors."}},
+			expected: []api.Message{
+				{Role: "system", Content: "Reply in Json."},
+				{Role: "user", Content: "List three colors."},
+			},
+		},
+		{
+			name:     "text",
+			format:   &ResponseFormat{Type: "text"},
+			messages: []Message{{Role: "user", Content: "List three colors."}},
+			expected: []api.Message{{Role: "user", Content: "List three colors."}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Request{Model: "test", Messages: tt.messages, ResponseFormat: tt.format}
+
+			req, err := FromRequest(r)
+			require.NoError(t, err)
+			assert.Len(t, req.Messages, len(tt.messages))
+
+			req, err = FromRequest(r, WithJSONInstruction())
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, req.Messages)
+		})
+	}
+}
+
+func TestRequestMetadata(t *testing.T) {
+	body := `{
+		"model": "test",
+		"messages": [{"role": "user", "content": "Hi"}],
+		"metadata": {"trace_id": "abc123", "tags": ["a", "b"]}
+	}`
+
+	var withMetadata Request
+	require.NoError(t, json.Unmarshal([]byte(body), &withMetadata))
+	assert.Equal(t, "abc123", withMetadata.Metadata["trace_id"])
+
+	withoutMetadata := withMetadata
+	withoutMetadata.Metadata = nil
+
+	a, err := FromRequest(withMetadata)
+	require.NoError(t, err)
+	b, err := FromRequest(withoutMetadata)
+	require.NoError(t, err)
+	assert.Equal(t, b, a)
+
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRequestUser(t *testing.T) {
+	var user string
+	capture := func(c *gin.Context) {
+		user = c.GetString("user")
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	r := newRouter(Middleware(), capture)
+	w := doRequest(t, r, "/v1/chat/completions", json.RawMessage(`{"model": "test", "messages": [{"role": "user", "content": "Hi"}], "user": "user-1234"}`))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "user-1234", user)
+
+	// the user never reaches the model
+	a, err := FromRequest(Request{Model: "test", Messages: []Message{{Role: "user", Content: "Hi"}}, User: "user-1234"})
+	require.NoError(t, err)
+	b, err := FromRequest(Request{Model: "test", Messages: []Message{{Role: "user", Content: "Hi"}}})
+	require.NoError(t, err)
+	assert.Equal(t, b, a)
+}
+
+func TestMiddlewareAcceptEventStream(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+	cases := []struct {
+		name   string
+		body   string
+		accept string
+		stream bool
+	}{
+		{name: "header only", body: `{"model":"test","messages":[{"role":"user","content":"Hi"}]}`, accept: "text/event-stream", stream: true},
+		{name: "body only", body: `{"model":"test","messages":[{"role":"user","content":"Hi"}],"stream":true}`, stream: true},
+		{name: "body false with header", body: `{"model":"test","messages":[{"role":"user","content":"Hi"}],"stream":false}`, accept: "text/event-stream", stream: false},
+		{name: "body true with json header", body: `{"model":"test","messages":[{"role":"user","content":"Hi"}],"stream":true}`, accept: "application/json", stream: true},
+		{name: "neither", body: `{"model":"test","messages":[{"role":"user","content":"Hi"}]}`, stream: false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body))
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			if tt.stream {
+				assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+				assert.Len(t, readChunks(t, w.Body), 3)
+			} else {
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestTrimmer(t *testing.T) {
+	var tr trimmer
+	pieces := []string{"\n ", "  Hello", " ", "world", "!\n", "\n"}
+
+	var sb strings.Builder
+	for _, p := range pieces {
+		sb.WriteString(tr.next(p, false))
+	}
+	sb.WriteString(tr.next("", true))
+
+	assert.Equal(t, "Hello world!", sb.String())
+}
+
+func TestMiddlewareTrimResponse(t *testing.T) {
+	responses := testResponses()
+	responses[0].Message.Content = "\n  Hello"
+	responses[1].Message.Content = ", world \n"
+
+	body := Request{Model: "test", Messages: []Message{{Role: "user", Content: "Hi"}}}
+
+	t.Run("off", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, responses...))
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(doRequest(t, r, "/v1/chat/completions", body).Body.Bytes(), &completion))
+		assert.Equal(t, "\n  Hello, world \n", completion.Choices[0].Message.Content)
+	})
+
+	r := newRouter(Middleware(WithTrimResponse()), chatHandler(t, responses...))
+
+	t.Run("completion", func(t *testing.T) {
+		var completion Completion
+		require.NoError(t, json.Unmarshal(doRequest(t, r, "/v1/chat/completions", body).Body.Bytes(), &completion))
+		assert.Equal(t, "Hello, world", completion.Choices[0].Message.Content)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		body := body
+		body.Stream = true
+
+		var sb strings.Builder
+		for _, chunk := range readChunks(t, doRequest(t, r, "/v1/chat/completions", body).Body) {
+			sb.WriteString(chunk.Choices[0].Delta.Content)
+		}
+
+		assert.Equal(t, "Hello, world", sb.String())
+	})
+}
+
+func TestMiddlewareServiceTier(t *testing.T) {
+	r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+	tier := "auto"
+
+	w := doRequest(t, r, "/v1/chat/completions", Request{
+		Model:       "test",
+		Messages:    []Message{{Role: "user", Content: "Hi"}},
+		ServiceTier: &tier,
+	})
+
+	var completion Completion
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+	require.NotNil(t, completion.ServiceTier)
+	assert.Equal(t, "default", *completion.ServiceTier)
+
+	w = doRequest(t, r, "/v1/chat/completions", Request{
+		Model:       "test",
+		Messages:    []Message{{Role: "user", Content: "Hi"}},
+		ServiceTier: &tier,
+		Stream:      true,
+	})
+
+	for _, chunk := range readChunks(t, w.Body) {
+		require.NotNil(t, chunk.ServiceTier)
+		assert.Equal(t, "default", *chunk.ServiceTier)
+	}
+
+	w = doRequest(t, r, "/v1/chat/completions", Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+	})
+	assert.NotContains(t, w.Body.String(), "service_tier")
+}
+
+// testBackend is a Backend with a fixed context length that counts one token
+// per whitespace separated word
+type testBackend struct {
+	contextLength    int
+	maxContextLength int
+	infill           string
+	reasoning        bool
+}
+
+func (b testBackend) ModelInfo(_ context.Context, model string) (ModelInfo, error) {
+	if model != "test" {
+		return ModelInfo{}, errors.New("model not found")
+	}
+
+	return ModelInfo{ContextLength: b.contextLength, MaxContextLength: b.maxContextLength, Infill: b.infill, Reasoning: b.reasoning}, nil
+}
+
+func (b testBackend) Tokenize(_ context.Context, _ string, _ map[string]any, content string) ([]int, error) {
+	return make([]int, len(strings.Fields(content))), nil
+}
+
+func (b testBackend) Detokenize(_ context.Context, _ string, tokens []int) (string, error) {
+	words := make([]string, len(tokens))
+	for i, token := range tokens {
+		words[i] = fmt.Sprintf("t%d", token)
+	}
+	return strings.Join(words, " "), nil
+}
+
+func TestMiddlewareContextLength(t *testing.T) {
+	r := newRouter(Middleware(WithBackend(testBackend{contextLength: 16})), chatHandler(t, testResponses()...))
+
+	intPtr := func(i int) *int { return &i }
+
+	cases := []struct {
+		name      string
+		model     string
+		content   string
+		maxTokens *int
+		options   map[string]any
+		code      int
+		message   string
+	}{
+		{name: "no max tokens", content: strings.Repeat("word ", 32), code: http.StatusOK},
+		{name: "in range", content: "hello there", maxTokens: intPtr(8), code: http.StatusOK},
+		{name: "max tokens over context", content: "hi", maxTokens: intPtr(32), code: http.StatusBadRequest, message: "maximum context length is 16 tokens"},
+		{name: "prompt and max tokens over context", content: strings.Repeat("word ", 10), maxTokens: intPtr(8), code: http.StatusBadRequest, message: "(10 in the messages, 8 in the completion)"},
+		{name: "larger num_ctx", content: "hi", maxTokens: intPtr(32), options: map[string]any{"num_ctx": 64}, code: http.StatusOK},
+		{name: "unknown model", model: "missing", content: "hi", maxTokens: intPtr(32), code: http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			model := tt.model
+			if model == "" {
+				model = "test"
+			}
+
+			w := doRequest(t, r, "/v1/chat/completions", Request{
+				Model:     model,
+				Messages:  []Message{{Role: "user", Content: tt.content}},
+				MaxTokens: tt.maxTokens,
+				Options:   tt.options,
+			})
+			assert.Equal(t, tt.code, w.Code)
+
+			if tt.message != "" {
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Contains(t, resp.Error.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestListMiddleware(t *testing.T) {
+	modified := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+
+	var calls int
+	handler := func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusOK, api.ListResponse{
+			Models: []api.ModelResponse{
+				{Name: "llama2:latest", ModifiedAt: modified},
+				{Name: "jmorgan/mixtral:8x7b", ModifiedAt: modified},
+			},
+		})
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Handle(http.MethodGet, "/v1/models", ListMiddleware(), handler)
+	r.Handle(http.MethodHead, "/v1/models", ListMiddleware(), handler)
+
+	t.Run("get", func(t *testing.T) {
+		calls = 0
+
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var list ListCompletion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Equal(t, "list", list.Object)
+		require.Len(t, list.Data, 2)
+		assert.Equal(t, "llama2:latest", list.Data[0].Id)
+		assert.Equal(t, "jmorgan", list.Data[1].OwnedBy)
+	})
+
+	t.Run("head", func(t *testing.T) {
+		calls = 0
+
+		req := httptest.NewRequest(http.MethodHead, "/v1/models", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Body.Bytes())
+		assert.Zero(t, calls)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		r := gin.New()
+		r.GET("/v1/models", ListMiddleware(), func(c *gin.Context) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "manifests unavailable"})
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "server_error", resp.Error.Type)
+		assert.Equal(t, "manifests unavailable", resp.Error.Message)
+	})
+}
+
+func TestMiddlewareAliases(t *testing.T) {
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		captured = api.ChatRequest{}
+		require.NoError(t, c.ShouldBindJSON(&captured))
+		c.JSON(http.StatusOK, testResponses()[2])
+	}
+
+	r := newRouter(Middleware(WithAliases(map[string]string{"gpt-4o": "llama3"})), capture)
+
+	cases := []struct {
+		model    string
+		expected string
+	}{
+		{model: "gpt-4o", expected: "llama3"},
+		{model: "llama2", expected: "llama2"},
+		{model: "gpt-4", expected: "gpt-4"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.model, func(t *testing.T) {
+			w := doRequest(t, r, "/v1/chat/completions", Request{
+				Model:    tt.model,
+				Messages: []Message{{Role: "user", Content: "Hi"}},
+			})
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.expected, captured.Model)
+		})
+	}
+}
+
+func TestListMiddlewareAliases(t *testing.T) {
+	modified := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/v1/models", ListMiddleware(WithAliases(map[string]string{
+		"gpt-4o":        "llama3",
+		"gpt-3.5-turbo": "llama2:7b",
+		"gpt-4":         "missing",
+		"mistral":       "llama3",
+	})), func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.ListResponse{
+			Models: []api.ModelResponse{
+				{Name: "llama3:latest", ModifiedAt: modified},
+				{Name: "llama2:7b", ModifiedAt: modified},
+				{Name: "mistral:latest", ModifiedAt: modified},
+			},
+		})
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var list ListCompletion
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+
+	var ids []string
+	for _, m := range list.Data {
+		ids = append(ids, m.Id)
+	}
+	assert.Equal(t, []string{"llama3:latest", "llama2:7b", "mistral:latest", "gpt-3.5-turbo", "gpt-4o"}, ids)
+	assert.Equal(t, modified.Unix(), list.Data[4].Created)
+}
+
+func TestRetrieveMiddleware(t *testing.T) {
+	modified := time.Date(2024, 2, 1, 12, 0, 0, 0, time.UTC)
+
+	var requested string
+	handler := func(c *gin.Context) {
+		var req api.ShowRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+		requested = req.Name
+
+		if req.Name == "missing" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, api.ShowResponse{ModifiedAt: modified})
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/v1/models/*model", RetrieveMiddleware(WithAliases(map[string]string{"gpt-4o": "llama3"})), handler)
+
+	cases := []struct {
+		name      string
+		path      string
+		requested string
+		model     Model
+	}{
+		{name: "library", path: "/v1/models/llama2", requested: "llama2", model: Model{Id: "llama2", Object: "model", Created: modified.Unix(), OwnedBy: "library"}},
+		{name: "namespace", path: "/v1/models/jmorgan/mixtral:8x7b", requested: "jmorgan/mixtral:8x7b", model: Model{Id: "jmorgan/mixtral:8x7b", Object: "model", Created: modified.Unix(), OwnedBy: "jmorgan"}},
+		{name: "alias", path: "/v1/models/gpt-4o", requested: "llama3", model: Model{Id: "gpt-4o", Object: "model", Created: modified.Unix(), OwnedBy: "library"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.requested, requested)
+
+			var model Model
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &model))
+			assert.Equal(t, tt.model, model)
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models/missing", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "not_found_error", resp.Error.Type)
+		assert.Equal(t, "model_not_found", *resp.Error.Code)
+		assert.Equal(t, "model", resp.Error.Param)
+		assert.Equal(t, "model 'missing' not found", resp.Error.Message)
+	})
+}
+
+func TestDeleteMiddleware(t *testing.T) {
+	var deleted string
+	handler := func(c *gin.Context) {
+		var req api.DeleteRequest
+		require.NoError(t, c.ShouldBindJSON(&req))
+
+		if req.Name == "missing" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found"})
+			return
+		}
+
+		deleted = req.Name
+		c.JSON(http.StatusOK, nil)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.DELETE("/v1/models/*model", DeleteMiddleware(), handler)
+
+	t.Run("deleted", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/v1/models/jmorgan/mixtral:8x7b", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "jmorgan/mixtral:8x7b", deleted)
+
+		var resp ModelDeleted
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, ModelDeleted{Id: "jmorgan/mixtral:8x7b", Object: "model", Deleted: true}, resp)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/v1/models/missing", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusNotFound, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "not_found_error", resp.Error.Type)
+		assert.Equal(t, "model_not_found", *resp.Error.Code)
+	})
+}
+
+// capabilityBackend reports the capabilities of each model it knows
+type capabilityBackend map[string][]string
+
+func (b capabilityBackend) ModelInfo(_ context.Context, model string) (ModelInfo, error) {
+	capabilities, ok := b[model]
+	if !ok {
+		return ModelInfo{}, errors.New("model not found")
+	}
+
+	return ModelInfo{ContextLength: 2048, Capabilities: capabilities}, nil
+}
+
+func (b capabilityBackend) Tokenize(_ context.Context, _ string, _ map[string]any, content string) ([]int, error) {
+	return make([]int, len(strings.Fields(content))), nil
+}
+
+func TestListMiddlewareCapability(t *testing.T) {
+	handler := func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.ListResponse{
+			Models: []api.ModelResponse{
+				{Name: "llama2:latest"},
+				{Name: "nomic-embed-text:latest"},
+				{Name: "missing:latest"},
+			},
+		})
+	}
+
+	backend := capabilityBackend{
+		"llama2:latest":           {"chat", "embedding"},
+		"nomic-embed-text:latest": {"embedding"},
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/v1/models", ListMiddleware(WithBackend(backend)), handler)
+
+	cases := []struct {
+		name     string
+		query    string
+		code     int
+		expected []string
+	}{
+		{name: "unfiltered", code: http.StatusOK, expected: []string{"llama2:latest", "nomic-embed-text:latest", "missing:latest"}},
+		{name: "chat", query: "?capability=chat", code: http.StatusOK, expected: []string{"llama2:latest"}},
+		{name: "embedding", query: "?capability=embedding", code: http.StatusOK, expected: []string{"llama2:latest", "nomic-embed-text:latest"}},
+		{name: "unknown", query: "?capability=vision", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/models"+tt.query, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, tt.code, w.Code)
+
+			if tt.code != http.StatusOK {
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, "capability", resp.Error.Param)
+				return
+			}
+
+			var list ListCompletion
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+
+			var ids []string
+			for _, m := range list.Data {
+				ids = append(ids, m.Id)
+			}
+			assert.Equal(t, tt.expected, ids)
+		})
+	}
+
+	t.Run("without backend", func(t *testing.T) {
+		r := gin.New()
+		r.GET("/v1/models", ListMiddleware(), handler)
+
+		req := httptest.NewRequest(http.MethodGet, "/v1/models?capability=chat", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestReasoner(t *testing.T) {
+	cases := []struct {
+		name      string
+		pieces    []string
+		content   string
+		reasoning string
+	}{
+		{name: "whole", pieces: []string{"<think>\nLet me think.\n</think>\n\nThe answer is 4."}, content: "The answer is 4.", reasoning: "Let me think.\n"},
+		{name: "no block", pieces: []string{"The answer ", "is 4."}, content: "The answer is 4."},
+		{name: "split tags", pieces: []string{"<th", "ink>Let me", " think.</thi", "nk>The ", "answer"}, content: "The answer", reasoning: "Let me think."},
+		{name: "split one character at a time", pieces: strings.Split("<think>hmm</think>ok", ""), content: "ok", reasoning: "hmm"},
+		{name: "angle bracket", pieces: []string{"1 <", " 2"}, content: "1 < 2"},
+		{name: "unterminated", pieces: []string{"<think>still", " thinking"}, reasoning: "still thinking"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var r reasoner
+			var content, reasoning strings.Builder
+			for i, piece := range tt.pieces {
+				c, rc := r.next(piece, i == len(tt.pieces)-1)
+				content.WriteString(c)
+				reasoning.WriteString(rc)
+			}
+
+			assert.Equal(t, tt.content, content.String())
+			assert.Equal(t, tt.reasoning, reasoning.String())
+		})
+	}
+}
+
+func TestMiddlewareReasoning(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	responses := []api.ChatResponse{
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: "<thi"}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: "nk>Two plus two</th"}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: "ink>\n\nIt's 4."}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant"}, Done: true},
+	}
+
+	req := Request{Model: "test", Messages: []Message{{Role: "user", Content: "What is 2+2?"}}}
+
+	t.Run("unset", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, responses...))
+		w := doRequest(t, r, "/v1/chat/completions", req)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, "<think>Two plus two</think>\n\nIt's 4.", completion.Choices[0].Message.Content)
+		assert.NotContains(t, w.Body.String(), "reasoning_content")
+	})
+
+	t.Run("separate", func(t *testing.T) {
+		r := newRouter(Middleware(WithReasoning(ReasoningSeparate)), chatHandler(t, responses...))
+		w := doRequest(t, r, "/v1/chat/completions", req)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, "It's 4.", completion.Choices[0].Message.Content)
+		assert.Equal(t, "Two plus two", completion.Choices[0].Message.ReasoningContent)
+	})
+
+	t.Run("strip", func(t *testing.T) {
+		r := newRouter(Middleware(WithReasoning(ReasoningStrip)), chatHandler(t, responses...))
+		w := doRequest(t, r, "/v1/chat/completions", req)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, "It's 4.", completion.Choices[0].Message.Content)
+		assert.NotContains(t, w.Body.String(), "reasoning_content")
+	})
+
+	t.Run("separate stream", func(t *testing.T) {
+		r := newRouter(Middleware(WithReasoning(ReasoningSeparate)), chatHandler(t, responses...))
+
+		req := req
+		req.Stream = true
+		w := doRequest(t, r, "/v1/chat/completions", req)
+
+		var content, reasoning strings.Builder
+		for _, chunk := range readChunks(t, w.Body) {
+			assert.NotContains(t, chunk.Choices[0].Delta.Content, "<")
+			content.WriteString(chunk.Choices[0].Delta.Content)
+			reasoning.WriteString(chunk.Choices[0].Delta.ReasoningContent)
+		}
+
+		assert.Equal(t, "It's 4.", content.String())
+		assert.Equal(t, "Two plus two", reasoning.String())
+	})
+}
+
+func TestMiddlewareLogprobs(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	responses := []api.ChatResponse{
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: "Hi"}, Logprobs: []api.Logprob{
+			{TokenLogprob: api.TokenLogprob{Token: "Hi", Logprob: -0.5}, TopLogprobs: []api.TokenLogprob{{Token: "Hi", Logprob: -0.5}, {Token: "Hello", Logprob: -1}}},
+		}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: " é"}, Logprobs: []api.Logprob{
+			{TokenLogprob: api.TokenLogprob{Token: " é", Logprob: -0.25}, TopLogprobs: []api.TokenLogprob{{Token: " é", Logprob: -0.25}}},
+		}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant"}, Done: true},
+	}
+
+	var captured api.ChatRequest
+	capture := func(c *gin.Context) {
+		captured = api.ChatRequest{}
+		require.NoError(t, c.ShouldBindBodyWith(&captured, binding.JSON))
+		chatHandler(t, responses...)(c)
+	}
+
+	r := newRouter(Middleware(), capture)
+	messages := []Message{{Role: "user", Content: "Hello"}}
+
+	t.Run("completion", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: messages, Logprobs: ptr(true), TopLogprobs: ptr(2)})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, captured.Logprobs)
+		assert.Equal(t, 2, captured.TopLogprobs)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, &ChoiceLogprobs{Content: []TokenLogprob{
+			{Token: "Hi", Logprob: -0.5, Bytes: []int{72, 105}, TopLogprobs: []TopLogprob{
+				{Token: "Hi", Logprob: -0.5, Bytes: []int{72, 105}},
+				{Token: "Hello", Logprob: -1, Bytes: []int{72, 101, 108, 108, 111}},
+			}},
+			{Token: " é", Logprob: -0.25, Bytes: []int{32, 195, 169}, TopLogprobs: []TopLogprob{
+				{Token: " é", Logprob: -0.25, Bytes: []int{32, 195, 169}},
+			}},
+		}}, completion.Choices[0].Logprobs)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: messages, Stream: true, Logprobs: ptr(true)})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		chunks := readChunks(t, w.Body)
+		require.Len(t, chunks, 3)
+		require.NotNil(t, chunks[0].Choices[0].Logprobs)
+		assert.Equal(t, "Hi", chunks[0].Choices[0].Logprobs.Content[0].Token)
+		require.NotNil(t, chunks[1].Choices[0].Logprobs)
+		assert.Equal(t, " é", chunks[1].Choices[0].Logprobs.Content[0].Token)
+		assert.Nil(t, chunks[2].Choices[0].Logprobs)
+	})
+
+	t.Run("not requested", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/chat/completions", Request{Model: "test", Messages: messages})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.False(t, captured.Logprobs)
+
+		var raw map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+		choice := raw["choices"].([]any)[0].(map[string]any)
+		assert.Contains(t, choice, "logprobs")
+		assert.Nil(t, choice["logprobs"])
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cases := []struct {
+			name string
+			req  Request
+			code string
+		}{
+			{name: "without logprobs", req: Request{TopLogprobs: ptr(2)}, code: "invalid_value"},
+			{name: "logprobs false", req: Request{Logprobs: ptr(false), TopLogprobs: ptr(2)}, code: "invalid_value"},
+			{name: "negative", req: Request{Logprobs: ptr(true), TopLogprobs: ptr(-1)}, code: "integer_below_min_value"},
+			{name: "too many", req: Request{Logprobs: ptr(true), TopLogprobs: ptr(21)}, code: "integer_above_max_value"},
+		}
+
+		for _, tt := range cases {
+			t.Run(tt.name, func(t *testing.T) {
+				tt.req.Model = "test"
+				tt.req.Messages = messages
+				w := doRequest(t, r, "/v1/chat/completions", tt.req)
+				require.Equal(t, http.StatusBadRequest, w.Code)
+
+				var resp ErrorResponse
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				assert.Equal(t, "top_logprobs", resp.Error.Param)
+				assert.Equal(t, tt.code, *resp.Error.Code)
+			})
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package openai
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateWindow is how long rate limits are counted over
+const rateWindow = time.Minute
+
+// RateLimits are the number of requests, and tokens, each client may use a
+// minute. Zero means no limit.
+type RateLimits struct {
+	Requests int
+	Tokens   int
+}
+
+// rateLimitKey is the context key of the function which charges the tokens
+// a request uses to its client
+type rateLimitKey struct{}
+
+// chargeTokens returns the function which charges the tokens a request uses
+// to its client's rate limit, or nil when requests aren't rate limited
+func chargeTokens(ctx context.Context) func(int) {
+	charge, _ := ctx.Value(rateLimitKey{}).(func(int))
+	return charge
+}
+
+// rateUsage is what a client has used in the current window
+type rateUsage struct {
+	start    time.Time
+	requests int
+	tokens   int
+}
+
+type rateLimiter struct {
+	limits RateLimits
+
+	mu      sync.Mutex
+	clients map[string]*rateUsage
+
+	// swept is when clients were last swept of those gone idle
+	swept time.Time
+}
+
+// usage returns the usage of a client in the window of now, starting a new
+// window once the last has passed
+func (l *rateLimiter) usage(client string, now time.Time) *rateUsage {
+	l.evict(now)
+
+	u, ok := l.clients[client]
+	if ok && now.Sub(u.start) < rateWindow {
+		return u
+	}
+
+	u = &rateUsage{start: now}
+	l.clients[client] = u
+	return u
+}
+
+// evict forgets clients whose windows have passed, at most once a window so
+// the clients of a busy server aren't all walked on every request
+func (l *rateLimiter) evict(now time.Time) {
+	if now.Sub(l.swept) < rateWindow {
+		return
+	}
+
+	for k, u := range l.clients {
+		if now.Sub(u.start) >= rateWindow {
+			delete(l.clients, k)
+		}
+	}
+
+	l.swept = now
+}
+
+// take counts a request of client, returning its usage including the request
+// and the error to respond with if it's over a limit
+func (l *rateLimiter) take(client string, now time.Time) (rateUsage, *ErrorResponse) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u := l.usage(client, now)
+	retry := u.start.Add(rateWindow).Sub(now)
+
+	if l.limits.Requests > 0 && u.requests >= l.limits.Requests {
+		resp := NewErrorWithCode(http.StatusTooManyRequests, fmt.Sprintf("Rate limit reached for requests per minute (RPM): Limit %d, Used %d, Requested 1. Please try again in %s.", l.limits.Requests, u.requests, retry.Round(time.Millisecond)), "rate_limit_exceeded", "")
+		return *u, &resp
+	}
+
+	if l.limits.Tokens > 0 && u.tokens >= l.limits.Tokens {
+		resp := NewErrorWithCode(http.StatusTooManyRequests, fmt.Sprintf("Rate limit reached for tokens per minute (TPM): Limit %d, Used %d. Please try again in %s.", l.limits.Tokens, u.tokens, retry.Round(time.Millisecond)), "rate_limit_exceeded", "")
+		resp.Error.Type = "tokens"
+		return *u, &resp
+	}
+
+	u.requests++
+	return *u, nil
+}
+
+func (l *rateLimiter) charge(client string, tokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.usage(client, time.Now()).tokens += tokens
+}
+
+// setHeaders sets the x-ratelimit headers of the limits which are set
+func (l *rateLimiter) setHeaders(c *gin.Context, u rateUsage, now time.Time) {
+	reset := u.start.Add(rateWindow).Sub(now).Round(time.Millisecond).String()
+
+	if l.limits.Requests > 0 {
+		c.Header("x-ratelimit-limit-requests", strconv.Itoa(l.limits.Requests))
+		c.Header("x-ratelimit-remaining-requests", strconv.Itoa(max(l.limits.Requests-u.requests, 0)))
+		c.Header("x-ratelimit-reset-requests", reset)
+	}
+
+	if l.limits.Tokens > 0 {
+		c.Header("x-ratelimit-limit-tokens", strconv.Itoa(l.limits.Tokens))
+		c.Header("x-ratelimit-remaining-tokens", strconv.Itoa(max(l.limits.Tokens-u.tokens, 0)))
+		c.Header("x-ratelimit-reset-tokens", reset)
+	}
+}
+
+// rateLimitClient identifies the client of a request by the API key
+// AuthMiddleware authenticated it with, or otherwise its IP address. Keys
+// which weren't verified aren't trusted, since a client could send a new one
+// with each request to get a fresh limit.
+func rateLimitClient(c *gin.Context) string {
+	if key, ok := c.Request.Context().Value(authKey{}).(string); ok {
+		return "key:" + key
+	}
+
+	return "ip:" + c.ClientIP()
+}
+
+// RateLimitMiddleware limits the requests, and tokens, each client of the
+// OpenAI endpoints may use a minute, setting OpenAI's x-ratelimit headers on
+// responses. Tokens are charged once a response finishes, so a request is
+// only rejected for tokens once earlier ones have used up the limit. Requests
+// a middleware makes on behalf of another, such as for each of its choices,
+// are charged to that request's client without counting as requests.
+func RateLimitMiddleware(limits RateLimits) gin.HandlerFunc {
+	l := &rateLimiter{limits: limits, clients: make(map[string]*rateUsage)}
+
+	return func(c *gin.Context) {
+		if chargeTokens(c.Request.Context()) != nil {
+			c.Next()
+			return
+		}
+
+		client := rateLimitClient(c)
+		now := time.Now()
+		u, resp := l.take(client, now)
+		l.setHeaders(c, u, now)
+		if resp != nil {
+			retry := u.start.Add(rateWindow).Sub(now)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, resp)
+			return
+		}
+
+		ctx := context.WithValue(c.Request.Context(), rateLimitKey{}, func(tokens int) {
+			l.charge(client, tokens)
+		})
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
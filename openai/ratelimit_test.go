@@ -0,0 +1,140 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	body := Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+	}
+
+	request := func(r http.Handler, key string, body Request) *httptest.ResponseRecorder {
+		bts, err := json.Marshal(body)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("requests", func(t *testing.T) {
+		r := newRouter(RateLimitMiddleware(RateLimits{Requests: 2}), Middleware(), chatHandler(t, testResponses()...))
+
+		for _, remaining := range []string{"1", "0"} {
+			w := request(r, "", body)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "2", w.Header().Get("x-ratelimit-limit-requests"))
+			assert.Equal(t, remaining, w.Header().Get("x-ratelimit-remaining-requests"))
+			assert.NotEmpty(t, w.Header().Get("x-ratelimit-reset-requests"))
+			assert.Empty(t, w.Header().Get("x-ratelimit-limit-tokens"))
+		}
+
+		w := request(r, "", body)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "0", w.Header().Get("x-ratelimit-remaining-requests"))
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "requests", resp.Error.Type)
+		assert.Equal(t, "rate_limit_exceeded", *resp.Error.Code)
+
+		// unverified API keys share the limit of their IP address
+		w = request(r, "sk-other", body)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		r := newRouter(AuthMiddleware("sk-test", "sk-other"), RateLimitMiddleware(RateLimits{Requests: 1}), Middleware(), chatHandler(t, testResponses()...))
+
+		w := request(r, "sk-test", body)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = request(r, "sk-test", body)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+		// clients with their own API key have their own limits
+		w = request(r, "sk-other", body)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "0", w.Header().Get("x-ratelimit-remaining-requests"))
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		r := newRouter(RateLimitMiddleware(RateLimits{Tokens: 5}), Middleware(), chatHandler(t, testResponses()...))
+
+		w := request(r, "sk-test", body)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "5", w.Header().Get("x-ratelimit-limit-tokens"))
+		assert.Equal(t, "5", w.Header().Get("x-ratelimit-remaining-tokens"))
+
+		// the first response used all 5 tokens
+		w = request(r, "sk-test", body)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "0", w.Header().Get("x-ratelimit-remaining-tokens"))
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "tokens", resp.Error.Type)
+		assert.Equal(t, "rate_limit_exceeded", *resp.Error.Code)
+	})
+
+	t.Run("choices", func(t *testing.T) {
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.POST("/v1/chat/completions", RateLimitMiddleware(RateLimits{Requests: 2, Tokens: 100}), ChoicesMiddleware(r, "/v1/chat/completions"), Middleware(), chatHandler(t, testResponses()...))
+
+		n := 2
+		choices := body
+		choices.N = &n
+		w := request(r, "", choices)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "1", w.Header().Get("x-ratelimit-remaining-requests"))
+
+		// each choice is charged, but only the request counts against the
+		// request limit
+		w = request(r, "", body)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "0", w.Header().Get("x-ratelimit-remaining-requests"))
+		assert.Equal(t, "90", w.Header().Get("x-ratelimit-remaining-tokens"))
+	})
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	l := &rateLimiter{limits: RateLimits{Requests: 1}, clients: make(map[string]*rateUsage)}
+
+	now := time.Now()
+	for _, client := range []string{"a", "b", "c"} {
+		_, resp := l.take(client, now)
+		require.Nil(t, resp)
+	}
+	assert.Len(t, l.clients, 3)
+
+	_, resp := l.take("d", now.Add(rateWindow/2))
+	require.Nil(t, resp)
+	assert.Len(t, l.clients, 4)
+
+	// clients whose windows have passed are forgotten, and those still in
+	// theirs kept
+	_, resp = l.take("e", now.Add(rateWindow))
+	require.Nil(t, resp)
+	assert.Len(t, l.clients, 2)
+	assert.Contains(t, l.clients, "d")
+	assert.Contains(t, l.clients, "e")
+}
@@ -0,0 +1,803 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// RealtimeSession is the configuration of a realtime session
+type RealtimeSession struct {
+	Id           string   `json:"id"`
+	Object       string   `json:"object"`
+	Model        string   `json:"model"`
+	Modalities   []string `json:"modalities"`
+	Instructions string   `json:"instructions"`
+	Temperature  *float64 `json:"temperature"`
+
+	// MaxResponseOutputTokens is a number of tokens, or "inf"
+	MaxResponseOutputTokens any            `json:"max_response_output_tokens"`
+	Tools                   []ResponseTool `json:"tools"`
+	ToolChoice              any            `json:"tool_choice"`
+}
+
+// RealtimeSessionUpdate is the part of a session a session.update changes.
+// Fields which are omitted are left as they were.
+type RealtimeSessionUpdate struct {
+	Model                   string         `json:"model,omitempty"`
+	Modalities              []string       `json:"modalities,omitempty"`
+	Instructions            *string        `json:"instructions,omitempty"`
+	Temperature             *float64       `json:"temperature,omitempty"`
+	MaxResponseOutputTokens any            `json:"max_response_output_tokens,omitempty"`
+	Tools                   []ResponseTool `json:"tools,omitempty"`
+	ToolChoice              any            `json:"tool_choice,omitempty"`
+}
+
+type RealtimeContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// RealtimeItem is an item of a realtime conversation: a message, a function
+// call or the output of one
+type RealtimeItem struct {
+	Id      string            `json:"id"`
+	Object  string            `json:"object"`
+	Type    string            `json:"type"`
+	Status  string            `json:"status,omitempty"`
+	Role    string            `json:"role,omitempty"`
+	Content []RealtimeContent `json:"content,omitempty"`
+
+	CallId    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+	Output    string `json:"output,omitempty"`
+}
+
+// RealtimeResponseConfig overrides the session's configuration for a single
+// response
+type RealtimeResponseConfig struct {
+	// Conversation is "auto" to add the response to the conversation, or
+	// "none" to leave the conversation as it was
+	Conversation    string         `json:"conversation,omitempty"`
+	Instructions    *string        `json:"instructions,omitempty"`
+	Temperature     *float64       `json:"temperature,omitempty"`
+	MaxOutputTokens any            `json:"max_output_tokens,omitempty"`
+	Tools           []ResponseTool `json:"tools,omitempty"`
+	ToolChoice      any            `json:"tool_choice,omitempty"`
+	Metadata        map[string]any `json:"metadata,omitempty"`
+}
+
+type RealtimeUsage struct {
+	TotalTokens  int `json:"total_tokens"`
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type RealtimeStatusDetails struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+type RealtimeResponse struct {
+	Id            string                 `json:"id"`
+	Object        string                 `json:"object"`
+	Status        string                 `json:"status"`
+	StatusDetails *RealtimeStatusDetails `json:"status_details"`
+	Output        []RealtimeItem         `json:"output"`
+	Metadata      map[string]any         `json:"metadata"`
+	Usage         *RealtimeUsage         `json:"usage"`
+}
+
+// RealtimeClientEvent is an event sent by a realtime client. Only the fields
+// of its type are set.
+type RealtimeClientEvent struct {
+	EventId        string                  `json:"event_id,omitempty"`
+	Type           string                  `json:"type"`
+	Session        *RealtimeSessionUpdate  `json:"session,omitempty"`
+	PreviousItemId *string                 `json:"previous_item_id,omitempty"`
+	Item           *RealtimeItem           `json:"item,omitempty"`
+	ItemId         string                  `json:"item_id,omitempty"`
+	Response       *RealtimeResponseConfig `json:"response,omitempty"`
+}
+
+// RealtimeError is the error of an error event, with the id of the client
+// event which caused it
+type RealtimeError struct {
+	Error
+	EventId string `json:"event_id,omitempty"`
+}
+
+// realtimeEvents are the client events which are handled
+var realtimeEvents = []string{
+	"session.update",
+	"conversation.item.create",
+	"conversation.item.retrieve",
+	"conversation.item.delete",
+	"response.create",
+	"response.cancel",
+}
+
+// realtimeMaxTokens parses a max_response_output_tokens or max_output_tokens,
+// a number of tokens or "inf"
+func realtimeMaxTokens(param string, v any) (*int, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "inf" {
+			return nil, nil
+		}
+	case float64:
+		if v >= 1 && v <= 4096 && v == math.Trunc(v) {
+			n := int(v)
+			return &n, nil
+		}
+	}
+
+	return nil, newParamError(param, "invalid_value", "Invalid '%s': expected an integer between 1 and 4096, or 'inf'.", param)
+}
+
+// validate checks an item a client adds to the conversation
+func (item RealtimeItem) validate() error {
+	switch item.Type {
+	case "message":
+		if !slices.Contains([]string{"user", "assistant", "system"}, item.Role) {
+			return newParamError("item.role", "invalid_value", "Invalid value: '%s'. Supported values are: 'user', 'assistant', and 'system'. - 'item.role'", item.Role)
+		}
+
+		for i, content := range item.Content {
+			switch content.Type {
+			case "input_text", "text", "output_text":
+			case "input_audio", "audio", "output_audio":
+				return newParamError(fmt.Sprintf("item.content[%d].type", i), "invalid_value", "Audio isn't supported, only text content. - 'item.content[%d].type'", i)
+			default:
+				return newParamError(fmt.Sprintf("item.content[%d].type", i), "invalid_value", "Invalid value: '%s'. Supported values are: 'input_text', 'text', and 'output_text'. - 'item.content[%d].type'", content.Type, i)
+			}
+		}
+	case "function_call":
+		if item.CallId == "" || item.Name == "" {
+			return newParamError("item.call_id", "missing_required_parameter", "Missing required parameters: function_call items need a 'call_id' and a 'name'.")
+		}
+	case "function_call_output":
+		if item.CallId == "" {
+			return newParamError("item.call_id", "missing_required_parameter", "Missing required parameter: 'item.call_id'.")
+		}
+	default:
+		return newParamError("item.type", "invalid_value", "Invalid value: '%s'. Supported values are: 'message', 'function_call', and 'function_call_output'. - 'item.type'", item.Type)
+	}
+
+	return nil
+}
+
+// realtimeMessages converts the items of a conversation into chat messages.
+// Function calls are added to the assistant message before them.
+func realtimeMessages(items []RealtimeItem) []Message {
+	var msgs []Message
+	for _, item := range items {
+		switch item.Type {
+		case "message":
+			texts := make([]string, len(item.Content))
+			for i, content := range item.Content {
+				texts[i] = content.Text
+			}
+
+			msgs = append(msgs, Message{Role: item.Role, Content: strings.Join(texts, "\n")})
+		case "function_call":
+			call := ToolCall{Id: item.CallId, Type: "function", Function: ToolCallFunction{Name: item.Name, Arguments: item.Arguments}}
+			if len(msgs) == 0 || msgs[len(msgs)-1].Role != "assistant" {
+				msgs = append(msgs, Message{Role: "assistant"})
+			}
+
+			msgs[len(msgs)-1].ToolCalls = append(msgs[len(msgs)-1].ToolCalls, call)
+		case "function_call_output":
+			msgs = append(msgs, Message{Role: "tool", ToolCallId: item.CallId, Content: item.Output})
+		}
+	}
+
+	return msgs
+}
+
+// realtimeConn is a realtime session over a WebSocket connection
+type realtimeConn struct {
+	ws   *websocket.Conn
+	next http.Handler
+	path string
+
+	// ctx is the context of the request which opened the connection
+	ctx context.Context
+
+	mu      sync.Mutex
+	session RealtimeSession
+	items   []RealtimeItem
+
+	// cancel cancels the response being generated, and done is closed once
+	// it finishes. Both are nil when no response is being generated.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// send sends a server event of type typ with the fields of data
+func (rc *realtimeConn) send(typ string, data map[string]any) {
+	data["type"] = typ
+	data["event_id"] = newId("event_")
+	if err := websocket.JSON.Send(rc.ws, data); err != nil {
+		slog.Debug("openai realtime send", "type", typ, "error", err)
+	}
+}
+
+// sendError sends an error event for err, caused by the client event with
+// eventId
+func (rc *realtimeConn) sendError(eventId string, err error) {
+	rc.send("error", map[string]any{"error": RealtimeError{Error: requestError(err).Error, EventId: eventId}})
+}
+
+// item returns the index of the item with id in the conversation
+func (rc *realtimeConn) item(id string) int {
+	return slices.IndexFunc(rc.items, func(item RealtimeItem) bool { return item.Id == id })
+}
+
+func (rc *realtimeConn) updateSession(update RealtimeSessionUpdate) error {
+	if _, err := realtimeMaxTokens("session.max_response_output_tokens", update.MaxResponseOutputTokens); err != nil {
+		return err
+	}
+
+	if _, err := chatTools("session.tools", update.Tools); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	s := &rc.session
+	if update.Model != "" {
+		s.Model = update.Model
+	}
+
+	if update.Instructions != nil {
+		s.Instructions = *update.Instructions
+	}
+
+	if update.Temperature != nil {
+		s.Temperature = update.Temperature
+	}
+
+	if update.MaxResponseOutputTokens != nil {
+		s.MaxResponseOutputTokens = update.MaxResponseOutputTokens
+	}
+
+	if update.Tools != nil {
+		s.Tools = update.Tools
+	}
+
+	if update.ToolChoice != nil {
+		s.ToolChoice = update.ToolChoice
+	}
+
+	rc.send("session.updated", map[string]any{"session": *s})
+	return nil
+}
+
+func (rc *realtimeConn) createItem(previous *string, item RealtimeItem) error {
+	if err := item.validate(); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if item.Id == "" {
+		item.Id = newId("item_")
+	} else if rc.item(item.Id) >= 0 {
+		return newParamError("item.id", "invalid_value", "Invalid 'item.id': an item with id '%s' already exists.", item.Id)
+	}
+	item.Object = "realtime.item"
+	item.Status = "completed"
+
+	// items are added at the end, at the start after "root", or after the
+	// previous item they name
+	i := len(rc.items)
+	if previous != nil && *previous == "root" {
+		i = 0
+	} else if previous != nil {
+		if i = rc.item(*previous); i < 0 {
+			return newParamError("previous_item_id", "invalid_value", "Invalid 'previous_item_id': no item with id '%s' exists.", *previous)
+		}
+		i++
+	}
+
+	var previousId any
+	if i > 0 {
+		previousId = rc.items[i-1].Id
+	}
+
+	rc.items = slices.Insert(rc.items, i, item)
+	rc.send("conversation.item.created", map[string]any{"previous_item_id": previousId, "item": item})
+	return nil
+}
+
+// chatRequest converts the conversation, and the session's configuration
+// with any overrides of config, into a chat completion request
+func (rc *realtimeConn) chatRequest(config RealtimeResponseConfig) (Request, error) {
+	s := rc.session
+	limit := s.MaxResponseOutputTokens
+	if config.Instructions != nil {
+		s.Instructions = *config.Instructions
+	}
+
+	if config.Temperature != nil {
+		s.Temperature = config.Temperature
+	}
+
+	if config.MaxOutputTokens != nil {
+		limit = config.MaxOutputTokens
+	}
+
+	if config.Tools != nil {
+		s.Tools = config.Tools
+	}
+
+	if config.ToolChoice != nil {
+		s.ToolChoice = config.ToolChoice
+	}
+
+	if config.Conversation != "" && config.Conversation != "auto" && config.Conversation != "none" {
+		return Request{}, newParamError("response.conversation", "invalid_value", "Invalid value: '%s'. Supported values are: 'auto' and 'none'. - 'response.conversation'", config.Conversation)
+	}
+
+	maxTokens, err := realtimeMaxTokens("response.max_output_tokens", limit)
+	if err != nil {
+		return Request{}, err
+	}
+
+	tools, err := chatTools("response.tools", s.Tools)
+	if err != nil {
+		return Request{}, err
+	}
+
+	req := Request{
+		Model:               s.Model,
+		Messages:            realtimeMessages(rc.items),
+		Stream:              true,
+		StreamOptions:       &StreamOptions{IncludeUsage: true},
+		MaxCompletionTokens: maxTokens,
+		Temperature:         s.Temperature,
+		System:              s.Instructions,
+		Tools:               tools,
+		Metadata:            config.Metadata,
+	}
+
+	if len(tools) > 0 {
+		req.ToolChoice = chatToolChoice(s.ToolChoice)
+	}
+
+	return req, nil
+}
+
+func (rc *realtimeConn) createResponse(config RealtimeResponseConfig) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.cancel != nil {
+		return newParamError("", "conversation_already_has_active_response", "Conversation already has an active response.")
+	}
+
+	req, err := rc.chatRequest(config)
+	if err != nil {
+		return err
+	}
+
+	resp := RealtimeResponse{
+		Id:       newId("resp_"),
+		Object:   "realtime.response",
+		Status:   "in_progress",
+		Output:   []RealtimeItem{},
+		Metadata: config.Metadata,
+	}
+
+	ctx, cancel := context.WithCancel(rc.ctx)
+	rc.cancel, rc.done = cancel, make(chan struct{})
+
+	rc.send("response.created", map[string]any{"response": resp})
+	go rc.respond(ctx, req, resp, config.Conversation != "none")
+	return nil
+}
+
+// respond generates a response, adding its output to the conversation when
+// conversation is set
+func (rc *realtimeConn) respond(ctx context.Context, req Request, resp RealtimeResponse, conversation bool) {
+	defer func() {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+
+		rc.cancel()
+		close(rc.done)
+		rc.cancel, rc.done = nil, nil
+	}()
+
+	s := &realtimeStream{rc: rc, ctx: ctx, header: make(http.Header), resp: resp, text: -1, calls: make(map[int]int)}
+	if err := s.generate(req); err != nil {
+		s.fail(requestError(err).Error)
+	}
+
+	s.finish(req.MaxCompletionTokens)
+	if conversation && s.resp.Status != "failed" {
+		rc.mu.Lock()
+		rc.items = append(rc.items, s.resp.Output...)
+		rc.mu.Unlock()
+	}
+
+	rc.send("response.done", map[string]any{"response": s.resp})
+}
+
+func (rc *realtimeConn) cancelResponse() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.cancel == nil {
+		return newParamError("", "response_cancel_not_active", "Cancellation failed: no active response found.")
+	}
+
+	rc.cancel()
+	return nil
+}
+
+func (rc *realtimeConn) handle(event RealtimeClientEvent) error {
+	switch event.Type {
+	case "session.update":
+		if event.Session == nil {
+			return newParamError("session", "missing_required_parameter", "Missing required parameter: 'session'.")
+		}
+
+		return rc.updateSession(*event.Session)
+	case "conversation.item.create":
+		if event.Item == nil {
+			return newParamError("item", "missing_required_parameter", "Missing required parameter: 'item'.")
+		}
+
+		return rc.createItem(event.PreviousItemId, *event.Item)
+	case "conversation.item.retrieve", "conversation.item.delete":
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+
+		i := rc.item(event.ItemId)
+		if i < 0 {
+			return newParamError("item_id", "item_not_found", "Item with item_id not found: %s", event.ItemId)
+		}
+
+		if event.Type == "conversation.item.retrieve" {
+			rc.send("conversation.item.retrieved", map[string]any{"item": rc.items[i]})
+			return nil
+		}
+
+		rc.items = slices.Delete(rc.items, i, i+1)
+		rc.send("conversation.item.deleted", map[string]any{"item_id": event.ItemId})
+		return nil
+	case "response.create":
+		var config RealtimeResponseConfig
+		if event.Response != nil {
+			config = *event.Response
+		}
+
+		return rc.createResponse(config)
+	case "response.cancel":
+		return rc.cancelResponse()
+	}
+
+	if strings.HasPrefix(event.Type, "input_audio_buffer.") || strings.HasPrefix(event.Type, "output_audio_buffer.") || event.Type == "conversation.item.truncate" {
+		return newParamError("type", "invalid_value", "Audio isn't supported, only text turns. - 'type'")
+	}
+
+	return newParamError("type", "invalid_value", "Invalid value: '%s'. Supported values are: '%s'. - 'type'", event.Type, strings.Join(realtimeEvents, "', '"))
+}
+
+// serve handles the events of the client until it disconnects, then cancels
+// any response still being generated
+func (rc *realtimeConn) serve() {
+	rc.send("session.created", map[string]any{"session": rc.session})
+
+	for {
+		var event RealtimeClientEvent
+		if err := websocket.JSON.Receive(rc.ws, &event); err != nil {
+			var serr *json.SyntaxError
+			var terr *json.UnmarshalTypeError
+			if errors.As(err, &serr) || errors.As(err, &terr) {
+				rc.sendError("", err)
+				continue
+			}
+
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("openai realtime receive", "error", err)
+			}
+			break
+		}
+
+		if err := rc.handle(event); err != nil {
+			rc.sendError(event.EventId, err)
+		}
+	}
+
+	rc.mu.Lock()
+	cancel, done := rc.cancel, rc.done
+	rc.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// realtimeStream translates the chunks of a streamed chat completion into
+// the events of a realtime response
+type realtimeStream struct {
+	rc  *realtimeConn
+	ctx context.Context
+
+	header  http.Header
+	code    int
+	pending []byte
+
+	resp   RealtimeResponse
+	reason string
+
+	// text is the output index of the message being streamed, or -1
+	text int
+
+	// calls maps the index of each streamed tool call to its output index
+	calls map[int]int
+
+	// body holds the response when the request fails
+	body bytes.Buffer
+}
+
+func (s *realtimeStream) Header() http.Header {
+	return s.header
+}
+
+func (s *realtimeStream) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+}
+
+// Flush does nothing, as each event is sent as it's written
+func (s *realtimeStream) Flush() {}
+
+func (s *realtimeStream) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+
+	if s.code != http.StatusOK {
+		return s.body.Write(b)
+	}
+
+	s.pending = append(s.pending, b...)
+	for {
+		event, rest, ok := bytes.Cut(s.pending, []byte("\n\n"))
+		if !ok {
+			return len(b), nil
+		}
+		s.pending = rest
+
+		data, ok := eventData(event)
+		if !ok || string(data) == "[DONE]" || s.resp.Status == "failed" {
+			continue
+		}
+
+		var failure ErrorResponse
+		if err := json.Unmarshal(data, &failure); err == nil && failure.Error.Message != "" {
+			s.fail(failure.Error)
+			continue
+		}
+
+		var chunk Chunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return 0, err
+		}
+
+		s.chunk(chunk)
+	}
+}
+
+// generate sends req to the chat completion handler, streaming its chunks
+// as events
+func (s *realtimeStream) generate(req Request) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.rc.path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	s.rc.next.ServeHTTP(s, r)
+	if s.code != http.StatusOK {
+		var resp ErrorResponse
+		if err := json.Unmarshal(s.body.Bytes(), &resp); err != nil {
+			return errors.New("unexpected response")
+		}
+
+		s.fail(resp.Error)
+	}
+
+	return nil
+}
+
+// fail ends the response with an error, unless it was cancelled
+func (s *realtimeStream) fail(e Error) {
+	if s.ctx.Err() != nil || s.resp.Status == "failed" {
+		return
+	}
+
+	s.resp.Status = "failed"
+	s.resp.StatusDetails = &RealtimeStatusDetails{Type: "failed", Error: &e}
+	s.rc.send("error", map[string]any{"error": RealtimeError{Error: e}})
+}
+
+func (s *realtimeStream) chunk(chunk Chunk) {
+	if len(chunk.Choices) == 0 {
+		if chunk.Usage != nil {
+			s.resp.Usage = &RealtimeUsage{TotalTokens: chunk.Usage.TotalTokens, InputTokens: chunk.Usage.PromptTokens, OutputTokens: chunk.Usage.CompletionTokens}
+		}
+
+		return
+	}
+
+	choice := chunk.Choices[0]
+	if choice.FinishReason != nil {
+		s.reason = *choice.FinishReason
+	}
+
+	if choice.Delta.Content != "" {
+		if s.text < 0 {
+			s.text = len(s.resp.Output)
+			item := RealtimeItem{Id: newId("item_"), Object: "realtime.item", Type: "message", Status: "in_progress", Role: "assistant"}
+			s.resp.Output = append(s.resp.Output, item)
+			s.rc.send("response.output_item.added", map[string]any{"response_id": s.resp.Id, "output_index": s.text, "item": item})
+
+			part := RealtimeContent{Type: "text"}
+			s.resp.Output[s.text].Content = []RealtimeContent{part}
+			s.rc.send("response.content_part.added", map[string]any{"response_id": s.resp.Id, "item_id": item.Id, "output_index": s.text, "content_index": 0, "part": part})
+		}
+
+		item := &s.resp.Output[s.text]
+		item.Content[0].Text += choice.Delta.Content
+		s.rc.send("response.output_text.delta", map[string]any{"response_id": s.resp.Id, "item_id": item.Id, "output_index": s.text, "content_index": 0, "delta": choice.Delta.Content})
+	}
+
+	for _, call := range choice.Delta.ToolCalls {
+		var index int
+		if call.Index != nil {
+			index = *call.Index
+		}
+
+		i, ok := s.calls[index]
+		if !ok {
+			s.closeText()
+
+			i = len(s.resp.Output)
+			s.calls[index] = i
+
+			item := RealtimeItem{Id: newId("item_"), Object: "realtime.item", Type: "function_call", Status: "in_progress", CallId: call.Id, Name: call.Function.Name}
+			s.resp.Output = append(s.resp.Output, item)
+			s.rc.send("response.output_item.added", map[string]any{"response_id": s.resp.Id, "output_index": i, "item": item})
+		}
+
+		item := &s.resp.Output[i]
+		item.Arguments += call.Function.Arguments
+		s.rc.send("response.function_call_arguments.delta", map[string]any{"response_id": s.resp.Id, "item_id": item.Id, "output_index": i, "call_id": item.CallId, "delta": call.Function.Arguments})
+	}
+}
+
+// closeText ends the message being streamed, if any
+func (s *realtimeStream) closeText() {
+	if s.text < 0 {
+		return
+	}
+
+	i := s.text
+	s.text = -1
+
+	item := &s.resp.Output[i]
+	item.Status = "completed"
+	part := item.Content[0]
+	s.rc.send("response.output_text.done", map[string]any{"response_id": s.resp.Id, "item_id": item.Id, "output_index": i, "content_index": 0, "text": part.Text})
+	s.rc.send("response.content_part.done", map[string]any{"response_id": s.resp.Id, "item_id": item.Id, "output_index": i, "content_index": 0, "part": part})
+	s.rc.send("response.output_item.done", map[string]any{"response_id": s.resp.Id, "output_index": i, "item": *item})
+}
+
+// finish ends the items of the response and sets its status. It's
+// cancelled if the client cancelled it, and incomplete if generation reached
+// maxTokens.
+func (s *realtimeStream) finish(maxTokens *int) {
+	s.closeText()
+
+	for i := range s.resp.Output {
+		item := &s.resp.Output[i]
+		if item.Type != "function_call" || item.Status == "completed" {
+			continue
+		}
+
+		item.Status = "completed"
+		s.rc.send("response.function_call_arguments.done", map[string]any{"response_id": s.resp.Id, "item_id": item.Id, "output_index": i, "call_id": item.CallId, "arguments": item.Arguments})
+		s.rc.send("response.output_item.done", map[string]any{"response_id": s.resp.Id, "output_index": i, "item": *item})
+	}
+
+	switch {
+	case s.ctx.Err() != nil:
+		s.resp.Status = "cancelled"
+		s.resp.StatusDetails = &RealtimeStatusDetails{Type: "cancelled", Reason: "client_cancelled"}
+	case s.resp.Status == "failed":
+	case s.reason == "length" || (maxTokens != nil && s.resp.Usage != nil && s.resp.Usage.OutputTokens >= *maxTokens):
+		s.resp.Status = "incomplete"
+		s.resp.StatusDetails = &RealtimeStatusDetails{Type: "incomplete", Reason: "max_output_tokens"}
+	default:
+		s.resp.Status = "completed"
+	}
+}
+
+// RealtimeMiddleware serves /v1/realtime, OpenAI's realtime API over a
+// WebSocket, for text turns. The model is named by the URL's model query
+// parameter. Each response is generated as a streamed chat completion sent to
+// next for path, with the conversation so far as its messages.
+func RealtimeMiddleware(next http.Handler, path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		model := c.Query("model")
+		if model == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(newParamError("model", "missing_required_parameter", "Missing required parameter: 'model'.")))
+			return
+		}
+
+		server := websocket.Server{
+			// browsers can't set headers, so they offer their key as a
+			// protocol alongside "realtime", which is the one accepted
+			Handshake: func(config *websocket.Config, r *http.Request) error {
+				if slices.Contains(config.Protocol, "realtime") {
+					config.Protocol = []string{"realtime"}
+				} else {
+					config.Protocol = nil
+				}
+				return nil
+			},
+			Handler: func(ws *websocket.Conn) {
+				rc := &realtimeConn{
+					ws:   ws,
+					next: next,
+					path: path,
+					ctx:  c.Request.Context(),
+					session: RealtimeSession{
+						Id:                      newId("sess_"),
+						Object:                  "realtime.session",
+						Model:                   model,
+						Modalities:              []string{"text"},
+						MaxResponseOutputTokens: "inf",
+						Tools:                   []ResponseTool{},
+						ToolChoice:              "auto",
+					},
+				}
+
+				rc.serve()
+			},
+		}
+
+		server.ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+	}
+}
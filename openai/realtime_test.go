@@ -0,0 +1,324 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestRealtimeMaxTokens(t *testing.T) {
+	n, err := realtimeMaxTokens("max", nil)
+	require.NoError(t, err)
+	assert.Nil(t, n)
+
+	n, err = realtimeMaxTokens("max", "inf")
+	require.NoError(t, err)
+	assert.Nil(t, n)
+
+	n, err = realtimeMaxTokens("max", 64.0)
+	require.NoError(t, err)
+	assert.Equal(t, ptr(64), n)
+
+	for _, v := range []any{0.0, 1.5, 5000.0, "64"} {
+		_, err := realtimeMaxTokens("max", v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestRealtimeMessages(t *testing.T) {
+	assert.Equal(t, []Message{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "What's the weather\nin Paris?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{Id: "call_1", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}}}},
+		{Role: "tool", ToolCallId: "call_1", Content: "Sunny"},
+	}, realtimeMessages([]RealtimeItem{
+		{Type: "message", Role: "system", Content: []RealtimeContent{{Type: "input_text", Text: "Be brief."}}},
+		{Type: "message", Role: "user", Content: []RealtimeContent{{Type: "input_text", Text: "What's the weather"}, {Type: "input_text", Text: "in Paris?"}}},
+		{Type: "function_call", CallId: "call_1", Name: "get_weather", Arguments: `{"city":"Paris"}`},
+		{Type: "function_call_output", CallId: "call_1", Output: "Sunny"},
+	}))
+}
+
+// realtimeClient is a connection to a realtime test server
+type realtimeClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+func dialRealtime(t *testing.T, handler gin.HandlerFunc, query string) *realtimeClient {
+	t.Helper()
+
+	r := newRouter(Middleware(), handler)
+	r.GET("/v1/realtime", RealtimeMiddleware(r, "/v1/chat/completions"))
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/realtime"+query, srv.URL)
+	require.NoError(t, err)
+	config.Protocol = []string{"realtime", "openai-insecure-api-key.sk-test"}
+
+	ws, err := websocket.DialConfig(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.Close() })
+
+	return &realtimeClient{t: t, ws: ws}
+}
+
+func (c *realtimeClient) send(event RealtimeClientEvent) {
+	c.t.Helper()
+	require.NoError(c.t, websocket.JSON.Send(c.ws, event))
+}
+
+func (c *realtimeClient) receive() map[string]any {
+	c.t.Helper()
+
+	require.NoError(c.t, c.ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var event map[string]any
+	require.NoError(c.t, websocket.JSON.Receive(c.ws, &event))
+	assert.True(c.t, strings.HasPrefix(event["event_id"].(string), "event_"))
+	return event
+}
+
+// receiveUntil returns the events received up to and including the first of
+// type typ
+func (c *realtimeClient) receiveUntil(typ string) []map[string]any {
+	c.t.Helper()
+
+	var events []map[string]any
+	for {
+		event := c.receive()
+		events = append(events, event)
+		if event["type"] == typ {
+			return events
+		}
+	}
+}
+
+func eventTypes(events []map[string]any) []string {
+	types := make([]string, len(events))
+	for i, event := range events {
+		types[i] = event["type"].(string)
+	}
+	return types
+}
+
+func TestRealtimeMiddleware(t *testing.T) {
+	userItem := func(text string) *RealtimeItem {
+		return &RealtimeItem{Type: "message", Role: "user", Content: []RealtimeContent{{Type: "input_text", Text: text}}}
+	}
+
+	t.Run("text turn", func(t *testing.T) {
+		reqs := make(chan api.ChatRequest, 2)
+		responses := chatHandler(t, testResponses()...)
+		c := dialRealtime(t, func(c *gin.Context) {
+			body, err := io.ReadAll(c.Request.Body)
+			require.NoError(t, err)
+
+			var req api.ChatRequest
+			require.NoError(t, json.Unmarshal(body, &req))
+			reqs <- req
+
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			responses(c)
+		}, "?model=test")
+
+		created := c.receive()
+		assert.Equal(t, "session.created", created["type"])
+		session := created["session"].(map[string]any)
+		assert.Equal(t, "test", session["model"])
+		assert.Equal(t, "inf", session["max_response_output_tokens"])
+
+		c.send(RealtimeClientEvent{Type: "session.update", Session: &RealtimeSessionUpdate{Instructions: ptr("Be brief.")}})
+		updated := c.receive()
+		assert.Equal(t, "session.updated", updated["type"])
+		assert.Equal(t, "Be brief.", updated["session"].(map[string]any)["instructions"])
+
+		c.send(RealtimeClientEvent{Type: "conversation.item.create", Item: userItem("Hi")})
+		item := c.receive()
+		assert.Equal(t, "conversation.item.created", item["type"])
+		assert.Nil(t, item["previous_item_id"])
+		userId := item["item"].(map[string]any)["id"].(string)
+		assert.True(t, strings.HasPrefix(userId, "item_"))
+
+		c.send(RealtimeClientEvent{Type: "response.create"})
+		events := c.receiveUntil("response.done")
+		assert.Equal(t, []string{
+			"response.created",
+			"response.output_item.added",
+			"response.content_part.added",
+			"response.output_text.delta",
+			"response.output_text.delta",
+			"response.output_text.done",
+			"response.content_part.done",
+			"response.output_item.done",
+			"response.done",
+		}, eventTypes(events))
+		assert.Equal(t, "Hello", events[3]["delta"])
+		assert.Equal(t, "Hello, world", events[5]["text"])
+
+		var done RealtimeResponse
+		d, err := json.Marshal(events[len(events)-1]["response"])
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(d, &done))
+		assert.Equal(t, "completed", done.Status)
+		assert.Equal(t, &RealtimeUsage{TotalTokens: 5, InputTokens: 3, OutputTokens: 2}, done.Usage)
+		require.Len(t, done.Output, 1)
+		assert.Equal(t, []RealtimeContent{{Type: "text", Text: "Hello, world"}}, done.Output[0].Content)
+
+		assert.Equal(t, []api.Message{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "Hi"}}, (<-reqs).Messages)
+
+		// the response is part of the conversation of the next
+		c.send(RealtimeClientEvent{Type: "conversation.item.create", Item: userItem("Again")})
+		item = c.receive()
+		assert.Equal(t, done.Output[0].Id, item["previous_item_id"])
+
+		c.send(RealtimeClientEvent{Type: "response.create", Response: &RealtimeResponseConfig{Conversation: "none", Instructions: ptr("")}})
+		c.receiveUntil("response.done")
+
+		assert.Equal(t, []api.Message{
+			{Role: "user", Content: "Hi"},
+			{Role: "assistant", Content: "Hello, world"},
+			{Role: "user", Content: "Again"},
+		}, (<-reqs).Messages)
+
+		// out of band responses aren't added to the conversation
+		c.send(RealtimeClientEvent{Type: "conversation.item.retrieve", ItemId: done.Output[0].Id})
+		assert.Equal(t, "conversation.item.retrieved", c.receive()["type"])
+
+		c.send(RealtimeClientEvent{Type: "conversation.item.delete", ItemId: userId})
+		deleted := c.receive()
+		assert.Equal(t, "conversation.item.deleted", deleted["type"])
+		assert.Equal(t, userId, deleted["item_id"])
+	})
+
+	t.Run("function call", func(t *testing.T) {
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		c := dialRealtime(t, chatHandler(t,
+			api.ChatResponse{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: `{"tool_calls": [{"name": "get_weather", "arguments": {"city": "Paris"}}]}`}},
+			api.ChatResponse{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant"}, Done: true},
+		), "?model=test")
+		c.receive()
+
+		tools := []ResponseTool{{Type: "function", Name: "get_weather", Parameters: json.RawMessage(`{"type":"object"}`)}}
+		c.send(RealtimeClientEvent{Type: "session.update", Session: &RealtimeSessionUpdate{Tools: tools}})
+		c.receive()
+
+		c.send(RealtimeClientEvent{Type: "conversation.item.create", Item: userItem("What's the weather in Paris?")})
+		c.receive()
+
+		c.send(RealtimeClientEvent{Type: "response.create"})
+		events := c.receiveUntil("response.done")
+		assert.Equal(t, []string{
+			"response.created",
+			"response.output_item.added",
+			"response.function_call_arguments.delta",
+			"response.function_call_arguments.done",
+			"response.output_item.done",
+			"response.done",
+		}, eventTypes(events))
+
+		assert.Equal(t, `{"city": "Paris"}`, events[3]["arguments"])
+		item := events[4]["item"].(map[string]any)
+		assert.Equal(t, "function_call", item["type"])
+		assert.Equal(t, "get_weather", item["name"])
+		assert.True(t, strings.HasPrefix(item["call_id"].(string), "call_"))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		cancelled := make(chan error, 1)
+		c := dialRealtime(t, slowHandler(t, 10*time.Millisecond, cancelled), "?model=test")
+		c.receive()
+
+		c.send(RealtimeClientEvent{Type: "conversation.item.create", Item: userItem("Hi")})
+		c.receive()
+
+		c.send(RealtimeClientEvent{Type: "response.create"})
+		c.receiveUntil("response.output_text.delta")
+
+		// only one response may be generated at a time
+		c.send(RealtimeClientEvent{EventId: "evt_1", Type: "response.create"})
+		failure := c.receiveUntil("error")
+		errorEvent := failure[len(failure)-1]["error"].(map[string]any)
+		assert.Equal(t, "conversation_already_has_active_response", errorEvent["code"])
+		assert.Equal(t, "evt_1", errorEvent["event_id"])
+
+		c.send(RealtimeClientEvent{Type: "response.cancel"})
+		events := c.receiveUntil("response.done")
+		assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+		response := events[len(events)-1]["response"].(map[string]any)
+		assert.Equal(t, "cancelled", response["status"])
+		assert.Equal(t, map[string]any{"type": "cancelled", "reason": "client_cancelled"}, response["status_details"])
+
+		c.send(RealtimeClientEvent{Type: "response.cancel"})
+		assert.Equal(t, "response_cancel_not_active", c.receive()["error"].(map[string]any)["code"])
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		c := dialRealtime(t, chatHandler(t, testResponses()...), "?model=test")
+		c.receive()
+
+		cases := []struct {
+			event RealtimeClientEvent
+			param string
+		}{
+			{event: RealtimeClientEvent{Type: "input_audio_buffer.append"}, param: "type"},
+			{event: RealtimeClientEvent{Type: "unknown"}, param: "type"},
+			{event: RealtimeClientEvent{Type: "conversation.item.create", Item: &RealtimeItem{Type: "message", Role: "user", Content: []RealtimeContent{{Type: "input_audio"}}}}, param: "item.content[0].type"},
+			{event: RealtimeClientEvent{Type: "conversation.item.create", Item: &RealtimeItem{Type: "message", Role: "tool"}}, param: "item.role"},
+			{event: RealtimeClientEvent{Type: "conversation.item.create", Item: userItem("Hi"), PreviousItemId: ptr("item_missing")}, param: "previous_item_id"},
+			{event: RealtimeClientEvent{Type: "conversation.item.delete", ItemId: "item_missing"}, param: "item_id"},
+			{event: RealtimeClientEvent{Type: "session.update", Session: &RealtimeSessionUpdate{MaxResponseOutputTokens: 0}}, param: "session.max_response_output_tokens"},
+			{event: RealtimeClientEvent{Type: "session.update", Session: &RealtimeSessionUpdate{Tools: []ResponseTool{{Type: "web_search"}}}}, param: "session.tools[0].type"},
+		}
+
+		for _, tt := range cases {
+			c.send(tt.event)
+			event := c.receive()
+			require.Equal(t, "error", event["type"], tt.param)
+			e := event["error"].(map[string]any)
+			assert.Equal(t, "invalid_request_error", e["type"])
+			assert.Equal(t, tt.param, e["param"])
+		}
+	})
+
+	t.Run("model not found", func(t *testing.T) {
+		c := dialRealtime(t, func(c *gin.Context) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+		}, "?model=missing")
+		c.receive()
+
+		c.send(RealtimeClientEvent{Type: "conversation.item.create", Item: userItem("Hi")})
+		c.receive()
+
+		c.send(RealtimeClientEvent{Type: "response.create"})
+		events := c.receiveUntil("response.done")
+		assert.Equal(t, []string{"response.created", "error", "response.done"}, eventTypes(events))
+		assert.Equal(t, "model_not_found", events[1]["error"].(map[string]any)["code"])
+		assert.Equal(t, "failed", events[2]["response"].(map[string]any)["status"])
+	})
+
+	t.Run("missing model", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+		r.GET("/v1/realtime", RealtimeMiddleware(r, "/v1/chat/completions"))
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/realtime", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
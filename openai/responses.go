@@ -0,0 +1,789 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ResponseRequest struct {
+	Model string `json:"model"`
+
+	// Input is a string, or an array of messages, function calls and their
+	// outputs
+	Input json.RawMessage `json:"input"`
+
+	// Instructions are sent to the model as a system message ahead of the
+	// input
+	Instructions      string         `json:"instructions"`
+	Stream            bool           `json:"stream"`
+	MaxOutputTokens   *int           `json:"max_output_tokens"`
+	Temperature       *float64       `json:"temperature"`
+	TopP              *float64       `json:"top_p"`
+	Tools             []ResponseTool `json:"tools"`
+	ToolChoice        any            `json:"tool_choice"`
+	ParallelToolCalls *bool          `json:"parallel_tool_calls"`
+	Text              *ResponseText  `json:"text"`
+
+	// PreviousResponseId continues a stored response. Responses are never
+	// stored, so it's rejected, and Store is accepted but has no effect.
+	PreviousResponseId string `json:"previous_response_id"`
+	Store              *bool  `json:"store"`
+
+	Metadata map[string]any `json:"metadata"`
+	User     string         `json:"user"`
+}
+
+// ResponseTool is a function the model may call. Unlike chat completion
+// tools, the function is described at the top level.
+type ResponseTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type ResponseText struct {
+	Format ResponseTextFormat `json:"format"`
+}
+
+// ResponseTextFormat is "text", "json_object", or a "json_schema" with its
+// schema inline
+type ResponseTextFormat struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// ResponseInputItem is an item of a request's input: a message, a function
+// call the model made or the output of one
+type ResponseInputItem struct {
+	// Type is "message" when it's omitted
+	Type string `json:"type,omitempty"`
+	Role string `json:"role,omitempty"`
+
+	// Content of a message is a string or an array of input_text,
+	// output_text and input_image parts
+	Content json.RawMessage `json:"content,omitempty"`
+
+	CallId    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+	Output    string `json:"output,omitempty"`
+}
+
+type ResponseInputContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ResponseOutputItem is a message or function call of a response
+type ResponseOutputItem struct {
+	Type   string `json:"type"`
+	Id     string `json:"id"`
+	Status string `json:"status"`
+
+	// Role and Content are set for messages
+	Role    string               `json:"role"`
+	Content []ResponseOutputText `json:"content"`
+
+	// CallId, Name and Arguments are set for function calls
+	CallId    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// MarshalJSON encodes an output item with only the fields of its type
+func (i ResponseOutputItem) MarshalJSON() ([]byte, error) {
+	if i.Type == "function_call" {
+		return json.Marshal(struct {
+			Type      string `json:"type"`
+			Id        string `json:"id"`
+			Status    string `json:"status"`
+			CallId    string `json:"call_id"`
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		}{i.Type, i.Id, i.Status, i.CallId, i.Name, i.Arguments})
+	}
+
+	content := i.Content
+	if content == nil {
+		content = []ResponseOutputText{}
+	}
+
+	return json.Marshal(struct {
+		Type    string               `json:"type"`
+		Id      string               `json:"id"`
+		Status  string               `json:"status"`
+		Role    string               `json:"role"`
+		Content []ResponseOutputText `json:"content"`
+	}{i.Type, i.Id, i.Status, i.Role, content})
+}
+
+type ResponseOutputText struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type ResponseUsage struct {
+	InputTokens         int                        `json:"input_tokens"`
+	InputTokensDetails  ResponseInputTokensDetails `json:"input_tokens_details"`
+	OutputTokens        int                        `json:"output_tokens"`
+	OutputTokensDetails ResponseOutputTokenDetails `json:"output_tokens_details"`
+	TotalTokens         int                        `json:"total_tokens"`
+}
+
+type ResponseInputTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+type ResponseOutputTokenDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+type IncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type Response struct {
+	Id                string               `json:"id"`
+	Object            string               `json:"object"`
+	CreatedAt         int64                `json:"created_at"`
+	Status            string               `json:"status"`
+	Model             string               `json:"model"`
+	Output            []ResponseOutputItem `json:"output"`
+	Error             *Error               `json:"error"`
+	IncompleteDetails *IncompleteDetails   `json:"incomplete_details"`
+	Instructions      *string              `json:"instructions"`
+	MaxOutputTokens   *int                 `json:"max_output_tokens"`
+	Temperature       *float64             `json:"temperature"`
+	TopP              *float64             `json:"top_p"`
+	Tools             []ResponseTool       `json:"tools"`
+	ToolChoice        any                  `json:"tool_choice"`
+	ParallelToolCalls bool                 `json:"parallel_tool_calls"`
+	Metadata          map[string]any       `json:"metadata"`
+	Usage             *ResponseUsage       `json:"usage"`
+}
+
+// inputItems returns the items of a request's input, which may be a single
+// user message as a string
+func (r ResponseRequest) inputItems() ([]ResponseInputItem, error) {
+	if len(r.Input) == 0 || string(r.Input) == "null" {
+		return nil, newParamError("input", "missing_required_parameter", "Missing required parameter: 'input'.")
+	}
+
+	var text string
+	if err := json.Unmarshal(r.Input, &text); err == nil {
+		content, _ := json.Marshal(text)
+		return []ResponseInputItem{{Type: "message", Role: "user", Content: content}}, nil
+	}
+
+	var items []ResponseInputItem
+	if err := json.Unmarshal(r.Input, &items); err != nil {
+		return nil, newParamError("input", "invalid_type", "Invalid type for 'input': expected a string or an array of input items, but got %s instead.", describeJSON(r.Input))
+	}
+
+	if len(items) == 0 {
+		return nil, newParamError("input", "empty_array", "Invalid 'input': empty array. Expected an array with minimum length 1, but got an empty array instead.")
+	}
+
+	return items, nil
+}
+
+// message converts the i'th input item, a message, into a chat message
+func (item ResponseInputItem) message(i int) (Message, error) {
+	switch item.Role {
+	case "user", "assistant", "system", "developer":
+	default:
+		return Message{}, newParamError(fmt.Sprintf("input[%d].role", i), "invalid_value", "Invalid value: '%s'. Supported values are: 'user', 'assistant', 'system', and 'developer'. - 'input[%d].role'", item.Role, i)
+	}
+
+	msg := Message{Role: item.Role}
+	if err := json.Unmarshal(item.Content, &msg.Content); err == nil {
+		return msg, nil
+	}
+
+	var parts []ResponseInputContent
+	if err := json.Unmarshal(item.Content, &parts); err != nil {
+		return Message{}, newParamError(fmt.Sprintf("input[%d].content", i), "invalid_type", "Invalid type for 'input[%d].content': expected a string or an array of content parts, but got %s instead.", i, describeJSON(item.Content))
+	}
+
+	msg.Parts = make([]ContentPart, 0, len(parts))
+	for j, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text":
+			msg.Parts = append(msg.Parts, ContentPart{Type: "text", Text: part.Text})
+		case "input_image":
+			if part.ImageURL == "" {
+				return Message{}, newParamError(fmt.Sprintf("input[%d].content[%d].image_url", i, j), "missing_required_parameter", "Invalid 'input[%d].content[%d]': images must be sent as an 'image_url'. Uploaded files aren't supported.", i, j)
+			}
+
+			msg.Parts = append(msg.Parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: part.ImageURL, Detail: part.Detail}})
+		default:
+			return Message{}, newParamError(fmt.Sprintf("input[%d].content[%d].type", i, j), "invalid_value", "Invalid value: '%s'. Supported values are: 'input_text', 'output_text', and 'input_image'. - 'input[%d].content[%d].type'", part.Type, i, j)
+		}
+	}
+
+	return msg, nil
+}
+
+// inputMessages converts input items into chat messages. Function calls are
+// added to the assistant message before them, and reasoning items, which
+// clients send back from earlier responses, are dropped.
+func inputMessages(items []ResponseInputItem) ([]Message, error) {
+	var msgs []Message
+	for i, item := range items {
+		switch item.Type {
+		case "", "message":
+			msg, err := item.message(i)
+			if err != nil {
+				return nil, err
+			}
+
+			msgs = append(msgs, msg)
+		case "function_call":
+			call := ToolCall{Id: item.CallId, Type: "function", Function: ToolCallFunction{Name: item.Name, Arguments: item.Arguments}}
+			if len(msgs) == 0 || msgs[len(msgs)-1].Role != "assistant" {
+				msgs = append(msgs, Message{Role: "assistant"})
+			}
+
+			msgs[len(msgs)-1].ToolCalls = append(msgs[len(msgs)-1].ToolCalls, call)
+		case "function_call_output":
+			msgs = append(msgs, Message{Role: "tool", ToolCallId: item.CallId, Content: item.Output})
+		case "reasoning":
+		default:
+			return nil, newParamError(fmt.Sprintf("input[%d].type", i), "invalid_value", "Invalid value: '%s'. Supported values are: 'message', 'function_call', 'function_call_output', and 'reasoning'. - 'input[%d].type'", item.Type, i)
+		}
+	}
+
+	return msgs, nil
+}
+
+// chatTools converts function tools, which are described at the top level,
+// into chat completion tools. Errors name the tools as param.
+func chatTools(param string, tools []ResponseTool) ([]Tool, error) {
+	var chat []Tool
+	for i, tool := range tools {
+		if tool.Type != "function" {
+			return nil, newParamError(fmt.Sprintf("%s[%d].type", param, i), "invalid_value", "Invalid value: '%s'. Supported values are: 'function'. - '%s[%d].type'", tool.Type, param, i)
+		}
+
+		chat = append(chat, Tool{Type: "function", Function: ToolFunction{Name: tool.Name, Description: tool.Description, Parameters: tool.Parameters}})
+	}
+
+	return chat, nil
+}
+
+// chatToolChoice converts a tool_choice which names its function at the top
+// level into a chat completion tool_choice
+func chatToolChoice(choice any) any {
+	if c, ok := choice.(map[string]any); ok && c["type"] == "function" {
+		return map[string]any{"type": "function", "function": map[string]any{"name": c["name"]}}
+	}
+
+	return choice
+}
+
+// chatRequest converts a Responses request into the chat completion request
+// which generates it
+func (r ResponseRequest) chatRequest() (Request, error) {
+	if r.Model == "" {
+		return Request{}, newParamError("model", "missing_required_parameter", "Missing required parameter: 'model'.")
+	}
+
+	if r.PreviousResponseId != "" {
+		return Request{}, newParamError("previous_response_id", "unsupported_parameter", "Unsupported parameter: 'previous_response_id'. Responses aren't stored, so send the whole conversation as the 'input'.")
+	}
+
+	items, err := r.inputItems()
+	if err != nil {
+		return Request{}, err
+	}
+
+	msgs, err := inputMessages(items)
+	if err != nil {
+		return Request{}, err
+	}
+
+	req := Request{
+		Model:               r.Model,
+		Messages:            msgs,
+		Stream:              r.Stream,
+		MaxCompletionTokens: r.MaxOutputTokens,
+		Temperature:         r.Temperature,
+		TopP:                r.TopP,
+		ParallelToolCalls:   r.ParallelToolCalls,
+		System:              r.Instructions,
+		Metadata:            r.Metadata,
+		User:                r.User,
+	}
+
+	if r.Stream {
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+
+	req.Tools, err = chatTools("tools", r.Tools)
+	if err != nil {
+		return Request{}, err
+	}
+	req.ToolChoice = chatToolChoice(r.ToolChoice)
+
+	if r.Text != nil {
+		switch format := r.Text.Format; format.Type {
+		case "", "text":
+		case "json_object":
+			req.ResponseFormat = &ResponseFormat{Type: "json_object"}
+		case "json_schema":
+			req.ResponseFormat = &ResponseFormat{Type: "json_schema", JsonSchema: &JsonSchema{
+				Name:        format.Name,
+				Description: format.Description,
+				Schema:      format.Schema,
+				Strict:      format.Strict,
+			}}
+		default:
+			return Request{}, newParamError("text.format.type", "invalid_value", "Invalid value: '%s'. Supported values are: 'text', 'json_object', and 'json_schema'. - 'text.format.type'", format.Type)
+		}
+	}
+
+	return req, nil
+}
+
+// response returns a response to the request, in progress and without
+// output
+func (r ResponseRequest) response(id string, created int64) Response {
+	resp := Response{
+		Id:                id,
+		Object:            "response",
+		CreatedAt:         created,
+		Status:            "in_progress",
+		Model:             r.Model,
+		Output:            []ResponseOutputItem{},
+		MaxOutputTokens:   r.MaxOutputTokens,
+		Temperature:       r.Temperature,
+		TopP:              r.TopP,
+		Tools:             r.Tools,
+		ToolChoice:        r.ToolChoice,
+		ParallelToolCalls: r.ParallelToolCalls == nil || *r.ParallelToolCalls,
+		Metadata:          r.Metadata,
+	}
+
+	if r.Instructions != "" {
+		resp.Instructions = &r.Instructions
+	}
+
+	if resp.Tools == nil {
+		resp.Tools = []ResponseTool{}
+	}
+
+	if resp.ToolChoice == nil {
+		resp.ToolChoice = "auto"
+	}
+
+	return resp
+}
+
+func toResponseUsage(u Usage) *ResponseUsage {
+	usage := &ResponseUsage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+		TotalTokens:  u.TotalTokens,
+	}
+
+	if u.PromptTokensDetails != nil {
+		usage.InputTokensDetails.CachedTokens = u.PromptTokensDetails.CachedTokens
+	}
+
+	if u.CompletionTokensDetails != nil {
+		usage.OutputTokensDetails.ReasoningTokens = u.CompletionTokensDetails.ReasoningTokens
+	}
+
+	return usage
+}
+
+// finish completes a response for the finish reason of its completion. It's
+// incomplete if generation was cut short, or reached max_output_tokens.
+func (r *Response) finish(reason string) {
+	if r.MaxOutputTokens != nil && r.Usage != nil && r.Usage.OutputTokens >= *r.MaxOutputTokens {
+		reason = "length"
+	}
+
+	status := "completed"
+	if reason == "length" {
+		status = "incomplete"
+		r.IncompleteDetails = &IncompleteDetails{Reason: "max_output_tokens"}
+	}
+
+	r.Status = status
+	for i := range r.Output {
+		r.Output[i].Status = status
+	}
+}
+
+func messageItem(text string) ResponseOutputItem {
+	return ResponseOutputItem{
+		Type:    "message",
+		Id:      newId("msg_"),
+		Status:  "in_progress",
+		Role:    "assistant",
+		Content: []ResponseOutputText{{Type: "output_text", Text: text, Annotations: []any{}}},
+	}
+}
+
+func functionCallItem(call ToolCall) ResponseOutputItem {
+	return ResponseOutputItem{
+		Type:      "function_call",
+		Id:        newId("fc_"),
+		Status:    "in_progress",
+		CallId:    call.Id,
+		Name:      call.Function.Name,
+		Arguments: call.Function.Arguments,
+	}
+}
+
+// responseStream translates the chunks of a streamed chat completion into
+// Responses events
+type responseStream struct {
+	gin.ResponseWriter
+
+	header  http.Header
+	code    int
+	pending []byte
+
+	resp   Response
+	seq    int
+	reason string
+
+	// text is the output index of the message being streamed, or -1
+	text int
+
+	// calls maps the index of each streamed tool call to its output index
+	calls map[int]int
+
+	// failed is set when an error has ended the stream
+	failed bool
+
+	// body holds the response when the request fails
+	body bytes.Buffer
+}
+
+func (s *responseStream) Header() http.Header {
+	return s.header
+}
+
+func (s *responseStream) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+}
+
+// emit sends an event of type typ with the fields of data
+func (s *responseStream) emit(typ string, data map[string]any) error {
+	data["type"] = typ
+	data["sequence_number"] = s.seq
+	s.seq++
+
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	s.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	if _, err := fmt.Fprintf(s.ResponseWriter, "event: %s\ndata: %s\n\n", typ, d); err != nil {
+		return err
+	}
+
+	s.ResponseWriter.Flush()
+	return nil
+}
+
+// closeText ends the message being streamed, if any
+func (s *responseStream) closeText() error {
+	if s.text < 0 {
+		return nil
+	}
+
+	i := s.text
+	s.text = -1
+
+	item := s.resp.Output[i]
+	item.Status = "completed"
+	part := item.Content[0]
+	if err := s.emit("response.output_text.done", map[string]any{"item_id": item.Id, "output_index": i, "content_index": 0, "text": part.Text}); err != nil {
+		return err
+	}
+
+	if err := s.emit("response.content_part.done", map[string]any{"item_id": item.Id, "output_index": i, "content_index": 0, "part": part}); err != nil {
+		return err
+	}
+
+	return s.emit("response.output_item.done", map[string]any{"output_index": i, "item": item})
+}
+
+func (s *responseStream) chunk(chunk Chunk) error {
+	if len(chunk.Choices) == 0 {
+		if chunk.Usage != nil {
+			s.resp.Usage = toResponseUsage(*chunk.Usage)
+		}
+
+		return nil
+	}
+
+	choice := chunk.Choices[0]
+	if choice.FinishReason != nil {
+		s.reason = *choice.FinishReason
+	}
+
+	if choice.Delta.Content != "" {
+		if s.text < 0 {
+			s.text = len(s.resp.Output)
+			item := messageItem("")
+			s.resp.Output = append(s.resp.Output, item)
+
+			if err := s.emit("response.output_item.added", map[string]any{"output_index": s.text, "item": item}); err != nil {
+				return err
+			}
+
+			if err := s.emit("response.content_part.added", map[string]any{"item_id": item.Id, "output_index": s.text, "content_index": 0, "part": item.Content[0]}); err != nil {
+				return err
+			}
+		}
+
+		item := &s.resp.Output[s.text]
+		item.Content[0].Text += choice.Delta.Content
+		if err := s.emit("response.output_text.delta", map[string]any{"item_id": item.Id, "output_index": s.text, "content_index": 0, "delta": choice.Delta.Content}); err != nil {
+			return err
+		}
+	}
+
+	for _, call := range choice.Delta.ToolCalls {
+		var index int
+		if call.Index != nil {
+			index = *call.Index
+		}
+
+		i, ok := s.calls[index]
+		if !ok {
+			if err := s.closeText(); err != nil {
+				return err
+			}
+
+			i = len(s.resp.Output)
+			s.calls[index] = i
+
+			item := functionCallItem(call)
+			item.Arguments = ""
+			s.resp.Output = append(s.resp.Output, item)
+			if err := s.emit("response.output_item.added", map[string]any{"output_index": i, "item": item}); err != nil {
+				return err
+			}
+		}
+
+		item := &s.resp.Output[i]
+		item.Arguments += call.Function.Arguments
+		if err := s.emit("response.function_call_arguments.delta", map[string]any{"item_id": item.Id, "output_index": i, "delta": call.Function.Arguments}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *responseStream) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+
+	if s.code != http.StatusOK {
+		return s.body.Write(b)
+	}
+
+	s.pending = append(s.pending, b...)
+	for {
+		event, rest, ok := bytes.Cut(s.pending, []byte("\n\n"))
+		if !ok {
+			return len(b), nil
+		}
+		s.pending = rest
+
+		data, ok := eventData(event)
+		if !ok || string(data) == "[DONE]" || s.failed {
+			continue
+		}
+
+		var failure ErrorResponse
+		if err := json.Unmarshal(data, &failure); err == nil && failure.Error.Message != "" {
+			if err := s.start(); err != nil {
+				return 0, err
+			}
+
+			// the stream has already started, so the error ends it
+			s.failed = true
+			if err := s.emit("error", map[string]any{"code": failure.Error.Code, "message": failure.Error.Message, "param": failure.Error.Param}); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		var chunk Chunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return 0, err
+		}
+
+		if chunk.Model != "" {
+			s.resp.Model = chunk.Model
+		}
+
+		if err := s.start(); err != nil {
+			return 0, err
+		}
+
+		if err := s.chunk(chunk); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// start sends the events which begin the stream, once
+func (s *responseStream) start() error {
+	if s.seq > 0 {
+		return nil
+	}
+
+	s.ResponseWriter.Header().Set("X-Request-ID", s.header.Get("X-Request-ID"))
+	if err := s.emit("response.created", map[string]any{"response": s.resp}); err != nil {
+		return err
+	}
+
+	return s.emit("response.in_progress", map[string]any{"response": s.resp})
+}
+
+// finish ends the stream with the completed response
+func (s *responseStream) finish() error {
+	if s.failed {
+		return nil
+	}
+
+	if err := s.closeText(); err != nil {
+		return err
+	}
+
+	for i, item := range s.resp.Output {
+		if item.Type != "function_call" {
+			continue
+		}
+
+		item.Status = "completed"
+		if err := s.emit("response.function_call_arguments.done", map[string]any{"item_id": item.Id, "output_index": i, "arguments": item.Arguments}); err != nil {
+			return err
+		}
+
+		if err := s.emit("response.output_item.done", map[string]any{"output_index": i, "item": item}); err != nil {
+			return err
+		}
+	}
+
+	s.resp.finish(s.reason)
+	event := "response.completed"
+	if s.resp.Status == "incomplete" {
+		event = "response.incomplete"
+	}
+
+	return s.emit(event, map[string]any{"response": s.resp})
+}
+
+// ResponsesMiddleware serves /v1/responses, OpenAI's Responses API. Each
+// request is converted into a chat completion request which is sent to next
+// for path, and the completion, or its chunks, are converted into a response
+// and its events. Responses aren't stored.
+func ResponsesMiddleware(next http.Handler, path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ResponseRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		chatReq, err := req.chatRequest()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		body, err := json.Marshal(chatReq)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		r, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, path, bytes.NewReader(body))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+		r.Header.Set("Content-Type", "application/json")
+
+		resp := req.response(newId("resp_"), time.Now().Unix())
+
+		if req.Stream {
+			s := &responseStream{ResponseWriter: c.Writer, header: make(http.Header), resp: resp, text: -1, calls: make(map[int]int)}
+			next.ServeHTTP(s, r)
+			if s.code != http.StatusOK {
+				c.Data(s.code, "application/json", s.body.Bytes())
+				c.Abort()
+				return
+			}
+
+			if err := s.finish(); err != nil {
+				slog.Debug("openai responses stream", "error", err)
+			}
+
+			c.Abort()
+			return
+		}
+
+		rec := &batchRecorder{header: make(http.Header)}
+		next.ServeHTTP(rec, r)
+		if rec.code != http.StatusOK {
+			c.Data(rec.code, "application/json", rec.body.Bytes())
+			c.Abort()
+			return
+		}
+
+		var completion Completion
+		if err := json.Unmarshal(rec.body.Bytes(), &completion); err != nil || len(completion.Choices) != 1 {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, "unexpected response"))
+			return
+		}
+
+		choice := completion.Choices[0]
+		resp.Model = completion.Model
+		if choice.Message.Content != "" {
+			resp.Output = append(resp.Output, messageItem(choice.Message.Content))
+		}
+
+		for _, call := range choice.Message.ToolCalls {
+			resp.Output = append(resp.Output, functionCallItem(call))
+		}
+
+		var reason string
+		if choice.FinishReason != nil {
+			reason = *choice.FinishReason
+		}
+		resp.Usage = toResponseUsage(completion.Usage)
+		resp.finish(reason)
+
+		c.Header("X-Request-ID", completion.Id)
+		c.AbortWithStatusJSON(http.StatusOK, resp)
+	}
+}
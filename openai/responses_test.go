@@ -0,0 +1,284 @@
+package openai
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestResponseRequestChatRequest(t *testing.T) {
+	var req ResponseRequest
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "test",
+		"instructions": "Be brief.",
+		"input": [
+			{"role": "user", "content": [{"type": "input_text", "text": "What's the weather in Paris?"}, {"type": "input_image", "image_url": "data:image/png;base64,aW1hZ2U="}]},
+			{"type": "reasoning", "id": "rs_1", "summary": []},
+			{"type": "message", "role": "assistant", "content": [{"type": "output_text", "text": "Let me check."}]},
+			{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": "{\"city\":\"Paris\"}"},
+			{"type": "function_call_output", "call_id": "call_1", "output": "Sunny"}
+		],
+		"max_output_tokens": 64,
+		"tools": [{"type": "function", "name": "get_weather", "parameters": {"type": "object"}}],
+		"tool_choice": {"type": "function", "name": "get_weather"},
+		"text": {"format": {"type": "json_schema", "name": "weather", "schema": {"type": "object"}}}
+	}`), &req))
+
+	chatReq, err := req.chatRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "test", chatReq.Model)
+	assert.Equal(t, "Be brief.", chatReq.System)
+	assert.Equal(t, ptr(64), chatReq.MaxCompletionTokens)
+	assert.Equal(t, []Message{
+		{Role: "user", Parts: []ContentPart{{Type: "text", Text: "What's the weather in Paris?"}, {Type: "image_url", ImageURL: &ImageURL{URL: "data:image/png;base64,aW1hZ2U="}}}},
+		{Role: "assistant", Parts: []ContentPart{{Type: "text", Text: "Let me check."}}, ToolCalls: []ToolCall{{Id: "call_1", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}}}},
+		{Role: "tool", ToolCallId: "call_1", Content: "Sunny"},
+	}, chatReq.Messages)
+	assert.Equal(t, []Tool{{Type: "function", Function: ToolFunction{Name: "get_weather", Parameters: json.RawMessage(`{"type": "object"}`)}}}, chatReq.Tools)
+	assert.Equal(t, map[string]any{"type": "function", "function": map[string]any{"name": "get_weather"}}, chatReq.ToolChoice)
+	assert.Equal(t, &ResponseFormat{Type: "json_schema", JsonSchema: &JsonSchema{Name: "weather", Schema: json.RawMessage(`{"type": "object"}`)}}, chatReq.ResponseFormat)
+
+	t.Run("string input", func(t *testing.T) {
+		chatReq, err := ResponseRequest{Model: "test", Input: json.RawMessage(`"Hi"`), Stream: true}.chatRequest()
+		require.NoError(t, err)
+		assert.Equal(t, []Message{{Role: "user", Content: "Hi"}}, chatReq.Messages)
+		assert.Equal(t, &StreamOptions{IncludeUsage: true}, chatReq.StreamOptions)
+	})
+
+	cases := []struct {
+		name  string
+		req   ResponseRequest
+		param string
+	}{
+		{name: "model", req: ResponseRequest{Input: json.RawMessage(`"Hi"`)}, param: "model"},
+		{name: "input", req: ResponseRequest{Model: "test"}, param: "input"},
+		{name: "empty input", req: ResponseRequest{Model: "test", Input: json.RawMessage(`[]`)}, param: "input"},
+		{name: "input type", req: ResponseRequest{Model: "test", Input: json.RawMessage(`1`)}, param: "input"},
+		{name: "item type", req: ResponseRequest{Model: "test", Input: json.RawMessage(`[{"type": "file_search_call"}]`)}, param: "input[0].type"},
+		{name: "role", req: ResponseRequest{Model: "test", Input: json.RawMessage(`[{"role": "tool", "content": "Hi"}]`)}, param: "input[0].role"},
+		{name: "part type", req: ResponseRequest{Model: "test", Input: json.RawMessage(`[{"role": "user", "content": [{"type": "input_file"}]}]`)}, param: "input[0].content[0].type"},
+		{name: "image file", req: ResponseRequest{Model: "test", Input: json.RawMessage(`[{"role": "user", "content": [{"type": "input_image", "file_id": "file-1"}]}]`)}, param: "input[0].content[0].image_url"},
+		{name: "tool type", req: ResponseRequest{Model: "test", Input: json.RawMessage(`"Hi"`), Tools: []ResponseTool{{Type: "web_search"}}}, param: "tools[0].type"},
+		{name: "text format", req: ResponseRequest{Model: "test", Input: json.RawMessage(`"Hi"`), Text: &ResponseText{Format: ResponseTextFormat{Type: "grammar"}}}, param: "text.format.type"},
+		{name: "previous response", req: ResponseRequest{Model: "test", Input: json.RawMessage(`"Hi"`), PreviousResponseId: "resp_1"}, param: "previous_response_id"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.req.chatRequest()
+			var perr *paramError
+			require.ErrorAs(t, err, &perr)
+			assert.Equal(t, tt.param, perr.param)
+		})
+	}
+}
+
+func responsesRouter(t *testing.T, responses ...api.ChatResponse) *gin.Engine {
+	r := newRouter(Middleware(), chatHandler(t, responses...))
+	r.POST("/v1/responses", ResponsesMiddleware(r, "/v1/chat/completions"))
+	return r
+}
+
+type responseEvent struct {
+	event string
+	data  map[string]any
+}
+
+// readResponseEvents parses the events of a Responses stream
+func readResponseEvents(t *testing.T, body string) []responseEvent {
+	t.Helper()
+
+	var events []responseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, responseEvent{event: event})
+		}
+
+		if d, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			require.NotEmpty(t, events)
+			require.NoError(t, json.Unmarshal([]byte(d), &events[len(events)-1].data))
+		}
+	}
+
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func TestResponsesMiddleware(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	call := []api.ChatResponse{
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: `{"tool_calls": [{"name": "get_weather", "arguments": {"city": `}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: `"Paris"}}]}`}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant"}, Done: true, Metrics: api.Metrics{PromptEvalCount: 3, EvalCount: 2}},
+	}
+	tools := []ResponseTool{{Type: "function", Name: "get_weather", Parameters: json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}}}`)}}
+
+	t.Run("response", func(t *testing.T) {
+		r := responsesRouter(t, testResponses()...)
+		w := doRequest(t, r, "/v1/responses", ResponseRequest{Model: "test", Input: json.RawMessage(`"Hi"`), Instructions: "Be brief."})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.True(t, strings.HasPrefix(w.Header().Get("X-Request-ID"), "chatcmpl-"))
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.True(t, strings.HasPrefix(resp.Id, "resp_"))
+		assert.Equal(t, "response", resp.Object)
+		assert.Equal(t, "completed", resp.Status)
+		assert.Equal(t, "test", resp.Model)
+		assert.Equal(t, ptr("Be brief."), resp.Instructions)
+		assert.Equal(t, "auto", resp.ToolChoice)
+		assert.Empty(t, resp.Tools)
+		assert.Nil(t, resp.IncompleteDetails)
+
+		require.Len(t, resp.Output, 1)
+		assert.Equal(t, "message", resp.Output[0].Type)
+		assert.True(t, strings.HasPrefix(resp.Output[0].Id, "msg_"))
+		assert.Equal(t, "completed", resp.Output[0].Status)
+		assert.Equal(t, "assistant", resp.Output[0].Role)
+		assert.Equal(t, []ResponseOutputText{{Type: "output_text", Text: "Hello, world", Annotations: []any{}}}, resp.Output[0].Content)
+		assert.Equal(t, &ResponseUsage{InputTokens: 3, OutputTokens: 2, TotalTokens: 5}, resp.Usage)
+
+		// items only have the fields of their type
+		var raw struct {
+			Output []map[string]any `json:"output"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+		assert.NotContains(t, raw.Output[0], "call_id")
+	})
+
+	t.Run("function call", func(t *testing.T) {
+		r := responsesRouter(t, call...)
+		w := doRequest(t, r, "/v1/responses", ResponseRequest{Model: "test", Input: json.RawMessage(`"What's the weather in Paris?"`), Tools: tools})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "completed", resp.Status)
+		require.Len(t, resp.Output, 1)
+		item := resp.Output[0]
+		assert.Equal(t, "function_call", item.Type)
+		assert.True(t, strings.HasPrefix(item.Id, "fc_"))
+		assert.True(t, strings.HasPrefix(item.CallId, "call_"))
+		assert.Equal(t, "get_weather", item.Name)
+		assert.Equal(t, `{"city": "Paris"}`, item.Arguments)
+		assert.Equal(t, tools, resp.Tools)
+	})
+
+	t.Run("incomplete", func(t *testing.T) {
+		r := responsesRouter(t, testResponses()...)
+		w := doRequest(t, r, "/v1/responses", ResponseRequest{Model: "test", Input: json.RawMessage(`"Hi"`), MaxOutputTokens: ptr(2)})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp Response
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "incomplete", resp.Status)
+		assert.Equal(t, &IncompleteDetails{Reason: "max_output_tokens"}, resp.IncompleteDetails)
+		assert.Equal(t, "incomplete", resp.Output[0].Status)
+
+		w = doRequest(t, r, "/v1/responses", ResponseRequest{Model: "test", Input: json.RawMessage(`"Hi"`), MaxOutputTokens: ptr(2), Stream: true})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		events := readResponseEvents(t, w.Body.String())
+		assert.Equal(t, "response.incomplete", events[len(events)-1].event)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		r := responsesRouter(t, testResponses()...)
+		w := doRequest(t, r, "/v1/responses", ResponseRequest{Model: "test", Input: json.RawMessage(`"Hi"`), Stream: true})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+		events := readResponseEvents(t, w.Body.String())
+		var types []string
+		for i, event := range events {
+			types = append(types, event.event)
+			assert.Equal(t, event.event, event.data["type"])
+			assert.Equal(t, float64(i), event.data["sequence_number"])
+		}
+		assert.Equal(t, []string{
+			"response.created",
+			"response.in_progress",
+			"response.output_item.added",
+			"response.content_part.added",
+			"response.output_text.delta",
+			"response.output_text.delta",
+			"response.output_text.done",
+			"response.content_part.done",
+			"response.output_item.done",
+			"response.completed",
+		}, types)
+
+		assert.Equal(t, "in_progress", events[0].data["response"].(map[string]any)["status"])
+		assert.Equal(t, ", world", events[5].data["delta"])
+		assert.Equal(t, "Hello, world", events[6].data["text"])
+
+		var completed Response
+		d, err := json.Marshal(events[len(events)-1].data["response"])
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(d, &completed))
+		assert.Equal(t, "completed", completed.Status)
+		require.Len(t, completed.Output, 1)
+		assert.Equal(t, "Hello, world", completed.Output[0].Content[0].Text)
+		assert.Equal(t, events[2].data["item"].(map[string]any)["id"], completed.Output[0].Id)
+		assert.Equal(t, &ResponseUsage{InputTokens: 3, OutputTokens: 2, TotalTokens: 5}, completed.Usage)
+	})
+
+	t.Run("stream function call", func(t *testing.T) {
+		r := responsesRouter(t, call...)
+		w := doRequest(t, r, "/v1/responses", ResponseRequest{Model: "test", Input: json.RawMessage(`"What's the weather in Paris?"`), Tools: tools, Stream: true})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		events := readResponseEvents(t, w.Body.String())
+		var types []string
+		var arguments string
+		for _, event := range events {
+			types = append(types, event.event)
+			if event.event == "response.function_call_arguments.delta" {
+				arguments += event.data["delta"].(string)
+			}
+		}
+
+		assert.NotContains(t, types, "response.output_text.delta")
+		assert.Equal(t, "response.output_item.added", types[2])
+		assert.Equal(t, "function_call", events[2].data["item"].(map[string]any)["type"])
+		assert.Equal(t, `{"city": "Paris"}`, arguments)
+		assert.Equal(t, []string{"response.function_call_arguments.done", "response.output_item.done", "response.completed"}, types[len(types)-3:])
+		assert.Equal(t, `{"city": "Paris"}`, events[len(events)-3].data["arguments"])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		r := responsesRouter(t, testResponses()...)
+		w := doRequest(t, r, "/v1/responses", ResponseRequest{Model: "test"})
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		var resp ErrorResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "input", resp.Error.Param)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		r := newRouter(Middleware(), func(c *gin.Context) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model 'missing' not found, try pulling it first"})
+		})
+		r.POST("/v1/responses", ResponsesMiddleware(r, "/v1/chat/completions"))
+
+		for _, stream := range []bool{false, true} {
+			w := doRequest(t, r, "/v1/responses", ResponseRequest{Model: "missing", Input: json.RawMessage(`"Hi"`), Stream: stream})
+			require.Equal(t, http.StatusNotFound, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "model_not_found", *resp.Error.Code)
+		}
+	})
+}
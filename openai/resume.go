@@ -0,0 +1,192 @@
+package openai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WithResume keeps the events of streamed chat completions so that clients
+// whose connection drops can resume them, by sending the request again with
+// the id of the last event they received as the Last-Event-ID header. A
+// stream whose client goes away carries on generating for up to window while
+// it waits to be resumed, and finished streams can be resumed for window
+// after they end.
+func WithResume(window time.Duration) Option {
+	return func(o *options) {
+		o.streams = &streams{window: window, streams: make(map[string]*stream)}
+	}
+}
+
+// streams holds the events of recent streams by completion id
+type streams struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+// stream is the events of one streamed completion
+type stream struct {
+	window time.Duration
+
+	// cancel stops generating the completion
+	cancel func()
+
+	mu     sync.Mutex
+	events [][]byte
+	done   bool
+
+	// added is closed, and replaced, whenever an event is added or the
+	// stream ends
+	added chan struct{}
+
+	// readers is the number of clients reading the stream. Generation is
+	// cancelled once it has had none for the window.
+	readers int
+	timer   *time.Timer
+}
+
+// start begins keeping the events of the stream of id, which is read by the
+// client which requested it
+func (s *streams) start(id string, cancel func()) *stream {
+	st := &stream{window: s.window, cancel: cancel, added: make(chan struct{}), readers: 1}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streams[id] = st
+	return st
+}
+
+// finish ends the stream of id, which is forgotten once the window passes
+func (s *streams) finish(id string, st *stream) {
+	st.mu.Lock()
+	st.done = true
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	close(st.added)
+	st.mu.Unlock()
+
+	time.AfterFunc(s.window, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.streams, id)
+	})
+}
+
+// resume sends the client the events of a stream which follow the event
+// last, until the stream ends
+func (s *streams) resume(c *gin.Context, last string) {
+	id, n, ok := parseEventId(last)
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+
+	if !ok || st == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, NewErrorWithCode(http.StatusNotFound, fmt.Sprintf("the stream of event '%s' can't be resumed, it doesn't exist or has expired", last), "stream_not_found", ""))
+		return
+	}
+
+	c.Header("X-Request-ID", id)
+	c.Header("Content-Type", "text/event-stream")
+	c.Status(http.StatusOK)
+	st.follow(c.Request.Context(), c.Writer, n)
+	c.Abort()
+}
+
+// eventId returns the id of the n'th event of the stream of id
+func eventId(id string, n int) string {
+	return fmt.Sprintf("%s/%d", id, n)
+}
+
+// parseEventId returns the stream and number of an event id
+func parseEventId(s string) (string, int, bool) {
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return "", 0, false
+	}
+
+	n, err := strconv.Atoi(s[i+1:])
+	if err != nil || n < 0 {
+		return "", 0, false
+	}
+
+	return s[:i], n, true
+}
+
+// add numbers an SSE event of the stream of id and keeps it, returning the
+// event with its id
+func (st *stream) add(id string, b []byte) []byte {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	event := append([]byte("id: "+eventId(id, len(st.events)+1)+"\n"), b...)
+	st.events = append(st.events, event)
+
+	close(st.added)
+	st.added = make(chan struct{})
+	return event
+}
+
+func (st *stream) attach() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.readers++
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+}
+
+// detach records that a client has stopped reading the stream
+func (st *stream) detach() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.readers--
+	if st.readers == 0 && !st.done {
+		st.timer = time.AfterFunc(st.window, st.cancel)
+	}
+}
+
+// follow writes the events after the n'th to w as they're added, until the
+// stream ends or the client goes away
+func (st *stream) follow(ctx context.Context, w gin.ResponseWriter, n int) {
+	st.attach()
+	defer st.detach()
+
+	for {
+		st.mu.Lock()
+		events, done, added := st.events[min(n, len(st.events)):], st.done, st.added
+		st.mu.Unlock()
+
+		for _, event := range events {
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+			n++
+		}
+		w.Flush()
+
+		if done {
+			return
+		}
+
+		select {
+		case <-added:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestParseEventId(t *testing.T) {
+	id, n, ok := parseEventId(eventId("chatcmpl-abc", 3))
+	require.True(t, ok)
+	assert.Equal(t, "chatcmpl-abc", id)
+	assert.Equal(t, 3, n)
+
+	for _, s := range []string{"", "chatcmpl-abc", "chatcmpl-abc/", "chatcmpl-abc/x", "chatcmpl-abc/-1"} {
+		_, _, ok := parseEventId(s)
+		assert.False(t, ok, s)
+	}
+}
+
+func TestMiddlewareResume(t *testing.T) {
+	body := Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+		Stream:   true,
+	}
+
+	bts, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	t.Run("resume", func(t *testing.T) {
+		cancelled := make(chan bool, 1)
+		handler := func(c *gin.Context) {
+			var req api.ChatRequest
+			require.NoError(t, c.ShouldBindJSON(&req))
+
+			for _, r := range testResponses() {
+				bts, err := json.Marshal(r)
+				require.NoError(t, err)
+				_, err = c.Writer.Write(append(bts, '\n'))
+				require.NoError(t, err)
+			}
+
+			cancelled <- c.Request.Context().Err() != nil
+		}
+
+		r := newRouter(Middleware(WithResume(time.Second)), handler)
+
+		// the client goes away after the first chunk, but generation carries on
+		w := &disconnectRecorder{ResponseRecorder: httptest.NewRecorder(), limit: 1}
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts)))
+		assert.False(t, <-cancelled)
+
+		id := w.Header().Get("X-Request-ID")
+		assert.True(t, strings.HasPrefix(w.Body.String(), "id: "+id+"/1\ndata: "))
+
+		first := readChunks(t, w.Body)
+		require.Len(t, first, 1)
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts))
+		req.Header.Set("Last-Event-ID", id+"/1")
+		resumed := httptest.NewRecorder()
+		r.ServeHTTP(resumed, req)
+		require.Equal(t, http.StatusOK, resumed.Code)
+		assert.Equal(t, "text/event-stream", resumed.Header().Get("Content-Type"))
+		assert.Equal(t, id, resumed.Header().Get("X-Request-ID"))
+
+		// the rest of the stream follows on from the last event received
+		assert.True(t, strings.HasPrefix(resumed.Body.String(), "id: "+id+"/2\n"))
+		assert.True(t, strings.HasSuffix(resumed.Body.String(), "data: [DONE]\n\n"))
+
+		rest := readChunks(t, resumed.Body)
+		require.Len(t, rest, 2)
+		assert.Equal(t, ", world", rest[0].Choices[0].Delta.Content)
+		assert.Equal(t, "stop", *rest[1].Choices[0].FinishReason)
+		for _, chunk := range rest {
+			assert.Equal(t, first[0].Id, chunk.Id)
+		}
+	})
+
+	t.Run("not resumed", func(t *testing.T) {
+		cancelled := make(chan error, 1)
+		r := newRouter(Middleware(WithResume(50*time.Millisecond)), slowHandler(t, 10*time.Millisecond, cancelled))
+
+		start := time.Now()
+		w := &disconnectRecorder{ResponseRecorder: httptest.NewRecorder(), limit: 1}
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts)))
+
+		// generation stops once the stream has gone unread for the window
+		assert.ErrorIs(t, <-cancelled, context.Canceled)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		r := newRouter(Middleware(WithResume(time.Second)), chatHandler(t, testResponses()...))
+
+		for _, last := range []string{"chatcmpl-missing/1", "1"} {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts))
+			req.Header.Set("Last-Event-ID", last)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, http.StatusNotFound, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "stream_not_found", *resp.Error.Code)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(bts))
+		req.Header.Set("Last-Event-ID", "chatcmpl-missing/1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), "id: ")
+		assert.Len(t, readChunks(t, w.Body), 3)
+	})
+}
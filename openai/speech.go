@@ -0,0 +1,124 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SpeechRequest is a /v1/audio/speech request
+type SpeechRequest struct {
+	Model          string   `json:"model"`
+	Input          string   `json:"input"`
+	Voice          string   `json:"voice"`
+	Instructions   string   `json:"instructions,omitempty"`
+	ResponseFormat string   `json:"response_format,omitempty"`
+	Speed          *float64 `json:"speed,omitempty"`
+}
+
+// speechFormats are the content types of the audio formats speech can be
+// generated in
+var speechFormats = map[string]string{
+	"mp3":  "audio/mpeg",
+	"opus": "audio/opus",
+	"aac":  "audio/aac",
+	"flac": "audio/flac",
+	"wav":  "audio/wav",
+	"pcm":  "audio/pcm",
+}
+
+// A Speaker is a Backend which can generate speech. It writes the audio to w
+// as it's generated, and returns ErrUnsupportedModel, before writing anything,
+// when the model can't generate speech.
+type Speaker interface {
+	Speak(ctx context.Context, r SpeechRequest, w io.Writer) error
+}
+
+func (r *SpeechRequest) validate() error {
+	switch {
+	case r.Model == "":
+		return newParamError("model", "missing_required_parameter", "'model' is a required property")
+	case r.Input == "":
+		return newParamError("input", "missing_required_parameter", "'input' is a required property")
+	case len([]rune(r.Input)) > 4096:
+		return newParamError("input", "string_above_max_length", "'%s...' is too long - 'input'", string([]rune(r.Input)[:16]))
+	case r.Voice == "":
+		return newParamError("voice", "missing_required_parameter", "'voice' is a required property")
+	case r.Speed != nil && (*r.Speed < 0.25 || *r.Speed > 4):
+		return newParamError("speed", "invalid_value", "%v is not between 0.25 and 4.0 - 'speed'", *r.Speed)
+	}
+
+	if r.ResponseFormat == "" {
+		r.ResponseFormat = "mp3"
+	}
+
+	if _, ok := speechFormats[r.ResponseFormat]; !ok {
+		return newParamError("response_format", "invalid_value", "Invalid value: '%s'. Supported values are: 'mp3', 'opus', 'aac', 'flac', 'wav', and 'pcm'. - 'response_format'", r.ResponseFormat)
+	}
+
+	return nil
+}
+
+// speechWriter sends the response headers on the first write of audio, so
+// errors before any is generated can still be reported with a status
+type speechWriter struct {
+	gin.ResponseWriter
+	contentType string
+}
+
+func (w *speechWriter) Write(b []byte) (int, error) {
+	if !w.Written() {
+		w.Header().Set("Content-Type", w.contentType)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.Flush()
+	return n, err
+}
+
+func (w *speechWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// SpeechMiddleware serves /v1/audio/speech, generating speech with speaker
+// and streaming the audio back as it's generated
+func SpeechMiddleware(speaker Speaker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req SpeechRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		req.ResponseFormat = strings.ToLower(req.ResponseFormat)
+		if err := req.validate(); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		w := &speechWriter{ResponseWriter: c.Writer, contentType: speechFormats[req.ResponseFormat]}
+		err := speaker.Speak(c.Request.Context(), req, w)
+		switch {
+		case err == nil:
+			if !w.Written() {
+				w.Header().Set("Content-Type", w.contentType)
+				c.Status(http.StatusOK)
+			}
+		case w.Written():
+			// the audio has been partly sent, so the stream is cut short
+			slog.Error("speech generation failed", "model", req.Model, "error", err)
+		case errors.Is(err, ErrUnsupportedModel):
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("model '%s' does not support speech generation", req.Model), "model_not_supported", "model"))
+		default:
+			slog.Error("speech generation failed", "model", req.Model, "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSpeaker "speaks" the input of the "tts" model as its bytes, a word at a
+// time, and rejects every other model. An input of "fail" fails after the
+// first word.
+type testSpeaker struct {
+	testBackend
+}
+
+func (testSpeaker) Speak(_ context.Context, r SpeechRequest, w io.Writer) error {
+	switch r.Model {
+	case "tts":
+	case "broken":
+		return errors.New("out of memory")
+	default:
+		return ErrUnsupportedModel
+	}
+
+	for _, word := range strings.Fields(r.Input) {
+		if word == "fail" {
+			return errors.New("out of memory")
+		}
+
+		if _, err := io.WriteString(w, word+r.Voice); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestSpeechMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/audio/speech", SpeechMiddleware(testSpeaker{}))
+
+	t.Run("mp3", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/audio/speech", SpeechRequest{Model: "tts", Input: "hello world", Voice: "."})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "audio/mpeg", w.Header().Get("Content-Type"))
+		assert.Equal(t, "hello.world.", w.Body.String())
+	})
+
+	t.Run("wav", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/audio/speech", SpeechRequest{Model: "tts", Input: "hello", Voice: "alloy", ResponseFormat: "WAV", Speed: ptr(1.5)})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "audio/wav", w.Header().Get("Content-Type"))
+		assert.Equal(t, "helloalloy", w.Body.String())
+	})
+
+	t.Run("failed midway", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/audio/speech", SpeechRequest{Model: "tts", Input: "hello fail", Voice: "."})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello.", w.Body.String())
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		w := doRequest(t, r, "/v1/audio/speech", SpeechRequest{Model: "broken", Input: "hello", Voice: "."})
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+
+	cases := []struct {
+		name  string
+		req   SpeechRequest
+		param string
+	}{
+		{name: "unsupported model", req: SpeechRequest{Model: "llama2", Input: "hello", Voice: "alloy"}, param: "model"},
+		{name: "missing model", req: SpeechRequest{Input: "hello", Voice: "alloy"}, param: "model"},
+		{name: "missing input", req: SpeechRequest{Model: "tts", Voice: "alloy"}, param: "input"},
+		{name: "long input", req: SpeechRequest{Model: "tts", Input: strings.Repeat("a", 4097), Voice: "alloy"}, param: "input"},
+		{name: "missing voice", req: SpeechRequest{Model: "tts", Input: "hello"}, param: "voice"},
+		{name: "invalid speed", req: SpeechRequest{Model: "tts", Input: "hello", Voice: "alloy", Speed: ptr(5.0)}, param: "speed"},
+		{name: "invalid response format", req: SpeechRequest{Model: "tts", Input: "hello", Voice: "alloy", ResponseFormat: "ogg"}, param: "response_format"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(t, r, "/v1/audio/speech", tt.req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "invalid_request_error", resp.Error.Type)
+			assert.Equal(t, tt.param, resp.Error.Param)
+		})
+	}
+}
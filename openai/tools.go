@@ -0,0 +1,433 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type ToolCall struct {
+	// Index identifies the call across the chunks of a streamed response
+	Index *int `json:"index,omitempty"`
+
+	// Id, Type and the function's Name are only sent in the first delta of a
+	// streamed call
+	Id       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name string `json:"name,omitempty"`
+
+	// Arguments are the JSON encoded arguments of the call
+	Arguments string `json:"arguments"`
+}
+
+// toolNamePattern matches the names OpenAI accepts for functions
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// toolChoice is a parsed tool_choice: a mode of "none", "auto" or
+// "required", and the function the model must call, if any
+type toolChoice struct {
+	mode string
+	name string
+}
+
+// toolChoice parses the tool_choice of a request. Tools are called at the
+// model's discretion by default.
+func (r Request) toolChoice() (toolChoice, error) {
+	switch choice := r.ToolChoice.(type) {
+	case nil:
+		return toolChoice{mode: "auto"}, nil
+	case string:
+		if !slices.Contains([]string{"none", "auto", "required"}, choice) {
+			return toolChoice{}, newParamError("tool_choice", "invalid_value", "Invalid value: '%s'. Supported values are: 'none', 'auto', and 'required'. - 'tool_choice'", choice)
+		}
+		return toolChoice{mode: choice}, nil
+	case map[string]any:
+		function, _ := choice["function"].(map[string]any)
+		name, _ := function["name"].(string)
+		if choice["type"] != "function" || name == "" {
+			return toolChoice{}, newParamError("tool_choice", "invalid_value", "Invalid 'tool_choice': expected an object with 'type' set to 'function' and a 'function.name'.")
+		}
+		return toolChoice{mode: "required", name: name}, nil
+	default:
+		raw, _ := json.Marshal(choice)
+		return toolChoice{}, newParamError("tool_choice", "invalid_type", "Invalid type for 'tool_choice': expected a string or an object, but got %s instead.", describeJSON(raw))
+	}
+}
+
+// validateTools checks the tools of a request and that tool_choice refers to
+// one of them
+func (r Request) validateTools() error {
+	for i, tool := range r.Tools {
+		if tool.Type != "function" {
+			return newParamError(fmt.Sprintf("tools[%d].type", i), "invalid_value", "Invalid value: '%s'. Supported values are: 'function'. - 'tools[%d].type'", tool.Type, i)
+		}
+
+		if !toolNamePattern.MatchString(tool.Function.Name) {
+			return newParamError(fmt.Sprintf("tools[%d].function.name", i), "invalid_value", "Invalid 'tools[%d].function.name': string does not match pattern. Expected a string that matches the pattern '^[a-zA-Z0-9_-]{1,64}$'.", i)
+		}
+	}
+
+	if r.ParallelToolCalls != nil && len(r.Tools) == 0 {
+		return newParamError("parallel_tool_calls", "invalid_value", "Invalid value for 'parallel_tool_calls': 'parallel_tool_calls' is only allowed when 'tools' are specified.")
+	}
+
+	if r.ToolChoice == nil {
+		return nil
+	}
+
+	if len(r.Tools) == 0 {
+		return newParamError("tool_choice", "invalid_value", "Invalid value for 'tool_choice': 'tool_choice' is only allowed when 'tools' are specified.")
+	}
+
+	choice, err := r.toolChoice()
+	if err != nil {
+		return err
+	}
+
+	if choice.name != "" && !slices.ContainsFunc(r.Tools, func(t Tool) bool { return t.Function.Name == choice.name }) {
+		return newParamError("tool_choice", "invalid_value", "Invalid value for 'tool_choice': function '%s' is not one of the 'tools'.", choice.name)
+	}
+
+	return nil
+}
+
+// parallelToolCalls reports whether the model may make more than one tool
+// call in a response
+func (r Request) parallelToolCalls() bool {
+	return r.ParallelToolCalls == nil || *r.ParallelToolCalls
+}
+
+// fromFunctions returns the request with the legacy functions and
+// function_call fields moved to tools and tool_choice
+func (r Request) fromFunctions() (Request, error) {
+	if r.Functions == nil && r.FunctionCall == nil {
+		return r, nil
+	}
+
+	if r.Tools != nil || r.ToolChoice != nil {
+		return Request{}, newParamError("functions", "invalid_value", "Invalid 'functions': 'functions' and 'function_call' can't be combined with 'tools' or 'tool_choice'.")
+	}
+
+	for i, function := range r.Functions {
+		if !toolNamePattern.MatchString(function.Name) {
+			return Request{}, newParamError(fmt.Sprintf("functions[%d].name", i), "invalid_value", "Invalid 'functions[%d].name': string does not match pattern. Expected a string that matches the pattern '^[a-zA-Z0-9_-]{1,64}$'.", i)
+		}
+
+		r.Tools = append(r.Tools, Tool{Type: "function", Function: function})
+	}
+
+	switch call := r.FunctionCall.(type) {
+	case nil:
+	case string:
+		if call != "none" && call != "auto" {
+			return Request{}, newParamError("function_call", "invalid_value", "Invalid value: '%s'. Supported values are: 'none' and 'auto'. - 'function_call'", call)
+		}
+		r.ToolChoice = call
+	case map[string]any:
+		name, _ := call["name"].(string)
+		if name == "" {
+			return Request{}, newParamError("function_call", "invalid_value", "Invalid 'function_call': expected an object with a 'name'.")
+		}
+
+		if !slices.ContainsFunc(r.Functions, func(f ToolFunction) bool { return f.Name == name }) {
+			return Request{}, newParamError("function_call", "invalid_value", "Invalid value for 'function_call': function '%s' is not one of the 'functions'.", name)
+		}
+		r.ToolChoice = map[string]any{"type": "function", "function": map[string]any{"name": name}}
+	default:
+		raw, _ := json.Marshal(call)
+		return Request{}, newParamError("function_call", "invalid_type", "Invalid type for 'function_call': expected a string or an object, but got %s instead.", describeJSON(raw))
+	}
+
+	// legacy responses carry a single function call
+	if r.ParallelToolCalls == nil {
+		parallel := false
+		r.ParallelToolCalls = &parallel
+	}
+
+	r.Functions, r.FunctionCall = nil, nil
+	return r, nil
+}
+
+// firstFunctionCall returns the first of the tool calls, or their deltas, as
+// a legacy function_call. Only one function is called per legacy response.
+func firstFunctionCall(calls []ToolCall) *ToolCallFunction {
+	for _, call := range calls {
+		if call.Index == nil || *call.Index == 0 {
+			function := call.Function
+			return &function
+		}
+	}
+
+	return nil
+}
+
+// toolCall is a tool call in the form models are instructed to write them
+type toolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// toolInstruction describes the tools to the model and how to call them
+func toolInstruction(tools []Tool, choice toolChoice, parallel bool) string {
+	var sb strings.Builder
+	sb.WriteString("You can call the following tools, whose parameters are described by JSON schemas:\n")
+	for _, tool := range tools {
+		d, _ := json.Marshal(tool.Function)
+		sb.Write(d)
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\nTo call tools, respond with only a JSON object of the form ")
+	sb.WriteString(`{"tool_calls": [{"name": "<tool name>", "arguments": {<arguments>}}]}`)
+	sb.WriteString(" and nothing else. ")
+
+	switch {
+	case choice.name != "":
+		fmt.Fprintf(&sb, "You must call the %s tool.", choice.name)
+	case choice.mode == "required":
+		sb.WriteString("You must call at least one tool.")
+	default:
+		sb.WriteString("If no tool is needed, respond to the user normally instead.")
+	}
+
+	if !parallel {
+		sb.WriteString(" Call at most one tool at a time.")
+	}
+
+	return sb.String()
+}
+
+// formatToolCalls writes the tool calls of an assistant message back in the
+// form the model was instructed to use
+func formatToolCalls(calls []ToolCall) string {
+	formatted := make([]toolCall, len(calls))
+	for i, call := range calls {
+		formatted[i] = toolCall{Name: call.Function.Name, Arguments: json.RawMessage(call.Function.Arguments)}
+		if !json.Valid(formatted[i].Arguments) {
+			formatted[i].Arguments, _ = json.Marshal(call.Function.Arguments)
+		}
+	}
+
+	d, _ := json.Marshal(map[string][]toolCall{"tool_calls": formatted})
+	return string(d)
+}
+
+// toolCallId returns a new id for a tool call
+func toolCallId() string {
+	return newId("call_")
+}
+
+// parseToolCalls parses content written by the model into tool calls. Nil is
+// returned when the content isn't entirely tool calls of the given tools, in
+// which case it is an ordinary response.
+func parseToolCalls(content string, tools []Tool) []ToolCall {
+	s := strings.TrimSpace(content)
+
+	// some models wrap JSON in a markdown code block
+	if strings.HasPrefix(s, "```") {
+		_, s, _ = strings.Cut(s, "\n")
+		s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "```"))
+	}
+
+	// models write the documented form, a bare call, or an array of calls
+	var calls []toolCall
+	var wrapped struct {
+		ToolCalls []toolCall `json:"tool_calls"`
+	}
+	var single toolCall
+
+	switch {
+	case json.Unmarshal([]byte(s), &wrapped) == nil && len(wrapped.ToolCalls) > 0:
+		calls = wrapped.ToolCalls
+	case json.Unmarshal([]byte(s), &single) == nil && single.Name != "":
+		calls = []toolCall{single}
+	case json.Unmarshal([]byte(s), &calls) == nil && len(calls) > 0:
+	default:
+		return nil
+	}
+
+	toolCalls := make([]ToolCall, len(calls))
+	for i, call := range calls {
+		if !slices.ContainsFunc(tools, func(t Tool) bool { return t.Function.Name == call.Name }) {
+			return nil
+		}
+
+		arguments := "{}"
+		if len(call.Arguments) > 0 && string(call.Arguments) != "null" {
+			var encoded string
+			if err := json.Unmarshal(call.Arguments, &encoded); err == nil {
+				// arguments which were already encoded as a string
+				arguments = encoded
+			} else {
+				arguments = string(call.Arguments)
+			}
+		}
+
+		toolCalls[i] = ToolCall{
+			Id:       toolCallId(),
+			Type:     "function",
+			Function: ToolCallFunction{Name: call.Name, Arguments: arguments},
+		}
+	}
+
+	return toolCalls
+}
+
+// The start of a tool call in the documented form, up to the opening brace
+// of its arguments, for the first call of a response and the calls after it
+var (
+	firstToolCallPattern = regexp.MustCompile("^\\s*(?:```(?:json)?\\s*)?" + `(?:\{\s*"tool_calls"\s*:\s*)?\[?\s*\{\s*"name"\s*:\s*"([a-zA-Z0-9_-]{1,64})"\s*,\s*"arguments"\s*:\s*\{`)
+	nextToolCallPattern  = regexp.MustCompile(`^\s*\}\s*,\s*\{\s*"name"\s*:\s*"([a-zA-Z0-9_-]{1,64})"\s*,\s*"arguments"\s*:\s*\{`)
+)
+
+// toolBuffer holds back streamed content which may be tool calls. Calls in
+// the documented form are streamed as they are written: a delta naming the
+// call once its arguments begin, then a delta for each fragment of the
+// arguments. Anything else which starts like JSON is held until the response
+// is done and parsed as a whole. Content which can't be a tool call, since it
+// doesn't start like JSON, is passed through as it arrives.
+type toolBuffer struct {
+	tools   []Tool
+	text    bool
+	pending string
+
+	// single stops at the first call, when parallel tool calls are disabled
+	single bool
+
+	// calls is the number of calls streamed so far and offset is how much of
+	// pending they have consumed. depth is the nesting of the arguments being
+	// streamed, or zero between calls.
+	calls    int
+	offset   int
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+func (b *toolBuffer) next(content string, done bool) (string, []ToolCall) {
+	if b.text {
+		return content, nil
+	}
+
+	b.pending += content
+	if trimmed := strings.TrimLeftFunc(b.pending, unicode.IsSpace); b.calls == 0 && trimmed != "" && !strings.ContainsAny(trimmed[:1], "{[`") {
+		b.text = true
+		return b.pending, nil
+	}
+
+	calls := b.stream()
+	if !done {
+		return "", calls
+	}
+
+	parsed := parseToolCalls(b.pending, b.tools)
+	if b.calls == 0 && parsed == nil {
+		return b.pending, nil
+	}
+
+	// calls which couldn't be followed as they were written, such as those
+	// with arguments encoded as a string, are sent whole
+	if b.single && len(parsed) > 1 {
+		parsed = parsed[:1]
+	}
+
+	for i := b.calls; i < len(parsed); i++ {
+		index := i
+		parsed[i].Index = &index
+		calls = append(calls, parsed[i])
+		b.calls++
+	}
+
+	return "", calls
+}
+
+// stream returns deltas for the tool calls written since it was last called
+func (b *toolBuffer) stream() []ToolCall {
+	var calls []ToolCall
+	for {
+		from := b.offset
+		if b.depth == 0 {
+			if b.single && b.calls > 0 {
+				return calls
+			}
+
+			pattern := nextToolCallPattern
+			if b.calls == 0 {
+				pattern = firstToolCallPattern
+			}
+
+			m := pattern.FindStringSubmatchIndex(b.pending[b.offset:])
+			if m == nil {
+				return calls
+			}
+
+			name := b.pending[b.offset+m[2] : b.offset+m[3]]
+			if !slices.ContainsFunc(b.tools, func(t Tool) bool { return t.Function.Name == name }) {
+				return calls
+			}
+
+			index := b.calls
+			calls = append(calls, ToolCall{
+				Index:    &index,
+				Id:       toolCallId(),
+				Type:     "function",
+				Function: ToolCallFunction{Name: name},
+			})
+
+			b.calls++
+			b.offset += m[1]
+			b.depth = 1
+			from = b.offset - 1
+		}
+
+		for b.offset < len(b.pending) && b.depth > 0 {
+			c := b.pending[b.offset]
+			b.offset++
+
+			switch {
+			case b.escaped:
+				b.escaped = false
+			case b.inString && c == '\\':
+				b.escaped = true
+			case c == '"':
+				b.inString = !b.inString
+			case b.inString:
+			case c == '{' || c == '[':
+				b.depth++
+			case c == '}' || c == ']':
+				b.depth--
+			}
+		}
+
+		if fragment := b.pending[from:b.offset]; fragment != "" {
+			if last := len(calls) - 1; last >= 0 && *calls[last].Index == b.calls-1 {
+				calls[last].Function.Arguments += fragment
+			} else {
+				index := b.calls - 1
+				calls = append(calls, ToolCall{Index: &index, Function: ToolCallFunction{Arguments: fragment}})
+			}
+		}
+
+		if b.depth > 0 {
+			return calls
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func weatherTools() []Tool {
+	return []Tool{
+		{Type: "function", Function: ToolFunction{
+			Name:        "get_weather",
+			Description: "Get the current weather in a city",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`),
+		}},
+		{Type: "function", Function: ToolFunction{Name: "get_time"}},
+	}
+}
+
+func TestParseToolCalls(t *testing.T) {
+	type call struct {
+		name      string
+		arguments string
+	}
+
+	cases := []struct {
+		name     string
+		content  string
+		expected []call
+	}{
+		{name: "documented", content: `{"tool_calls": [{"name": "get_weather", "arguments": {"city": "Paris"}}]}`, expected: []call{{"get_weather", `{"city": "Paris"}`}}},
+		{name: "bare call", content: ` {"name": "get_weather", "arguments": {"city": "Paris"}}` + "\n", expected: []call{{"get_weather", `{"city": "Paris"}`}}},
+		{name: "array", content: `[{"name": "get_weather", "arguments": {"city": "Paris"}}, {"name": "get_time"}]`, expected: []call{{"get_weather", `{"city": "Paris"}`}, {"get_time", "{}"}}},
+		{name: "code block", content: "```json\n{\"name\": \"get_time\", \"arguments\": {}}\n```", expected: []call{{"get_time", "{}"}}},
+		{name: "encoded arguments", content: `{"name": "get_weather", "arguments": "{\"city\": \"Paris\"}"}`, expected: []call{{"get_weather", `{"city": "Paris"}`}}},
+		{name: "text", content: "It's sunny in Paris."},
+		{name: "unknown tool", content: `{"name": "get_stock_price", "arguments": {}}`},
+		{name: "other json", content: `{"city": "Paris"}`},
+		{name: "trailing text", content: `{"name": "get_time", "arguments": {}} Let me check.`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := parseToolCalls(tt.content, weatherTools())
+			if tt.expected == nil {
+				assert.Nil(t, calls)
+				return
+			}
+
+			require.Len(t, calls, len(tt.expected))
+			for i, expected := range tt.expected {
+				assert.Equal(t, "function", calls[i].Type)
+				assert.True(t, strings.HasPrefix(calls[i].Id, "call_"))
+				assert.Equal(t, expected.name, calls[i].Function.Name)
+				assert.Equal(t, expected.arguments, calls[i].Function.Arguments)
+			}
+		})
+	}
+}
+
+func TestToolBuffer(t *testing.T) {
+	t.Run("call", func(t *testing.T) {
+		b := toolBuffer{tools: weatherTools()}
+
+		content, calls := b.next(`{"tool_calls": [{"name": "get_`, false)
+		assert.Empty(t, content)
+		assert.Nil(t, calls)
+
+		content, calls = b.next(`weather", "arguments": {"ci`, false)
+		assert.Empty(t, content)
+		require.Len(t, calls, 1)
+		assert.Equal(t, 0, *calls[0].Index)
+		assert.True(t, strings.HasPrefix(calls[0].Id, "call_"))
+		assert.Equal(t, "function", calls[0].Type)
+		assert.Equal(t, ToolCallFunction{Name: "get_weather", Arguments: `{"ci`}, calls[0].Function)
+
+		_, calls = b.next(`ty": "{Paris}\""}}, {"name": "get_time", "arguments": {`, false)
+		require.Len(t, calls, 2)
+		assert.Equal(t, ToolCall{Index: ptr(0), Function: ToolCallFunction{Arguments: `ty": "{Paris}\""}`}}, calls[0])
+		assert.Equal(t, 1, *calls[1].Index)
+		assert.Equal(t, ToolCallFunction{Name: "get_time", Arguments: "{"}, calls[1].Function)
+
+		_, calls = b.next("}}]}", false)
+		assert.Equal(t, []ToolCall{{Index: ptr(1), Function: ToolCallFunction{Arguments: "}"}}}, calls)
+
+		content, calls = b.next("", true)
+		assert.Empty(t, content)
+		assert.Nil(t, calls)
+		assert.Equal(t, 2, b.calls)
+	})
+
+	t.Run("call parsed when done", func(t *testing.T) {
+		b := toolBuffer{tools: weatherTools()}
+		for _, piece := range []string{" ", `{"arguments": {}, `, `"name": "get_time"}`} {
+			content, calls := b.next(piece, false)
+			assert.Empty(t, content)
+			assert.Nil(t, calls)
+		}
+
+		content, calls := b.next("", true)
+		assert.Empty(t, content)
+		require.Len(t, calls, 1)
+		assert.Equal(t, 0, *calls[0].Index)
+		assert.Equal(t, ToolCallFunction{Name: "get_time", Arguments: "{}"}, calls[0].Function)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		b := toolBuffer{tools: weatherTools()}
+
+		content, calls := b.next(" ", false)
+		assert.Empty(t, content)
+		assert.Nil(t, calls)
+
+		content, _ = b.next("It's {sunny}", false)
+		assert.Equal(t, " It's {sunny}", content)
+
+		content, calls = b.next(" today.", true)
+		assert.Equal(t, " today.", content)
+		assert.Nil(t, calls)
+	})
+
+	t.Run("json which isn't a call", func(t *testing.T) {
+		b := toolBuffer{tools: weatherTools()}
+
+		content, _ := b.next(`{"city":`, false)
+		assert.Empty(t, content)
+
+		content, calls := b.next(` "Paris"}`, true)
+		assert.Equal(t, `{"city": "Paris"}`, content)
+		assert.Nil(t, calls)
+	})
+}
+
+func TestRequestValidateTools(t *testing.T) {
+	cases := []struct {
+		name       string
+		tools      []Tool
+		toolChoice any
+
+		parallelToolCalls *bool
+		param             string
+	}{
+		{name: "valid", tools: weatherTools()},
+		{name: "valid choice", tools: weatherTools(), toolChoice: "required"},
+		{name: "valid named choice", tools: weatherTools(), toolChoice: map[string]any{"type": "function", "function": map[string]any{"name": "get_time"}}},
+		{name: "tool type", tools: []Tool{{Type: "retrieval", Function: ToolFunction{Name: "search"}}}, param: "tools[0].type"},
+		{name: "tool name", tools: []Tool{{Type: "function", Function: ToolFunction{Name: "get weather"}}}, param: "tools[0].function.name"},
+		{name: "choice without tools", toolChoice: "auto", param: "tool_choice"},
+		{name: "parallel tool calls without tools", parallelToolCalls: ptr(false), param: "parallel_tool_calls"},
+		{name: "unknown choice", tools: weatherTools(), toolChoice: "always", param: "tool_choice"},
+		{name: "choice type", tools: weatherTools(), toolChoice: 1.0, param: "tool_choice"},
+		{name: "named choice not a tool", tools: weatherTools(), toolChoice: map[string]any{"type": "function", "function": map[string]any{"name": "get_stock_price"}}, param: "tool_choice"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Request{
+				Model:      "test",
+				Messages:   []Message{{Role: "user", Content: "Hi"}},
+				Tools:      tt.tools,
+				ToolChoice: tt.toolChoice,
+
+				ParallelToolCalls: tt.parallelToolCalls,
+			}.validate()
+			if tt.param == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var perr *paramError
+			require.ErrorAs(t, err, &perr)
+			assert.Equal(t, tt.param, perr.param)
+		})
+	}
+}
+
+func TestFromRequestTools(t *testing.T) {
+	messages := []Message{
+		{Role: "user", Content: "What's the weather in Paris?"},
+		{Role: "assistant", ToolCalls: []ToolCall{{Id: "call_1", Type: "function", Function: ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}}}},
+		{Role: "tool", ToolCallId: "call_1", Content: `{"temperature": 22}`},
+		{Role: "tool", ToolCallId: "call_2", Content: "12:00"},
+	}
+
+	t.Run("auto", func(t *testing.T) {
+		req, err := FromRequest(Request{Model: "test", Messages: messages, Tools: weatherTools()})
+		require.NoError(t, err)
+		require.Len(t, req.Messages, 5)
+
+		assert.Equal(t, "system", req.Messages[0].Role)
+		assert.Contains(t, req.Messages[0].Content, `"name":"get_weather"`)
+		assert.Contains(t, req.Messages[0].Content, "respond to the user normally")
+		assert.Empty(t, req.Format)
+
+		assert.Equal(t, api.Message{Role: "assistant", Content: `{"tool_calls":[{"name":"get_weather","arguments":{"city":"Paris"}}]}`}, req.Messages[2])
+		assert.Equal(t, api.Message{Role: "user", Content: "Result of calling the get_weather tool:\n{\"temperature\": 22}"}, req.Messages[3])
+		assert.Equal(t, api.Message{Role: "user", Content: "Result of calling a tool:\n12:00"}, req.Messages[4])
+	})
+
+	t.Run("required", func(t *testing.T) {
+		req, err := FromRequest(Request{Model: "test", Messages: messages[:1], Tools: weatherTools(), ToolChoice: map[string]any{"type": "function", "function": map[string]any{"name": "get_weather"}}})
+		require.NoError(t, err)
+		assert.Contains(t, req.Messages[0].Content, "You must call the get_weather tool.")
+		assert.Equal(t, "json", req.Format)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		req, err := FromRequest(Request{Model: "test", Messages: messages[:1], Tools: weatherTools(), ToolChoice: "none"})
+		require.NoError(t, err)
+		assert.Equal(t, []api.Message{{Role: "user", Content: "What's the weather in Paris?"}}, req.Messages)
+	})
+}
+
+func TestMiddlewareToolCalls(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	call := []api.ChatResponse{
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: `{"tool_calls": [{"name": "get_weather", "arguments": {"city": `}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: `"Paris"}}]}`}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant"}, Done: true},
+	}
+
+	req := Request{
+		Model:    "test",
+		Messages: []Message{{Role: "user", Content: "What's the weather in Paris?"}},
+		Tools:    weatherTools(),
+	}
+
+	t.Run("completion", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, call...))
+		w := doRequest(t, r, "/v1/chat/completions", req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		choice := completion.Choices[0]
+		assert.Equal(t, "tool_calls", *choice.FinishReason)
+		assert.Empty(t, choice.Message.Content)
+		require.Len(t, choice.Message.ToolCalls, 1)
+		assert.Nil(t, choice.Message.ToolCalls[0].Index)
+		assert.Equal(t, "get_weather", choice.Message.ToolCalls[0].Function.Name)
+		assert.Equal(t, `{"city": "Paris"}`, choice.Message.ToolCalls[0].Function.Arguments)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, call...))
+
+		req := req
+		req.Stream = true
+		w := doRequest(t, r, "/v1/chat/completions", req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		chunks := readChunks(t, w.Body)
+		require.NotEmpty(t, chunks)
+		for _, chunk := range chunks {
+			assert.Empty(t, chunk.Choices[0].Delta.Content)
+		}
+
+		var deltas []ToolCall
+		for _, chunk := range chunks {
+			deltas = append(deltas, chunk.Choices[0].Delta.ToolCalls...)
+		}
+		require.Len(t, deltas, 2)
+		assert.Equal(t, 0, *deltas[0].Index)
+		assert.Equal(t, "get_weather", deltas[0].Function.Name)
+		assert.Equal(t, `{"city": "Paris"}`, deltas[0].Function.Arguments+deltas[1].Function.Arguments)
+		assert.Equal(t, ToolCall{Index: ptr(0), Function: ToolCallFunction{Arguments: `"Paris"}`}}, deltas[1])
+
+		assert.Nil(t, chunks[0].Choices[0].FinishReason)
+		assert.Equal(t, "tool_calls", *chunks[len(chunks)-1].Choices[0].FinishReason)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, testResponses()...))
+		w := doRequest(t, r, "/v1/chat/completions", req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, "stop", *completion.Choices[0].FinishReason)
+		assert.NotEmpty(t, completion.Choices[0].Message.Content)
+		assert.Empty(t, completion.Choices[0].Message.ToolCalls)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, call...))
+
+		req := req
+		req.ToolChoice = "none"
+		w := doRequest(t, r, "/v1/chat/completions", req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		assert.Equal(t, "stop", *completion.Choices[0].FinishReason)
+		assert.Contains(t, completion.Choices[0].Message.Content, "get_weather")
+	})
+}
+
+func TestFromRequestFunctions(t *testing.T) {
+	functions := []ToolFunction{{Name: "get_weather", Parameters: json.RawMessage(`{"type":"object"}`)}}
+	messages := []Message{
+		{Role: "user", Content: "What's the weather in Paris?"},
+		{Role: "assistant", FunctionCall: &ToolCallFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		{Role: "function", Name: "get_weather", Content: "sunny"},
+	}
+
+	req, err := FromRequest(Request{Model: "test", Messages: messages, Functions: functions, FunctionCall: map[string]any{"name": "get_weather"}})
+	require.NoError(t, err)
+	require.Len(t, req.Messages, 4)
+	assert.Contains(t, req.Messages[0].Content, "You must call the get_weather tool.")
+	assert.Equal(t, api.Message{Role: "assistant", Content: `{"tool_calls":[{"name":"get_weather","arguments":{"city":"Paris"}}]}`}, req.Messages[2])
+	assert.Equal(t, api.Message{Role: "user", Content: "Result of calling the get_weather tool:\nsunny"}, req.Messages[3])
+
+	cases := []struct {
+		name  string
+		req   Request
+		param string
+	}{
+		{name: "with tools", req: Request{Functions: functions, Tools: weatherTools()}, param: "functions"},
+		{name: "function name", req: Request{Functions: []ToolFunction{{Name: "get weather"}}}, param: "functions[0].name"},
+		{name: "required", req: Request{Functions: functions, FunctionCall: "required"}, param: "function_call"},
+		{name: "unknown function", req: Request{Functions: functions, FunctionCall: map[string]any{"name": "get_time"}}, param: "function_call"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Model = "test"
+			tt.req.Messages = messages[:1]
+			_, err := FromRequest(tt.req)
+
+			var perr *paramError
+			require.ErrorAs(t, err, &perr)
+			assert.Equal(t, tt.param, perr.param)
+		})
+	}
+}
+
+func TestMiddlewareFunctionCall(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	call := []api.ChatResponse{
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: `{"name": "get_weather", "arguments": {"city": `}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: `"Paris"}}`}},
+		{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant"}, Done: true},
+	}
+
+	req := Request{
+		Model:     "test",
+		Messages:  []Message{{Role: "user", Content: "What's the weather in Paris?"}},
+		Functions: []ToolFunction{weatherTools()[0].Function},
+	}
+
+	t.Run("completion", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, call...))
+		w := doRequest(t, r, "/v1/chat/completions", req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var completion Completion
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+		choice := completion.Choices[0]
+		assert.Equal(t, "function_call", *choice.FinishReason)
+		assert.Empty(t, choice.Message.ToolCalls)
+		assert.Equal(t, &ToolCallFunction{Name: "get_weather", Arguments: `{"city": "Paris"}`}, choice.Message.FunctionCall)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		r := newRouter(Middleware(), chatHandler(t, call...))
+
+		req := req
+		req.Stream = true
+		w := doRequest(t, r, "/v1/chat/completions", req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var name, arguments string
+		chunks := readChunks(t, w.Body)
+		for _, chunk := range chunks {
+			assert.Empty(t, chunk.Choices[0].Delta.ToolCalls)
+			if call := chunk.Choices[0].Delta.FunctionCall; call != nil {
+				name += call.Name
+				arguments += call.Arguments
+			}
+		}
+
+		assert.Equal(t, "get_weather", name)
+		assert.Equal(t, `{"city": "Paris"}`, arguments)
+		assert.Equal(t, "function_call", *chunks[len(chunks)-1].Choices[0].FinishReason)
+	})
+}
+
+func TestParallelToolCalls(t *testing.T) {
+	content := `[{"name": "get_weather", "arguments": {"city": "Paris"}}, {"name": "get_weather", "arguments": {"city": "Rome"}}]`
+
+	t.Run("instruction", func(t *testing.T) {
+		messages := []Message{{Role: "user", Content: "What's the weather in Paris and Rome?"}}
+
+		req, err := FromRequest(Request{Model: "test", Messages: messages, Tools: weatherTools()})
+		require.NoError(t, err)
+		assert.NotContains(t, req.Messages[0].Content, "at most one")
+
+		req, err = FromRequest(Request{Model: "test", Messages: messages, Tools: weatherTools(), ParallelToolCalls: ptr(false)})
+		require.NoError(t, err)
+		assert.Contains(t, req.Messages[0].Content, "Call at most one tool at a time.")
+	})
+
+	t.Run("buffer", func(t *testing.T) {
+		b := toolBuffer{tools: weatherTools(), single: true}
+		_, calls := b.next(content, false)
+		require.Len(t, calls, 1)
+		assert.Equal(t, `{"city": "Paris"}`, calls[0].Function.Arguments)
+
+		_, calls = b.next("", true)
+		assert.Nil(t, calls)
+		assert.Equal(t, 1, b.calls)
+	})
+
+	for _, parallel := range []bool{true, false} {
+		expected := 2
+		if !parallel {
+			expected = 1
+		}
+
+		t.Run(fmt.Sprintf("parallel %t", parallel), func(t *testing.T) {
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			r := newRouter(Middleware(), chatHandler(t, api.ChatResponse{Model: "test", CreatedAt: start, Message: api.Message{Role: "assistant", Content: content}, Done: true}))
+			w := doRequest(t, r, "/v1/chat/completions", Request{
+				Model:             "test",
+				Messages:          []Message{{Role: "user", Content: "What's the weather in Paris and Rome?"}},
+				Tools:             weatherTools(),
+				ParallelToolCalls: &parallel,
+			})
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var completion Completion
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &completion))
+			assert.Len(t, completion.Choices[0].Message.ToolCalls, expected)
+		})
+	}
+}
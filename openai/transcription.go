@@ -0,0 +1,131 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TranscriptionRequest is the audio and parameters of a
+// /v1/audio/transcriptions request
+type TranscriptionRequest struct {
+	Model       string
+	Audio       []byte
+	Filename    string
+	Language    string
+	Prompt      string
+	Temperature float64
+}
+
+type TranscriptionSegment struct {
+	Id    int     `json:"id"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+// Transcription is the text of a transcribed audio file. Language, Duration
+// and Segments are only reported for the verbose_json response format.
+type Transcription struct {
+	Task     string                 `json:"task,omitempty"`
+	Language string                 `json:"language,omitempty"`
+	Duration float64                `json:"duration,omitempty"`
+	Text     string                 `json:"text"`
+	Segments []TranscriptionSegment `json:"segments,omitempty"`
+}
+
+// A Transcriber is a Backend which can transcribe audio. It returns
+// ErrUnsupportedModel when the model can't transcribe audio.
+type Transcriber interface {
+	Transcribe(ctx context.Context, r TranscriptionRequest) (Transcription, error)
+}
+
+var ErrUnsupportedModel = errors.New("unsupported model")
+
+// transcriptionRequest reads a multipart transcription request
+func transcriptionRequest(c *gin.Context) (TranscriptionRequest, error) {
+	model := c.PostForm("model")
+	if model == "" {
+		return TranscriptionRequest{}, newParamError("model", "missing_required_parameter", "'model' is a required property")
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return TranscriptionRequest{}, newParamError("file", "missing_required_parameter", "'file' is a required property")
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return TranscriptionRequest{}, err
+	}
+	defer f.Close()
+
+	audio, err := io.ReadAll(f)
+	if err != nil {
+		return TranscriptionRequest{}, err
+	}
+
+	var temperature float64
+	if s := c.PostForm("temperature"); s != "" {
+		temperature, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			return TranscriptionRequest{}, newParamError("temperature", "invalid_type", "%s is not of type 'number' - 'temperature'", s)
+		}
+	}
+
+	return TranscriptionRequest{
+		Model:       model,
+		Audio:       audio,
+		Filename:    fh.Filename,
+		Language:    c.PostForm("language"),
+		Prompt:      c.PostForm("prompt"),
+		Temperature: temperature,
+	}, nil
+}
+
+// TranscriptionMiddleware serves /v1/audio/transcriptions, transcribing the
+// uploaded audio with transcriber
+func TranscriptionMiddleware(transcriber Transcriber) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, err := transcriptionRequest(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, requestError(err))
+			return
+		}
+
+		format := c.DefaultPostForm("response_format", "json")
+		switch format {
+		case "json", "text", "verbose_json":
+		default:
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("Invalid value: '%s'. Supported values are: 'json', 'text', and 'verbose_json'. - 'response_format'", format), "invalid_value", "response_format"))
+			return
+		}
+
+		transcription, err := transcriber.Transcribe(c.Request.Context(), req)
+		switch {
+		case errors.Is(err, ErrUnsupportedModel):
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewErrorWithCode(http.StatusBadRequest, fmt.Sprintf("model '%s' does not support audio transcription", req.Model), "model_not_supported", "model"))
+			return
+		case err != nil:
+			slog.Error("transcription failed", "model", req.Model, "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		switch format {
+		case "text":
+			c.String(http.StatusOK, transcription.Text)
+		case "verbose_json":
+			transcription.Task = "transcribe"
+			c.JSON(http.StatusOK, transcription)
+		default:
+			c.JSON(http.StatusOK, Transcription{Text: transcription.Text})
+		}
+	}
+}
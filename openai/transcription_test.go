@@ -0,0 +1,120 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTranscriber echoes the request back as a transcription of the "whisper"
+// model and rejects every other model
+type testTranscriber struct {
+	testBackend
+}
+
+func (testTranscriber) Transcribe(_ context.Context, r TranscriptionRequest) (Transcription, error) {
+	if r.Model != "whisper" {
+		return Transcription{}, ErrUnsupportedModel
+	}
+
+	text := string(r.Audio)
+	if r.Prompt != "" {
+		text = r.Prompt + " " + text
+	}
+
+	return Transcription{
+		Language: r.Language,
+		Duration: 1.5,
+		Text:     text,
+		Segments: []TranscriptionSegment{{Id: 0, Start: 0, End: 1.5, Text: text}},
+	}, nil
+}
+
+func doTranscription(t *testing.T, r http.Handler, fields map[string]string, audio []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for k, v := range fields {
+		require.NoError(t, mw.WriteField(k, v))
+	}
+
+	if audio != nil {
+		fw, err := mw.CreateFormFile("file", "audio.wav")
+		require.NoError(t, err)
+		_, err = fw.Write(audio)
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/audio/transcriptions", &b)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestTranscriptionMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/audio/transcriptions", TranscriptionMiddleware(testTranscriber{}))
+
+	t.Run("json", func(t *testing.T) {
+		w := doTranscription(t, r, map[string]string{"model": "whisper", "language": "en"}, []byte("hello"))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, map[string]any{"text": "hello"}, resp)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		w := doTranscription(t, r, map[string]string{"model": "whisper", "response_format": "text"}, []byte("hello"))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "hello", w.Body.String())
+	})
+
+	t.Run("verbose json", func(t *testing.T) {
+		w := doTranscription(t, r, map[string]string{"model": "whisper", "language": "en", "prompt": "well", "response_format": "verbose_json"}, []byte("hello"))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp Transcription
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "transcribe", resp.Task)
+		assert.Equal(t, "en", resp.Language)
+		assert.Equal(t, "well hello", resp.Text)
+		assert.Len(t, resp.Segments, 1)
+	})
+
+	cases := []struct {
+		name   string
+		fields map[string]string
+		audio  []byte
+	}{
+		{name: "unsupported model", fields: map[string]string{"model": "llama2"}, audio: []byte("hello")},
+		{name: "missing model", fields: map[string]string{}, audio: []byte("hello")},
+		{name: "missing file", fields: map[string]string{"model": "whisper"}},
+		{name: "invalid temperature", fields: map[string]string{"model": "whisper", "temperature": "warm"}, audio: []byte("hello")},
+		{name: "invalid response format", fields: map[string]string{"model": "whisper", "response_format": "srt"}, audio: []byte("hello")},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doTranscription(t, r, tt.fields, tt.audio)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "invalid_request_error", resp.Error.Type)
+		})
+	}
+}
@@ -118,14 +118,22 @@ func Prompt(promptTemplate string, p PromptVars) (string, error) {
 	return prompt.String(), nil
 }
 
-// PreResponsePrompt returns the prompt before the response tag
+// PreResponsePrompt returns the prompt before the response tag. A response
+// in p is a partial response, which is appended for the model to continue.
 func (m *Model) PreResponsePrompt(p PromptVars) (string, error) {
 	pre, _, err := extractParts(m.Template)
 	if err != nil {
 		return "", err
 	}
 
-	return Prompt(pre, p)
+	response := p.Response
+	p.Response = ""
+	prompt, err := Prompt(pre, p)
+	if err != nil {
+		return "", err
+	}
+
+	return prompt + response, nil
 }
 
 // PostResponseTemplate returns the template after the response tag
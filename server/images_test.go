@@ -104,6 +104,15 @@ func TestModel_PreResponsePrompt(t *testing.T) {
 			},
 			want: "<|im_start|>user\nWhat are the potion ingredients?<|im_end|><|im_start|>assistant\n",
 		},
+		{
+			name:     "Partial Response",
+			template: "<|im_start|>user\n{{ .Prompt }}<|im_end|><|im_start|>assistant\n{{ .Response }}<|im_end|>",
+			vars: PromptVars{
+				Prompt:   "Which potion is best? Answer with the potion only.",
+				Response: "potion",
+			},
+			want: "<|im_start|>user\nWhich potion is best? Answer with the potion only.<|im_end|><|im_start|>assistant\npotion",
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmorganca/ollama/llm"
+	"github.com/jmorganca/ollama/openai"
+)
+
+// encoderFamilies are model architectures which only produce embeddings
+var encoderFamilies = []string{"bert", "nomic-bert"}
+
+// infillFormats are the fill-in-the-middle prompts of code models, found by
+// the special token in their vocabulary which begins them
+var infillFormats = []struct {
+	token  string
+	format string
+}{
+	// StarCoder
+	{"<fim_prefix>", "<fim_prefix>%[1]s<fim_suffix>%[2]s<fim_middle>"},
+	// CodeGemma and Qwen2.5-Coder
+	{"<|fim_prefix|>", "<|fim_prefix|>%[1]s<|fim_suffix|>%[2]s<|fim_middle|>"},
+	// DeepSeek Coder
+	{"<｜fim▁begin｜>", "<｜fim▁begin｜>%[1]s<｜fim▁hole｜>%[2]s<｜fim▁end｜>"},
+	// Code Llama
+	{"▁<PRE>", "<PRE> %[1]s <SUF>%[2]s <MID>"},
+	// Codestral
+	{"[SUFFIX]", "[SUFFIX]%[2]s[PREFIX]%[1]s"},
+}
+
+// infillFormat returns the fill-in-the-middle format of a model's vocabulary,
+// or "" if it has none
+func infillFormat(tokens []string) string {
+	for _, f := range infillFormats {
+		if slices.Contains(tokens, f.token) {
+			return f.format
+		}
+	}
+
+	return ""
+}
+
+// openaiBackend provides model details to the openai compatibility middleware
+type openaiBackend struct {
+	workDir string
+
+	// infos caches the details of models by their digest, which changes
+	// whenever any of them could, so model files are only decoded once
+	infos *sync.Map
+}
+
+func newOpenAIBackend(workDir string) openaiBackend {
+	return openaiBackend{workDir: workDir, infos: &sync.Map{}}
+}
+
+func (b openaiBackend) ModelInfo(_ context.Context, name string) (openai.ModelInfo, error) {
+	model, err := GetModel(name)
+	if err != nil {
+		return openai.ModelInfo{}, err
+	}
+
+	if info, ok := b.infos.Load(model.Digest); ok {
+		return info.(openai.ModelInfo), nil
+	}
+
+	info, err := modelInfo(model)
+	if err != nil {
+		return openai.ModelInfo{}, err
+	}
+
+	b.infos.Store(model.Digest, info)
+	return info, nil
+}
+
+// modelInfo reads the details of a model from its options and model file
+func modelInfo(model *Model) (openai.ModelInfo, error) {
+	opts, err := modelOptions(model, nil)
+	if err != nil {
+		return openai.ModelInfo{}, err
+	}
+
+	info := openai.ModelInfo{
+		ContextLength: opts.NumCtx,
+		// any model can embed, and all but encoders can chat
+		Capabilities: []string{"chat", "embedding"},
+	}
+
+	f, err := os.Open(model.ModelPath)
+	if err != nil {
+		return info, nil
+	}
+	defer f.Close()
+
+	// the trained context length is only an upper bound so a model file
+	// that can't be read still reports its default context
+	if ggml, err := llm.DecodeGGML(f); err == nil {
+		info.MaxContextLength = int(ggml.NumCtx())
+
+		if slices.Contains(encoderFamilies, ggml.ModelFamily()) {
+			info.Capabilities = []string{"embedding"}
+		}
+
+		tokens := ggml.Tokens()
+		info.Infill = infillFormat(tokens)
+		info.Reasoning = slices.Contains(tokens, "<think>")
+	}
+
+	return info, nil
+}
+
+// runner returns a runner for a model's tokenizer. A runner of the model
+// which is already loaded is used whatever its options, since they don't
+// change the tokenizer. Otherwise the model is loaded with options, the
+// options of the request which needs it, so the request doesn't load it
+// again. The caller must lock loaded.mu.
+func (b openaiBackend) runner(name string, options map[string]any) (llm.LLM, error) {
+	model, err := GetModel(name)
+	if err != nil {
+		var pErr *fs.PathError
+		if errors.As(err, &pErr) {
+			return nil, fmt.Errorf("model '%s' not found, try pulling it first", name)
+		}
+		return nil, err
+	}
+
+	if loaded.runner != nil && loaded.ModelPath == model.ModelPath {
+		return loaded.runner, nil
+	}
+
+	opts, err := modelOptions(model, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := load(b.workDir, model, opts, defaultSessionDuration); err != nil {
+		return nil, err
+	}
+
+	return loaded.runner, nil
+}
+
+// Tokenize encodes content with the model's tokenizer
+func (b openaiBackend) Tokenize(ctx context.Context, name string, options map[string]any, content string) ([]int, error) {
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	runner, err := b.runner(name, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return runner.Encode(ctx, content)
+}
+
+// Detokenize decodes tokens with the model's tokenizer. Inputs of tokens are
+// only sent with embedding requests, which use the default options.
+func (b openaiBackend) Detokenize(ctx context.Context, name string, tokens []int) (string, error) {
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	runner, err := b.runner(name, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return runner.Decode(ctx, tokens)
+}
+
+// parseModelAliases parses a comma separated list of alias=model pairs, e.g.
+// "gpt-4o=llama3,gpt-3.5-turbo=llama2"
+func parseModelAliases(s string) map[string]string {
+	aliases := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		alias, model, ok := strings.Cut(pair, "=")
+		alias, model = strings.TrimSpace(alias), strings.TrimSpace(model)
+		if !ok || alias == "" || model == "" {
+			slog.Warn(fmt.Sprintf("invalid OLLAMA_MODEL_ALIASES entry %q", pair))
+			continue
+		}
+
+		aliases[alias] = model
+	}
+
+	return aliases
+}
+
+// envLimit reads a limit from the environment variable key, where zero, or
+// an unset or invalid value, means no limit
+func envLimit(key string) int {
+	s := os.Getenv(key)
+	if s == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		slog.Warn(fmt.Sprintf("invalid %s %q", key, s))
+		return 0
+	}
+
+	return n
+}
+
+// rateLimits reads the per minute rate limits of the compatibility endpoints
+// from OLLAMA_RATE_LIMIT_REQUESTS and OLLAMA_RATE_LIMIT_TOKENS
+func rateLimits() openai.RateLimits {
+	return openai.RateLimits{
+		Requests: envLimit("OLLAMA_RATE_LIMIT_REQUESTS"),
+		Tokens:   envLimit("OLLAMA_RATE_LIMIT_TOKENS"),
+	}
+}
+
+// apiKeys reads the API keys of the compatibility endpoints from
+// OLLAMA_API_KEYS, a comma separated list, and OLLAMA_API_KEYS_FILE, a file
+// with one key per line. It reports whether either is set, so a key file
+// which can't be read leaves the endpoints locked rather than open.
+func apiKeys() ([]string, bool) {
+	var keys []string
+	for _, key := range strings.Split(os.Getenv("OLLAMA_API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	path := os.Getenv("OLLAMA_API_KEYS_FILE")
+	if path != "" {
+		bts, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error(fmt.Sprintf("couldn't read OLLAMA_API_KEYS_FILE: %v", err))
+		}
+
+		for _, line := range strings.Split(string(bts), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+	}
+
+	return keys, os.Getenv("OLLAMA_API_KEYS") != "" || path != ""
+}
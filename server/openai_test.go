@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/openai"
+	"github.com/jmorganca/ollama/parser"
+)
+
+func TestParseModelAliases(t *testing.T) {
+	cases := []struct {
+		name string
+		arg  string
+		want map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"single", "gpt-4o=llama3", map[string]string{"gpt-4o": "llama3"}},
+		{"multiple", "gpt-4o=llama3, gpt-3.5-turbo = llama2:7b", map[string]string{"gpt-4o": "llama3", "gpt-3.5-turbo": "llama2:7b"}},
+		{"invalid entries", "gpt-4o,=llama3,gpt-4=,,gpt-3.5-turbo=llama2", map[string]string{"gpt-3.5-turbo": "llama2"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseModelAliases(tt.arg))
+		})
+	}
+}
+
+func TestInfillFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		tokens []string
+		want   string
+	}{
+		{"none", []string{"<s>", "</s>", "hello"}, ""},
+		{"starcoder", []string{"<|endoftext|>", "<fim_prefix>", "<fim_middle>", "<fim_suffix>"}, "<fim_prefix>a<fim_suffix>b<fim_middle>"},
+		{"codellama", []string{"<s>", "▁<PRE>", "▁<SUF>", "▁<MID>"}, "<PRE> a <SUF>b <MID>"},
+		{"codestral", []string{"[PREFIX]", "[SUFFIX]", "[MIDDLE]"}, "[SUFFIX]b[PREFIX]a"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			format := infillFormat(tt.tokens)
+			if tt.want == "" {
+				assert.Empty(t, format)
+				return
+			}
+
+			assert.Equal(t, tt.want, fmt.Sprintf(format, "a", "b"))
+		})
+	}
+}
+
+// createOpenAITestModel creates a model named test in a new models directory
+func createOpenAITestModel(t *testing.T) *Model {
+	t.Helper()
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	f, err := os.CreateTemp(t.TempDir(), "ollama-model")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("GGUF\x02\x00"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	commands, err := parser.Parse(strings.NewReader("FROM " + f.Name()))
+	require.NoError(t, err)
+	require.NoError(t, CreateModel(context.TODO(), "test", "", commands, func(api.ProgressResponse) {}))
+
+	model, err := GetModel("test")
+	require.NoError(t, err)
+	return model
+}
+
+func TestOpenAIBackendModelInfo(t *testing.T) {
+	model := createOpenAITestModel(t)
+	backend := newOpenAIBackend("")
+
+	info, err := backend.ModelInfo(context.TODO(), "test")
+	require.NoError(t, err)
+	assert.Equal(t, api.DefaultOptions().NumCtx, info.ContextLength)
+
+	cached, ok := backend.infos.Load(model.Digest)
+	require.True(t, ok)
+	assert.Equal(t, info, cached)
+
+	// later lookups don't read the model file again
+	backend.infos.Store(model.Digest, openai.ModelInfo{ContextLength: 1})
+	info, err = backend.ModelInfo(context.TODO(), "test")
+	require.NoError(t, err)
+	assert.Equal(t, 1, info.ContextLength)
+}
+
+func TestOpenAIBackendTokenize(t *testing.T) {
+	model := createOpenAITestModel(t)
+
+	// a runner loaded with other options is used rather than reloaded
+	runner := &MockLLM{encoding: []int{1, 2, 3}}
+	loaded.runner = runner
+	loaded.Model = model
+	loaded.Options = &api.Options{Runner: api.Runner{NumCtx: 8192}}
+	t.Cleanup(func() {
+		loaded.runner, loaded.Model, loaded.Options = nil, nil, nil
+	})
+
+	tokens, err := newOpenAIBackend("").Tokenize(context.TODO(), "test", map[string]any{"num_ctx": 4096}, "hello")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, tokens)
+	assert.Same(t, runner, loaded.runner)
+	assert.Equal(t, 8192, loaded.Options.NumCtx)
+
+	_, err = newOpenAIBackend("").Tokenize(context.TODO(), "missing", nil, "hello")
+	assert.ErrorContains(t, err, "not found")
+}
+
+func TestAPIKeys(t *testing.T) {
+	t.Setenv("OLLAMA_API_KEYS", "")
+	t.Setenv("OLLAMA_API_KEYS_FILE", "")
+	_, ok := apiKeys()
+	assert.False(t, ok)
+
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("# clients\nsk-file-one\n\n  sk-file-two  \n"), 0o600))
+
+	t.Setenv("OLLAMA_API_KEYS", "sk-env-one, sk-env-two,")
+	t.Setenv("OLLAMA_API_KEYS_FILE", path)
+	keys, ok := apiKeys()
+	assert.True(t, ok)
+	assert.Equal(t, []string{"sk-env-one", "sk-env-two", "sk-file-one", "sk-file-two"}, keys)
+
+	// a missing key file still turns authentication on
+	t.Setenv("OLLAMA_API_KEYS", "")
+	t.Setenv("OLLAMA_API_KEYS_FILE", filepath.Join(t.TempDir(), "missing"))
+	keys, ok = apiKeys()
+	assert.True(t, ok)
+	assert.Empty(t, keys)
+}
+
+func TestEnvLimit(t *testing.T) {
+	for value, expected := range map[string]int{"": 0, "4": 4, "0": 0, "-1": 0, "four": 0} {
+		t.Setenv("OLLAMA_MAX_CHAT_REQUESTS", value)
+		assert.Equal(t, expected, envLimit("OLLAMA_MAX_CHAT_REQUESTS"), value)
+	}
+}
+
+func TestUnservedEndpoints(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	router := (&Server{WorkDir: t.TempDir()}).GenerateRoutes()
+
+	// the backend has no runner for these, so they aren't routed
+	for _, path := range []string{"/v1/audio/transcriptions", "/v1/audio/speech", "/v1/images/generations", "/v1/fine_tuning/jobs"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}")))
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+}
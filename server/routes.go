@@ -23,9 +23,13 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 
+	"github.com/jmorganca/ollama/anthropic"
 	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/cohere"
+	"github.com/jmorganca/ollama/gemini"
 	"github.com/jmorganca/ollama/gpu"
 	"github.com/jmorganca/ollama/llm"
+	"github.com/jmorganca/ollama/openai"
 	"github.com/jmorganca/ollama/parser"
 	"github.com/jmorganca/ollama/version"
 )
@@ -63,9 +67,7 @@ var loaded struct {
 var defaultSessionDuration = 5 * time.Minute
 
 // load a model into memory if it is not already loaded, it is up to the caller to lock loaded.mu before calling this function
-func load(c *gin.Context, model *Model, opts api.Options, sessionDuration time.Duration) error {
-	workDir := c.GetString("workDir")
-
+func load(workDir string, model *Model, opts api.Options, sessionDuration time.Duration) error {
 	needLoad := loaded.runner == nil || // is there a model loaded?
 		loaded.ModelPath != model.ModelPath || // has the base model changed?
 		!reflect.DeepEqual(loaded.AdapterPaths, model.AdapterPaths) || // have the adapters changed?
@@ -176,6 +178,9 @@ func GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	// used by the openai middleware to derive a system fingerprint
+	c.Set("digest", model.Digest)
+
 	opts, err := modelOptions(model, req.Options)
 	if err != nil {
 		if errors.Is(err, api.ErrInvalidOpts) {
@@ -186,6 +191,9 @@ func GenerateHandler(c *gin.Context) {
 		return
 	}
 
+	// part of the system fingerprint, along with the digest
+	c.Set("runner", opts.Runner)
+
 	var sessionDuration time.Duration
 	if req.KeepAlive == nil {
 		sessionDuration = defaultSessionDuration
@@ -193,7 +201,7 @@ func GenerateHandler(c *gin.Context) {
 		sessionDuration = req.KeepAlive.Duration
 	}
 
-	if err := load(c, model, opts, sessionDuration); err != nil {
+	if err := load(c.GetString("workDir"), model, opts, sessionDuration); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -271,7 +279,10 @@ func GenerateHandler(c *gin.Context) {
 
 			// Build up the full response
 			if _, err := generated.WriteString(r.Content); err != nil {
-				ch <- gin.H{"error": err.Error()}
+				select {
+				case ch <- gin.H{"error": err.Error()}:
+				case <-c.Request.Context().Done():
+				}
 				return
 			}
 
@@ -280,11 +291,13 @@ func GenerateHandler(c *gin.Context) {
 				CreatedAt: time.Now().UTC(),
 				Done:      r.Done,
 				Response:  r.Content,
+				Logprobs:  r.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
 					EvalCount:          r.EvalCount,
 					EvalDuration:       r.EvalDuration,
+					PromptCachedCount:  r.PromptCachedCount,
 				},
 			}
 
@@ -297,19 +310,29 @@ func GenerateHandler(c *gin.Context) {
 					promptVars.Response = generated.String()
 					result, err := model.PostResponseTemplate(promptVars)
 					if err != nil {
-						ch <- gin.H{"error": err.Error()}
+						select {
+						case ch <- gin.H{"error": err.Error()}:
+						case <-c.Request.Context().Done():
+						}
 						return
 					}
 					embd, err := loaded.runner.Encode(c.Request.Context(), prompt+result)
 					if err != nil {
-						ch <- gin.H{"error": err.Error()}
+						select {
+						case ch <- gin.H{"error": err.Error()}:
+						case <-c.Request.Context().Done():
+						}
 						return
 					}
 					resp.Context = embd
 				}
 			}
 
-			ch <- resp
+			// don't block generation on a client that has gone away
+			select {
+			case ch <- resp:
+			case <-c.Request.Context().Done():
+			}
 		}
 
 		var images []llm.ImageData
@@ -326,9 +349,15 @@ func GenerateHandler(c *gin.Context) {
 			Format:  req.Format,
 			Images:  images,
 			Options: opts,
+
+			Logprobs:    req.Logprobs,
+			TopLogprobs: req.TopLogprobs,
 		}
 		if err := loaded.runner.Predict(c.Request.Context(), predictReq, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			select {
+			case ch <- gin.H{"error": err.Error()}:
+			case <-c.Request.Context().Done():
+			}
 		}
 	}()
 
@@ -336,10 +365,12 @@ func GenerateHandler(c *gin.Context) {
 		// Accumulate responses into the final response
 		var final api.GenerateResponse
 		var sb strings.Builder
+		var logprobs []api.Logprob
 		for resp := range ch {
 			switch r := resp.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(r.Response)
+				logprobs = append(logprobs, r.Logprobs...)
 				final = r
 			case gin.H:
 				if errorMsg, ok := r["error"].(string); ok {
@@ -356,6 +387,7 @@ func GenerateHandler(c *gin.Context) {
 		}
 
 		final.Response = sb.String()
+		final.Logprobs = logprobs
 		c.JSON(http.StatusOK, final)
 		return
 	}
@@ -411,7 +443,7 @@ func EmbeddingHandler(c *gin.Context) {
 		sessionDuration = req.KeepAlive.Duration
 	}
 
-	if err := load(c, model, opts, sessionDuration); err != nil {
+	if err := load(c.GetString("workDir"), model, opts, sessionDuration); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -720,6 +752,12 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 		Messages: msgs,
 	}
 
+	if fp, err := ParseModelPath(req.Model).GetManifestPath(); err == nil {
+		if fi, err := os.Stat(fp); err == nil {
+			resp.ModifiedAt = fi.ModTime()
+		}
+	}
+
 	var params []string
 	cs := 30
 	for k, v := range model.Options {
@@ -894,6 +932,17 @@ func NewServer() (*Server, error) {
 	}, nil
 }
 
+// batchStore opens the store of the files and batches of the /v1 batch API,
+// in the models directory
+func batchStore(next http.Handler) (*openai.BatchStore, error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return openai.NewBatchStore(next, filepath.Join(dir, "batches"), 4)
+}
+
 func (s *Server) GenerateRoutes() http.Handler {
 	var origins []string
 	if o := os.Getenv("OLLAMA_ORIGINS"); o != "" {
@@ -935,12 +984,159 @@ func (s *Server) GenerateRoutes() http.Handler {
 	r.POST("/api/blobs/:digest", CreateBlobHandler)
 	r.HEAD("/api/blobs/:digest", HeadBlobHandler)
 
+	// Compatibility endpoints
+	backend := newOpenAIBackend(s.WorkDir)
+
+	var timeout time.Duration
+	if t := os.Getenv("OLLAMA_GENERATION_TIMEOUT"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("invalid OLLAMA_GENERATION_TIMEOUT %q: %v", t, err))
+		}
+		timeout = d
+	}
+
+	aliases := openai.WithAliases(parseModelAliases(os.Getenv("OLLAMA_MODEL_ALIASES")))
+
+	chatOpts := []openai.Option{openai.WithBackend(backend), openai.WithTimeout(timeout), aliases}
+	if os.Getenv("OLLAMA_DEFAULT_MAX_TOKENS") != "" {
+		chatOpts = append(chatOpts, openai.WithDefaultMaxTokens())
+	}
+
+	if os.Getenv("OLLAMA_MERGE_SYSTEM_MESSAGES") != "" {
+		chatOpts = append(chatOpts, openai.WithMergeSystemMessages())
+	}
+
+	if os.Getenv("OLLAMA_ALTERNATE_ROLES") != "" {
+		chatOpts = append(chatOpts, openai.WithAlternateRoles())
+	}
+
+	if os.Getenv("OLLAMA_JSON_INSTRUCTION") != "" {
+		chatOpts = append(chatOpts, openai.WithJSONInstruction())
+	}
+
+	if os.Getenv("OLLAMA_TRIM_RESPONSE") != "" {
+		chatOpts = append(chatOpts, openai.WithTrimResponse())
+	}
+
+	if reasoning := openai.Reasoning(os.Getenv("OLLAMA_REASONING")); reasoning != "" {
+		if reasoning.Valid() {
+			chatOpts = append(chatOpts, openai.WithReasoning(reasoning))
+		} else {
+			slog.Warn(fmt.Sprintf("invalid OLLAMA_REASONING %q: must be %q or %q", reasoning, openai.ReasoningSeparate, openai.ReasoningStrip))
+		}
+	}
+
+	if hosts := os.Getenv("OLLAMA_IMAGE_HOSTS"); hosts != "" {
+		chatOpts = append(chatOpts, openai.WithImageHosts(strings.Split(hosts, ",")...))
+	}
+
+	if t := os.Getenv("OLLAMA_SSE_HEARTBEAT"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("invalid OLLAMA_SSE_HEARTBEAT %q: %v", t, err))
+		}
+		chatOpts = append(chatOpts, openai.WithHeartbeat(d))
+	}
+
+	if t := os.Getenv("OLLAMA_STREAM_RESUME"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("invalid OLLAMA_STREAM_RESUME %q: %v", t, err))
+		} else if d > 0 {
+			chatOpts = append(chatOpts, openai.WithResume(d))
+		}
+	}
+
+	v1 := r.Group("/v1")
+
+	// Azure OpenAI requests name a deployment in place of the model
+	azure := r.Group("/openai/deployments/:deployment", openai.AzureMiddleware())
+
+	// Gemini requests name the model and method in the path
+	v1beta := r.Group("/v1beta")
+
+	if keys, ok := apiKeys(); ok {
+		auth := openai.AuthMiddleware(keys...)
+		v1.Use(auth)
+		azure.Use(auth)
+		v1beta.Use(auth)
+	}
+
+	if limits := rateLimits(); limits != (openai.RateLimits{}) {
+		limit := openai.RateLimitMiddleware(limits)
+		v1.Use(limit)
+		azure.Use(limit)
+		v1beta.Use(limit)
+	}
+
+	chat := []gin.HandlerFunc{openai.ChoicesMiddleware(r, "/v1/chat/completions"), openai.MiddlewareWithLimit(envLimit("OLLAMA_MAX_CHAT_REQUESTS"), chatOpts...), ChatHandler}
+	completions := []gin.HandlerFunc{openai.CompletionChoicesMiddleware(r, "/v1/completions"), openai.CompletionsMiddleware(openai.WithBackend(backend), aliases), GenerateHandler}
+	embeddings := openai.EmbeddingsMiddleware(r, "/api/embeddings", openai.WithBackend(backend), aliases)
+
+	v1.POST("/chat/completions", chat...)
+	v1.POST("/completions", completions...)
+	v1.POST("/chat/completions/batch", openai.BatchMiddleware(r, "/v1/chat/completions", 4))
+	v1.POST("/responses", openai.ResponsesMiddleware(r, "/v1/chat/completions"))
+	v1.GET("/realtime", openai.RealtimeMiddleware(r, "/v1/chat/completions"))
+	v1.DELETE("/models/*model", openai.DeleteMiddleware(), DeleteModelHandler)
+	v1.POST("/embeddings", embeddings)
+	v1.POST("/moderations", openai.ModerationMiddleware(r, "/v1/chat/completions", os.Getenv("OLLAMA_MODERATION_MODEL")))
+	v1.POST("/messages", anthropic.Middleware(), ChatHandler)
+	v1.POST("/rerank", cohere.RerankMiddleware(r, "/api/embeddings"))
+
+	// endpoints which need a runner this backend doesn't have are only
+	// served once it has one
+	if transcriber, ok := any(backend).(openai.Transcriber); ok {
+		v1.POST("/audio/transcriptions", openai.TranscriptionMiddleware(transcriber))
+	}
+
+	if speaker, ok := any(backend).(openai.Speaker); ok {
+		v1.POST("/audio/speech", openai.SpeechMiddleware(speaker))
+	}
+
+	if generator, ok := any(backend).(openai.ImageGenerator); ok {
+		v1.POST("/images/generations", openai.ImagesMiddleware(generator))
+	}
+
+	if batches, err := batchStore(r); err != nil {
+		slog.Warn(fmt.Sprintf("batches and fine-tuning are unavailable: %v", err))
+	} else {
+		v1.POST("/files", batches.UploadFile)
+		v1.GET("/files", batches.ListFiles)
+		v1.GET("/files/:id", batches.GetFile)
+		v1.GET("/files/:id/content", batches.FileContent)
+		v1.DELETE("/files/:id", batches.DeleteFile)
+		v1.POST("/batches", batches.CreateBatch)
+		v1.GET("/batches", batches.ListBatches)
+		v1.GET("/batches/:id", batches.GetBatch)
+		v1.POST("/batches/:id/cancel", batches.CancelBatch)
+
+		// fine-tuning is only served once the backend can train models
+		if trainer, ok := any(backend).(openai.Trainer); ok {
+			jobs := openai.NewFineTuningJobs(r, "/api/create", batches, trainer)
+			v1.POST("/fine_tuning/jobs", jobs.CreateJob)
+			v1.GET("/fine_tuning/jobs", jobs.ListJobs)
+			v1.GET("/fine_tuning/jobs/:id", jobs.GetJob)
+			v1.GET("/fine_tuning/jobs/:id/events", jobs.ListEvents)
+			v1.POST("/fine_tuning/jobs/:id/cancel", jobs.CancelJob)
+		}
+	}
+
+	azure.POST("/chat/completions", chat...)
+	azure.POST("/completions", completions...)
+	azure.POST("/embeddings", embeddings)
+
+	v1beta.POST("/models/*action", gemini.Middleware(), ChatHandler)
+
 	for _, method := range []string{http.MethodGet, http.MethodHead} {
 		r.Handle(method, "/", func(c *gin.Context) {
 			c.String(http.StatusOK, "Ollama is running")
 		})
 
 		r.Handle(method, "/api/tags", ListModelsHandler)
+		v1.Handle(method, "/models", openai.ListMiddleware(openai.WithBackend(backend), aliases), ListModelsHandler)
+		v1.Handle(method, "/models/*model", openai.RetrieveMiddleware(aliases), ShowModelHandler)
 		r.Handle(method, "/api/version", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"version": version.Version})
 		})
@@ -1099,6 +1295,14 @@ func ChatHandler(c *gin.Context) {
 		return
 	}
 
+	var grammar string
+	if len(req.Schema) > 0 {
+		if grammar, err = llm.SchemaGrammar(req.Schema); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid schema: %v", err)})
+			return
+		}
+	}
+
 	model, err := GetModel(req.Model)
 	if err != nil {
 		var pErr *fs.PathError
@@ -1110,6 +1314,9 @@ func ChatHandler(c *gin.Context) {
 		return
 	}
 
+	// used by the openai middleware to derive a system fingerprint
+	c.Set("digest", model.Digest)
+
 	opts, err := modelOptions(model, req.Options)
 	if err != nil {
 		if errors.Is(err, api.ErrInvalidOpts) {
@@ -1120,6 +1327,9 @@ func ChatHandler(c *gin.Context) {
 		return
 	}
 
+	// part of the system fingerprint, along with the digest
+	c.Set("runner", opts.Runner)
+
 	var sessionDuration time.Duration
 	if req.KeepAlive == nil {
 		sessionDuration = defaultSessionDuration
@@ -1127,7 +1337,7 @@ func ChatHandler(c *gin.Context) {
 		sessionDuration = req.KeepAlive.Duration
 	}
 
-	if err := load(c, model, opts, sessionDuration); err != nil {
+	if err := load(c.GetString("workDir"), model, opts, sessionDuration); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -1175,11 +1385,15 @@ func ChatHandler(c *gin.Context) {
 				CreatedAt: time.Now().UTC(),
 				Message:   api.Message{Role: "assistant", Content: r.Content},
 				Done:      r.Done,
+
+				StopSequence: r.StopSequence,
+				Logprobs:     r.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
 					EvalCount:          r.EvalCount,
 					EvalDuration:       r.EvalDuration,
+					PromptCachedCount:  r.PromptCachedCount,
 				},
 			}
 
@@ -1188,7 +1402,11 @@ func ChatHandler(c *gin.Context) {
 				resp.LoadDuration = checkpointLoaded.Sub(checkpointStart)
 			}
 
-			ch <- resp
+			// don't block generation on a client that has gone away
+			select {
+			case ch <- resp:
+			case <-c.Request.Context().Done():
+			}
 		}
 
 		// Start prediction
@@ -1197,9 +1415,16 @@ func ChatHandler(c *gin.Context) {
 			Format:  req.Format,
 			Images:  images,
 			Options: opts,
+			Grammar: grammar,
+
+			Logprobs:    req.Logprobs,
+			TopLogprobs: req.TopLogprobs,
 		}
 		if err := loaded.runner.Predict(c.Request.Context(), predictReq, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			select {
+			case ch <- gin.H{"error": err.Error()}:
+			case <-c.Request.Context().Done():
+			}
 		}
 	}()
 
@@ -1207,10 +1432,12 @@ func ChatHandler(c *gin.Context) {
 		// Accumulate responses into the final response
 		var final api.ChatResponse
 		var sb strings.Builder
+		var logprobs []api.Logprob
 		for resp := range ch {
 			switch r := resp.(type) {
 			case api.ChatResponse:
 				sb.WriteString(r.Message.Content)
+				logprobs = append(logprobs, r.Logprobs...)
 				final = r
 			case gin.H:
 				if errorMsg, ok := r["error"].(string); ok {
@@ -1227,6 +1454,7 @@ func ChatHandler(c *gin.Context) {
 		}
 
 		final.Message = api.Message{Role: "assistant", Content: sb.String()}
+		final.Logprobs = logprobs
 		c.JSON(http.StatusOK, final)
 		return
 	}